@@ -11,12 +11,14 @@ import (
 	identity "github.com/steinarvk/orclib/module/orc-identity"
 	identityapi "github.com/steinarvk/orclib/module/orc-identityapi"
 	jsonapi "github.com/steinarvk/orclib/module/orc-jsonapi"
+	orckeyaudit "github.com/steinarvk/orclib/module/orc-keyaudit"
 	logging "github.com/steinarvk/orclib/module/orc-logging"
 	orcouterauth "github.com/steinarvk/orclib/module/orc-outerauth"
 	orcpersistentkeys "github.com/steinarvk/orclib/module/orc-persistentkeys"
 	persistentkeysapi "github.com/steinarvk/orclib/module/orc-persistentkeysapi"
 	orcprometheus "github.com/steinarvk/orclib/module/orc-prometheus"
 	publickeyregistry "github.com/steinarvk/orclib/module/orc-publickeyregistry"
+	publickeyregistryapi "github.com/steinarvk/orclib/module/orc-publickeyregistryapi"
 	sectiontraceapi "github.com/steinarvk/orclib/module/orc-sectiontraceapi"
 	server "github.com/steinarvk/orclib/module/orc-server"
 )
@@ -26,6 +28,7 @@ var baseModules = []orc.Module{
 	jsonapi.M,
 	orcpersistentkeys.M,
 	orcephemeralkeys.M,
+	orckeyaudit.M,
 	persistentkeysapi.M,
 	identityapi.M,
 	canonicalhost.M,
@@ -34,6 +37,7 @@ var baseModules = []orc.Module{
 	orcouterauth.M,
 	orcprometheus.M,
 	publickeyregistry.M,
+	publickeyregistryapi.M,
 	sectiontraceapi.M,
 	orccors.M,
 	orcclient.M,
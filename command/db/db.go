@@ -0,0 +1,286 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/steinarvk/orc"
+	"github.com/steinarvk/orclib/lib/orcdb"
+	"github.com/steinarvk/orclib/lib/pgpencrypt"
+	"github.com/steinarvk/orclib/lib/postgresdb"
+)
+
+type connectionFlags struct {
+	dialect      string
+	dataSource   string
+	passwordFile string
+	lockTimeout  time.Duration
+}
+
+// pgpDecrypter reads the private keys in keyringFilename, unlocking them
+// with the passphrase in passphraseFilename if given.
+func pgpDecrypter(keyringFilename, passphraseFilename string) (*pgpencrypt.Decrypter, error) {
+	keyring := &pgpencrypt.Keyring{}
+	if err := keyring.AddFromFile(keyringFilename); err != nil {
+		return nil, err
+	}
+
+	var passphrase []byte
+	if passphraseFilename != "" {
+		data, err := ioutil.ReadFile(passphraseFilename)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read passphrase: %v", err)
+		}
+		passphrase = []byte(strings.TrimRight(string(data), "\r\n"))
+	}
+
+	decrypter, err := keyring.Decrypter(passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decrypt with %q: %v", keyringFilename, err)
+	}
+	return decrypter, nil
+}
+
+// open opens the database. With inspect, as for showing its status or for
+// dry runs, the database is not changed, and must already exist.
+func (c *connectionFlags) open(ctx context.Context, schema *orcdb.Schema, inspect bool) (*orcdb.Database, error) {
+	dialect, err := orcdb.DialectByName(c.dialect)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.dataSource == "" {
+		return nil, fmt.Errorf("missing --database")
+	}
+
+	if inspect && dialect == orcdb.SQLite && !strings.HasPrefix(c.dataSource, "file:") {
+		// Opening a SQLite database that does not exist would create it.
+		if _, err := os.Stat(c.dataSource); err != nil {
+			return nil, fmt.Errorf("Unable to open database: %v", err)
+		}
+	}
+
+	dataSourceName := c.dataSource
+	if dialect == orcdb.Postgres {
+		var password string
+		if c.passwordFile != "" {
+			data, err := ioutil.ReadFile(c.passwordFile)
+			if err != nil {
+				return nil, fmt.Errorf("Unable to read database password: %v", err)
+			}
+			password = strings.TrimSpace(string(data))
+		}
+		dataSourceName, err = postgresdb.ConnectionString(c.dataSource, password)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	opts := []orcdb.OpenOption{orcdb.SkipMigrations(), orcdb.MigrationLockTimeout(c.lockTimeout)}
+	if inspect {
+		opts = append(opts, orcdb.Inspect())
+	}
+
+	return schema.Open(ctx, dialect, dataSourceName, opts...)
+}
+
+func printSteps(verb string, steps []orcdb.MigrationStep, dryRun bool) {
+	if dryRun {
+		verb = "Dry run: " + strings.ToLower(verb)
+	}
+	for _, step := range steps {
+		fmt.Printf("%s %s\n", verb, step)
+		for _, stmt := range step.Sql {
+			fmt.Printf("    %s\n", strings.TrimSpace(stmt))
+		}
+	}
+}
+
+func printStatus(status *orcdb.MigrationStatus) error {
+	fmt.Printf("Schema:  %s (%s)\n", status.Schema, status.Dialect)
+	fmt.Printf("Version: %d (latest %d)\n\n", status.Version, status.LatestVersion)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "UPGRADE\tSTATE\tAPPLIED AT\tREVERSIBLE\n")
+	for _, upgrade := range status.Upgrades {
+		state := "pending"
+		switch {
+		case upgrade.Modified:
+			state = "modified"
+		case upgrade.Applied:
+			state = "applied"
+		}
+		appliedAt := upgrade.AppliedAt
+		if appliedAt == "" {
+			appliedAt = "-"
+		}
+		reversible := "no"
+		if upgrade.Reversible {
+			reversible = "yes"
+		}
+		fmt.Fprintf(w, "%d => %d\t%s\t%s\t%s\n", upgrade.From, upgrade.To, state, appliedAt, reversible)
+	}
+	for _, entry := range status.Unknown {
+		fmt.Fprintf(w, "%d => %d\t%s\t%s\t%s\n", entry.From, entry.To, "unknown", entry.AppliedAt, "-")
+	}
+	return w.Flush()
+}
+
+// NewCommand returns a "db" command with subcommands to show the status of
+// a database with the given schema and to migrate it.
+func NewCommand(schema *orcdb.Schema) *cobra.Command {
+	dbCommand := orc.Command(nil, nil, cobra.Command{
+		Use:   "db",
+		Short: fmt.Sprintf("Commands to inspect and migrate the %q database", schema.Name),
+	}, nil)
+
+	var conn connectionFlags
+	connFlags := orc.FlagsModule(func(flags *pflag.FlagSet) {
+		flags.StringVar(&conn.dialect, "database_dialect", orcdb.SQLite.Name(), "database dialect: sqlite or postgres")
+		flags.StringVar(&conn.dataSource, "database", "", "SQLite database file, or PostgreSQL connection string (without password)")
+		flags.StringVar(&conn.passwordFile, "database_password_file", "", "file containing the PostgreSQL password")
+		flags.DurationVar(&conn.lockTimeout, "database_migration_lock_timeout", orcdb.DefaultMigrationLockTimeout, "how long to wait for other instances to finish migrating")
+	})
+
+	var dryRun bool
+	dryRunFlags := orc.FlagsModule(func(flags *pflag.FlagSet) {
+		flags.BoolVar(&dryRun, "dry_run", false, "run the migration in a transaction that is rolled back")
+	})
+
+	var targetVersion int
+	migrateFlags := orc.FlagsModule(func(flags *pflag.FlagSet) {
+		flags.IntVar(&targetVersion, "to", orcdb.LatestVersion, "version to migrate to (default latest)")
+	})
+
+	orc.Command(dbCommand, orc.Modules(
+		connFlags,
+	), cobra.Command{
+		Use:   "status",
+		Short: "Show the version of the database and its applied and pending upgrades",
+	}, func() error {
+		ctx := context.Background()
+
+		db, err := conn.open(ctx, schema, true)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+
+		status, err := db.Status(ctx)
+		if err != nil {
+			return err
+		}
+
+		return printStatus(status)
+	})
+
+	orc.Command(dbCommand, orc.Modules(
+		connFlags,
+		dryRunFlags,
+		migrateFlags,
+	), cobra.Command{
+		Use:   "migrate",
+		Short: "Upgrade (or downgrade) the database to a version",
+	}, func() error {
+		ctx := context.Background()
+
+		db, err := conn.open(ctx, schema, dryRun)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+
+		steps, err := db.MigrateTo(ctx, targetVersion, dryRun)
+		if err == nil && len(steps) == 0 {
+			fmt.Printf("Nothing to do.\n")
+		}
+		printSteps("Migrated", steps, dryRun)
+		return err
+	})
+
+	orc.Command(dbCommand, orc.Modules(
+		connFlags,
+		dryRunFlags,
+	), cobra.Command{
+		Use:   "rollback",
+		Short: "Reverse the last applied upgrade",
+	}, func() error {
+		ctx := context.Background()
+
+		db, err := conn.open(ctx, schema, dryRun)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+
+		step, err := db.Rollback(ctx, dryRun)
+		if step != nil {
+			printSteps("Rolled back", []orcdb.MigrationStep{*step}, dryRun)
+		}
+		return err
+	})
+
+	var restoreFrom, restoreDecryptWith, restoreDecryptPassphraseFile string
+	var restoreOverwrite bool
+	restoreFlags := orc.FlagsModule(func(flags *pflag.FlagSet) {
+		flags.StringVar(&restoreFrom, "from", "", "SQLite snapshot to restore")
+		flags.StringVar(&restoreDecryptWith, "decrypt_with", "", "keyring file with the private PGP key to decrypt an encrypted (.pgp) snapshot")
+		flags.StringVar(&restoreDecryptPassphraseFile, "decrypt_passphrase_file", "", "file containing the passphrase of the private PGP key")
+		flags.BoolVar(&restoreOverwrite, "overwrite", false, "replace the contents of an existing database")
+	})
+
+	orc.Command(dbCommand, orc.Modules(
+		connFlags,
+		restoreFlags,
+	), cobra.Command{
+		Use:   "restore",
+		Short: "Replace a SQLite database with a snapshot (stop servers using it first)",
+	}, func() error {
+		ctx := context.Background()
+
+		dialect, err := orcdb.DialectByName(conn.dialect)
+		if err != nil {
+			return err
+		}
+		if dialect != orcdb.SQLite {
+			return fmt.Errorf("Restoring is only supported for SQLite databases")
+		}
+		if conn.dataSource == "" {
+			return fmt.Errorf("missing --database")
+		}
+		if restoreFrom == "" {
+			return fmt.Errorf("missing --from")
+		}
+
+		if _, err := os.Stat(conn.dataSource); err == nil && !restoreOverwrite {
+			return fmt.Errorf("Database %q exists; pass --overwrite to replace its contents", conn.dataSource)
+		}
+
+		var opts []orcdb.RestoreOption
+		if restoreDecryptWith != "" {
+			decrypter, err := pgpDecrypter(restoreDecryptWith, restoreDecryptPassphraseFile)
+			if err != nil {
+				return err
+			}
+			opts = append(opts, orcdb.DecryptWith(decrypter.Decrypt))
+		} else if strings.HasSuffix(restoreFrom, ".pgp") {
+			return fmt.Errorf("missing --decrypt_with (private PGP key to decrypt %q)", restoreFrom)
+		}
+
+		if err := schema.RestoreSQLite(ctx, restoreFrom, conn.dataSource, conn.lockTimeout, opts...); err != nil {
+			return err
+		}
+
+		fmt.Printf("Restored %s from %s.\n", conn.dataSource, restoreFrom)
+		return nil
+	})
+
+	return dbCommand
+}
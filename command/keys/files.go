@@ -0,0 +1,191 @@
+package keys
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/steinarvk/orc"
+	"github.com/steinarvk/orclib/lib/cryptopacket"
+	"github.com/steinarvk/orclib/lib/mutatefile"
+
+	persistentkeys "github.com/steinarvk/orclib/module/orc-persistentkeys"
+	publickeyregistry "github.com/steinarvk/orclib/module/orc-publickeyregistry"
+)
+
+// writeOutputFile writes to a temporary file and renames it into place
+// only if write succeeds, so that a failure never leaves partial output.
+func writeOutputFile(filename string, write func(w io.Writer) error) error {
+	tempFilename := filename + mutatefile.TemporaryNewFileSuffix
+
+	f, err := os.OpenFile(tempFilename, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("Error creating %q: %v", tempFilename, err)
+	}
+
+	if err := write(f); err != nil {
+		f.Close()
+		os.Remove(tempFilename)
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(tempFilename)
+		return fmt.Errorf("Error closing %q after writing: %v", tempFilename, err)
+	}
+
+	if err := os.Rename(tempFilename, filename); err != nil {
+		os.Remove(tempFilename)
+		return fmt.Errorf("Error renaming %q to %q: %v", tempFilename, filename, err)
+	}
+
+	return nil
+}
+
+func init() {
+	var inputFilename, outputFilename, signatureFilename, recipient string
+	fileFlags := orc.FlagsModule(func(flags *pflag.FlagSet) {
+		flags.StringVar(&inputFilename, "input", "", "file to read")
+		flags.StringVar(&outputFilename, "output", "", "file to write")
+		flags.StringVar(&signatureFilename, "signature", "", "detached signature file")
+		flags.StringVar(&recipient, "recipient", "", "intended recipient of the file")
+	})
+
+	requireFlags := func(names map[string]string) error {
+		for name, value := range names {
+			if value == "" {
+				return fmt.Errorf("missing --%s", name)
+			}
+		}
+		return nil
+	}
+
+	orc.Command(KeysCommand, orc.Modules(
+		persistentkeys.M,
+		publickeyregistry.M,
+		fileFlags,
+	), cobra.Command{
+		Use:   "encrypt-file",
+		Short: "Encrypt a file of any size to a recipient",
+	}, func() error {
+		if err := requireFlags(map[string]string{"input": inputFilename, "output": outputFilename, "recipient": recipient}); err != nil {
+			return err
+		}
+
+		in, err := os.Open(inputFilename)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+
+		return writeOutputFile(outputFilename, func(out io.Writer) error {
+			w, err := cryptopacket.EncryptStream(out, persistentkeys.M.Keys, publickeyregistry.M, recipient)
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(w, in); err != nil {
+				return fmt.Errorf("Error encrypting %q: %v", inputFilename, err)
+			}
+			return w.Close()
+		})
+	})
+
+	orc.Command(KeysCommand, orc.Modules(
+		persistentkeys.M,
+		publickeyregistry.M,
+		fileFlags,
+	), cobra.Command{
+		Use:   "decrypt-file",
+		Short: "Verify and decrypt a file encrypted with encrypt-file",
+	}, func() error {
+		if err := requireFlags(map[string]string{"input": inputFilename, "output": outputFilename}); err != nil {
+			return err
+		}
+
+		in, err := os.Open(inputFilename)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+
+		return writeOutputFile(outputFilename, func(out io.Writer) error {
+			r, header, err := cryptopacket.DecryptStream(in, persistentkeys.M.Keys, publickeyregistry.M)
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(out, r); err != nil {
+				return fmt.Errorf("Error decrypting %q: %v", inputFilename, err)
+			}
+			fmt.Fprintf(os.Stderr, "Decrypted file from %q (sent %s)\n", header.Contents.Sender, header.Contents.Timestamp)
+			return nil
+		})
+	})
+
+	orc.Command(KeysCommand, orc.Modules(
+		persistentkeys.M,
+		fileFlags,
+	), cobra.Command{
+		Use:   "sign-file",
+		Short: "Create a detached signature of a file",
+	}, func() error {
+		if err := requireFlags(map[string]string{"input": inputFilename, "signature": signatureFilename}); err != nil {
+			return err
+		}
+
+		in, err := os.Open(inputFilename)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+
+		sig, err := cryptopacket.SignDetached(in, persistentkeys.M.Keys)
+		if err != nil {
+			return err
+		}
+
+		return writeOutputFile(signatureFilename, func(out io.Writer) error {
+			enc := json.NewEncoder(out)
+			enc.SetIndent("", "  ")
+			return enc.Encode(sig)
+		})
+	})
+
+	orc.Command(KeysCommand, orc.Modules(
+		publickeyregistry.M,
+		fileFlags,
+	), cobra.Command{
+		Use:   "verify-file",
+		Short: "Verify a detached signature of a file",
+	}, func() error {
+		if err := requireFlags(map[string]string{"input": inputFilename, "signature": signatureFilename}); err != nil {
+			return err
+		}
+
+		sigFile, err := os.Open(signatureFilename)
+		if err != nil {
+			return err
+		}
+		defer sigFile.Close()
+
+		var sig cryptopacket.DetachedSignature
+		if err := json.NewDecoder(sigFile).Decode(&sig); err != nil {
+			return fmt.Errorf("Invalid signature file %q: %v", signatureFilename, err)
+		}
+
+		in, err := os.Open(inputFilename)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+
+		if err := cryptopacket.VerifyDetached(in, &sig, publickeyregistry.M); err != nil {
+			return err
+		}
+
+		fmt.Printf("Valid signature by %q (signed %s)\n", sig.Contents.Signer, sig.Contents.Timestamp)
+		return nil
+	})
+}
@@ -0,0 +1,253 @@
+package keys
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/steinarvk/orc"
+	"github.com/steinarvk/orclib/lib/keyformats"
+	"github.com/steinarvk/orclib/lib/orckeys"
+
+	persistentkeys "github.com/steinarvk/orclib/module/orc-persistentkeys"
+	orctinkgcpkms "github.com/steinarvk/orclib/module/orc-tinkgcpkms"
+	orctinklocalkms "github.com/steinarvk/orclib/module/orc-tinklocalkms"
+	orctinkvaultkms "github.com/steinarvk/orclib/module/orc-tinkvaultkms"
+)
+
+const (
+	formatJWKS     = "jwks"
+	formatJWK      = "jwk"
+	formatPEM      = "pem"
+	formatTinkJSON = "tink-json"
+)
+
+func writeJSON(w io.Writer, value interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(value)
+}
+
+// exportKeys writes the keys in the given format. Only the current
+// generation is exported, except in JWKS which holds every generation.
+func exportKeys(w io.Writer, keys *orckeys.Keys, format, use string, includePrivate bool) error {
+	public := keys.Public()
+
+	switch format {
+	case formatJWKS:
+		var jwks keyformats.JWKS
+		var err error
+		if includePrivate {
+			jwks, err = keyformats.KeysToJWKS(keys)
+		} else {
+			jwks, err = keyformats.PublicKeysToJWKS(public)
+		}
+		if err != nil {
+			return err
+		}
+		return writeJSON(w, jwks)
+
+	case formatJWK:
+		standardKeys, err := keys.StandardKeys()
+		if err != nil {
+			return err
+		}
+		for _, key := range standardKeys {
+			if key.Use != use {
+				continue
+			}
+			jwk, err := keyformats.ToJWK(key, keyformats.KeyID(keys.Metadata, key.Use), includePrivate)
+			if err != nil {
+				return err
+			}
+			return writeJSON(w, jwk)
+		}
+		return fmt.Errorf("No key with use %q (expected %q or %q)", use, orckeys.UseSigning, orckeys.UseEncryption)
+
+	case formatPEM:
+		standardKeys, err := keys.StandardKeys()
+		if err != nil {
+			return err
+		}
+		data, err := keyformats.ToPEM(standardKeys, includePrivate)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+
+	case formatTinkJSON:
+		var tinkKeys *keyformats.TinkJSONKeys
+		var err error
+		if includePrivate {
+			tinkKeys, err = keyformats.KeysToTinkJSON(keys)
+		} else {
+			tinkKeys, err = keyformats.PublicKeysToTinkJSON(public)
+		}
+		if err != nil {
+			return err
+		}
+		return writeJSON(w, tinkKeys)
+	}
+
+	return fmt.Errorf("Unknown --format %q (expected %s, %s, %s or %s)", format, formatJWKS, formatJWK, formatPEM, formatTinkJSON)
+}
+
+// importKeys reads keys in the given format. It returns private keys if the
+// input has them, and otherwise only public keys.
+func importKeys(data []byte, format, owner string) (*orckeys.Keys, *orckeys.PublicKeyPacket, error) {
+	requireOwner := func() error {
+		if owner == "" {
+			return fmt.Errorf("missing --canonical_host (owner of the imported keys)")
+		}
+		return nil
+	}
+
+	switch format {
+	case formatJWKS, formatJWK:
+		if err := requireOwner(); err != nil {
+			return nil, nil, err
+		}
+		var jwks keyformats.JWKS
+		if format == formatJWKS {
+			if err := json.Unmarshal(data, &jwks); err != nil {
+				return nil, nil, fmt.Errorf("Invalid JWKS: %v", err)
+			}
+		} else {
+			// A JWK holds a single key, so the signing and the encryption
+			// key are given as concatenated JWKs.
+			dec := json.NewDecoder(bytes.NewReader(data))
+			for dec.More() {
+				var jwk keyformats.JWK
+				if err := dec.Decode(&jwk); err != nil {
+					return nil, nil, fmt.Errorf("Invalid JWK: %v", err)
+				}
+				jwks.Keys = append(jwks.Keys, jwk)
+			}
+		}
+		if jwks.HasPrivateKeys() {
+			keys, err := keyformats.KeysFromJWKS(owner, jwks)
+			return keys, nil, err
+		}
+		public, err := keyformats.PublicKeyPacketFromJWKS(owner, jwks)
+		return nil, &public, err
+
+	case formatPEM:
+		if err := requireOwner(); err != nil {
+			return nil, nil, err
+		}
+		if keyformats.IsPrivatePEM(data) {
+			keys, err := keyformats.KeysFromPEM(owner, data)
+			return keys, nil, err
+		}
+		public, err := keyformats.PublicKeyPacketFromPEM(owner, data)
+		return nil, &public, err
+
+	case formatTinkJSON:
+		var tinkKeys keyformats.TinkJSONKeys
+		if err := json.Unmarshal(data, &tinkKeys); err != nil {
+			return nil, nil, fmt.Errorf("Invalid Tink JSON keys: %v", err)
+		}
+		if owner != "" {
+			tinkKeys.Metadata.Owner = owner
+		}
+		if tinkKeys.Metadata.Owner == "" {
+			if err := requireOwner(); err != nil {
+				return nil, nil, err
+			}
+		}
+		if tinkKeys.Private {
+			keys, err := tinkKeys.Keys()
+			return keys, nil, err
+		}
+		public, err := tinkKeys.PublicKeyPacket()
+		return nil, &public, err
+	}
+
+	return nil, nil, fmt.Errorf("Unknown --format %q (expected %s, %s, %s or %s)", format, formatJWKS, formatJWK, formatPEM, formatTinkJSON)
+}
+
+func init() {
+	var exportFormat, exportUse, exportOutputFilename string
+	var exportIncludePrivate bool
+
+	exportFlags := orc.FlagsModule(func(flags *pflag.FlagSet) {
+		flags.StringVar(&exportFormat, "format", formatJWKS, "format to export: jwks, jwk, pem or tink-json")
+		flags.StringVar(&exportUse, "key", orckeys.UseSigning, "key to export with --format=jwk: sig or enc")
+		flags.BoolVar(&exportIncludePrivate, "include_private", false, "export private keys, unencrypted")
+		flags.StringVar(&exportOutputFilename, "output", "", "file to write (default stdout)")
+	})
+
+	orc.Command(KeysCommand, orc.Modules(
+		persistentkeys.M,
+		exportFlags,
+	), cobra.Command{
+		Use:   "export",
+		Short: "Export keys in a standard format (JWKS, JWK, PEM or Tink JSON keysets)",
+	}, func() error {
+		write := func(w io.Writer) error {
+			return exportKeys(w, persistentkeys.M.Keys, exportFormat, exportUse, exportIncludePrivate)
+		}
+		if exportOutputFilename == "" {
+			return write(os.Stdout)
+		}
+		return writeOutputFile(exportOutputFilename, write)
+	})
+
+	var importFormat, importInputFilename, importOwner, importMasterKeyURI, importRegistryToUpdateFilename string
+
+	importFlags := orc.FlagsModule(func(flags *pflag.FlagSet) {
+		flags.StringVar(&importFormat, "format", formatJWKS, "format to import: jwks, jwk (a signing and an encryption JWK, concatenated), pem or tink-json")
+		flags.StringVar(&importInputFilename, "input", "", "file to read")
+		flags.StringVar(&importOwner, "canonical_host", "", "canonical host (or name) of owner of the keys")
+		flags.StringVar(&importMasterKeyURI, "master_key_uri", "", "URI to master key for imported private keys")
+		flags.StringVar(&importRegistryToUpdateFilename, "update_public_keys", "", "public key registry file to update")
+	})
+
+	orc.Command(KeysCommand, orc.Modules(
+		importFlags,
+		orctinkgcpkms.M,
+		orctinklocalkms.M,
+		orctinkvaultkms.M,
+	), cobra.Command{
+		Use:   "import",
+		Short: "Import keys in a standard format, printing orc private keys (encrypted) or public keys",
+	}, func() error {
+		if importInputFilename == "" {
+			return fmt.Errorf("missing --input")
+		}
+		data, err := ioutil.ReadFile(importInputFilename)
+		if err != nil {
+			return err
+		}
+
+		keys, public, err := importKeys(data, importFormat, importOwner)
+		if err != nil {
+			return err
+		}
+
+		if keys != nil {
+			if importMasterKeyURI == "" {
+				return fmt.Errorf("missing --master_key_uri (required to write imported private keys)")
+			}
+			publicKeys := keys.Public()
+			public = &publicKeys
+		}
+
+		if importRegistryToUpdateFilename != "" {
+			if err := updateRegistryFile(importRegistryToUpdateFilename, *public); err != nil {
+				return err
+			}
+		}
+
+		if keys != nil {
+			return keys.WriteEncrypted(os.Stdout, importMasterKeyURI)
+		}
+		return writeJSON(os.Stdout, public)
+	})
+}
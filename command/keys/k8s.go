@@ -0,0 +1,123 @@
+package keys
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	"github.com/steinarvk/orclib/lib/k8smanifest"
+	"github.com/steinarvk/orclib/lib/orckeys"
+	"github.com/steinarvk/orclib/lib/orcouterauth"
+)
+
+const (
+	k8sKeysDataKey       = "keys.json"
+	k8sPublicKeysDataKey = "public_keys.json"
+)
+
+type k8sOptions struct {
+	SecretName    string
+	ConfigMapName string
+	Namespace     string
+
+	// OuterAuthFilenames are existing outer auth secret files to include.
+	OuterAuthFilenames []string
+
+	// NewOuterAuthName, if set, is the name of a new outer auth secret to
+	// generate and include.
+	NewOuterAuthName string
+
+	// RegistryFilename, if set, is a public key registry file to put in the
+	// ConfigMap instead of only the new public keys.
+	RegistryFilename string
+}
+
+func outerAuthDataKey(name string) string {
+	return "outerauth-" + name + ".json"
+}
+
+// k8sManifests returns a Secret with the encrypted keys and any outer auth
+// secrets, and optionally a ConfigMap with a public key registry.
+func k8sManifests(keys *orckeys.Keys, masterKeyURI string, opts k8sOptions) ([]interface{}, error) {
+	var keysData bytes.Buffer
+	if err := keys.WriteEncrypted(&keysData, masterKeyURI); err != nil {
+		return nil, err
+	}
+
+	secretFiles := map[string][]byte{
+		k8sKeysDataKey: keysData.Bytes(),
+	}
+
+	addSecretFile := func(key string, data []byte) error {
+		if _, ok := secretFiles[key]; ok {
+			return fmt.Errorf("Duplicate file %q in secret", key)
+		}
+		secretFiles[key] = data
+		return nil
+	}
+
+	for _, filename := range opts.OuterAuthFilenames {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		if err := addSecretFile(filepath.Base(filename), data); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.NewOuterAuthName != "" {
+		secret, err := orcouterauth.GenerateSecret(opts.NewOuterAuthName, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		data, err := json.Marshal(secret)
+		if err != nil {
+			return nil, err
+		}
+		if err := addSecretFile(outerAuthDataKey(secret.Name), data); err != nil {
+			return nil, err
+		}
+	}
+
+	secret, err := k8smanifest.NewSecret(k8smanifest.ObjectMeta{
+		Name:      opts.SecretName,
+		Namespace: opts.Namespace,
+	}, secretFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := []interface{}{secret}
+
+	if opts.ConfigMapName == "" {
+		return rv, nil
+	}
+
+	var registryData []byte
+	if opts.RegistryFilename != "" {
+		registryData, err = ioutil.ReadFile(opts.RegistryFilename)
+	} else {
+		registryData, err = json.Marshal(map[string]orckeys.PublicKeyPacket{
+			keys.Metadata.Owner: keys.Public(),
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	configMap, err := k8smanifest.NewConfigMap(k8smanifest.ObjectMeta{
+		Name:      opts.ConfigMapName,
+		Namespace: opts.Namespace,
+	}, map[string][]byte{
+		k8sPublicKeysDataKey: registryData,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return append(rv, configMap), nil
+}
@@ -5,18 +5,22 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
-	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 	"github.com/steinarvk/orc"
 	"github.com/steinarvk/orclib/lib/cryptopacket"
+	"github.com/steinarvk/orclib/lib/k8smanifest"
+	"github.com/steinarvk/orclib/lib/localkms"
 	"github.com/steinarvk/orclib/lib/mutatefile"
 	"github.com/steinarvk/orclib/lib/orckeys"
 
 	persistentkeys "github.com/steinarvk/orclib/module/orc-persistentkeys"
 	publickeyregistry "github.com/steinarvk/orclib/module/orc-publickeyregistry"
 	orctinkgcpkms "github.com/steinarvk/orclib/module/orc-tinkgcpkms"
+	orctinklocalkms "github.com/steinarvk/orclib/module/orc-tinklocalkms"
+	orctinkvaultkms "github.com/steinarvk/orclib/module/orc-tinkvaultkms"
 )
 
 var (
@@ -26,6 +30,23 @@ var (
 	}, nil)
 )
 
+// updateRegistryFile adds or replaces public keys in a public key registry
+// file.
+func updateRegistryFile(filename string, public orckeys.PublicKeyPacket) error {
+	var existing map[string]orckeys.PublicKeyPacket
+	return mutatefile.MutateFile(filename, 0600, func(data []byte) ([]byte, error) {
+		if len(data) == 0 {
+			existing = map[string]orckeys.PublicKeyPacket{}
+		} else {
+			if err := json.Unmarshal(data, &existing); err != nil {
+				return nil, fmt.Errorf("Invalid data: %v", err)
+			}
+		}
+		existing[public.Metadata.Owner] = public
+		return json.Marshal(existing)
+	})
+}
+
 func init() {
 	var masterKeyURI string
 	masterKeyURIFlags := orc.FlagsModule(func(flags *pflag.FlagSet) {
@@ -42,6 +63,11 @@ func init() {
 		flags.StringVar(&keyOwnerFlag, "canonical_host", "", "canonical host (or name) of owner of the keys")
 	})
 
+	var algorithmFlag string
+	algorithmFlags := orc.FlagsModule(func(flags *pflag.FlagSet) {
+		flags.StringVar(&algorithmFlag, "algorithm", "", "algorithms for new keys: a suite (p256, 25519) or <signing>+<encryption>, e.g. ed25519+hpke-x25519")
+	})
+
 	var registryToUpdateFilename string
 	registryToUpdateFlags := orc.FlagsModule(func(flags *pflag.FlagSet) {
 		flags.StringVar(&registryToUpdateFilename, "update_public_keys", "", "public key registry file to update")
@@ -51,18 +77,7 @@ func init() {
 		if registryToUpdateFilename == "" {
 			return nil
 		}
-		var existing map[string]orckeys.PublicKeyPacket
-		return mutatefile.MutateFile(registryToUpdateFilename, 0600, func(data []byte) ([]byte, error) {
-			if len(data) == 0 {
-				existing = map[string]orckeys.PublicKeyPacket{}
-			} else {
-				if err := json.Unmarshal(data, &existing); err != nil {
-					return nil, fmt.Errorf("Invalid data: %v", err)
-				}
-			}
-			existing[public.Metadata.Owner] = public
-			return json.Marshal(existing)
-		})
+		return updateRegistryFile(registryToUpdateFilename, public)
 	}
 
 	orc.Command(KeysCommand, orc.Modules(
@@ -86,21 +101,116 @@ func init() {
 	generateFlags := orc.Modules(
 		masterKeyURIFlags,
 		keyOwnerFlags,
+		algorithmFlags,
 		registryToUpdateFlags,
 		orctinkgcpkms.M,
+		orctinklocalkms.M,
+		orctinkvaultkms.M,
 	)
 
+	generateKeys := func() (*orckeys.Keys, error) {
+		if keyOwnerFlag == "" {
+			return nil, fmt.Errorf("missing --canonical_host (canonical host, or other alias, of key owner)")
+		}
+
+		algorithms := orckeys.DefaultAlgorithms
+		if algorithmFlag != "" {
+			parsed, err := orckeys.ParseAlgorithms(algorithmFlag)
+			if err != nil {
+				return nil, err
+			}
+			algorithms = parsed
+		}
+
+		keys, err := orckeys.GenerateWithAlgorithms(keyOwnerFlag, algorithms)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := maybeUpdateRegistry(keys.Public()); err != nil {
+			return nil, err
+		}
+
+		return keys, nil
+	}
+
 	orc.Command(KeysCommand, orc.Modules(
 		generateFlags,
 	), cobra.Command{
 		Use:   "generate",
 		Short: "Generate a new set of keys",
 	}, func() error {
-		if keyOwnerFlag == "" {
-			return fmt.Errorf("missing --canonical_host (canonical host, or other alias, of key owner)")
+		keys, err := generateKeys()
+		if err != nil {
+			return err
+		}
+
+		return keys.WriteEncrypted(os.Stdout, masterKeyURI)
+	})
+
+	var localMasterKeyFilename string
+	var localMasterKeyFromPassphrase bool
+	localMasterKeyFlags := orc.FlagsModule(func(flags *pflag.FlagSet) {
+		flags.StringVar(&localMasterKeyFilename, "output", "", "file to write the new master key to")
+		flags.BoolVar(&localMasterKeyFromPassphrase, "passphrase", false, "derive the master key from the passphrase in --local_kms_passphrase_file instead of storing a random key")
+	})
+
+	orc.Command(KeysCommand, orc.Modules(
+		localMasterKeyFlags,
+	), cobra.Command{
+		Use:   "create-local-master-key",
+		Short: "Create a master key file for use with local-kms:// URIs",
+	}, func() error {
+		if localMasterKeyFilename == "" {
+			return fmt.Errorf("missing --output")
+		}
+
+		newKeyFile := localkms.NewKeysetKeyFile
+		if localMasterKeyFromPassphrase {
+			newKeyFile = localkms.NewPassphraseKeyFile
+		}
+
+		keyFile, err := newKeyFile()
+		if err != nil {
+			return err
+		}
+
+		if err := keyFile.WriteNew(localMasterKeyFilename); err != nil {
+			return err
+		}
+
+		fmt.Printf("%s%s\n", localkms.Prefix, localMasterKeyFilename)
+		return nil
+	})
+
+	var rotationOverlap, activateAfter time.Duration
+	rotateFlags := orc.FlagsModule(func(flags *pflag.FlagSet) {
+		flags.DurationVar(&rotationOverlap, "rotation_overlap", 7*24*time.Hour, "how long the old keys remain valid after the new keys become active")
+		flags.DurationVar(&activateAfter, "activate_after", 0, "delay before the new keys become active, to let peers pick up the new public keys first")
+	})
+
+	orc.Command(KeysCommand, orc.Modules(
+		persistentkeys.M,
+		masterKeyURIFlags,
+		registryToUpdateFlags,
+		algorithmFlags,
+		rotateFlags,
+	), cobra.Command{
+		Use:   "rotate",
+		Short: "Generate a new generation of keys, keeping the current ones valid for a while",
+	}, func() error {
+		activateAt := time.Now().Add(activateAfter)
+
+		algorithms := persistentkeys.M.Keys.Algorithms()
+		if algorithmFlag != "" {
+			parsed, err := orckeys.ParseAlgorithms(algorithmFlag)
+			if err != nil {
+				return err
+			}
+			algorithms = parsed
 		}
 
-		keys, err := orckeys.Generate(keyOwnerFlag)
+		keys, err := persistentkeys.M.Keys.RotateTo(algorithms, activateAt, rotationOverlap)
 		if err != nil {
 			return err
 		}
@@ -109,9 +219,74 @@ func init() {
 			return err
 		}
 
+		if registryToUpdateFilename == "" {
+			enc := json.NewEncoder(os.Stderr)
+			enc.SetIndent("", "  ")
+			enc.Encode(keys.Public())
+		}
+
 		return keys.WriteEncrypted(os.Stdout, masterKeyURI)
 	})
 
+	orc.Command(KeysCommand, orc.Modules(
+		persistentkeys.M,
+	), cobra.Command{
+		Use:   "countersign",
+		Short: "Countersign public keys read from stdin with these keys, e.g. as a root of trust",
+	}, func() error {
+		var public orckeys.PublicKeyPacket
+		if err := json.NewDecoder(os.Stdin).Decode(&public); err != nil {
+			return fmt.Errorf("Invalid public keys on stdin: %v", err)
+		}
+
+		countersigned, err := persistentkeys.M.Keys.Countersign(public)
+		if err != nil {
+			return err
+		}
+
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(countersigned)
+	})
+
+	var keysFileToUpdate string
+	keysFileToUpdateFlags := orc.FlagsModule(func(flags *pflag.FlagSet) {
+		flags.StringVar(&keysFileToUpdate, "keys_file_to_update", "", "private keys file to add countersignatures to")
+	})
+
+	orc.Command(KeysCommand, orc.Modules(
+		keysFileToUpdateFlags,
+	), cobra.Command{
+		Use:   "attach-countersignatures",
+		Short: "Add countersignatures from countersigned public keys on stdin to a private keys file",
+	}, func() error {
+		if keysFileToUpdate == "" {
+			return fmt.Errorf("missing --keys_file_to_update")
+		}
+
+		var public orckeys.PublicKeyPacket
+		if err := json.NewDecoder(os.Stdin).Decode(&public); err != nil {
+			return fmt.Errorf("Invalid public keys on stdin: %v", err)
+		}
+
+		return mutatefile.MutateFile(keysFileToUpdate, 0600, func(data []byte) ([]byte, error) {
+			if len(data) == 0 {
+				return nil, fmt.Errorf("No such keys file")
+			}
+			var packet orckeys.PrivateKeyPacket
+			if err := json.Unmarshal(data, &packet); err != nil {
+				return nil, fmt.Errorf("Invalid keys file: %v", err)
+			}
+			if packet.Metadata.Owner != public.Metadata.Owner {
+				return nil, fmt.Errorf("Keys file is owned by %q, but public keys are for %q", packet.Metadata.Owner, public.Metadata.Owner)
+			}
+			if added := packet.AttachCountersignatures(public); added == 0 {
+				return nil, fmt.Errorf("No new countersignatures for these keys")
+			}
+			return json.Marshal(packet)
+		})
+	})
+
 	orc.Command(KeysCommand, orc.Modules(
 		persistentkeys.M,
 		publickeyregistry.M,
@@ -163,34 +338,44 @@ func init() {
 		return nil
 	})
 
+	var k8sOpts k8sOptions
+	k8sFlags := orc.FlagsModule(func(flags *pflag.FlagSet) {
+		flags.StringVar(&k8sOpts.SecretName, "k8s_secret_name", "", "name of the Kubernetes Secret (default orckeys-<canonical host>)")
+		flags.StringVar(&k8sOpts.ConfigMapName, "k8s_public_keys_configmap", "", "name of a Kubernetes ConfigMap to create with the public keys (default none)")
+		flags.StringVar(&k8sOpts.Namespace, "k8s_namespace", "", "Kubernetes namespace of the created objects")
+		flags.StringSliceVar(&k8sOpts.OuterAuthFilenames, "include_outer_auth", nil, "outer auth secret files to include in the Secret")
+		flags.StringVar(&k8sOpts.NewOuterAuthName, "generate_outer_auth", "", "name of a new outer auth secret to generate and include in the Secret")
+	})
+
 	orc.Command(KeysCommand, orc.Modules(
 		generateFlags,
+		k8sFlags,
 	), cobra.Command{
 		Use:   "generate-k8s",
-		Short: "Print shell commands to generate a Kubernetes secret with keys",
+		Short: "Generate keys and print Kubernetes manifests (a Secret, and optionally a ConfigMap) for them",
+		Long: `Generate keys and print Kubernetes manifests for them, to be applied with "kubectl apply -f".
+
+The Secret contains the encrypted keys as keys.json, and outer auth secrets as
+further files. The ConfigMap, if requested, contains public_keys.json: the
+file from --update_public_keys after it has been updated, or else a registry
+of only the new public keys.`,
 	}, func() error {
-		if keyOwnerFlag == "" {
-			return fmt.Errorf("missing --canonical_host (canonical host, or other alias, of key owner)")
+		keys, err := generateKeys()
+		if err != nil {
+			return err
 		}
 
-		index := -1
-		for i, arg := range os.Args {
-			if arg == "generate-k8s" {
-				index = i
-				break
-			}
+		opts := k8sOpts
+		if opts.SecretName == "" {
+			opts.SecretName = "orckeys-" + keyOwnerFlag
 		}
-		if index == -1 {
-			return fmt.Errorf("Unable to find self in command line")
-		}
-
-		prefixArgs := os.Args[:index]
-		suffixArgs := os.Args[index+1:]
+		opts.RegistryFilename = registryToUpdateFilename
 
-		prefix := strings.Join(prefixArgs, " ")
-		suffix := strings.Join(suffixArgs, " ")
-		fmt.Printf("%s generate %s | kubectl create secret generic orckeys-%s --from-file=keys.json=/dev/stdin\n", prefix, suffix, keyOwnerFlag)
+		manifests, err := k8sManifests(keys, masterKeyURI, opts)
+		if err != nil {
+			return err
+		}
 
-		return nil
+		return k8smanifest.Write(os.Stdout, manifests...)
 	})
 }
@@ -0,0 +1,70 @@
+package secrets
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/steinarvk/orc"
+	"github.com/steinarvk/orclib/lib/orcouterauth"
+)
+
+var (
+	SecretsCommand = orc.Command(nil, nil, cobra.Command{
+		Use:   "secrets",
+		Short: "Commands to manipulate shared secrets",
+	}, nil)
+)
+
+func init() {
+	var name, outputFilename string
+	outerAuthFlags := orc.FlagsModule(func(flags *pflag.FlagSet) {
+		flags.StringVar(&name, "name", "", "name of the secret, as shown in logs")
+		flags.StringVar(&outputFilename, "output", "", "file to create (default stdout)")
+	})
+
+	orc.Command(SecretsCommand, orc.Modules(
+		outerAuthFlags,
+	), cobra.Command{
+		Use:   "generate-outer-auth",
+		Short: "Generate a new shared secret for --outer_auth",
+		Long: `Generate a new shared secret for --outer_auth.
+
+Servers accept any secret listed with --outer_auth, and clients use the first.
+To rotate, add the new secret last everywhere, then move it first, and finally
+remove the old one.`,
+	}, func() error {
+		if name == "" {
+			return fmt.Errorf("missing --name")
+		}
+
+		secret, err := orcouterauth.GenerateSecret(name, time.Now())
+		if err != nil {
+			return err
+		}
+
+		data, err := json.MarshalIndent(secret, "", "  ")
+		if err != nil {
+			return err
+		}
+		data = append(data, '\n')
+
+		if outputFilename == "" {
+			_, err := os.Stdout.Write(data)
+			return err
+		}
+
+		f, err := os.OpenFile(outputFilename, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err != nil {
+			return fmt.Errorf("Error creating %q: %v", outputFilename, err)
+		}
+		if _, err := f.Write(data); err != nil {
+			f.Close()
+			return fmt.Errorf("Error writing %q: %v", outputFilename, err)
+		}
+		return f.Close()
+	})
+}
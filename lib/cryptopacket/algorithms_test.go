@@ -0,0 +1,104 @@
+package cryptopacket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/steinarvk/orclib/lib/orckeys"
+)
+
+func TestMixedAlgorithms(t *testing.T) {
+	alice, err := orckeys.GenerateWithAlgorithms("alice", orckeys.AlgorithmSuites["25519"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := orckeys.Generate("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	carol, err := orckeys.Generate("carol")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Carol migrates to new algorithms, keeping her old keys valid for a while.
+	carol, err = carol.RotateTo(orckeys.AlgorithmSuites["25519"], time.Now(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := carol.Algorithms().Signing; got != orckeys.SigningEd25519 {
+		t.Fatalf("rotated keys use %q, want %q", got, orckeys.SigningEd25519)
+	}
+
+	alicePublic, bobPublic, carolPublic := alice.Public(), bob.Public(), carol.Public()
+	registry := mapRegistry{"alice": &alicePublic, "bob": &bobPublic, "carol": &carolPublic}
+
+	for _, tc := range []struct {
+		sender, recipient *orckeys.Keys
+	}{
+		{alice, bob},
+		{bob, alice},
+		{carol, bob},
+		{bob, carol},
+	} {
+		ciphertext, err := Pack("hello", tc.sender, registry, tc.recipient.Metadata.Owner)
+		if err != nil {
+			t.Fatalf("%s -> %s: %v", tc.sender.Metadata.Owner, tc.recipient.Metadata.Owner, err)
+		}
+		var got string
+		if _, err := Unpack(&got, ciphertext, tc.recipient, registry); err != nil {
+			t.Fatalf("%s -> %s: %v", tc.sender.Metadata.Owner, tc.recipient.Metadata.Owner, err)
+		}
+		if got != "hello" {
+			t.Errorf("%s -> %s: got %q", tc.sender.Metadata.Owner, tc.recipient.Metadata.Owner, got)
+		}
+	}
+
+	ciphertext, err := PackForRecipients("hello", bob, registry, []string{"alice", "carol"}, PackOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, recipient := range []*orckeys.Keys{alice, carol} {
+		if _, err := Unpack(nil, ciphertext, recipient, registry); err != nil {
+			t.Errorf("%s: %v", recipient.Metadata.Owner, err)
+		}
+	}
+}
+
+func TestParseAlgorithms(t *testing.T) {
+	got, err := orckeys.ParseAlgorithms("ed25519+ecies-p256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (orckeys.Algorithms{Signing: orckeys.SigningEd25519, Encryption: orckeys.EncryptionECIESP256}); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for _, bad := range []string{"", "rsa", "ed25519+rsa", "ecies-p256+ed25519"} {
+		if _, err := orckeys.ParseAlgorithms(bad); err == nil {
+			t.Errorf("ParseAlgorithms(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestAlgorithmsInferredFromKeys(t *testing.T) {
+	keys, err := orckeys.GenerateWithAlgorithms("alice", orckeys.AlgorithmSuites["25519"])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Keys from before algorithms were recorded.
+	public := keys.Public()
+	public.Metadata.SigningAlgorithm = ""
+	public.Metadata.EncryptionAlgorithm = ""
+
+	got, err := public.Algorithms()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := orckeys.AlgorithmSuites["25519"]; got != want {
+		t.Errorf("inferred algorithms %v, want %v", got, want)
+	}
+	if _, err := public.StandardKeys(); err != nil {
+		t.Errorf("StandardKeys: %v", err)
+	}
+}
@@ -0,0 +1,121 @@
+package cryptopacket
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/steinarvk/orclib/lib/orchash"
+	"github.com/steinarvk/orclib/lib/orctimestamp"
+)
+
+// AuditRecord describes one use of the local keys on a packet, stream or
+// detached signature.
+type AuditRecord struct {
+	Timestamp string   `json:"timestamp"`
+	Operation string   `json:"operation"`
+	ID        string   `json:"id,omitempty"`
+	Self      string   `json:"self,omitempty"`
+	Peers     []string `json:"peers,omitempty"`
+	Outcome   string   `json:"outcome"`
+	Error     string   `json:"error,omitempty"`
+}
+
+type AuditLog interface {
+	Record(AuditRecord) error
+}
+
+var (
+	auditLogMu sync.Mutex
+	auditLog   AuditLog
+)
+
+// SetAuditLog sets the audit log that all subsequent operations are
+// recorded to. A nil log disables auditing.
+func SetAuditLog(log AuditLog) {
+	auditLogMu.Lock()
+	defer auditLogMu.Unlock()
+	auditLog = log
+}
+
+func getAuditLog() AuditLog {
+	auditLogMu.Lock()
+	defer auditLogMu.Unlock()
+	return auditLog
+}
+
+// SignatureID identifies a packet, stream or detached signature by the hash
+// of its signature.
+func SignatureID(signature string) string {
+	if signature == "" {
+		return ""
+	}
+	return orchash.ComputeHash([]byte(signature))
+}
+
+func recordAudit(operation, self, signature string, peers []string, err error) {
+	log := getAuditLog()
+	if log == nil {
+		return
+	}
+
+	rec := AuditRecord{
+		Timestamp: orctimestamp.Format(time.Now()),
+		Operation: operation,
+		ID:        SignatureID(signature),
+		Self:      self,
+		Peers:     peers,
+		Outcome:   outcomeOf(err),
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+
+	if err := log.Record(rec); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"operation": operation,
+			"id":        rec.ID,
+			"error":     err,
+		}).Errorf("Failed to write audit record")
+	}
+}
+
+// FileAuditLog appends audit records as JSON lines to a file, syncing after
+// every record.
+type FileAuditLog struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+func OpenFileAuditLog(filename string) (*FileAuditLog, error) {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open audit log %q: %v", filename, err)
+	}
+	return &FileAuditLog{f: f}, nil
+}
+
+func (l *FileAuditLog) Record(rec AuditRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("Error serializing audit record: %v", err)
+	}
+	data = append(data, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, err := l.f.Write(data); err != nil {
+		return fmt.Errorf("Error writing audit record: %v", err)
+	}
+	return l.f.Sync()
+}
+
+func (l *FileAuditLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
@@ -0,0 +1,51 @@
+package cryptopacket
+
+import (
+	"testing"
+)
+
+type memoryAuditLog []AuditRecord
+
+func (l *memoryAuditLog) Record(rec AuditRecord) error {
+	*l = append(*l, rec)
+	return nil
+}
+
+func TestAuditLog(t *testing.T) {
+	alice, bob, registry := newTestParties(t)
+
+	var log memoryAuditLog
+	SetAuditLog(&log)
+	defer SetAuditLog(nil)
+
+	ciphertext, err := Pack("hello", alice, registry, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet, err := Unpack(nil, ciphertext, bob, registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Unpack(nil, ciphertext, alice, registry); err == nil {
+		t.Fatalf("Unpack by non-recipient succeeded")
+	}
+
+	if len(log) != 3 {
+		t.Fatalf("got %d audit records, want 3: %v", len(log), log)
+	}
+
+	packID := SignatureID(packet.Signature)
+	for i, want := range []AuditRecord{
+		{Operation: "pack", ID: packID, Self: "alice", Outcome: "ok"},
+		{Operation: "unpack", ID: packID, Self: "bob", Outcome: "ok"},
+		{Operation: "unpack", Self: "alice", Outcome: "error"},
+	} {
+		got := log[i]
+		if got.Operation != want.Operation || got.ID != want.ID || got.Self != want.Self || got.Outcome != want.Outcome {
+			t.Errorf("audit record %d = %+v, want %+v", i, got, want)
+		}
+	}
+	if peers := log[1].Peers; len(peers) != 1 || peers[0] != "alice" {
+		t.Errorf("unpack audit record has peers %v, want [alice]", peers)
+	}
+}
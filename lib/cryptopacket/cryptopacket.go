@@ -7,9 +7,19 @@ type Contents struct {
 	// Recipient is the canonical host of the recipient, to whom the message is encrypted.
 	Recipient string `json:"recipient,omitempty"`
 
+	// Recipients lists the canonical hosts of all recipients of a packet
+	// encrypted to several recipients. Recipient is then empty.
+	Recipients []string `json:"recipients,omitempty"`
+
 	// Sender is the canonical host of the sender.
 	Sender string `json:"sender"`
 
+	// Expires, if set, is the time after which the packet must not be accepted.
+	Expires string `json:"expires,omitempty"`
+
+	// Nonce, if set, is a unique value allowing recipients to reject replays.
+	Nonce string `json:"nonce,omitempty"`
+
 	// Payload is the message contained in the packet.
 	Payload interface{} `json:"payload"`
 }
@@ -15,7 +15,7 @@ func DecryptString(dec tink.HybridDecrypt, data string) (string, error) {
 
 	plaintext, err := dec.Decrypt(ciphertextData, nil)
 	if err != nil {
-		return "", nil
+		return "", err
 	}
 	return string(plaintext), nil
 }
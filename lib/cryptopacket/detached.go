@@ -0,0 +1,105 @@
+package cryptopacket
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/steinarvk/orclib/lib/orchash"
+	"github.com/steinarvk/orclib/lib/orckeys"
+	"github.com/steinarvk/orclib/lib/orctimestamp"
+)
+
+type DetachedContents struct {
+	Timestamp string `json:"timestamp"`
+	Signer    string `json:"signer"`
+
+	// Hash is the hash of the signed content, in orchash format.
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+// DetachedSignature is a signature over the hash of content kept elsewhere.
+type DetachedSignature struct {
+	Contents  DetachedContents `json:"contents"`
+	Signature string           `json:"signature"`
+}
+
+// SignDetached reads r to the end and signs its hash.
+func SignDetached(r io.Reader, keys *orckeys.Keys) (*DetachedSignature, error) {
+	return SignDetachedContext(context.Background(), r, keys)
+}
+
+// SignDetachedContext is like SignDetached, but traces the signing within
+// ctx.
+func SignDetachedContext(ctx context.Context, r io.Reader, keys *orckeys.Keys) (*DetachedSignature, error) {
+	now := time.Now()
+
+	signingKeys, err := keys.ActiveAt(now)
+	if err != nil {
+		return nil, err
+	}
+
+	hash, size, err := orchash.ComputeReaderHash(r)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading content to sign: %v", err)
+	}
+
+	contents := DetachedContents{
+		Timestamp: orctimestamp.Format(now),
+		Signer:    keys.Metadata.Owner,
+		Hash:      hash,
+		Size:      size,
+	}
+	op := beginOperation(ctx, opSign, "")
+	signature, err := SignJSON(signingKeys.Signer, contents)
+	recordAudit("sign_detached", keys.Metadata.Owner, signature, nil, op.end(err))
+	if err != nil {
+		return nil, err
+	}
+
+	return &DetachedSignature{
+		Contents:  contents,
+		Signature: signature,
+	}, nil
+}
+
+// VerifyDetached reads r to the end and checks that sig is a valid
+// signature of its content.
+func VerifyDetached(r io.Reader, sig *DetachedSignature, registry PublicKeyRegistry) error {
+	return VerifyDetachedContext(context.Background(), r, sig, registry)
+}
+
+// VerifyDetachedContext is like VerifyDetached, but traces the verification
+// within ctx.
+func VerifyDetachedContext(ctx context.Context, r io.Reader, sig *DetachedSignature, registry PublicKeyRegistry) error {
+	if registry == nil {
+		return fmt.Errorf("Missing public key registry")
+	}
+
+	op := beginOperation(ctx, opVerify, peerUnverified)
+	err := op.endVerified(sig.Contents.Signer, verifyDetached(r, sig, registry))
+	recordAudit("verify_detached", "", sig.Signature, []string{sig.Contents.Signer}, err)
+	return err
+}
+
+func verifyDetached(r io.Reader, sig *DetachedSignature, registry PublicKeyRegistry) error {
+	signerPubKey, err := registry.LookupPublicKeys(sig.Contents.Signer)
+	if err != nil {
+		return fmt.Errorf("Error looking up signer %q: %v", sig.Contents.Signer, err)
+	}
+	if err := verifyWithAnyValidKey(sig.Contents, sig.Signature, sig.Contents.Signer, signerPubKey); err != nil {
+		return err
+	}
+
+	hash, size, err := orchash.ComputeReaderHash(r)
+	if err != nil {
+		return fmt.Errorf("Error reading signed content: %v", err)
+	}
+	if size != sig.Contents.Size || hash != sig.Contents.Hash {
+		return fmt.Errorf("Content does not match signature by %q", sig.Contents.Signer)
+	}
+
+	return nil
+}
@@ -11,7 +11,7 @@ import (
 func EncryptString(enc tink.HybridEncrypt, data string) (string, error) {
 	ciphertext, err := enc.Encrypt([]byte(data), nil)
 	if err != nil {
-		return "", nil
+		return "", err
 	}
 	return base64.RawStdEncoding.EncodeToString(ciphertext), nil
 }
@@ -0,0 +1,80 @@
+package cryptopacket
+
+import (
+	"fmt"
+	"time"
+)
+
+type BadSignatureError struct {
+	Sender string
+	Err    error
+}
+
+func (e BadSignatureError) Error() string {
+	return fmt.Sprintf("Invalid signature by %q: %v", e.Sender, e.Err)
+}
+
+func (e BadSignatureError) Unwrap() error { return e.Err }
+
+type StaleError struct {
+	Timestamp string
+	Age       time.Duration
+	MaxAge    time.Duration
+}
+
+func (e StaleError) Error() string {
+	return fmt.Sprintf("Packet from %s is too old (%v > %v)", e.Timestamp, e.Age, e.MaxAge)
+}
+
+type FromFutureError struct {
+	Timestamp string
+	Skew      time.Duration
+}
+
+func (e FromFutureError) Error() string {
+	return fmt.Sprintf("Packet timestamp %s is %v in the future", e.Timestamp, e.Skew)
+}
+
+type ExpiredError struct {
+	Expires string
+}
+
+func (e ExpiredError) Error() string {
+	return fmt.Sprintf("Packet expired at %s", e.Expires)
+}
+
+type WrongRecipientError struct {
+	Recipient string
+	Want      string
+}
+
+func (e WrongRecipientError) Error() string {
+	return fmt.Sprintf("Packet is for %q, not %q", e.Recipient, e.Want)
+}
+
+type ReplayError struct {
+	Sender string
+	Nonce  string
+}
+
+func (e ReplayError) Error() string {
+	return fmt.Sprintf("Replayed packet from %q (nonce %q)", e.Sender, e.Nonce)
+}
+
+type MissingNonceError struct {
+	Sender string
+}
+
+func (e MissingNonceError) Error() string {
+	return fmt.Sprintf("Packet from %q has no nonce", e.Sender)
+}
+
+type MalformedTimestampError struct {
+	Field string
+	Value string
+	Err   error
+}
+
+func (e MalformedTimestampError) Error() string {
+	return fmt.Sprintf("Malformed %s %q: %v", e.Field, e.Value, e.Err)
+}
@@ -0,0 +1,127 @@
+package cryptopacket
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/steinarvk/sectiontrace"
+)
+
+const (
+	statsNamespace = "cryptopacket"
+
+	opSign    = "sign"
+	opVerify  = "verify"
+	opEncrypt = "encrypt"
+	opDecrypt = "decrypt"
+
+	// peerUnverified labels operations on packets whose claimed sender
+	// has not been verified, so that callers cannot add a time series for
+	// each sender they make up.
+	peerUnverified = "unverified"
+
+	// peerMultiple labels operations on packets for several recipients,
+	// rather than adding a time series for each combination of them.
+	peerMultiple = "multiple"
+)
+
+var (
+	metricOperations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: statsNamespace,
+		Name:      "operations",
+		Help:      "Number of packet operations, by operation, peer owner and outcome",
+	},
+		[]string{"operation", "peer", "outcome"},
+	)
+
+	operationSections = map[string]sectiontrace.Section{
+		opSign:    sectiontrace.New(fmt.Sprintf("CryptoPacket(%s)", opSign)),
+		opVerify:  sectiontrace.New(fmt.Sprintf("CryptoPacket(%s)", opVerify)),
+		opEncrypt: sectiontrace.New(fmt.Sprintf("CryptoPacket(%s)", opEncrypt)),
+		opDecrypt: sectiontrace.New(fmt.Sprintf("CryptoPacket(%s)", opDecrypt)),
+	}
+)
+
+// operation is a traced and counted sign, verify, encrypt or decrypt step.
+// The peer may be filled in before end, e.g. once the sender of a packet
+// being decrypted is known.
+type operation struct {
+	name   string
+	peer   string
+	active sectiontrace.ActiveSection
+}
+
+// beginOperation starts the operation as a section within ctx.
+func beginOperation(ctx context.Context, name, peer string) *operation {
+	_, active := operationSections[name].Begin(ctx)
+	return &operation{
+		name:   name,
+		peer:   peer,
+		active: active,
+	}
+}
+
+// end records the outcome of the operation and returns err unchanged.
+func (o *operation) end(err error) error {
+	o.active.End(err)
+	metricOperations.With(prometheus.Labels{
+		"operation": o.name,
+		"peer":      o.peer,
+		"outcome":   outcomeOf(err),
+	}).Inc()
+	return err
+}
+
+// endVerified is like end, but labels the operation with peer only if it
+// succeeded.
+func (o *operation) endVerified(peer string, err error) error {
+	if err == nil {
+		o.peer = peer
+	}
+	return o.end(err)
+}
+
+// recipientsPeer returns the peer label of an operation on a packet for
+// the given recipients.
+func recipientsPeer(owners []string) string {
+	if len(owners) > 1 {
+		return peerMultiple
+	}
+	return strings.Join(owners, "")
+}
+
+func outcomeOf(err error) string {
+	switch err.(type) {
+	case nil:
+		return "ok"
+	case BadSignatureError:
+		return "bad_signature"
+	case StaleError:
+		return "stale"
+	case FromFutureError:
+		return "from_future"
+	case ExpiredError:
+		return "expired"
+	case WrongRecipientError:
+		return "wrong_recipient"
+	case ReplayError:
+		return "replay"
+	case MissingNonceError:
+		return "missing_nonce"
+	case MalformedTimestampError:
+		return "malformed_timestamp"
+	default:
+		return "error"
+	}
+}
+
+// peers lists the recipients the contents are addressed to, if any.
+func (c *Contents) peers() []string {
+	if c.Recipient != "" {
+		return []string{c.Recipient}
+	}
+	return c.Recipients
+}
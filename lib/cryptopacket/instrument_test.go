@@ -0,0 +1,93 @@
+package cryptopacket
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/steinarvk/sectiontrace"
+)
+
+func TestOperationPeerIsVerified(t *testing.T) {
+	alice, bob, registry := newTestParties(t)
+
+	count := func(op, peer, outcome string) float64 {
+		return testutil.ToFloat64(metricOperations.With(prometheus.Labels{"operation": op, "peer": peer, "outcome": outcome}))
+	}
+
+	plaintext, err := PackUnencrypted("hello", alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var packet Packet
+	if err := json.Unmarshal([]byte(plaintext), &packet); err != nil {
+		t.Fatal(err)
+	}
+
+	verified := count(opVerify, "alice", "ok")
+	if _, err := UnpackUnencrypted(nil, plaintext, registry); err != nil {
+		t.Fatal(err)
+	}
+	if got := count(opVerify, "alice", "ok") - verified; got != 1 {
+		t.Errorf("verifications labelled alice: got %v want 1", got)
+	}
+
+	// Claimed senders are not used as labels unless verified.
+	for _, sender := range []string{"bob", "mallory"} {
+		packet.Contents.Sender = sender
+		forged, err := json.Marshal(packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		unverified := count(opVerify, peerUnverified, "bad_signature") + count(opVerify, peerUnverified, "error")
+		if _, err := UnpackUnencrypted(nil, string(forged), registry); err == nil {
+			t.Fatalf("unpacked packet forged as from %q", sender)
+		}
+		if got := count(opVerify, peerUnverified, "bad_signature") + count(opVerify, peerUnverified, "error") - unverified; got != 1 {
+			t.Errorf("failed verifications labelled %q: got %v want 1", peerUnverified, got)
+		}
+		if got := count(opVerify, sender, "bad_signature") + count(opVerify, sender, "error"); got != 0 {
+			t.Errorf("failed verifications labelled %q: got %v want 0", sender, got)
+		}
+	}
+
+	if got := recipientsPeer([]string{"alice", "bob"}); got != peerMultiple {
+		t.Errorf("recipientsPeer(alice, bob) = %q want %q", got, peerMultiple)
+	}
+	if got := recipientsPeer([]string{bob.Metadata.Owner}); got != "bob" {
+		t.Errorf("recipientsPeer(bob) = %q want bob", got)
+	}
+}
+
+func TestOperationsAreTracedWithinCaller(t *testing.T) {
+	alice, bob, registry := newTestParties(t)
+
+	var hadParents []bool
+	defer func(hook func(overhead, internal time.Duration, hadParent bool)) { sectiontrace.OnTimeSpent = hook }(sectiontrace.OnTimeSpent)
+	sectiontrace.OnTimeSpent = func(_, _ time.Duration, hadParent bool) {
+		hadParents = append(hadParents, hadParent)
+	}
+
+	ctx, caller := sectiontrace.New("Caller").Begin(context.Background())
+	ciphertext, err := PackContext(ctx, "hello", alice, registry, "bob", PackOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := UnpackContext(ctx, nil, ciphertext, bob, registry, UnpackOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	caller.End(nil)
+
+	// Sign, encrypt, decrypt and verify, then the caller itself.
+	if len(hadParents) != 5 {
+		t.Fatalf("traced %d sections, want 5", len(hadParents))
+	}
+	for i, hadParent := range hadParents[:4] {
+		if !hadParent {
+			t.Errorf("operation %d was traced without the caller as parent", i)
+		}
+	}
+}
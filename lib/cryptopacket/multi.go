@@ -0,0 +1,233 @@
+package cryptopacket
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/tink/go/aead"
+	"github.com/google/tink/go/insecurecleartextkeyset"
+	"github.com/google/tink/go/keyset"
+	"github.com/steinarvk/orclib/lib/canonicalgojson"
+	"github.com/steinarvk/orclib/lib/orckeys"
+)
+
+const (
+	MultiRecipientFormatVersion = 1
+)
+
+var (
+	contentKeyContextInfo    = []byte("orc-packet-content-key")
+	multiRecipientEnvelopeAD = []byte("orc-multi-recipient-packet")
+
+	DefaultContentKeyTemplate = aead.AES256GCMKeyTemplate()
+)
+
+// WrappedKey is the content key of a multi-recipient packet, hybrid-encrypted
+// to one recipient.
+type WrappedKey struct {
+	Recipient string `json:"recipient"`
+	KeyID     string `json:"key_id"`
+	Key       string `json:"key"`
+}
+
+// MultiRecipientEnvelope is the encrypted form of a packet for several
+// recipients: the packet is encrypted once with a random content key, which
+// is wrapped for each recipient.
+type MultiRecipientEnvelope struct {
+	Version     int          `json:"version"`
+	WrappedKeys []WrappedKey `json:"wrapped_keys"`
+	Ciphertext  string       `json:"ciphertext"`
+}
+
+func (c *Contents) isFor(owner string) bool {
+	if c.Recipient == owner {
+		return true
+	}
+	for _, recipient := range c.Recipients {
+		if recipient == owner {
+			return true
+		}
+	}
+	return false
+}
+
+func isMultiRecipient(packetdata string) bool {
+	return strings.HasPrefix(strings.TrimSpace(packetdata), "{")
+}
+
+// PackForRecipients signs payload and encrypts it so that each of the
+// recipients can decrypt it with Unpack.
+func PackForRecipients(payload interface{}, keys *orckeys.Keys, registry PublicKeyRegistry, recipientOwners []string, opts PackOptions) (string, error) {
+	return PackForRecipientsContext(context.Background(), payload, keys, registry, recipientOwners, opts)
+}
+
+// PackForRecipientsContext is like PackForRecipients, but traces the
+// signing and encryption within ctx.
+func PackForRecipientsContext(ctx context.Context, payload interface{}, keys *orckeys.Keys, registry PublicKeyRegistry, recipientOwners []string, opts PackOptions) (string, error) {
+	if len(recipientOwners) == 0 {
+		return "", fmt.Errorf("Missing recipients")
+	}
+	rv, signature, err := packForRecipients(ctx, payload, keys, registry, recipientOwners, opts)
+	recordAudit("pack", keys.Metadata.Owner, signature, recipientOwners, err)
+	return rv, err
+}
+
+func packForRecipients(ctx context.Context, payload interface{}, keys *orckeys.Keys, registry PublicKeyRegistry, recipientOwners []string, opts PackOptions) (string, string, error) {
+	now := time.Now()
+
+	var recipients []orckeys.PublicKeyPacket
+	seen := map[string]bool{}
+	for _, owner := range recipientOwners {
+		if seen[owner] {
+			return "", "", fmt.Errorf("Duplicate recipient %q", owner)
+		}
+		seen[owner] = true
+
+		publicKeys, err := registry.LookupPublicKeys(owner)
+		if err != nil {
+			return "", "", err
+		}
+		active, err := publicKeys.ActiveAt(now)
+		if err != nil {
+			return "", "", err
+		}
+		recipients = append(recipients, active)
+	}
+
+	wrapped, err := signedPacket(ctx, payload, keys, now, opts, func(contents *Contents) {
+		contents.Recipients = append([]string(nil), recipientOwners...)
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	op := beginOperation(ctx, opEncrypt, recipientsPeer(recipientOwners))
+	ciphertext, err := encryptForRecipients(wrapped, recipients)
+	return ciphertext, wrapped.Signature, op.end(err)
+}
+
+func encryptForRecipients(wrapped Packet, recipients []orckeys.PublicKeyPacket) (string, error) {
+	contentKey, err := keyset.NewHandle(DefaultContentKeyTemplate)
+	if err != nil {
+		return "", fmt.Errorf("Failed to generate content key: %v", err)
+	}
+	var contentKeyBuf bytes.Buffer
+	if err := insecurecleartextkeyset.Write(contentKey, keyset.NewBinaryWriter(&contentKeyBuf)); err != nil {
+		return "", fmt.Errorf("Failed to serialize content key: %v", err)
+	}
+
+	envelope := MultiRecipientEnvelope{
+		Version: MultiRecipientFormatVersion,
+	}
+
+	for _, recipient := range recipients {
+		encrypter, err := recipient.EncryptTo()
+		if err != nil {
+			return "", err
+		}
+		wrappedKey, err := encrypter.Encrypt(contentKeyBuf.Bytes(), contentKeyContextInfo)
+		if err != nil {
+			return "", fmt.Errorf("Failed to wrap content key for %q: %v", recipient.Metadata.Owner, err)
+		}
+		envelope.WrappedKeys = append(envelope.WrappedKeys, WrappedKey{
+			Recipient: recipient.Metadata.Owner,
+			KeyID:     recipient.Metadata.ID,
+			Key:       base64.RawStdEncoding.EncodeToString(wrappedKey),
+		})
+	}
+
+	plaintext, err := canonicalgojson.MarshalCanonicalGoJSON(wrapped)
+	if err != nil {
+		return "", fmt.Errorf("Error marshalling data canonically: %v", err)
+	}
+	contentAEAD, err := aead.New(contentKey)
+	if err != nil {
+		return "", fmt.Errorf("Failed to create content AEAD: %v", err)
+	}
+	ciphertext, err := contentAEAD.Encrypt(plaintext, multiRecipientEnvelopeAD)
+	if err != nil {
+		return "", fmt.Errorf("Failed to encrypt packet: %v", err)
+	}
+	envelope.Ciphertext = base64.RawStdEncoding.EncodeToString(ciphertext)
+
+	data, err := json.Marshal(envelope)
+	if err != nil {
+		return "", fmt.Errorf("Error serializing JSON: %v", err)
+	}
+	return string(data), nil
+}
+
+func unwrapContentKey(keys *orckeys.Keys, envelope *MultiRecipientEnvelope) (*keyset.Handle, error) {
+	ids := map[string]bool{}
+	for _, generation := range keys.Generations() {
+		ids[generation.Metadata.ID] = true
+	}
+
+	var firstErr error
+	for _, wrappedKey := range envelope.WrappedKeys {
+		if wrappedKey.Recipient != keys.Metadata.Owner || !ids[wrappedKey.KeyID] {
+			continue
+		}
+		wrappedKeyData, err := base64.RawStdEncoding.DecodeString(wrappedKey.Key)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid wrapped key: %v", err)
+		}
+		contentKeyData, err := keys.Decrypt.Decrypt(wrappedKeyData, contentKeyContextInfo)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		return insecurecleartextkeyset.Read(keyset.NewBinaryReader(bytes.NewReader(contentKeyData)))
+	}
+
+	if firstErr != nil {
+		return nil, fmt.Errorf("Unable to unwrap content key: %v", firstErr)
+	}
+	return nil, fmt.Errorf("Packet has no key for %q", keys.Metadata.Owner)
+}
+
+func decryptMultiRecipient(keys *orckeys.Keys, packetdata string, packet *Packet) error {
+	var envelope MultiRecipientEnvelope
+	if err := json.Unmarshal([]byte(packetdata), &envelope); err != nil {
+		return fmt.Errorf("Unable to unmarshal envelope: %v", err)
+	}
+	if envelope.Version != MultiRecipientFormatVersion {
+		return fmt.Errorf("Unsupported envelope version %d", envelope.Version)
+	}
+
+	contentKey, err := unwrapContentKey(keys, &envelope)
+	if err != nil {
+		return err
+	}
+	contentAEAD, err := aead.New(contentKey)
+	if err != nil {
+		return fmt.Errorf("Failed to create content AEAD: %v", err)
+	}
+
+	ciphertext, err := base64.RawStdEncoding.DecodeString(envelope.Ciphertext)
+	if err != nil {
+		return fmt.Errorf("Invalid ciphertext: %v", err)
+	}
+	plaintext, err := contentAEAD.Decrypt(ciphertext, multiRecipientEnvelopeAD)
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(plaintext, packet); err != nil {
+		return fmt.Errorf("Unable to unmarshal packet: %v", err)
+	}
+
+	// Another recipient could re-wrap the content key for us; only accept
+	// packets that the sender addressed to us.
+	if !packet.Contents.isFor(keys.Metadata.Owner) {
+		return WrongRecipientError{Recipient: strings.Join(packet.Contents.Recipients, ","), Want: keys.Metadata.Owner}
+	}
+	return nil
+}
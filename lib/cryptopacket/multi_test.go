@@ -0,0 +1,36 @@
+package cryptopacket
+
+import (
+	"testing"
+
+	"github.com/steinarvk/orclib/lib/orckeys"
+)
+
+func TestPackForRecipients(t *testing.T) {
+	alice, bob, registry := newTestParties(t)
+	carol, err := orckeys.Generate("carol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	carolPublic := carol.Public()
+	registry["carol"] = &carolPublic
+
+	ciphertext, err := PackForRecipients("hello", alice, registry, []string{"bob", "carol"}, PackOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, recipient := range []*orckeys.Keys{bob, carol} {
+		var got string
+		if _, err := UnpackWithOptions(&got, ciphertext, recipient, registry, UnpackOptions{Recipient: recipient.Metadata.Owner}); err != nil {
+			t.Fatalf("%s: %v", recipient.Metadata.Owner, err)
+		}
+		if got != "hello" {
+			t.Errorf("%s: got %q, want %q", recipient.Metadata.Owner, got, "hello")
+		}
+	}
+
+	if _, err := Unpack(nil, ciphertext, alice, registry); err == nil {
+		t.Errorf("Unpack by non-recipient succeeded")
+	}
+}
@@ -0,0 +1,116 @@
+package cryptopacket
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/steinarvk/orclib/lib/orctimestamp"
+	"github.com/steinarvk/orclib/lib/uniqueid"
+)
+
+type PackOptions struct {
+	// TTL, if nonzero, sets the expiry time of the packet.
+	TTL time.Duration
+
+	// WithNonce adds a unique nonce, allowing recipients to reject replays.
+	WithNonce bool
+}
+
+func (o PackOptions) apply(contents *Contents, now time.Time) error {
+	if o.TTL > 0 {
+		contents.Expires = orctimestamp.Format(now.Add(o.TTL))
+	}
+	if o.WithNonce {
+		nonce, err := uniqueid.New()
+		if err != nil {
+			return fmt.Errorf("Failed to generate nonce: %v", err)
+		}
+		contents.Nonce = nonce
+	}
+	return nil
+}
+
+type UnpackOptions struct {
+	// MaxAge, if nonzero, rejects packets with older timestamps.
+	MaxAge time.Duration
+
+	// ClockSkew is the tolerance allowed for differences between the clocks
+	// of sender and recipient, applied to all time checks.
+	ClockSkew time.Duration
+
+	// Recipient, if set, must equal the recipient named in the packet.
+	// Typically the canonical host of the unpacking server.
+	Recipient string
+
+	// RequireNonce rejects packets without a nonce.
+	RequireNonce bool
+
+	// ReplayCache, if set, rejects packets whose nonce has been seen before.
+	ReplayCache ReplayCache
+}
+
+func parseTimestamp(field, value string) (time.Time, error) {
+	t, err := orctimestamp.Parse(value)
+	if err != nil {
+		return time.Time{}, MalformedTimestampError{Field: field, Value: value, Err: err}
+	}
+	return t, nil
+}
+
+func (o *UnpackOptions) check(contents *Contents, now time.Time) error {
+	if o.Recipient != "" && !contents.isFor(o.Recipient) {
+		recipient := contents.Recipient
+		if len(contents.Recipients) > 0 {
+			recipient = strings.Join(contents.Recipients, ",")
+		}
+		return WrongRecipientError{Recipient: recipient, Want: o.Recipient}
+	}
+
+	timestamp, err := parseTimestamp("timestamp", contents.Timestamp)
+	if err != nil {
+		return err
+	}
+
+	if skew := timestamp.Sub(now); skew > o.ClockSkew {
+		return FromFutureError{Timestamp: contents.Timestamp, Skew: skew}
+	}
+
+	// retainUntil is how long a nonce must be remembered to reject replays.
+	var retainUntil time.Time
+
+	if o.MaxAge > 0 {
+		if age := now.Sub(timestamp); age > o.MaxAge+o.ClockSkew {
+			return StaleError{Timestamp: contents.Timestamp, Age: age, MaxAge: o.MaxAge}
+		}
+		retainUntil = timestamp.Add(o.MaxAge + o.ClockSkew)
+	}
+
+	if contents.Expires != "" {
+		expires, err := parseTimestamp("expiry time", contents.Expires)
+		if err != nil {
+			return err
+		}
+		if now.After(expires.Add(o.ClockSkew)) {
+			return ExpiredError{Expires: contents.Expires}
+		}
+		if retainUntil.IsZero() || expires.Add(o.ClockSkew).Before(retainUntil) {
+			retainUntil = expires.Add(o.ClockSkew)
+		}
+	}
+
+	if contents.Nonce == "" {
+		if o.RequireNonce {
+			return MissingNonceError{Sender: contents.Sender}
+		}
+		return nil
+	}
+
+	if o.ReplayCache != nil {
+		if seen := o.ReplayCache.CheckAndAdd(contents.Sender+"/"+contents.Nonce, retainUntil); seen {
+			return ReplayError{Sender: contents.Sender, Nonce: contents.Nonce}
+		}
+	}
+
+	return nil
+}
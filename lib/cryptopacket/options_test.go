@@ -0,0 +1,62 @@
+package cryptopacket
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestUnpackOptions(t *testing.T) {
+	alice, _, registry := newTestParties(t)
+
+	fresh, err := PackUnencryptedWithOptions("hello", alice, PackOptions{TTL: time.Minute, WithNonce: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := PackUnencryptedWithOptions("hello", alice, PackOptions{TTL: time.Nanosecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := PackUnencrypted("hello", alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	cache := NewReplayCache(time.Hour)
+
+	if _, err := UnpackUnencryptedWithOptions(nil, fresh, registry, UnpackOptions{ReplayCache: cache}); err != nil {
+		t.Errorf("first unpack failed: %v", err)
+	}
+
+	var replay ReplayError
+	if _, err := UnpackUnencryptedWithOptions(nil, fresh, registry, UnpackOptions{ReplayCache: cache}); !errors.As(err, &replay) {
+		t.Errorf("replayed unpack: got %v, want ReplayError", err)
+	}
+
+	var expiredErr ExpiredError
+	if _, err := UnpackUnencryptedWithOptions(nil, expired, registry, UnpackOptions{}); !errors.As(err, &expiredErr) {
+		t.Errorf("expired unpack: got %v, want ExpiredError", err)
+	}
+
+	var stale StaleError
+	if _, err := UnpackUnencryptedWithOptions(nil, plain, registry, UnpackOptions{MaxAge: time.Millisecond}); !errors.As(err, &stale) {
+		t.Errorf("stale unpack: got %v, want StaleError", err)
+	}
+
+	var missingNonce MissingNonceError
+	if _, err := UnpackUnencryptedWithOptions(nil, plain, registry, UnpackOptions{RequireNonce: true}); !errors.As(err, &missingNonce) {
+		t.Errorf("unpack without nonce: got %v, want MissingNonceError", err)
+	}
+
+	var wrongRecipient WrongRecipientError
+	if _, err := UnpackUnencryptedWithOptions(nil, plain, registry, UnpackOptions{Recipient: "bob"}); !errors.As(err, &wrongRecipient) {
+		t.Errorf("unpack for other recipient: got %v, want WrongRecipientError", err)
+	}
+
+	var badSignature BadSignatureError
+	registry["alice"] = registry["bob"]
+	if _, err := UnpackUnencryptedWithOptions(nil, plain, registry, UnpackOptions{}); !errors.As(err, &badSignature) {
+		t.Errorf("unpack with wrong key: got %v, want BadSignatureError", err)
+	}
+}
@@ -2,6 +2,7 @@ package cryptopacket
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"time"
 
@@ -16,6 +17,17 @@ type PublicKeyRegistry interface {
 }
 
 func Pack(payload interface{}, keys *orckeys.Keys, registry PublicKeyRegistry, recipientOwner string) (string, error) {
+	return PackContext(context.Background(), payload, keys, registry, recipientOwner, PackOptions{})
+}
+
+// PackWithOptions is like Pack, but may add an expiry time and a nonce.
+func PackWithOptions(payload interface{}, keys *orckeys.Keys, registry PublicKeyRegistry, recipientOwner string, opts PackOptions) (string, error) {
+	return PackContext(context.Background(), payload, keys, registry, recipientOwner, opts)
+}
+
+// PackContext is like PackWithOptions, but traces the signing and
+// encryption within ctx.
+func PackContext(ctx context.Context, payload interface{}, keys *orckeys.Keys, registry PublicKeyRegistry, recipientOwner string, opts PackOptions) (string, error) {
 	if recipientOwner == "" {
 		return "", fmt.Errorf("Missing recipient")
 	}
@@ -23,73 +35,144 @@ func Pack(payload interface{}, keys *orckeys.Keys, registry PublicKeyRegistry, r
 	if err != nil {
 		return "", err
 	}
-	return packEncryptedOrUnencrypted(payload, keys, recipientPubKey)
+	return packEncryptedOrUnencrypted(ctx, payload, keys, recipientPubKey, opts)
 }
 
 func Unpack(target interface{}, ciphertext string, keys *orckeys.Keys, registry PublicKeyRegistry) (*Packet, error) {
 	if registry == nil {
 		return nil, fmt.Errorf("Missing public key registry")
 	}
-	return unpackGeneric(target, ciphertext, keys, registry)
+	return unpackGeneric(context.Background(), target, ciphertext, keys, registry, nil)
+}
+
+// UnpackWithOptions is like Unpack, but also checks the packet against opts.
+func UnpackWithOptions(target interface{}, ciphertext string, keys *orckeys.Keys, registry PublicKeyRegistry, opts UnpackOptions) (*Packet, error) {
+	return UnpackContext(context.Background(), target, ciphertext, keys, registry, opts)
+}
+
+// UnpackContext is like UnpackWithOptions, but traces the decryption and
+// verification within ctx.
+func UnpackContext(ctx context.Context, target interface{}, ciphertext string, keys *orckeys.Keys, registry PublicKeyRegistry, opts UnpackOptions) (*Packet, error) {
+	if registry == nil {
+		return nil, fmt.Errorf("Missing public key registry")
+	}
+	return unpackGeneric(ctx, target, ciphertext, keys, registry, &opts)
 }
 
 func UnpackUnencrypted(target interface{}, plaintext string, registry PublicKeyRegistry) (*Packet, error) {
 	if registry == nil {
 		return nil, fmt.Errorf("Missing public key registry")
 	}
-	return unpackGeneric(target, plaintext, nil, registry)
+	return unpackGeneric(context.Background(), target, plaintext, nil, registry, nil)
+}
+
+// UnpackUnencryptedWithOptions is like UnpackUnencrypted, but also checks the packet against opts.
+func UnpackUnencryptedWithOptions(target interface{}, plaintext string, registry PublicKeyRegistry, opts UnpackOptions) (*Packet, error) {
+	return UnpackUnencryptedContext(context.Background(), target, plaintext, registry, opts)
+}
+
+// UnpackUnencryptedContext is like UnpackUnencryptedWithOptions, but traces
+// the verification within ctx.
+func UnpackUnencryptedContext(ctx context.Context, target interface{}, plaintext string, registry PublicKeyRegistry, opts UnpackOptions) (*Packet, error) {
+	if registry == nil {
+		return nil, fmt.Errorf("Missing public key registry")
+	}
+	return unpackGeneric(ctx, target, plaintext, nil, registry, &opts)
 }
 
 func UnpackWithoutVerification(target interface{}, ciphertext string, keys *orckeys.Keys) (*Packet, error) {
 	if keys == nil {
 		return nil, fmt.Errorf("Missing server keys")
 	}
-	return unpackGeneric(target, ciphertext, keys, nil)
+	return unpackGeneric(context.Background(), target, ciphertext, keys, nil, nil)
 }
 
-func unpackGeneric(target interface{}, packetdata string, keysForDecryption *orckeys.Keys, registryForVerification PublicKeyRegistry) (*Packet, error) {
+func unpackGeneric(ctx context.Context, target interface{}, packetdata string, keysForDecryption *orckeys.Keys, registryForVerification PublicKeyRegistry, opts *UnpackOptions) (*Packet, error) {
 	var packet Packet
+	var self string
+	if keysForDecryption != nil {
+		self = keysForDecryption.Metadata.Owner
+	}
+
+	err := unpackPacket(ctx, &packet, packetdata, keysForDecryption, registryForVerification, opts)
+	var peers []string
+	if packet.Contents.Sender != "" {
+		peers = []string{packet.Contents.Sender}
+	}
+	recordAudit("unpack", self, packet.Signature, peers, err)
+	if err != nil {
+		return nil, err
+	}
+
+	if target != nil {
+		data, err := json.Marshal(packet.Contents.Payload)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to marshal data: %v", err)
+		}
+		if err := json.Unmarshal(data, target); err != nil {
+			return nil, fmt.Errorf("Unable to unmarshal data: %v", err)
+		}
+	}
+
+	return &packet, nil
+}
+
+func unpackPacket(ctx context.Context, packet *Packet, packetdata string, keysForDecryption *orckeys.Keys, registryForVerification PublicKeyRegistry, opts *UnpackOptions) error {
 	if keysForDecryption == nil {
-		if err := json.Unmarshal([]byte(packetdata), &packet); err != nil {
-			return nil, fmt.Errorf("Unable to unmarshal packet: %v", err)
+		if err := json.Unmarshal([]byte(packetdata), packet); err != nil {
+			return fmt.Errorf("Unable to unmarshal packet: %v", err)
 		}
 	} else {
-		if err := DecryptIntoJSON(keysForDecryption.Decrypt, packetdata, &packet); err != nil {
-			return nil, fmt.Errorf("Unable to decrypt packet: %v", err)
+		op := beginOperation(ctx, opDecrypt, peerUnverified)
+		var err error
+		if isMultiRecipient(packetdata) {
+			err = decryptMultiRecipient(keysForDecryption, packetdata, packet)
+		} else {
+			err = DecryptIntoJSON(keysForDecryption.Decrypt, packetdata, packet)
+		}
+		if err := op.end(err); err != nil {
+			return fmt.Errorf("Unable to decrypt packet: %v", err)
 		}
 	}
 
 	if registryForVerification != nil {
+		op := beginOperation(ctx, opVerify, peerUnverified)
 		senderPubKey, err := registryForVerification.LookupPublicKeys(packet.Contents.Sender)
 		if err != nil {
-			return nil, fmt.Errorf("Error looking up packet sender %q: %v", packet.Contents.Sender, err)
+			return op.end(fmt.Errorf("Error looking up packet sender %q: %v", packet.Contents.Sender, err))
 		}
 
-		ok, err := VerifyJSON(packet.Contents, packet.Signature, senderPubKey.PublicSigningKey)
-		if !ok || err != nil {
-			return nil, fmt.Errorf("Invalid signature by %q: %v", packet.Contents.Sender, err)
+		if err := op.endVerified(packet.Contents.Sender, verifyWithAnyValidKey(packet.Contents, packet.Signature, packet.Contents.Sender, senderPubKey)); err != nil {
+			return err
 		}
 	}
 
-	if target != nil {
-		data, err := json.Marshal(packet.Contents.Payload)
-		if err != nil {
-			return nil, fmt.Errorf("Unable to marshal data: %v", err)
-		}
-		if err := json.Unmarshal(data, target); err != nil {
-			return nil, fmt.Errorf("Unable to unmarshal data: %v", err)
+	if opts != nil {
+		if err := opts.check(&packet.Contents, time.Now()); err != nil {
+			return err
 		}
 	}
 
-	return &packet, nil
+	return nil
 }
 
 func PackUnencrypted(payload interface{}, keys *orckeys.Keys) (string, error) {
-	return packEncryptedOrUnencrypted(payload, keys, nil)
+	return packEncryptedOrUnencrypted(context.Background(), payload, keys, nil, PackOptions{})
+}
+
+// PackUnencryptedWithOptions is like PackUnencrypted, but may add an expiry time and a nonce.
+func PackUnencryptedWithOptions(payload interface{}, keys *orckeys.Keys, opts PackOptions) (string, error) {
+	return PackUnencryptedContext(context.Background(), payload, keys, opts)
+}
+
+// PackUnencryptedContext is like PackUnencryptedWithOptions, but traces the
+// signing within ctx.
+func PackUnencryptedContext(ctx context.Context, payload interface{}, keys *orckeys.Keys, opts PackOptions) (string, error) {
+	return packEncryptedOrUnencrypted(ctx, payload, keys, nil, opts)
 }
 
 func PackUnencryptedJSON(payload interface{}, keys *orckeys.Keys) (*Packet, error) {
-	marshalled, err := packEncryptedOrUnencrypted(payload, keys, nil)
+	marshalled, err := packEncryptedOrUnencrypted(context.Background(), payload, keys, nil, PackOptions{})
 	if err != nil {
 		return nil, err
 	}
@@ -100,29 +183,92 @@ func PackUnencryptedJSON(payload interface{}, keys *orckeys.Keys) (*Packet, erro
 	return &rv, nil
 }
 
-func packEncryptedOrUnencrypted(payload interface{}, keys *orckeys.Keys, encryptToRecipient *orckeys.PublicKeyPacket) (string, error) {
+// verifyWithAnyValidKey accepts a signature made with any generation of the
+// sender's keys that is currently valid.
+func verifyWithAnyValidKey(contents interface{}, signature string, sender string, senderPubKey *orckeys.PublicKeyPacket) error {
+	candidates := senderPubKey.ValidAt(time.Now())
+	if len(candidates) == 0 {
+		return BadSignatureError{Sender: sender, Err: fmt.Errorf("no currently valid public keys")}
+	}
+
+	var firstErr error
+	for _, candidate := range candidates {
+		ok, err := VerifyJSON(contents, signature, candidate.PublicSigningKey)
+		if ok && err == nil {
+			return nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return BadSignatureError{Sender: sender, Err: firstErr}
+}
+
+// signedPacket builds and signs the packet contents. The contents are passed
+// to addressTo, if non-nil, before signing.
+func signedPacket(ctx context.Context, payload interface{}, keys *orckeys.Keys, now time.Time, opts PackOptions, addressTo func(*Contents)) (Packet, error) {
+	signingKeys, err := keys.ActiveAt(now)
+	if err != nil {
+		return Packet{}, err
+	}
+
 	contents := Contents{
-		Timestamp: orctimestamp.Format(time.Now()),
+		Timestamp: orctimestamp.Format(now),
 		Sender:    keys.Metadata.Owner,
 		Payload:   payload,
 	}
-	if encryptToRecipient != nil {
-		contents.Recipient = encryptToRecipient.Metadata.Owner
+	if addressTo != nil {
+		addressTo(&contents)
 	}
-	signature, err := SignJSON(keys.Signer, contents)
-	if err != nil {
-		return "", err
+	if err := opts.apply(&contents, now); err != nil {
+		return Packet{}, err
 	}
-	wrapped := Packet{
+	op := beginOperation(ctx, opSign, recipientsPeer(contents.peers()))
+	signature, err := SignJSON(signingKeys.Signer, contents)
+	if err := op.end(err); err != nil {
+		return Packet{}, err
+	}
+	return Packet{
 		Contents:  contents,
 		Signature: signature,
+	}, nil
+}
+
+func packEncryptedOrUnencrypted(ctx context.Context, payload interface{}, keys *orckeys.Keys, encryptToRecipient *orckeys.PublicKeyPacket, opts PackOptions) (string, error) {
+	var peers []string
+	if encryptToRecipient != nil {
+		peers = []string{encryptToRecipient.Metadata.Owner}
 	}
+	rv, signature, err := packAndMaybeEncrypt(ctx, payload, keys, encryptToRecipient, opts)
+	recordAudit("pack", keys.Metadata.Owner, signature, peers, err)
+	return rv, err
+}
+
+func packAndMaybeEncrypt(ctx context.Context, payload interface{}, keys *orckeys.Keys, encryptToRecipient *orckeys.PublicKeyPacket, opts PackOptions) (string, string, error) {
+	now := time.Now()
+
+	var addressTo func(*Contents)
 	if encryptToRecipient != nil {
-		encrypter, err := encryptToRecipient.EncryptTo()
+		addressTo = func(contents *Contents) {
+			contents.Recipient = encryptToRecipient.Metadata.Owner
+		}
+	}
+	wrapped, err := signedPacket(ctx, payload, keys, now, opts, addressTo)
+	if err != nil {
+		return "", "", err
+	}
+	if encryptToRecipient != nil {
+		op := beginOperation(ctx, opEncrypt, encryptToRecipient.Metadata.Owner)
+		recipientKeys, err := encryptToRecipient.ActiveAt(now)
+		if err != nil {
+			return "", wrapped.Signature, op.end(err)
+		}
+		encrypter, err := recipientKeys.EncryptTo()
 		if err != nil {
-			return "", err
+			return "", wrapped.Signature, op.end(err)
 		}
-		return EncryptJSON(encrypter, wrapped)
+		ciphertext, err := EncryptJSON(encrypter, wrapped)
+		return ciphertext, wrapped.Signature, op.end(err)
 	}
 
 	// Return unencrypted
@@ -130,7 +276,7 @@ func packEncryptedOrUnencrypted(payload interface{}, keys *orckeys.Keys, encrypt
 	enc := json.NewEncoder(unencryptedBuf)
 	enc.SetIndent("", "  ")
 	if err := enc.Encode(wrapped); err != nil {
-		return "", fmt.Errorf("Error serializing JSON: %v", err)
+		return "", wrapped.Signature, fmt.Errorf("Error serializing JSON: %v", err)
 	}
-	return unencryptedBuf.String(), nil
+	return unencryptedBuf.String(), wrapped.Signature, nil
 }
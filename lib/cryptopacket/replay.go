@@ -0,0 +1,58 @@
+package cryptopacket
+
+import (
+	"sync"
+	"time"
+)
+
+type ReplayCache interface {
+	// CheckAndAdd records key until retainUntil (or the cache's default
+	// retention if zero), and reports whether it had already been recorded.
+	CheckAndAdd(key string, retainUntil time.Time) bool
+}
+
+type memoryReplayCache struct {
+	mu               sync.Mutex
+	defaultRetention time.Duration
+	entries          map[string]time.Time
+	nextPrune        time.Time
+}
+
+// NewReplayCache returns an in-memory ReplayCache. Packets that neither
+// expire nor are subject to a maximum age are remembered for defaultRetention.
+func NewReplayCache(defaultRetention time.Duration) ReplayCache {
+	return &memoryReplayCache{
+		defaultRetention: defaultRetention,
+		entries:          map[string]time.Time{},
+	}
+}
+
+func (c *memoryReplayCache) prune(now time.Time) {
+	if now.Before(c.nextPrune) {
+		return
+	}
+	for key, retainUntil := range c.entries {
+		if now.After(retainUntil) {
+			delete(c.entries, key)
+		}
+	}
+	c.nextPrune = now.Add(time.Minute)
+}
+
+func (c *memoryReplayCache) CheckAndAdd(key string, retainUntil time.Time) bool {
+	now := time.Now()
+	if retainUntil.IsZero() {
+		retainUntil = now.Add(c.defaultRetention)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.prune(now)
+
+	if existing, ok := c.entries[key]; ok && !now.After(existing) {
+		return true
+	}
+	c.entries[key] = retainUntil
+	return false
+}
@@ -0,0 +1,77 @@
+package cryptopacket
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/steinarvk/orclib/lib/orckeys"
+	"github.com/steinarvk/orclib/lib/orctimestamp"
+)
+
+type mapRegistry map[string]*orckeys.PublicKeyPacket
+
+func (r mapRegistry) LookupPublicKeys(owner string) (*orckeys.PublicKeyPacket, error) {
+	if rv, ok := r[owner]; ok {
+		return rv, nil
+	}
+	return nil, fmt.Errorf("No public keys found for %q", owner)
+}
+
+func TestRotation(t *testing.T) {
+	alice, err := orckeys.Generate("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := orckeys.Generate("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldBobPublic := bob.Public()
+	registry := mapRegistry{"bob": &oldBobPublic}
+
+	sentBeforeRotation, err := Pack("hello", alice, registry, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signedBeforeRotation, err := PackUnencrypted("hello", bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bob, err = bob.Rotate(time.Now(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newBobPublic := bob.Public()
+	if len(newBobPublic.Previous) != 1 {
+		t.Fatalf("rotated public keys have %d previous generations; want 1", len(newBobPublic.Previous))
+	}
+	registry["bob"] = &newBobPublic
+	registry["alice"] = func() *orckeys.PublicKeyPacket { p := alice.Public(); return &p }()
+
+	var got string
+	if _, err := Unpack(&got, sentBeforeRotation, bob, registry); err != nil || got != "hello" {
+		t.Errorf("Unpack(old packet) = %q, %v; want hello", got, err)
+	}
+	if _, err := UnpackUnencrypted(nil, signedBeforeRotation, registry); err != nil {
+		t.Errorf("verifying signature by previous key failed: %v", err)
+	}
+
+	signedAfterRotation, err := PackUnencrypted("hello", bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := UnpackUnencrypted(nil, signedAfterRotation, mapRegistry{"bob": &oldBobPublic}); err == nil {
+		t.Errorf("signature by new key verified with only the old public key")
+	}
+
+	newBobPublic.Previous[0].Metadata.NotAfter = orctimestamp.Format(time.Now().Add(-time.Minute))
+	if _, err := UnpackUnencrypted(nil, signedBeforeRotation, registry); err == nil {
+		t.Errorf("signature by expired key verified")
+	}
+	if _, err := UnpackUnencrypted(nil, signedAfterRotation, registry); err != nil {
+		t.Errorf("verifying signature by current key failed: %v", err)
+	}
+}
@@ -0,0 +1,245 @@
+package cryptopacket
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/google/tink/go/insecurecleartextkeyset"
+	"github.com/google/tink/go/keyset"
+	"github.com/google/tink/go/streamingaead"
+	"github.com/steinarvk/orclib/lib/canonicalgojson"
+	"github.com/steinarvk/orclib/lib/orckeys"
+	"github.com/steinarvk/orclib/lib/orctimestamp"
+)
+
+const (
+	StreamFormatVersion = 1
+
+	maxStreamHeaderBytes = 1 << 16
+)
+
+var (
+	streamKeyContextInfo = []byte("orc-stream-key")
+
+	DefaultStreamingKeyTemplate = streamingaead.AES256GCMHKDF1MBKeyTemplate()
+)
+
+type StreamHeaderContents struct {
+	Version   int    `json:"version"`
+	Timestamp string `json:"timestamp"`
+	Sender    string `json:"sender"`
+	Recipient string `json:"recipient"`
+
+	// EncryptedKey is the data-encryption key for the body, a Tink streaming
+	// AEAD keyset, hybrid-encrypted to the recipient.
+	EncryptedKey string `json:"encrypted_key"`
+}
+
+// StreamHeader is written as a single line of JSON before the encrypted body.
+// The body is encrypted with the canonical JSON form of the header contents
+// as associated data, and the header is signed by the sender.
+type StreamHeader struct {
+	Contents  StreamHeaderContents `json:"contents"`
+	Signature string               `json:"signature"`
+}
+
+// EncryptStream writes a stream header to w and returns a writer that
+// encrypts everything written to it to recipientOwner. The caller must Close
+// the returned writer to finish the stream; this does not close w.
+func EncryptStream(w io.Writer, keys *orckeys.Keys, registry PublicKeyRegistry, recipientOwner string) (io.WriteCloser, error) {
+	return EncryptStreamContext(context.Background(), w, keys, registry, recipientOwner)
+}
+
+// EncryptStreamContext is like EncryptStream, but traces the encryption and
+// signing of the header within ctx.
+func EncryptStreamContext(ctx context.Context, w io.Writer, keys *orckeys.Keys, registry PublicKeyRegistry, recipientOwner string) (io.WriteCloser, error) {
+	if recipientOwner == "" {
+		return nil, fmt.Errorf("Missing recipient")
+	}
+	rv, signature, err := encryptStream(ctx, w, keys, registry, recipientOwner)
+	recordAudit("encrypt_stream", keys.Metadata.Owner, signature, []string{recipientOwner}, err)
+	return rv, err
+}
+
+func encryptStream(ctx context.Context, w io.Writer, keys *orckeys.Keys, registry PublicKeyRegistry, recipientOwner string) (io.WriteCloser, string, error) {
+	recipientPubKey, err := registry.LookupPublicKeys(recipientOwner)
+	if err != nil {
+		return nil, "", err
+	}
+
+	now := time.Now()
+
+	signingKeys, err := keys.ActiveAt(now)
+	if err != nil {
+		return nil, "", err
+	}
+	recipientKeys, err := recipientPubKey.ActiveAt(now)
+	if err != nil {
+		return nil, "", err
+	}
+	encrypter, err := recipientKeys.EncryptTo()
+	if err != nil {
+		return nil, "", err
+	}
+
+	dataKey, err := keyset.NewHandle(DefaultStreamingKeyTemplate)
+	if err != nil {
+		return nil, "", fmt.Errorf("Failed to generate data-encryption key: %v", err)
+	}
+	var dataKeyBuf bytes.Buffer
+	if err := insecurecleartextkeyset.Write(dataKey, keyset.NewBinaryWriter(&dataKeyBuf)); err != nil {
+		return nil, "", fmt.Errorf("Failed to serialize data-encryption key: %v", err)
+	}
+	op := beginOperation(ctx, opEncrypt, recipientOwner)
+	encryptedKey, err := encrypter.Encrypt(dataKeyBuf.Bytes(), streamKeyContextInfo)
+	if err := op.end(err); err != nil {
+		return nil, "", fmt.Errorf("Failed to encrypt data-encryption key: %v", err)
+	}
+
+	contents := StreamHeaderContents{
+		Version:      StreamFormatVersion,
+		Timestamp:    orctimestamp.Format(now),
+		Sender:       keys.Metadata.Owner,
+		Recipient:    recipientKeys.Metadata.Owner,
+		EncryptedKey: base64.RawStdEncoding.EncodeToString(encryptedKey),
+	}
+	op = beginOperation(ctx, opSign, recipientOwner)
+	signature, err := SignJSON(signingKeys.Signer, contents)
+	if err := op.end(err); err != nil {
+		return nil, "", err
+	}
+	associatedData, err := canonicalgojson.MarshalCanonicalGoJSON(contents)
+	if err != nil {
+		return nil, signature, fmt.Errorf("Error marshalling data canonically: %v", err)
+	}
+
+	headerData, err := json.Marshal(StreamHeader{
+		Contents:  contents,
+		Signature: signature,
+	})
+	if err != nil {
+		return nil, signature, fmt.Errorf("Error serializing stream header: %v", err)
+	}
+	if _, err := w.Write(append(headerData, '\n')); err != nil {
+		return nil, signature, fmt.Errorf("Error writing stream header: %v", err)
+	}
+
+	streamingAEAD, err := streamingaead.New(dataKey)
+	if err != nil {
+		return nil, signature, fmt.Errorf("Failed to create streaming AEAD: %v", err)
+	}
+	encrypting, err := streamingAEAD.NewEncryptingWriter(w, associatedData)
+	return encrypting, signature, err
+}
+
+func readStreamHeader(r *bufio.Reader) (*StreamHeader, error) {
+	var line []byte
+	for {
+		chunk, isPrefix, err := r.ReadLine()
+		if err != nil {
+			return nil, fmt.Errorf("Error reading stream header: %v", err)
+		}
+		line = append(line, chunk...)
+		if len(line) > maxStreamHeaderBytes {
+			return nil, fmt.Errorf("Stream header too large")
+		}
+		if !isPrefix {
+			break
+		}
+	}
+
+	var header StreamHeader
+	if err := json.Unmarshal(line, &header); err != nil {
+		return nil, fmt.Errorf("Unable to unmarshal stream header: %v", err)
+	}
+	if header.Contents.Version != StreamFormatVersion {
+		return nil, fmt.Errorf("Unsupported stream format version %d", header.Contents.Version)
+	}
+	return &header, nil
+}
+
+// DecryptStream reads and verifies a stream header from r, and returns a
+// reader of the decrypted body. The body is authenticated as it is read, so
+// a read error means that the plaintext read so far must not be trusted.
+func DecryptStream(r io.Reader, keys *orckeys.Keys, registry PublicKeyRegistry) (io.Reader, *StreamHeader, error) {
+	return DecryptStreamContext(context.Background(), r, keys, registry)
+}
+
+// DecryptStreamContext is like DecryptStream, but traces the verification
+// and decryption of the header within ctx.
+func DecryptStreamContext(ctx context.Context, r io.Reader, keys *orckeys.Keys, registry PublicKeyRegistry) (io.Reader, *StreamHeader, error) {
+	if keys == nil {
+		return nil, nil, fmt.Errorf("Missing server keys")
+	}
+	if registry == nil {
+		return nil, nil, fmt.Errorf("Missing public key registry")
+	}
+
+	plaintext, header, err := decryptStream(ctx, r, keys, registry)
+	var signature string
+	var peers []string
+	if header != nil {
+		signature = header.Signature
+		peers = []string{header.Contents.Sender}
+	}
+	recordAudit("decrypt_stream", keys.Metadata.Owner, signature, peers, err)
+	return plaintext, header, err
+}
+
+// decryptStream returns the header whenever it was read, even on error.
+func decryptStream(ctx context.Context, r io.Reader, keys *orckeys.Keys, registry PublicKeyRegistry) (io.Reader, *StreamHeader, error) {
+	buffered := bufio.NewReader(r)
+
+	header, err := readStreamHeader(buffered)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	op := beginOperation(ctx, opVerify, peerUnverified)
+	senderPubKey, err := registry.LookupPublicKeys(header.Contents.Sender)
+	if err != nil {
+		return nil, header, op.end(fmt.Errorf("Error looking up stream sender %q: %v", header.Contents.Sender, err))
+	}
+	if err := op.endVerified(header.Contents.Sender, verifyWithAnyValidKey(header.Contents, header.Signature, header.Contents.Sender, senderPubKey)); err != nil {
+		return nil, header, err
+	}
+	if header.Contents.Recipient != keys.Metadata.Owner {
+		return nil, header, fmt.Errorf("Stream is for %q, not %q", header.Contents.Recipient, keys.Metadata.Owner)
+	}
+
+	encryptedKey, err := base64.RawStdEncoding.DecodeString(header.Contents.EncryptedKey)
+	if err != nil {
+		return nil, header, fmt.Errorf("Invalid encrypted key in stream header: %v", err)
+	}
+	op = beginOperation(ctx, opDecrypt, header.Contents.Sender)
+	dataKeyData, err := keys.Decrypt.Decrypt(encryptedKey, streamKeyContextInfo)
+	if err := op.end(err); err != nil {
+		return nil, header, fmt.Errorf("Unable to decrypt data-encryption key: %v", err)
+	}
+	dataKey, err := insecurecleartextkeyset.Read(keyset.NewBinaryReader(bytes.NewReader(dataKeyData)))
+	if err != nil {
+		return nil, header, fmt.Errorf("Invalid data-encryption key: %v", err)
+	}
+
+	associatedData, err := canonicalgojson.MarshalCanonicalGoJSON(header.Contents)
+	if err != nil {
+		return nil, header, fmt.Errorf("Error marshalling data canonically: %v", err)
+	}
+
+	streamingAEAD, err := streamingaead.New(dataKey)
+	if err != nil {
+		return nil, header, fmt.Errorf("Failed to create streaming AEAD: %v", err)
+	}
+	plaintext, err := streamingAEAD.NewDecryptingReader(buffered, associatedData)
+	if err != nil {
+		return nil, header, fmt.Errorf("Unable to decrypt stream: %v", err)
+	}
+
+	return plaintext, header, nil
+}
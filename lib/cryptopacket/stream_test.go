@@ -0,0 +1,90 @@
+package cryptopacket
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"testing"
+
+	"github.com/steinarvk/orclib/lib/orckeys"
+)
+
+func newTestParties(t *testing.T) (*orckeys.Keys, *orckeys.Keys, mapRegistry) {
+	alice, err := orckeys.Generate("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := orckeys.Generate("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	alicePublic, bobPublic := alice.Public(), bob.Public()
+	return alice, bob, mapRegistry{"alice": &alicePublic, "bob": &bobPublic}
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	alice, bob, registry := newTestParties(t)
+
+	plaintext := make([]byte, 3<<20+17)
+	rand.Read(plaintext)
+
+	var ciphertext bytes.Buffer
+	w, err := EncryptStream(&ciphertext, alice, registry, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(plaintext); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, header, err := DecryptStream(bytes.NewReader(ciphertext.Bytes()), bob, registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Contents.Sender != "alice" {
+		t.Errorf("sender = %q want alice", header.Contents.Sender)
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil || !bytes.Equal(got, plaintext) {
+		t.Errorf("decrypted stream differs from plaintext (err %v)", err)
+	}
+
+	if _, _, err := DecryptStream(bytes.NewReader(ciphertext.Bytes()), alice, registry); err == nil {
+		t.Errorf("stream for bob decrypted by alice")
+	}
+
+	tampered := append([]byte(nil), ciphertext.Bytes()...)
+	tampered[len(tampered)-100] ^= 1
+	r, _, err = DecryptStream(bytes.NewReader(tampered), bob, registry)
+	if err == nil {
+		if _, err = ioutil.ReadAll(r); err == nil {
+			t.Errorf("tampered stream decrypted without error")
+		}
+	}
+}
+
+func TestDetachedSignature(t *testing.T) {
+	alice, _, registry := newTestParties(t)
+
+	content := []byte("a large file, presumably")
+	sig, err := SignDetached(bytes.NewReader(content), alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := VerifyDetached(bytes.NewReader(content), sig, registry); err != nil {
+		t.Errorf("VerifyDetached failed: %v", err)
+	}
+	if err := VerifyDetached(bytes.NewReader(append(content, '!')), sig, registry); err == nil {
+		t.Errorf("VerifyDetached accepted modified content")
+	}
+
+	forged := *sig
+	forged.Contents.Signer = "bob"
+	if err := VerifyDetached(bytes.NewReader(content), &forged, registry); err == nil {
+		t.Errorf("VerifyDetached accepted signature attributed to wrong signer")
+	}
+}
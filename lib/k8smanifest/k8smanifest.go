@@ -0,0 +1,98 @@
+package k8smanifest
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+var validDataKey = regexp.MustCompile(`^[-._a-zA-Z0-9]+$`)
+
+type ObjectMeta struct {
+	Name      string            `yaml:"name"`
+	Namespace string            `yaml:"namespace,omitempty"`
+	Labels    map[string]string `yaml:"labels,omitempty"`
+}
+
+// Secret is a Kubernetes Secret of type Opaque. Data values are base64
+// encoded, as the API expects.
+type Secret struct {
+	APIVersion string            `yaml:"apiVersion"`
+	Kind       string            `yaml:"kind"`
+	Metadata   ObjectMeta        `yaml:"metadata"`
+	Type       string            `yaml:"type"`
+	Data       map[string]string `yaml:"data"`
+}
+
+type ConfigMap struct {
+	APIVersion string            `yaml:"apiVersion"`
+	Kind       string            `yaml:"kind"`
+	Metadata   ObjectMeta        `yaml:"metadata"`
+	Data       map[string]string `yaml:"data"`
+}
+
+func checkDataKeys(files map[string][]byte) error {
+	var keys []string
+	for key := range files {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !validDataKey.MatchString(key) {
+			return fmt.Errorf("Invalid data key %q (must match %s)", key, validDataKey)
+		}
+	}
+	return nil
+}
+
+// NewSecret returns a Secret holding the given files.
+func NewSecret(meta ObjectMeta, files map[string][]byte) (*Secret, error) {
+	if err := checkDataKeys(files); err != nil {
+		return nil, err
+	}
+	data := map[string]string{}
+	for key, value := range files {
+		data[key] = base64.StdEncoding.EncodeToString(value)
+	}
+	return &Secret{
+		APIVersion: "v1",
+		Kind:       "Secret",
+		Metadata:   meta,
+		Type:       "Opaque",
+		Data:       data,
+	}, nil
+}
+
+// NewConfigMap returns a ConfigMap holding the given (text) files.
+func NewConfigMap(meta ObjectMeta, files map[string][]byte) (*ConfigMap, error) {
+	if err := checkDataKeys(files); err != nil {
+		return nil, err
+	}
+	data := map[string]string{}
+	for key, value := range files {
+		data[key] = string(value)
+	}
+	return &ConfigMap{
+		APIVersion: "v1",
+		Kind:       "ConfigMap",
+		Metadata:   meta,
+		Data:       data,
+	}, nil
+}
+
+// Write writes the objects as a multi-document YAML stream, suitable for
+// "kubectl apply -f".
+func Write(w io.Writer, objects ...interface{}) error {
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	for _, obj := range objects {
+		if err := enc.Encode(obj); err != nil {
+			return fmt.Errorf("Error encoding manifest: %v", err)
+		}
+	}
+	return enc.Close()
+}
@@ -0,0 +1,58 @@
+package k8smanifest
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+func TestWrite(t *testing.T) {
+	secret, err := NewSecret(ObjectMeta{Name: "orckeys-alice", Namespace: "prod"}, map[string][]byte{
+		"keys.json": []byte(`{"secret":"x"}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	configMap, err := NewConfigMap(ObjectMeta{Name: "orcpublickeys"}, map[string][]byte{
+		"public_keys.json": []byte(`{}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := Write(&buf, secret, configMap); err != nil {
+		t.Fatal(err)
+	}
+
+	dec := yaml.NewDecoder(strings.NewReader(buf.String()))
+
+	var gotSecret Secret
+	if err := dec.Decode(&gotSecret); err != nil {
+		t.Fatal(err)
+	}
+	if gotSecret.Kind != "Secret" || gotSecret.Metadata.Namespace != "prod" {
+		t.Errorf("unexpected secret: %+v", gotSecret)
+	}
+	data, err := base64.StdEncoding.DecodeString(gotSecret.Data["keys.json"])
+	if err != nil || string(data) != `{"secret":"x"}` {
+		t.Errorf("keys.json = %q (%v)", data, err)
+	}
+
+	var gotConfigMap ConfigMap
+	if err := dec.Decode(&gotConfigMap); err != nil {
+		t.Fatal(err)
+	}
+	if gotConfigMap.Data["public_keys.json"] != `{}` {
+		t.Errorf("unexpected config map: %+v", gotConfigMap)
+	}
+}
+
+func TestInvalidDataKey(t *testing.T) {
+	if _, err := NewSecret(ObjectMeta{Name: "x"}, map[string][]byte{"a/b": nil}); err == nil {
+		t.Errorf("NewSecret accepted data key with slash")
+	}
+}
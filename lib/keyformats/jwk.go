@@ -0,0 +1,398 @@
+package keyformats
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/steinarvk/orclib/lib/orckeys"
+	"github.com/steinarvk/orclib/lib/orctimestamp"
+	"github.com/steinarvk/orclib/lib/uniqueid"
+)
+
+// JWK is a JSON Web Key (RFC 7517) for an EC, Ed25519 or X25519 key.
+// TinkKeyID is an extension member that other tools ignore.
+type JWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+	D   string `json:"d,omitempty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+
+	TinkKeyID uint32 `json:"orc_tink_key_id,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+var b64 = base64.RawURLEncoding
+
+// KeyID is the "kid" of a key in a JWKS: the ID of its generation of orc
+// keys, suffixed by its use.
+func KeyID(metadata orckeys.Metadata, use string) string {
+	return metadata.ID + "." + use
+}
+
+func splitKeyID(kid string) (string, string) {
+	if i := strings.LastIndex(kid, "."); i >= 0 {
+		return kid[:i], kid[i+1:]
+	}
+	return kid, ""
+}
+
+func fixedBytes(n *big.Int) string {
+	return b64.EncodeToString(n.FillBytes(make([]byte, 32)))
+}
+
+// ToJWK converts a key, including its private part only if includePrivate
+// is set.
+func ToJWK(key orckeys.StandardKey, kid string, includePrivate bool) (JWK, error) {
+	rv := JWK{
+		Kid:       kid,
+		Use:       key.Use,
+		TinkKeyID: key.TinkKeyID,
+	}
+
+	switch pub := key.Public.(type) {
+	case *ecdsa.PublicKey:
+		rv.Kty = "EC"
+		rv.Crv = "P-256"
+		rv.X = fixedBytes(pub.X)
+		rv.Y = fixedBytes(pub.Y)
+		if key.Algorithm == orckeys.SigningECDSAP256 {
+			rv.Alg = "ES256"
+		}
+		if includePrivate {
+			priv, ok := key.Private.(*ecdsa.PrivateKey)
+			if !ok {
+				return JWK{}, fmt.Errorf("Missing private key")
+			}
+			rv.D = fixedBytes(priv.D)
+		}
+
+	case ed25519.PublicKey:
+		rv.Kty = "OKP"
+		rv.Crv = "Ed25519"
+		rv.Alg = "EdDSA"
+		rv.X = b64.EncodeToString(pub)
+		if includePrivate {
+			priv, ok := key.Private.(ed25519.PrivateKey)
+			if !ok {
+				return JWK{}, fmt.Errorf("Missing private key")
+			}
+			rv.D = b64.EncodeToString(priv.Seed())
+		}
+
+	case *ecdh.PublicKey:
+		rv.Kty = "OKP"
+		rv.Crv = "X25519"
+		rv.X = b64.EncodeToString(pub.Bytes())
+		if includePrivate {
+			priv, ok := key.Private.(*ecdh.PrivateKey)
+			if !ok {
+				return JWK{}, fmt.Errorf("Missing private key")
+			}
+			rv.D = b64.EncodeToString(priv.Bytes())
+		}
+
+	default:
+		return JWK{}, fmt.Errorf("Unsupported key type %T", key.Public)
+	}
+
+	return rv, nil
+}
+
+// FromJWK converts a JWK back into a key. EC keys must state their use,
+// since the same kind of key is used for signing and encryption.
+func FromJWK(jwk JWK) (orckeys.StandardKey, error) {
+	decode := func(field, value string) ([]byte, error) {
+		data, err := b64.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %q in JWK: %v", field, err)
+		}
+		return data, nil
+	}
+
+	x, err := decode("x", jwk.X)
+	if err != nil {
+		return orckeys.StandardKey{}, err
+	}
+	var d []byte
+	if jwk.D != "" {
+		d, err = decode("d", jwk.D)
+		if err != nil {
+			return orckeys.StandardKey{}, err
+		}
+	}
+
+	rv := orckeys.StandardKey{Use: jwk.Use, TinkKeyID: jwk.TinkKeyID}
+
+	switch {
+	case jwk.Kty == "EC" && jwk.Crv == "P-256":
+		y, err := decode("y", jwk.Y)
+		if err != nil {
+			return orckeys.StandardKey{}, err
+		}
+		switch jwk.Use {
+		case orckeys.UseSigning:
+			rv.Algorithm = orckeys.SigningECDSAP256
+		case orckeys.UseEncryption:
+			rv.Algorithm = orckeys.EncryptionECIESP256
+		default:
+			return orckeys.StandardKey{}, fmt.Errorf("EC JWK %q must have use %q or %q", jwk.Kid, orckeys.UseSigning, orckeys.UseEncryption)
+		}
+		pub := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return orckeys.StandardKey{}, fmt.Errorf("EC JWK %q is not on curve P-256", jwk.Kid)
+		}
+		rv.Public = pub
+		if d != nil {
+			rv.Private = &ecdsa.PrivateKey{PublicKey: *pub, D: new(big.Int).SetBytes(d)}
+		}
+
+	case jwk.Kty == "OKP" && jwk.Crv == "Ed25519":
+		if jwk.Use != "" && jwk.Use != orckeys.UseSigning {
+			return orckeys.StandardKey{}, fmt.Errorf("Ed25519 JWK %q has use %q", jwk.Kid, jwk.Use)
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return orckeys.StandardKey{}, fmt.Errorf("Ed25519 JWK %q has invalid public key length %d", jwk.Kid, len(x))
+		}
+		rv.Use = orckeys.UseSigning
+		rv.Algorithm = orckeys.SigningEd25519
+		rv.Public = ed25519.PublicKey(x)
+		if d != nil {
+			if len(d) != ed25519.SeedSize {
+				return orckeys.StandardKey{}, fmt.Errorf("Ed25519 JWK %q has invalid private key length %d", jwk.Kid, len(d))
+			}
+			rv.Private = ed25519.NewKeyFromSeed(d)
+		}
+
+	case jwk.Kty == "OKP" && jwk.Crv == "X25519":
+		if jwk.Use != "" && jwk.Use != orckeys.UseEncryption {
+			return orckeys.StandardKey{}, fmt.Errorf("X25519 JWK %q has use %q", jwk.Kid, jwk.Use)
+		}
+		rv.Use = orckeys.UseEncryption
+		rv.Algorithm = orckeys.EncryptionHPKEX25519
+		pub, err := ecdh.X25519().NewPublicKey(x)
+		if err != nil {
+			return orckeys.StandardKey{}, fmt.Errorf("Invalid X25519 JWK %q: %v", jwk.Kid, err)
+		}
+		rv.Public = pub
+		if d != nil {
+			priv, err := ecdh.X25519().NewPrivateKey(d)
+			if err != nil {
+				return orckeys.StandardKey{}, fmt.Errorf("Invalid X25519 JWK %q: %v", jwk.Kid, err)
+			}
+			rv.Private = priv
+		}
+
+	default:
+		return orckeys.StandardKey{}, fmt.Errorf("Unsupported JWK %q with kty %q and crv %q", jwk.Kid, jwk.Kty, jwk.Crv)
+	}
+
+	if rv.Private != nil {
+		if err := checkPrivateMatchesPublic(rv); err != nil {
+			return orckeys.StandardKey{}, fmt.Errorf("JWK %q: %v", jwk.Kid, err)
+		}
+	}
+
+	return rv, nil
+}
+
+func checkPrivateMatchesPublic(key orckeys.StandardKey) error {
+	if priv, ok := key.Private.(*ecdsa.PrivateKey); ok {
+		x, y := priv.Curve.ScalarBaseMult(priv.D.Bytes())
+		if x.Cmp(priv.X) != 0 || y.Cmp(priv.Y) != 0 {
+			return fmt.Errorf("Private key does not match public key")
+		}
+		return nil
+	}
+
+	priv, ok := key.Private.(interface{ Public() crypto.PublicKey })
+	if !ok {
+		return fmt.Errorf("Unsupported private key type %T", key.Private)
+	}
+	pub, ok := key.Public.(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !pub.Equal(priv.Public()) {
+		return fmt.Errorf("Private key does not match public key")
+	}
+	return nil
+}
+
+// PublicKeysToJWKS converts every generation of public keys.
+func PublicKeysToJWKS(packet orckeys.PublicKeyPacket) (JWKS, error) {
+	var rv JWKS
+	for _, generation := range packet.Generations() {
+		standardKeys, err := generation.StandardKeys()
+		if err != nil {
+			return JWKS{}, err
+		}
+		for _, key := range standardKeys {
+			jwk, err := ToJWK(key, KeyID(generation.Metadata, key.Use), false)
+			if err != nil {
+				return JWKS{}, err
+			}
+			rv.Keys = append(rv.Keys, jwk)
+		}
+	}
+	return rv, nil
+}
+
+// KeysToJWKS converts every generation of keys, including private keys.
+func KeysToJWKS(keys *orckeys.Keys) (JWKS, error) {
+	var rv JWKS
+	for _, generation := range keys.Generations() {
+		standardKeys, err := generation.StandardKeys()
+		if err != nil {
+			return JWKS{}, err
+		}
+		for _, key := range standardKeys {
+			jwk, err := ToJWK(key, KeyID(generation.Metadata, key.Use), true)
+			if err != nil {
+				return JWKS{}, err
+			}
+			rv.Keys = append(rv.Keys, jwk)
+		}
+	}
+	return rv, nil
+}
+
+// keyPair is the signing and encryption key of one generation.
+type keyPair struct {
+	id                  string
+	signing, encryption *orckeys.StandardKey
+}
+
+// pairsFromJWKS groups the keys of a JWKS into generations by key ID. The
+// first generation is the current one. Without key IDs, the set must
+// contain exactly one signing and one encryption key.
+func pairsFromJWKS(set JWKS) ([]*keyPair, error) {
+	var pairs []*keyPair
+	byID := map[string]*keyPair{}
+
+	for _, jwk := range set.Keys {
+		key, err := FromJWK(jwk)
+		if err != nil {
+			return nil, err
+		}
+
+		id, _ := splitKeyID(jwk.Kid)
+		pair, ok := byID[id]
+		if !ok {
+			pair = &keyPair{id: id}
+			byID[id] = pair
+			pairs = append(pairs, pair)
+		}
+
+		slot := &pair.signing
+		if key.Use == orckeys.UseEncryption {
+			slot = &pair.encryption
+		}
+		if *slot != nil {
+			return nil, fmt.Errorf("Multiple %q keys with key ID %q", key.Use, jwk.Kid)
+		}
+		*slot = &key
+	}
+
+	if len(pairs) == 0 {
+		return nil, fmt.Errorf("No keys in JWKS")
+	}
+	for _, pair := range pairs {
+		if pair.signing == nil || pair.encryption == nil {
+			return nil, fmt.Errorf("Keys %q lack a signing or an encryption key", pair.id)
+		}
+	}
+	return pairs, nil
+}
+
+func newMetadata(id, owner string) (orckeys.Metadata, error) {
+	if id == "" {
+		newID, err := uniqueid.New()
+		if err != nil {
+			return orckeys.Metadata{}, fmt.Errorf("Failed to generate unique ID: %v", err)
+		}
+		id = newID
+	}
+	now := orctimestamp.Format(time.Now())
+	return orckeys.Metadata{
+		ID:      id,
+		Owner:   owner,
+		Created: now,
+		Updated: now,
+	}, nil
+}
+
+// PublicKeyPacketFromJWKS builds public keys for owner from a JWKS.
+func PublicKeyPacketFromJWKS(owner string, set JWKS) (orckeys.PublicKeyPacket, error) {
+	pairs, err := pairsFromJWKS(set)
+	if err != nil {
+		return orckeys.PublicKeyPacket{}, err
+	}
+
+	var generations []orckeys.PublicKeyPacket
+	for _, pair := range pairs {
+		metadata, err := newMetadata(pair.id, owner)
+		if err != nil {
+			return orckeys.PublicKeyPacket{}, err
+		}
+		packet, err := orckeys.PublicKeyPacketFromStandard(metadata, *pair.signing, *pair.encryption)
+		if err != nil {
+			return orckeys.PublicKeyPacket{}, err
+		}
+		generations = append(generations, packet)
+	}
+
+	rv := generations[0]
+	rv.Previous = generations[1:]
+	return rv, nil
+}
+
+// KeysFromJWKS builds keys for owner from a JWKS with private keys.
+func KeysFromJWKS(owner string, set JWKS) (*orckeys.Keys, error) {
+	pairs, err := pairsFromJWKS(set)
+	if err != nil {
+		return nil, err
+	}
+
+	var generations []*orckeys.Keys
+	for _, pair := range pairs {
+		metadata, err := newMetadata(pair.id, owner)
+		if err != nil {
+			return nil, err
+		}
+		keys, err := orckeys.KeysFromStandard(metadata, *pair.signing, *pair.encryption)
+		if err != nil {
+			return nil, err
+		}
+		generations = append(generations, keys)
+	}
+
+	rv := generations[0]
+	rv.Previous = generations[1:]
+	return rv, nil
+}
+
+// HasPrivateKeys reports whether the JWKS contains any private keys.
+func (s JWKS) HasPrivateKeys() bool {
+	for _, jwk := range s.Keys {
+		if jwk.D != "" {
+			return true
+		}
+	}
+	return false
+}
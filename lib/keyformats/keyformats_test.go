@@ -0,0 +1,261 @@
+package keyformats
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/steinarvk/orclib/lib/orckeys"
+)
+
+// checkInteroperable checks that public can verify signatures by keys, and
+// that keys can decrypt what is encrypted to public.
+func checkInteroperable(t *testing.T, keys *orckeys.Keys, public orckeys.PublicKeyPacket) {
+	t.Helper()
+
+	message := []byte("hello")
+
+	sig, err := keys.Signer.Sign(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier, err := public.VerifyFrom()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifier.Verify(sig, message); err != nil {
+		t.Errorf("Verify() = %v", err)
+	}
+
+	encrypter, err := public.EncryptTo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, err := encrypter.Encrypt(message, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := keys.Decrypt.Decrypt(ciphertext, nil)
+	if err != nil {
+		t.Fatalf("Decrypt() = %v", err)
+	}
+	if !bytes.Equal(plaintext, message) {
+		t.Errorf("Decrypt() = %q, want %q", plaintext, message)
+	}
+}
+
+func jsonRoundTrip(t *testing.T, in, out interface{}) {
+	t.Helper()
+	data, err := json.Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for suiteName, algorithms := range orckeys.AlgorithmSuites {
+		t.Run(suiteName, func(t *testing.T) {
+			keys, err := orckeys.GenerateWithAlgorithms("alice", algorithms)
+			if err != nil {
+				t.Fatal(err)
+			}
+			keys, err = keys.Rotate(time.Now(), time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			public := keys.Public()
+
+			t.Run("jwks-public", func(t *testing.T) {
+				jwks, err := PublicKeysToJWKS(public)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var decoded JWKS
+				jsonRoundTrip(t, jwks, &decoded)
+				if decoded.HasPrivateKeys() {
+					t.Fatalf("public JWKS has private keys")
+				}
+				imported, err := PublicKeyPacketFromJWKS("alice", decoded)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(imported.Previous) != 1 {
+					t.Errorf("imported %d previous generations, want 1", len(imported.Previous))
+				}
+				if imported.Metadata.ID != public.Metadata.ID {
+					t.Errorf("imported ID %q, want %q", imported.Metadata.ID, public.Metadata.ID)
+				}
+				checkInteroperable(t, keys, imported)
+			})
+
+			t.Run("jwks-private", func(t *testing.T) {
+				jwks, err := KeysToJWKS(keys)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var decoded JWKS
+				jsonRoundTrip(t, jwks, &decoded)
+				imported, err := KeysFromJWKS("alice", decoded)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(imported.Previous) != 1 {
+					t.Errorf("imported %d previous generations, want 1", len(imported.Previous))
+				}
+				checkInteroperable(t, imported, public)
+			})
+
+			t.Run("pem", func(t *testing.T) {
+				publicKeys, err := public.StandardKeys()
+				if err != nil {
+					t.Fatal(err)
+				}
+				publicPEM, err := ToPEM(publicKeys, false)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if IsPrivatePEM(publicPEM) {
+					t.Fatalf("public PEM detected as private")
+				}
+				signing, encryption, err := FromPEM(publicPEM)
+				if err != nil {
+					t.Fatal(err)
+				}
+				importedPublic, err := orckeys.PublicKeyPacketFromStandard(public.Metadata, signing, encryption)
+				if err != nil {
+					t.Fatal(err)
+				}
+				checkInteroperable(t, keys, importedPublic)
+
+				privateKeys, err := keys.StandardKeys()
+				if err != nil {
+					t.Fatal(err)
+				}
+				privatePEM, err := ToPEM(privateKeys, true)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !IsPrivatePEM(privatePEM) {
+					t.Fatalf("private PEM not detected as private")
+				}
+				signing, encryption, err = FromPEM(privatePEM)
+				if err != nil {
+					t.Fatal(err)
+				}
+				imported, err := orckeys.KeysFromStandard(keys.Metadata, signing, encryption)
+				if err != nil {
+					t.Fatal(err)
+				}
+				checkInteroperable(t, imported, public)
+			})
+
+			t.Run("tink-json", func(t *testing.T) {
+				publicJSON, err := PublicKeysToTinkJSON(public)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var decodedPublic TinkJSONKeys
+				jsonRoundTrip(t, publicJSON, &decodedPublic)
+				importedPublic, err := decodedPublic.PublicKeyPacket()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if importedPublic.PublicSigningKey != public.PublicSigningKey || importedPublic.PublicEncryptionKey != public.PublicEncryptionKey {
+					t.Errorf("Tink JSON public keys did not round-trip exactly")
+				}
+
+				privateJSON, err := KeysToTinkJSON(keys)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var decodedPrivate TinkJSONKeys
+				jsonRoundTrip(t, privateJSON, &decodedPrivate)
+				imported, err := decodedPrivate.Keys()
+				if err != nil {
+					t.Fatal(err)
+				}
+				checkInteroperable(t, imported, public)
+			})
+		})
+	}
+}
+
+func TestFromJWKRejectsMismatchedPrivateKey(t *testing.T) {
+	a, err := orckeys.GenerateWithAlgorithms("a", orckeys.AlgorithmSuites["25519"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := orckeys.GenerateWithAlgorithms("b", orckeys.AlgorithmSuites["25519"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	aKeys, err := a.StandardKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bKeys, err := b.StandardKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwk, err := ToJWK(aKeys[0], "a.sig", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := ToJWK(bKeys[0], "b.sig", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwk.D = other.D
+
+	if _, err := FromJWK(jwk); err == nil {
+		t.Errorf("FromJWK accepted a private key not matching the public key")
+	}
+}
+
+func TestTinkJSONAlgorithmsFromKeysets(t *testing.T) {
+	keys, err := orckeys.GenerateWithAlgorithms("alice", orckeys.AlgorithmSuites["25519"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	public := keys.Public()
+
+	publicJSON, err := PublicKeysToTinkJSON(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateJSON, err := KeysToTinkJSON(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Keysets from elsewhere carry no algorithms in their metadata.
+	for _, tinkKeys := range []*TinkJSONKeys{publicJSON, privateJSON} {
+		tinkKeys.Metadata.SigningAlgorithm = ""
+		tinkKeys.Metadata.EncryptionAlgorithm = ""
+	}
+
+	importedPublic, err := publicJSON.PublicKeyPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	imported, err := privateJSON.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, metadata := range []orckeys.Metadata{importedPublic.Metadata, imported.Metadata} {
+		if metadata.SigningAlgorithm != orckeys.SigningEd25519 || metadata.EncryptionAlgorithm != orckeys.EncryptionHPKEX25519 {
+			t.Errorf("imported algorithms %q+%q, want %v", metadata.SigningAlgorithm, metadata.EncryptionAlgorithm, orckeys.AlgorithmSuites["25519"])
+		}
+	}
+
+	// Metadata contradicting the keysets is rejected.
+	publicJSON.Metadata.SigningAlgorithm = orckeys.SigningECDSAP256
+	if _, err := publicJSON.PublicKeyPacket(); err == nil {
+		t.Errorf("imported Ed25519 keys labelled %q", orckeys.SigningECDSAP256)
+	}
+}
@@ -0,0 +1,195 @@
+package keyformats
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/steinarvk/orclib/lib/orckeys"
+)
+
+const (
+	pemPublicKey  = "PUBLIC KEY"
+	pemPrivateKey = "PRIVATE KEY"
+
+	pemTinkKeyIDLabel = "Orc-Tink-Key-Id:"
+	pemBegin          = "-----BEGIN "
+)
+
+// ToPEM encodes the signing and then the encryption key of one generation
+// as PKIX public keys, or as PKCS #8 private keys if includePrivate is set.
+// The Tink key IDs are written as explanatory text before each block rather
+// than as PEM headers, which OpenSSL refuses for keys.
+func ToPEM(keys []orckeys.StandardKey, includePrivate bool) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, key := range keys {
+		if key.TinkKeyID != 0 {
+			fmt.Fprintf(&buf, "%s %d\n", pemTinkKeyIDLabel, key.TinkKeyID)
+		}
+		block := &pem.Block{Type: pemPublicKey}
+		var err error
+		if includePrivate {
+			block.Type = pemPrivateKey
+			block.Bytes, err = x509.MarshalPKCS8PrivateKey(key.Private)
+		} else {
+			block.Bytes, err = x509.MarshalPKIXPublicKey(key.Public)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Unable to encode %q key: %v", key.Use, err)
+		}
+		if err := pem.Encode(&buf, block); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// FromPEM decodes a signing and an encryption key written by ToPEM, in
+// that order.
+func FromPEM(data []byte) (signing, encryption orckeys.StandardKey, err error) {
+	var keys []orckeys.StandardKey
+	for {
+		begin := bytes.Index(data, []byte(pemBegin))
+		if begin < 0 {
+			break
+		}
+		tinkKeyID, err := tinkKeyIDFromText(data[:begin])
+		if err != nil {
+			return orckeys.StandardKey{}, orckeys.StandardKey{}, err
+		}
+		var block *pem.Block
+		block, data = pem.Decode(data[begin:])
+		if block == nil {
+			return orckeys.StandardKey{}, orckeys.StandardKey{}, fmt.Errorf("Malformed PEM block")
+		}
+		use := orckeys.UseSigning
+		if len(keys) > 0 {
+			use = orckeys.UseEncryption
+		}
+		key, err := keyFromPEMBlock(block, use)
+		if err != nil {
+			return orckeys.StandardKey{}, orckeys.StandardKey{}, err
+		}
+		key.TinkKeyID = tinkKeyID
+		keys = append(keys, key)
+	}
+
+	if len(bytes.TrimSpace(data)) != 0 {
+		return orckeys.StandardKey{}, orckeys.StandardKey{}, fmt.Errorf("Trailing data after PEM blocks")
+	}
+	if len(keys) != 2 {
+		return orckeys.StandardKey{}, orckeys.StandardKey{}, fmt.Errorf("Expected 2 PEM blocks (signing and encryption keys), got %d", len(keys))
+	}
+	return keys[0], keys[1], nil
+}
+
+// tinkKeyIDFromText finds the Tink key ID written by ToPEM in the text
+// preceding a PEM block. Keys without one get a fresh key ID on import.
+func tinkKeyIDFromText(text []byte) (uint32, error) {
+	for _, line := range strings.Split(string(text), "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, pemTinkKeyIDLabel) {
+			continue
+		}
+		value := strings.TrimSpace(strings.TrimPrefix(line, pemTinkKeyIDLabel))
+		id, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return 0, fmt.Errorf("Invalid %s %q: %v", pemTinkKeyIDLabel, value, err)
+		}
+		return uint32(id), nil
+	}
+	return 0, nil
+}
+
+func keyFromPEMBlock(block *pem.Block, use string) (orckeys.StandardKey, error) {
+	rv := orckeys.StandardKey{Use: use}
+
+	switch block.Type {
+	case pemPublicKey:
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return orckeys.StandardKey{}, fmt.Errorf("Invalid public %q key: %v", use, err)
+		}
+		rv.Public = pub
+
+	case pemPrivateKey:
+		priv, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return orckeys.StandardKey{}, fmt.Errorf("Invalid private %q key: %v", use, err)
+		}
+		rv.Private = priv
+		switch priv := priv.(type) {
+		case *ecdsa.PrivateKey:
+			rv.Public = &priv.PublicKey
+		case ed25519.PrivateKey:
+			rv.Public = priv.Public()
+		case *ecdh.PrivateKey:
+			rv.Public = priv.PublicKey()
+		}
+
+	default:
+		return orckeys.StandardKey{}, fmt.Errorf("Unsupported PEM block type %q", block.Type)
+	}
+
+	switch pub := rv.Public.(type) {
+	case *ecdsa.PublicKey:
+		if pub.Curve != elliptic.P256() {
+			return orckeys.StandardKey{}, fmt.Errorf("Unsupported curve %s for %q key", pub.Curve.Params().Name, use)
+		}
+		rv.Algorithm = orckeys.SigningECDSAP256
+		if use == orckeys.UseEncryption {
+			rv.Algorithm = orckeys.EncryptionECIESP256
+		}
+	case ed25519.PublicKey:
+		rv.Algorithm = orckeys.SigningEd25519
+	case *ecdh.PublicKey:
+		if pub.Curve() != ecdh.X25519() {
+			return orckeys.StandardKey{}, fmt.Errorf("Unsupported ECDH curve for %q key", use)
+		}
+		rv.Algorithm = orckeys.EncryptionHPKEX25519
+	default:
+		return orckeys.StandardKey{}, fmt.Errorf("Unsupported key type %T for %q key", rv.Public, use)
+	}
+
+	return rv, nil
+}
+
+// IsPrivatePEM reports whether data contains PEM-encoded private keys.
+func IsPrivatePEM(data []byte) bool {
+	block, _ := pem.Decode(data)
+	return block != nil && block.Type == pemPrivateKey
+}
+
+// PublicKeyPacketFromPEM builds public keys for owner from PEM-encoded
+// public keys.
+func PublicKeyPacketFromPEM(owner string, data []byte) (orckeys.PublicKeyPacket, error) {
+	signing, encryption, err := FromPEM(data)
+	if err != nil {
+		return orckeys.PublicKeyPacket{}, err
+	}
+	metadata, err := newMetadata("", owner)
+	if err != nil {
+		return orckeys.PublicKeyPacket{}, err
+	}
+	return orckeys.PublicKeyPacketFromStandard(metadata, signing, encryption)
+}
+
+// KeysFromPEM builds keys for owner from PEM-encoded private keys.
+func KeysFromPEM(owner string, data []byte) (*orckeys.Keys, error) {
+	signing, encryption, err := FromPEM(data)
+	if err != nil {
+		return nil, err
+	}
+	metadata, err := newMetadata("", owner)
+	if err != nil {
+		return nil, err
+	}
+	return orckeys.KeysFromStandard(metadata, signing, encryption)
+}
@@ -0,0 +1,50 @@
+package keyformats
+
+import (
+	"encoding/json"
+
+	"github.com/steinarvk/orclib/lib/orckeys"
+)
+
+// TinkJSONKeys holds one generation of keys as keysets in Tink's JSON
+// keyset format, together with their orc metadata. Private keysets are not
+// encrypted.
+type TinkJSONKeys struct {
+	Metadata         orckeys.Metadata `json:"metadata"`
+	Private          bool             `json:"private"`
+	SigningKeyset    json.RawMessage  `json:"signing_keyset"`
+	EncryptionKeyset json.RawMessage  `json:"encryption_keyset"`
+}
+
+func PublicKeysToTinkJSON(packet orckeys.PublicKeyPacket) (*TinkJSONKeys, error) {
+	signing, encryption, err := packet.TinkJSONKeysets()
+	if err != nil {
+		return nil, err
+	}
+	return &TinkJSONKeys{
+		Metadata:         packet.Metadata,
+		SigningKeyset:    signing,
+		EncryptionKeyset: encryption,
+	}, nil
+}
+
+func KeysToTinkJSON(keys *orckeys.Keys) (*TinkJSONKeys, error) {
+	signing, encryption, err := keys.TinkJSONKeysets()
+	if err != nil {
+		return nil, err
+	}
+	return &TinkJSONKeys{
+		Metadata:         keys.Metadata,
+		Private:          true,
+		SigningKeyset:    signing,
+		EncryptionKeyset: encryption,
+	}, nil
+}
+
+func (t *TinkJSONKeys) PublicKeyPacket() (orckeys.PublicKeyPacket, error) {
+	return orckeys.PublicKeyPacketFromTinkJSON(t.Metadata, t.SigningKeyset, t.EncryptionKeyset)
+}
+
+func (t *TinkJSONKeys) Keys() (*orckeys.Keys, error) {
+	return orckeys.KeysFromTinkJSON(t.Metadata, t.SigningKeyset, t.EncryptionKeyset)
+}
@@ -0,0 +1,178 @@
+package localkms
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/google/tink/go/aead"
+	"github.com/google/tink/go/aead/subtle"
+	"github.com/google/tink/go/insecurecleartextkeyset"
+	"github.com/google/tink/go/keyset"
+	"github.com/google/tink/go/tink"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	Prefix = "local-kms://"
+
+	TypeKeyset     = "keyset"
+	TypePassphrase = "passphrase"
+
+	derivedKeyLength = 32
+)
+
+// ScryptParams are the parameters used to derive a key from a passphrase.
+type ScryptParams struct {
+	Salt []byte `json:"salt"`
+	N    int    `json:"n"`
+	R    int    `json:"r"`
+	P    int    `json:"p"`
+}
+
+var DefaultScryptParams = ScryptParams{
+	N: 1 << 15,
+	R: 8,
+	P: 1,
+}
+
+// KeyFile is the contents of the file a local-kms:// URI points to.
+// It holds either a cleartext Tink AEAD keyset, or the parameters needed to
+// derive a key from a passphrase kept elsewhere.
+type KeyFile struct {
+	Type   string          `json:"type"`
+	Keyset json.RawMessage `json:"keyset,omitempty"`
+	Scrypt *ScryptParams   `json:"scrypt,omitempty"`
+}
+
+// Client is a Tink KMS client for local-kms:// URIs.
+type Client struct {
+	// Passphrase is called to get the passphrase for passphrase key files.
+	Passphrase func() ([]byte, error)
+}
+
+func (c *Client) Supported(keyURI string) bool {
+	return strings.HasPrefix(keyURI, Prefix)
+}
+
+// Filename returns the key file named by a local-kms:// URI.
+func Filename(keyURI string) (string, error) {
+	if !strings.HasPrefix(keyURI, Prefix) {
+		return "", fmt.Errorf("Not a %s URI: %q", Prefix, keyURI)
+	}
+	filename := strings.TrimPrefix(keyURI, Prefix)
+	if filename == "" {
+		return "", fmt.Errorf("Missing filename in %q", keyURI)
+	}
+	return filename, nil
+}
+
+func (c *Client) GetAEAD(keyURI string) (tink.AEAD, error) {
+	filename, err := Filename(keyURI)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read local master key %q: %v", filename, err)
+	}
+
+	var keyFile KeyFile
+	if err := json.Unmarshal(data, &keyFile); err != nil {
+		return nil, fmt.Errorf("Unable to parse local master key %q: %v", filename, err)
+	}
+
+	switch keyFile.Type {
+	case TypeKeyset:
+		handle, err := insecurecleartextkeyset.Read(keyset.NewJSONReader(bytes.NewReader(keyFile.Keyset)))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid keyset in local master key %q: %v", filename, err)
+		}
+		return aead.New(handle)
+
+	case TypePassphrase:
+		if keyFile.Scrypt == nil {
+			return nil, fmt.Errorf("Missing scrypt parameters in local master key %q", filename)
+		}
+		if c.Passphrase == nil {
+			return nil, fmt.Errorf("Local master key %q requires a passphrase, but none is configured", filename)
+		}
+		passphrase, err := c.Passphrase()
+		if err != nil {
+			return nil, fmt.Errorf("Unable to get passphrase for local master key %q: %v", filename, err)
+		}
+		return deriveAEAD(passphrase, *keyFile.Scrypt)
+	}
+
+	return nil, fmt.Errorf("Unknown type %q of local master key %q", keyFile.Type, filename)
+}
+
+func deriveAEAD(passphrase []byte, params ScryptParams) (tink.AEAD, error) {
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf("Empty passphrase")
+	}
+	key, err := scrypt.Key(passphrase, params.Salt, params.N, params.R, params.P, derivedKeyLength)
+	if err != nil {
+		return nil, fmt.Errorf("Key derivation failed: %v", err)
+	}
+	return subtle.NewAESGCM(key)
+}
+
+// NewKeysetKeyFile generates a new random AES-256-GCM master key.
+func NewKeysetKeyFile() (*KeyFile, error) {
+	handle, err := keyset.NewHandle(aead.AES256GCMKeyTemplate())
+	if err != nil {
+		return nil, fmt.Errorf("Failed to generate master key: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := insecurecleartextkeyset.Write(handle, keyset.NewJSONWriter(&buf)); err != nil {
+		return nil, fmt.Errorf("Failed to serialize master key: %v", err)
+	}
+
+	return &KeyFile{
+		Type:   TypeKeyset,
+		Keyset: json.RawMessage(buf.Bytes()),
+	}, nil
+}
+
+// NewPassphraseKeyFile creates parameters for a passphrase-derived master key
+// with a fresh random salt.
+func NewPassphraseKeyFile() (*KeyFile, error) {
+	params := DefaultScryptParams
+	params.Salt = make([]byte, 32)
+	if _, err := rand.Read(params.Salt); err != nil {
+		return nil, fmt.Errorf("Failed to generate salt: %v", err)
+	}
+
+	return &KeyFile{
+		Type:   TypePassphrase,
+		Scrypt: &params,
+	}, nil
+}
+
+// WriteNew writes the key file, refusing to overwrite an existing file.
+func (k *KeyFile) WriteNew(filename string) error {
+	data, err := json.MarshalIndent(k, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("Error creating %q: %v", filename, err)
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("Error writing to %q: %v", filename, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("Error closing %q after writing: %v", filename, err)
+	}
+	return nil
+}
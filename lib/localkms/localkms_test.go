@@ -0,0 +1,57 @@
+package localkms
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/tink/go/core/registry"
+	"github.com/steinarvk/orclib/lib/orckeys"
+)
+
+func TestOrcKeysRoundTrip(t *testing.T) {
+	passphrase := []byte("correct horse battery staple")
+	registry.RegisterKMSClient(&Client{
+		Passphrase: func() ([]byte, error) { return passphrase, nil },
+	})
+
+	for _, newKeyFile := range []func() (*KeyFile, error){NewKeysetKeyFile, NewPassphraseKeyFile} {
+		keyFile, err := newKeyFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		filename := filepath.Join(t.TempDir(), "master.json")
+		if err := keyFile.WriteNew(filename); err != nil {
+			t.Fatal(err)
+		}
+		if err := keyFile.WriteNew(filename); err == nil {
+			t.Errorf("WriteNew overwrote existing %s key file", keyFile.Type)
+		}
+
+		keys, err := orckeys.Generate("example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var buf bytes.Buffer
+		if err := keys.WriteEncrypted(&buf, Prefix+filename); err != nil {
+			t.Fatalf("WriteEncrypted with %s key file: %v", keyFile.Type, err)
+		}
+
+		loaded, err := orckeys.LoadEncrypted(bytes.NewReader(buf.Bytes()), "")
+		if err != nil {
+			t.Fatalf("LoadEncrypted with %s key file: %v", keyFile.Type, err)
+		}
+		if loaded.Public().PublicSigningKey != keys.Public().PublicSigningKey {
+			t.Errorf("%s key file: loaded keys differ from written keys", keyFile.Type)
+		}
+
+		if keyFile.Type == TypePassphrase {
+			passphrase = []byte("wrong")
+			if _, err := orckeys.LoadEncrypted(bytes.NewReader(buf.Bytes()), ""); err == nil {
+				t.Errorf("LoadEncrypted succeeded with wrong passphrase")
+			}
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package orcdb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+	"github.com/steinarvk/sectiontrace"
+)
+
+// maxBatchParams keeps multi-row inserts within the default parameter
+// limit of older SQLite versions.
+const maxBatchParams = 999
+
+// bulkCopier is implemented by dialects with a faster way than multi-row
+// inserts to load many rows.
+type bulkCopier interface {
+	copyIn(ctx context.Context, tx *sql.Tx, tableName string, fieldNames []string, rows [][]interface{}) error
+}
+
+// copyIn loads the rows with COPY.
+func (postgresDialect) copyIn(ctx context.Context, tx *sql.Tx, tableName string, fieldNames []string, rows [][]interface{}) error {
+	copySQL := pq.CopyIn(tableName, fieldNames...)
+	if parts := strings.SplitN(tableName, ".", 2); len(parts) == 2 {
+		copySQL = pq.CopyInSchema(parts[0], parts[1], fieldNames...)
+	}
+
+	stmt, err := tx.PrepareContext(ctx, copySQL)
+	if err != nil {
+		return err
+	}
+
+	for _, row := range rows {
+		if _, err := stmt.ExecContext(ctx, row...); err != nil {
+			stmt.Close()
+			return err
+		}
+	}
+
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		stmt.Close()
+		return err
+	}
+
+	return stmt.Close()
+}
+
+// BatchInsert inserts many rows into a table at once.
+type BatchInsert struct {
+	dialect    Dialect
+	section    sectiontrace.Section
+	queryName  string
+	tableName  string
+	fieldNames []string
+	single     *PreparedExec
+}
+
+// PrepareBatchInsert prepares inserts of many rows into tableName, each
+// taking a parameter for each of fieldNames. Rows are loaded with COPY on
+// Postgres, and with multi-row inserts otherwise.
+func (d *Database) PrepareBatchInsert(outErr *error, tableName string, fieldNames []string) *BatchInsert {
+	if *outErr != nil {
+		return nil
+	}
+
+	if len(fieldNames) == 0 {
+		*outErr = fmt.Errorf("Batch insert into %q has no fields", tableName)
+		return nil
+	}
+
+	single := d.PrepareInsertExec(outErr, tableName, fieldNames)
+	if single == nil {
+		return nil
+	}
+
+	queryName := fmt.Sprintf("batch-insert-%s-(%s)", tableName, strings.Join(fieldNames, ","))
+	return &BatchInsert{
+		dialect:    d.dialect,
+		section:    sections.Get(d.dialect, queryName),
+		queryName:  queryName,
+		tableName:  tableName,
+		fieldNames: fieldNames,
+		single:     single,
+	}
+}
+
+// Insert inserts rows, each a map from field name to value.
+func (b *BatchInsert) Insert(ctx context.Context, tx *sql.Tx, rows []map[string]interface{}) error {
+	if len(rows) == 0 {
+		return nil
+	}
+
+	return b.section.Do(ctx, func(ctx context.Context) error {
+		args := make([][]interface{}, len(rows))
+		for i, row := range rows {
+			rowArgs, err := fromArgmap(b.fieldNames, row)
+			if err != nil {
+				return QueryFailed{b.queryName, fmt.Errorf("row %d: %v", i, err)}
+			}
+			args[i] = rowArgs
+		}
+
+		if copier, ok := b.dialect.(bulkCopier); ok {
+			if err := copier.copyIn(ctx, tx, b.tableName, b.fieldNames, args); err != nil {
+				return QueryFailed{b.queryName, err}
+			}
+			return nil
+		}
+
+		rowsPerStatement := maxBatchParams / len(b.fieldNames)
+		if rowsPerStatement < 1 {
+			rowsPerStatement = 1
+		}
+
+		for start := 0; start < len(args); start += rowsPerStatement {
+			end := start + rowsPerStatement
+			if end > len(args) {
+				end = len(args)
+			}
+			chunk := args[start:end]
+
+			var err error
+			if len(chunk) == 1 {
+				_, err = tx.Stmt(b.single.stmt).ExecContext(ctx, chunk[0]...)
+			} else {
+				var flat []interface{}
+				for _, rowArgs := range chunk {
+					flat = append(flat, rowArgs...)
+				}
+				_, err = tx.ExecContext(ctx, insertSQL(b.dialect, b.tableName, b.fieldNames, len(chunk)), flat...)
+			}
+			if err != nil {
+				return QueryFailed{b.queryName, err}
+			}
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,193 @@
+package orcdb
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+// Dialect covers the differences between the supported databases, so
+// that the same schema and queries can run on either.
+type Dialect interface {
+	// Name identifies the dialect, e.g. "sqlite" or "postgres".
+	Name() string
+
+	// DriverName is the database/sql driver to open.
+	DriverName() string
+
+	// Placeholder returns the placeholder for the positional parameter
+	// at position (starting from 1).
+	Placeholder(position int) string
+
+	// ParamPrefixes lists the characters that may introduce a named
+	// parameter, e.g. ":" in ":name".
+	ParamPrefixes() string
+
+	// ListTablesQuery returns a query listing the names of all tables.
+	ListTablesQuery() string
+
+	// SerialPrimaryKey is the column definition of an integer primary key
+	// generated by the database, which replaces SerialPrimaryKey in
+	// schema upgrades. Generated keys are never reused, even for rows
+	// that have been deleted.
+	SerialPrimaryKey() string
+
+	// OnOpen is called when a database has been opened, before the
+	// schema is checked.
+	OnOpen(ctx context.Context, db *sql.DB) error
+
+	// AfterStartup is called once the schema is up to date.
+	AfterStartup(ctx context.Context, db *sql.DB) error
+
+	// LockMigrations waits up to timeout for an exclusive lock, shared
+	// between processes, on migrating the schema. It returns a function
+	// to release the lock.
+	LockMigrations(ctx context.Context, db *sql.DB, schemaName string, timeout time.Duration) (func() error, error)
+
+	// IsRetryable reports whether err means that a transaction failed
+	// because of concurrent transactions, and may succeed if retried.
+	IsRetryable(err error) bool
+
+	// Explain returns the plan of a query with positional parameters, as
+	// text.
+	Explain(ctx context.Context, q Queryer, query string, args []interface{}) (string, error)
+}
+
+var (
+	SQLite   Dialect = sqliteDialect{}
+	Postgres Dialect = postgresDialect{}
+)
+
+// DialectByName returns the dialect with the given name.
+func DialectByName(name string) (Dialect, error) {
+	for _, dialect := range []Dialect{SQLite, Postgres} {
+		if dialect.Name() == strings.ToLower(name) {
+			return dialect, nil
+		}
+	}
+	return nil, fmt.Errorf("Unknown database dialect %q (expected %q or %q)", name, SQLite.Name(), Postgres.Name())
+}
+
+type sqliteDialect struct {
+	opts SQLiteOptions
+}
+
+func (sqliteDialect) Name() string       { return "sqlite" }
+func (sqliteDialect) DriverName() string { return "sqlite3" }
+
+func (sqliteDialect) Placeholder(position int) string { return "?" }
+
+// SQLite itself accepts "@name" and "$name" as well as ":name".
+func (sqliteDialect) ParamPrefixes() string { return ":@$" }
+
+// Without AUTOINCREMENT, SQLite reuses the key of the last row once it
+// has been deleted.
+func (sqliteDialect) SerialPrimaryKey() string { return "INTEGER PRIMARY KEY AUTOINCREMENT" }
+
+func (sqliteDialect) ListTablesQuery() string {
+	return `SELECT name FROM sqlite_master WHERE type = 'table';`
+}
+
+// OnOpen applies the pragmas, for databases opened without the dialect's
+// connector; otherwise they have already been applied to each connection.
+func (d sqliteDialect) OnOpen(ctx context.Context, db *sql.DB) error {
+	pragmas, err := d.opts.pragmas()
+	if err != nil {
+		return err
+	}
+	for _, pragma := range pragmas {
+		if _, err := db.ExecContext(ctx, pragma); err != nil {
+			return fmt.Errorf("Unable to set %q: %v", pragma, err)
+		}
+	}
+	return nil
+}
+
+func (sqliteDialect) IsRetryable(err error) bool {
+	var sqliteErr sqlite3.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
+}
+
+// Explain renders the EXPLAIN QUERY PLAN tree, indenting each step below
+// its parent.
+func (sqliteDialect) Explain(ctx context.Context, q Queryer, query string, args []interface{}) (string, error) {
+	rows, err := explainRows(ctx, q, "EXPLAIN QUERY PLAN "+query, args)
+	if err != nil {
+		return "", err
+	}
+
+	depths := map[string]int{}
+	var lines []string
+	for _, row := range rows {
+		if len(row) < 4 {
+			return "", fmt.Errorf("Unexpected EXPLAIN QUERY PLAN row: %v", row)
+		}
+		id, parent, detail := row[0], row[1], row[3]
+		depth := 0
+		if parentDepth, ok := depths[parent]; ok {
+			depth = parentDepth + 1
+		}
+		depths[id] = depth
+		lines = append(lines, strings.Repeat("  ", depth)+detail)
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+func (d sqliteDialect) AfterStartup(ctx context.Context, db *sql.DB) error {
+	if d.opts.SkipVacuum {
+		return nil
+	}
+	if _, err := db.ExecContext(ctx, `VACUUM;`); err != nil {
+		return fmt.Errorf("vacuuming database failed: %v", err)
+	}
+	return nil
+}
+
+type postgresDialect struct{}
+
+func (postgresDialect) Name() string       { return "postgres" }
+func (postgresDialect) DriverName() string { return "postgres" }
+
+func (postgresDialect) Placeholder(position int) string { return fmt.Sprintf("$%d", position) }
+
+func (postgresDialect) ParamPrefixes() string { return ":" }
+
+func (postgresDialect) SerialPrimaryKey() string { return "BIGSERIAL PRIMARY KEY" }
+
+func (postgresDialect) ListTablesQuery() string {
+	return `SELECT table_name AS name FROM information_schema.tables WHERE table_schema = 'public';`
+}
+
+// IsRetryable is true for serialization failures and deadlocks.
+func (postgresDialect) IsRetryable(err error) bool {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return false
+	}
+	return pqErr.Code == "40001" || pqErr.Code == "40P01"
+}
+
+func (postgresDialect) Explain(ctx context.Context, q Queryer, query string, args []interface{}) (string, error) {
+	rows, err := explainRows(ctx, q, "EXPLAIN "+query, args)
+	if err != nil {
+		return "", err
+	}
+
+	var lines []string
+	for _, row := range rows {
+		lines = append(lines, strings.Join(row, " "))
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+func (postgresDialect) OnOpen(ctx context.Context, db *sql.DB) error       { return nil }
+func (postgresDialect) AfterStartup(ctx context.Context, db *sql.DB) error { return nil }
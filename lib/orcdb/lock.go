@@ -0,0 +1,163 @@
+package orcdb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultMigrationLockTimeout = time.Minute
+
+	lockPollInterval = 250 * time.Millisecond
+)
+
+// MigrationLockTimeout sets how long to wait for another instance to
+// finish migrating the database.
+func MigrationLockTimeout(timeout time.Duration) OpenOption {
+	return func(opts *openOptions) {
+		opts.lockTimeout = timeout
+	}
+}
+
+// pollLock calls try until it succeeds, or until timeout.
+func pollLock(ctx context.Context, what string, timeout time.Duration, try func() (bool, error)) error {
+	deadline := time.Now().Add(timeout)
+	logged := false
+
+	for {
+		ok, err := try()
+		if err != nil {
+			return fmt.Errorf("Error acquiring %s: %v", what, err)
+		}
+		if ok {
+			return nil
+		}
+
+		if !logged {
+			logrus.Infof("Waiting up to %v for %s", timeout, what)
+			logged = true
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Timed out after %v waiting for %s", timeout, what)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(lockPollInterval):
+		}
+	}
+}
+
+func (d *Database) withMigrationLock(ctx context.Context, callback func() error) error {
+	unlock, err := d.dialect.LockMigrations(ctx, d.db, d.schema.Name, d.lockTimeout)
+	if err != nil {
+		return err
+	}
+
+	err = callback()
+
+	if unlockErr := unlock(); unlockErr != nil && err == nil {
+		err = fmt.Errorf("Error releasing migration lock: %v", unlockErr)
+	}
+
+	return err
+}
+
+func sqliteMainFilename(ctx context.Context, db *sql.DB) (string, error) {
+	rows, err := db.QueryContext(ctx, `PRAGMA database_list;`)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var seq int
+		var name, file string
+		if err := rows.Scan(&seq, &name, &file); err != nil {
+			return "", err
+		}
+		if name == "main" {
+			return file, nil
+		}
+	}
+
+	return "", rows.Err()
+}
+
+// LockMigrations takes an exclusive lock on a file next to the database
+// file. In-memory databases are private to the process and need no lock.
+func (sqliteDialect) LockMigrations(ctx context.Context, db *sql.DB, schemaName string, timeout time.Duration) (func() error, error) {
+	filename, err := sqliteMainFilename(ctx, db)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to find database file: %v", err)
+	}
+
+	if filename == "" {
+		return func() error { return nil }, nil
+	}
+
+	lockFilename := filename + ".migrationlock"
+	f, err := os.OpenFile(lockFilename, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open lock file: %v", err)
+	}
+
+	what := fmt.Sprintf("migration lock %q", lockFilename)
+	if err := pollLock(ctx, what, timeout, func() (bool, error) {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == syscall.EWOULDBLOCK {
+			return false, nil
+		}
+		return err == nil, err
+	}); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	// Closing the file releases the lock.
+	return f.Close, nil
+}
+
+func advisoryLockKey(schemaName string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte("orcdb.migrations." + schemaName))
+	return int64(h.Sum64())
+}
+
+// LockMigrations takes a session-level advisory lock keyed on the schema
+// name, on a connection reserved until the lock is released.
+func (postgresDialect) LockMigrations(ctx context.Context, db *sql.DB, schemaName string, timeout time.Duration) (func() error, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	key := advisoryLockKey(schemaName)
+
+	what := fmt.Sprintf("migration lock for schema %q", schemaName)
+	if err := pollLock(ctx, what, timeout, func() (bool, error) {
+		var ok bool
+		err := conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1);`, key).Scan(&ok)
+		return ok, err
+	}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return func() error {
+		_, err := conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1);`, key)
+		if closeErr := conn.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	}, nil
+}
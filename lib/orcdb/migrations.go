@@ -0,0 +1,483 @@
+package orcdb
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/steinarvk/orclib/lib/orchash"
+	"github.com/steinarvk/orclib/lib/orctimestamp"
+)
+
+const (
+	// LatestVersion as a migration target means the version reached by
+	// applying all upgrades.
+	LatestVersion = -1
+
+	historyTableName = "___orcschema_history"
+
+	// metaVersionHistory is the metatable version that added the
+	// history table.
+	metaVersionHistory = 2
+)
+
+// MigrationStep upgrades the schema from one version to another, or
+// reverses such an upgrade if Down is set.
+type MigrationStep struct {
+	From int
+	To   int
+	Down bool
+	Sql  []string
+}
+
+func (m MigrationStep) String() string {
+	if m.Down {
+		return fmt.Sprintf("%d => %d (down)", m.From, m.To)
+	}
+	return fmt.Sprintf("%d => %d", m.From, m.To)
+}
+
+// UpgradeStatus describes one upgrade of the schema and whether it has
+// been applied.
+type UpgradeStatus struct {
+	From    int
+	To      int
+	Applied bool
+
+	// AppliedAt is empty if the upgrade was applied before history was
+	// kept.
+	AppliedAt string
+
+	// Modified is set if the upgrade has been edited since it was applied.
+	Modified bool
+
+	Reversible bool
+}
+
+// HistoryEntry is a row of the history table.
+type HistoryEntry struct {
+	From      int
+	To        int
+	Checksum  string
+	AppliedAt string
+}
+
+type MigrationStatus struct {
+	Schema        string
+	Dialect       string
+	Version       int
+	LatestVersion int
+
+	// Upgrades lists the upgrades of the schema, in order from version 0.
+	Upgrades []UpgradeStatus
+
+	// Unknown lists applied upgrades that are not in the schema, e.g.
+	// because the database was migrated by a newer program.
+	Unknown []HistoryEntry
+}
+
+// upgradeChecksum hashes the statements of an upgrade, encoded as JSON.
+// Canonical JSON is not used, since it rejects the newlines of multi-line
+// statements.
+func upgradeChecksum(upgrade SchemaUpgrade) (string, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(upgrade.Sql); err != nil {
+		return "", err
+	}
+	return orchash.ComputeHash(bytes.TrimSuffix(buf.Bytes(), []byte("\n"))), nil
+}
+
+// chain returns the upgrade steps from version 0, in order.
+func (s *Schema) chain() ([]MigrationStep, error) {
+	var rv []MigrationStep
+	version := 0
+	for {
+		upgrade, ok := s.Upgrades[version]
+		if !ok {
+			return rv, nil
+		}
+
+		nextVer := version + 1
+		if upgrade.Next != 0 {
+			nextVer = upgrade.Next
+		}
+
+		if nextVer <= version {
+			return nil, fmt.Errorf("Invalid update (%d => %d): version must increase", version, nextVer)
+		}
+
+		rv = append(rv, MigrationStep{From: version, To: nextVer, Sql: upgrade.Sql})
+		version = nextVer
+	}
+}
+
+// plan returns the steps to migrate from one version to another.
+func (s *Schema) plan(from, to int) ([]MigrationStep, error) {
+	chain, err := s.chain()
+	if err != nil {
+		return nil, err
+	}
+
+	latest := 0
+	if len(chain) > 0 {
+		latest = chain[len(chain)-1].To
+	}
+	if to == LatestVersion {
+		to = latest
+		if from > to {
+			// The database is newer than the schema; leave it be.
+			return nil, nil
+		}
+	}
+
+	var rv []MigrationStep
+
+	if to >= from {
+		for _, step := range chain {
+			if step.From >= from && step.To <= to {
+				rv = append(rv, step)
+			}
+		}
+		if len(rv) == 0 && from == to {
+			return nil, nil
+		}
+		if len(rv) == 0 || rv[0].From != from || rv[len(rv)-1].To != to {
+			return nil, fmt.Errorf("No sequence of upgrades leads from version %d to %d", from, to)
+		}
+		return rv, nil
+	}
+
+	for i := len(chain) - 1; i >= 0; i-- {
+		step := chain[i]
+		if step.To > from || step.From < to {
+			continue
+		}
+		down := s.Upgrades[step.From].Down
+		if len(down) == 0 {
+			return nil, fmt.Errorf("Upgrade %s has no down migration", step)
+		}
+		rv = append(rv, MigrationStep{From: step.To, To: step.From, Down: true, Sql: down})
+	}
+	if len(rv) == 0 || rv[0].From != from || rv[len(rv)-1].To != to {
+		return nil, fmt.Errorf("No sequence of upgrades leads back from version %d to %d", from, to)
+	}
+	return rv, nil
+}
+
+func getMetaVersion(ctx context.Context, q Queryer) (int, error) {
+	var metaVersion int
+	err := q.QueryRowContext(ctx, `SELECT meta_version FROM ___orcschema;`).Scan(&metaVersion)
+	return metaVersion, err
+}
+
+func (d *Database) upgradeMetatable(ctx context.Context) error {
+	return d.runInTransaction(ctx, defaultTxOpts, func(tx *sql.Tx) error {
+		return d.upgradeMetatableInTx(ctx, tx)
+	})
+}
+
+func (d *Database) upgradeMetatableInTx(ctx context.Context, tx *sql.Tx) error {
+	metaVersion, err := getMetaVersion(ctx, tx)
+	if err != nil {
+		return err
+	}
+
+	if metaVersion >= metaVersionHistory {
+		return nil
+	}
+
+	createHistory := `CREATE TABLE ___orcschema_history (
+		from_version INTEGER NOT NULL,
+		to_version INTEGER NOT NULL,
+		checksum TEXT NOT NULL,
+		applied_at TEXT NOT NULL
+	);`
+	if _, err := tx.ExecContext(ctx, createHistory); err != nil {
+		return fmt.Errorf("error creating %s: %v", historyTableName, err)
+	}
+
+	return d.exec(ctx, tx, `UPDATE ___orcschema SET meta_version = :meta_version;`, map[string]interface{}{
+		"meta_version": metaVersionHistory,
+	})
+}
+
+// history lists the applied upgrades. A database opened with Inspect may
+// predate the history table, and then has none.
+func (d *Database) history(ctx context.Context, q Queryer) ([]HistoryEntry, error) {
+	metaVersion, err := getMetaVersion(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	if metaVersion < metaVersionHistory {
+		return nil, nil
+	}
+
+	rows, err := q.QueryContext(ctx, `SELECT from_version, to_version, checksum, applied_at FROM ___orcschema_history ORDER BY from_version;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rv []HistoryEntry
+	for rows.Next() {
+		var entry HistoryEntry
+		if err := rows.Scan(&entry.From, &entry.To, &entry.Checksum, &entry.AppliedAt); err != nil {
+			return nil, err
+		}
+		rv = append(rv, entry)
+	}
+	return rv, rows.Err()
+}
+
+// Version returns the current version of the database.
+func (d *Database) Version(ctx context.Context) (int, error) {
+	_, version, err := getSchemaVersion(ctx, d.db)
+	return version, err
+}
+
+// Status describes the applied and pending upgrades of the database.
+func (d *Database) Status(ctx context.Context) (*MigrationStatus, error) {
+	version, err := d.Version(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	chain, err := d.schema.chain()
+	if err != nil {
+		return nil, err
+	}
+
+	history, err := d.history(ctx, d.db)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := &MigrationStatus{
+		Schema:  d.schema.Name,
+		Dialect: d.dialect.Name(),
+		Version: version,
+	}
+
+	known := map[int]bool{}
+
+	for _, step := range chain {
+		upgrade := d.schema.Upgrades[step.From]
+		status := UpgradeStatus{
+			From:       step.From,
+			To:         step.To,
+			Applied:    step.To <= version,
+			Reversible: len(upgrade.Down) > 0,
+		}
+
+		checksum, err := upgradeChecksum(upgrade)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range history {
+			if entry.From == step.From && entry.To == step.To {
+				known[entry.From] = true
+				status.AppliedAt = entry.AppliedAt
+				status.Modified = entry.Checksum != checksum
+			}
+		}
+
+		rv.Upgrades = append(rv.Upgrades, status)
+		rv.LatestVersion = step.To
+	}
+
+	for _, entry := range history {
+		if !known[entry.From] {
+			rv.Unknown = append(rv.Unknown, entry)
+		}
+	}
+
+	return rv, nil
+}
+
+func (d *Database) verifyChecksums(ctx context.Context) error {
+	status, err := d.Status(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, upgrade := range status.Upgrades {
+		if upgrade.Modified {
+			return fmt.Errorf("Upgrade %d => %d has been modified since it was applied (at %s)", upgrade.From, upgrade.To, upgrade.AppliedAt)
+		}
+	}
+
+	return nil
+}
+
+func (d *Database) applyStep(ctx context.Context, tx *sql.Tx, step MigrationStep) error {
+	_, version, err := getSchemaVersion(ctx, tx)
+	if err != nil {
+		return err
+	}
+
+	if version != step.From {
+		return fmt.Errorf("Version expectation mismatch during migration %s, yet version was %d", step, version)
+	}
+
+	for _, stmt := range step.Sql {
+		stmt = strings.ReplaceAll(stmt, SerialPrimaryKey, d.dialect.SerialPrimaryKey())
+		logrus.Infof("executing statement: %q", stmt)
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+
+	_, version, err = getSchemaVersion(ctx, tx)
+	if err != nil {
+		return err
+	}
+
+	if version != step.From {
+		return fmt.Errorf("Version expectation mismatch during migration %s, yet version was %d after script ran", step, version)
+	}
+
+	if err := d.exec(ctx, tx, `UPDATE ___orcschema SET version = :version ;`, map[string]interface{}{"version": step.To}); err != nil {
+		return err
+	}
+
+	if step.Down {
+		err = d.exec(ctx, tx, `DELETE FROM ___orcschema_history WHERE from_version = :from_version AND to_version = :to_version;`, map[string]interface{}{
+			"from_version": step.To,
+			"to_version":   step.From,
+		})
+	} else {
+		var checksum string
+		checksum, err = upgradeChecksum(d.schema.Upgrades[step.From])
+		if err != nil {
+			return err
+		}
+		err = d.exec(ctx, tx, `INSERT INTO ___orcschema_history (from_version, to_version, checksum, applied_at) VALUES (:from_version, :to_version, :checksum, :applied_at);`, map[string]interface{}{
+			"from_version": step.From,
+			"to_version":   step.To,
+			"checksum":     checksum,
+			"applied_at":   orctimestamp.Format(time.Now()),
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	_, version, err = getSchemaVersion(ctx, tx)
+	if err != nil {
+		return err
+	}
+
+	if version != step.To {
+		return fmt.Errorf("Version expectation mismatch during migration %s, yet version was %d after version should have been updated", step, version)
+	}
+
+	return nil
+}
+
+// MigrateTo upgrades or downgrades the database to a version, or to
+// LatestVersion, returning the steps taken. Each step runs in its own
+// transaction. With dryRun, all steps run in one transaction that is
+// then rolled back.
+func (d *Database) MigrateTo(ctx context.Context, version int, dryRun bool) ([]MigrationStep, error) {
+	var steps []MigrationStep
+	err := d.withMigrationLock(ctx, func() error {
+		var err error
+		steps, err = d.migrateTo(ctx, version, dryRun)
+		return err
+	})
+	return steps, err
+}
+
+func (d *Database) migrateTo(ctx context.Context, version int, dryRun bool) ([]MigrationStep, error) {
+	current, err := d.Version(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	steps, err := d.schema.plan(current, version)
+	if err != nil {
+		return nil, err
+	}
+
+	if dryRun {
+		return steps, d.dryRun(ctx, steps)
+	}
+
+	for i, step := range steps {
+		err := d.runInTransaction(ctx, defaultTxOpts, func(tx *sql.Tx) error {
+			return d.applyStep(ctx, tx, step)
+		})
+		logrus.Infof("Performed database migration: %s: err: %v", step, err)
+		if err != nil {
+			return steps[:i], err
+		}
+	}
+
+	return steps, nil
+}
+
+// Rollback reverses the last applied upgrade.
+func (d *Database) Rollback(ctx context.Context, dryRun bool) (*MigrationStep, error) {
+	var step *MigrationStep
+	err := d.withMigrationLock(ctx, func() error {
+		var err error
+		step, err = d.rollback(ctx, dryRun)
+		return err
+	})
+	return step, err
+}
+
+func (d *Database) rollback(ctx context.Context, dryRun bool) (*MigrationStep, error) {
+	current, err := d.Version(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	chain, err := d.schema.chain()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, step := range chain {
+		if step.To == current {
+			steps, err := d.migrateTo(ctx, step.From, dryRun)
+			if len(steps) == 0 {
+				return nil, err
+			}
+			return &steps[0], err
+		}
+	}
+
+	return nil, fmt.Errorf("No upgrade leads to the current version %d", current)
+}
+
+func (d *Database) dryRun(ctx context.Context, steps []MigrationStep) error {
+	tx, err := d.db.BeginTx(ctx, defaultTxOpts)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// A database opened with Inspect may still need its metatable
+	// upgraded; that too is rolled back.
+	if err := d.upgradeMetatableInTx(ctx, tx); err != nil {
+		return err
+	}
+
+	for _, step := range steps {
+		if err := d.applyStep(ctx, tx, step); err != nil {
+			return fmt.Errorf("Dry run of migration %s failed: %v", step, err)
+		}
+		logrus.Infof("Dry run of database migration: %s: ok", step)
+	}
+
+	return nil
+}
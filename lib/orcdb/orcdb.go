@@ -0,0 +1,392 @@
+package orcdb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/steinarvk/sectiontrace"
+)
+
+type SchemaUpgrade struct {
+	Next int
+	Sql  []string
+
+	// Down, if set, reverses the upgrade.
+	Down []string
+}
+
+type Schema struct {
+	Name           string
+	Upgrades       map[int]SchemaUpgrade
+	CurrentVersion int
+}
+
+type sectionmaker struct {
+	mu       sync.Mutex
+	sections map[string]sectiontrace.Section
+}
+
+var sections = &sectionmaker{}
+
+func (s *sectionmaker) Get(dialect Dialect, name string) sectiontrace.Section {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.sections == nil {
+		s.sections = map[string]sectiontrace.Section{}
+	}
+
+	name = fmt.Sprintf("%sdb.%s", dialect.Name(), name)
+
+	sec, ok := s.sections[name]
+	if !ok {
+		sec = sectiontrace.New(name)
+		s.sections[name] = sec
+	}
+
+	return sec
+}
+
+// SerialPrimaryKey stands for the dialect's SerialPrimaryKey in the
+// statements of schema upgrades, e.g.
+//
+//	`CREATE TABLE events (id ` + orcdb.SerialPrimaryKey + `, body TEXT);`
+const SerialPrimaryKey = "{{SERIAL PRIMARY KEY}}"
+
+// SequentialUpgrades returns upgrades from version 0 to 1, 1 to 2, and so
+// on, each consisting of one or more statements.
+func SequentialUpgrades(upgrades ...[]string) map[int]SchemaUpgrade {
+	m := map[int]SchemaUpgrade{}
+	for i, upgrade := range upgrades {
+		m[i] = SchemaUpgrade{Sql: upgrade}
+	}
+	return m
+}
+
+type Database struct {
+	schema      *Schema
+	dialect     Dialect
+	db          *sql.DB
+	lockTimeout time.Duration
+	slowQueries *slowQueryLog
+}
+
+const (
+	schemaTableName = "___orcschema"
+)
+
+var (
+	defaultTxOpts = &sql.TxOptions{Isolation: sql.LevelSerializable}
+)
+
+type Queryer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+type openOptions struct {
+	skipMigrations bool
+	inspect        bool
+	lockTimeout    time.Duration
+	pool           PoolConfig
+
+	slowQueryThreshold time.Duration
+}
+
+type OpenOption func(*openOptions)
+
+// SkipMigrations opens the database as it is, without applying upgrades or
+// checking the version, e.g. to inspect or migrate it manually.
+func SkipMigrations() OpenOption {
+	return func(opts *openOptions) {
+		opts.skipMigrations = true
+	}
+}
+
+// Inspect opens the database without changing it, e.g. to show its status
+// or to dry-run a migration. The database must already have been created
+// with a schema; its metatable is not upgraded, upgrades are neither
+// applied nor checked, and startup maintenance such as VACUUM is skipped.
+func Inspect() OpenOption {
+	return func(opts *openOptions) {
+		opts.inspect = true
+	}
+}
+
+// Open opens the database with the driver of dialect, and brings it up to
+// date with the schema.
+func (s *Schema) Open(ctx context.Context, dialect Dialect, dataSourceName string, options ...OpenOption) (*Database, error) {
+	var db *sql.DB
+	if opener, ok := dialect.(connectorOpener); ok {
+		connector, err := opener.connector(dataSourceName)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to open database: %v", err)
+		}
+		db = sql.OpenDB(connector)
+	} else {
+		var err error
+		db, err = sql.Open(dialect.DriverName(), dataSourceName)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to open database: %v", err)
+		}
+	}
+
+	rv, err := s.OpenDB(ctx, dialect, db, options...)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return rv, nil
+}
+
+// OpenDB brings an already opened database up to date with the schema.
+func (s *Schema) OpenDB(ctx context.Context, dialect Dialect, db *sql.DB, options ...OpenOption) (*Database, error) {
+	opts := openOptions{
+		lockTimeout: DefaultMigrationLockTimeout,
+	}
+	for _, option := range options {
+		option(&opts)
+	}
+
+	if err := opts.pool.validate(dialect); err != nil {
+		return nil, err
+	}
+	opts.pool.apply(db)
+
+	rv := &Database{
+		schema:      s,
+		dialect:     dialect,
+		db:          db,
+		lockTimeout: opts.lockTimeout,
+	}
+
+	if opts.slowQueryThreshold > 0 {
+		rv.slowQueries = &slowQueryLog{threshold: opts.slowQueryThreshold}
+	}
+
+	if err := rv.startup(ctx, opts); err != nil {
+		return nil, fmt.Errorf("Unable to open database: %v", err)
+	}
+
+	return rv, nil
+}
+
+// SchemaName returns the name of the schema of the database.
+func (d *Database) SchemaName() string {
+	return d.schema.Name
+}
+
+// Dialect returns the dialect of the database.
+func (d *Database) Dialect() Dialect {
+	return d.dialect
+}
+
+// exec runs a query with named parameters outside any prepared statement.
+func (d *Database) exec(ctx context.Context, q Queryer, query string, argmap map[string]interface{}) error {
+	rewritten, paramNames := rewriteNamedParams(d.dialect, query)
+	args, err := fromArgmap(paramNames, argmap)
+	if err != nil {
+		return err
+	}
+	_, err = q.ExecContext(ctx, rewritten, args...)
+	return err
+}
+
+func (d *Database) createMetatable(ctx context.Context, q Queryer) error {
+	sqlquery1 := `CREATE TABLE ___orcschema (
+		name TEXT NOT NULL,
+		version INTEGER NOT NULL,
+		meta_version INTEGER NOT NULL
+	);
+	`
+	sqlquery2 := `INSERT INTO ___orcschema (name, version, meta_version) VALUES (:name, :version, :meta_version);`
+
+	initialVersion := int(0)
+	initialMetaVersion := int(1)
+
+	if _, err := q.ExecContext(ctx, sqlquery1); err != nil {
+		return fmt.Errorf("error creating metatable: %v", err)
+	}
+
+	if err := d.exec(ctx, q, sqlquery2, map[string]interface{}{
+		"name":         d.schema.Name,
+		"version":      initialVersion,
+		"meta_version": initialMetaVersion,
+	}); err != nil {
+		return fmt.Errorf("error creating metatable: %v", err)
+	}
+
+	return nil
+}
+
+func (d *Database) doesMetatableExist(ctx context.Context, q Queryer) (bool, error) {
+	rows, err := q.QueryContext(ctx, d.dialect.ListTablesQuery())
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	var sawMetatable bool
+	var sawOtherTables []string
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return false, err
+		}
+
+		if name != schemaTableName {
+			sawOtherTables = append(sawOtherTables, name)
+		} else {
+			sawMetatable = true
+		}
+	}
+
+	switch {
+	case sawMetatable:
+		return true, nil
+	case len(sawOtherTables) > 0:
+		return false, fmt.Errorf("Database expectation mismatch: did not see %q but saw other tables: %v", schemaTableName, sawOtherTables)
+	default:
+		return false, nil
+	}
+}
+
+func (d *Database) startup(ctx context.Context, opts openOptions) error {
+	if d.schema.Name == "" {
+		return fmt.Errorf("Invalid schema: missing name")
+	}
+
+	if err := d.dialect.OnOpen(ctx, d.db); err != nil {
+		return err
+	}
+
+	if opts.inspect {
+		_, err := d.checkSchemaName(ctx)
+		return err
+	}
+
+	// Instances starting at the same time take turns, so that one
+	// migrates and the others then find the database up to date.
+	if err := d.withMigrationLock(ctx, func() error {
+		return d.migrateOnStartup(ctx, opts)
+	}); err != nil {
+		return err
+	}
+
+	return d.dialect.AfterStartup(ctx, d.db)
+}
+
+func (d *Database) migrateOnStartup(ctx context.Context, opts openOptions) error {
+	exists, err := d.doesMetatableExist(ctx, d.db)
+	if err != nil {
+		return err
+	}
+
+	if !exists {
+		if err := d.runInTransaction(ctx, defaultTxOpts, func(tx *sql.Tx) error {
+			return d.createMetatable(ctx, tx)
+		}); err != nil {
+			return err
+		}
+	}
+
+	if err := d.upgradeMetatable(ctx); err != nil {
+		return err
+	}
+
+	version, err := d.checkSchemaName(ctx)
+	if err != nil {
+		return err
+	}
+
+	if opts.skipMigrations {
+		return nil
+	}
+
+	if err := d.verifyChecksums(ctx); err != nil {
+		return err
+	}
+
+	if _, err := d.migrateTo(ctx, LatestVersion, false); err != nil {
+		return err
+	}
+
+	if d.schema.CurrentVersion != 0 {
+		_, upgradedVersion, err := getSchemaVersion(ctx, d.db)
+		if err != nil {
+			return err
+		}
+		if upgradedVersion != d.schema.CurrentVersion {
+			return fmt.Errorf("Database version expectation failure (got %d => %d want %d)", version, upgradedVersion, d.schema.CurrentVersion)
+		}
+	}
+
+	return nil
+}
+
+// checkSchemaName checks that the database has been created with the
+// schema, and returns its version.
+func (d *Database) checkSchemaName(ctx context.Context) (int, error) {
+	exists, err := d.doesMetatableExist(ctx, d.db)
+	if err != nil {
+		return 0, err
+	}
+	if !exists {
+		return 0, fmt.Errorf("Database has no %q table; it has not been created", schemaTableName)
+	}
+
+	name, version, err := getSchemaVersion(ctx, d.db)
+	if err != nil {
+		return 0, err
+	}
+	if name != d.schema.Name {
+		return 0, fmt.Errorf("Database schema mismatch (got %q want %q)", name, d.schema.Name)
+	}
+	return version, nil
+}
+
+func (d *Database) runInTransaction(ctx context.Context, opts *sql.TxOptions, callback func(tx *sql.Tx) error) error {
+	tx, err := d.db.BeginTx(ctx, opts)
+	if err != nil {
+		return err
+	}
+
+	if err := callback(tx); err != nil {
+		rollbackErr := tx.Rollback()
+		if rollbackErr != nil {
+			return fmt.Errorf("%w, then rollback error: %v", err, rollbackErr)
+		}
+		return err
+	}
+
+	// A failed commit ends the transaction, so there is nothing to roll
+	// back, and the error is returned as is for the dialect to tell
+	// whether it is retryable.
+	return tx.Commit()
+}
+
+func getSchemaVersion(ctx context.Context, q Queryer) (string, int, error) {
+	sqlquery := `SELECT name, version FROM ___orcschema;`
+	var name string
+	var version int
+	if err := q.QueryRowContext(ctx, sqlquery).Scan(&name, &version); err != nil {
+		return "", 0, err
+	}
+
+	return name, version, nil
+}
+
+func (d *Database) Close() error {
+	var err error
+	if d.db != nil {
+		err = d.db.Close()
+	}
+	d.db = nil
+	return err
+}
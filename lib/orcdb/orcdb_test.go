@@ -0,0 +1,878 @@
+package orcdb
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+func TestRewriteNamedParams(t *testing.T) {
+	testcases := []struct {
+		query        string
+		wantSQLite   string
+		wantPostgres string
+		wantNames    []string
+	}{
+		{
+			query:        `SELECT * FROM t WHERE a = :a AND b = :b_2`,
+			wantSQLite:   `SELECT * FROM t WHERE a = ? AND b = ?`,
+			wantPostgres: `SELECT * FROM t WHERE a = $1 AND b = $2`,
+			wantNames:    []string{"a", "b_2"},
+		},
+		{
+			query:        `SELECT :x::text, ':y', ":z", x[1:2] -- :w` + "\n" + `/* :v */ FROM t WHERE a = :x`,
+			wantSQLite:   `SELECT ?::text, ':y', ":z", x[1:2] -- :w` + "\n" + `/* :v */ FROM t WHERE a = ?`,
+			wantPostgres: `SELECT $1::text, ':y', ":z", x[1:2] -- :w` + "\n" + `/* :v */ FROM t WHERE a = $2`,
+			wantNames:    []string{"x", "x"},
+		},
+		{
+			query:        `SELECT 'it''s :not' FROM t`,
+			wantSQLite:   `SELECT 'it''s :not' FROM t`,
+			wantPostgres: `SELECT 'it''s :not' FROM t`,
+		},
+		{
+			query:        `SELECT a$b FROM t WHERE a = @a AND b = $b AND c @> :c`,
+			wantSQLite:   `SELECT a$b FROM t WHERE a = ? AND b = ? AND c @> ?`,
+			wantPostgres: `SELECT a$b FROM t WHERE a = @a AND b = $b AND c @> $1`,
+			wantNames:    []string{"a", "b", "c"},
+		},
+	}
+
+	for _, tc := range testcases {
+		gotSQLite, names := rewriteNamedParams(SQLite, tc.query)
+		if gotSQLite != tc.wantSQLite || !reflect.DeepEqual(names, tc.wantNames) {
+			t.Errorf("rewriteNamedParams(SQLite, %q) = %q, %v; want %q, %v", tc.query, gotSQLite, names, tc.wantSQLite, tc.wantNames)
+		}
+		gotPostgres, _ := rewriteNamedParams(Postgres, tc.query)
+		if gotPostgres != tc.wantPostgres {
+			t.Errorf("rewriteNamedParams(Postgres, %q) = %q; want %q", tc.query, gotPostgres, tc.wantPostgres)
+		}
+	}
+}
+
+func TestRewriteDollarQuotes(t *testing.T) {
+	query := `CREATE FUNCTION f() RETURNS int AS $$ SELECT :x $$ LANGUAGE sql; SELECT $tag$ :y $ $tag$, a$b, :z`
+	want := `CREATE FUNCTION f() RETURNS int AS $$ SELECT :x $$ LANGUAGE sql; SELECT $tag$ :y $ $tag$, a$b, $1`
+
+	got, names := rewriteNamedParams(Postgres, query)
+	if got != want || !reflect.DeepEqual(names, []string{"z"}) {
+		t.Errorf("rewriteNamedParams(Postgres, %q) = %q, %v; want %q, [z]", query, got, names, want)
+	}
+}
+
+func TestSQLiteParamPrefixes(t *testing.T) {
+	ctx := context.Background()
+
+	schema := &Schema{Name: "test"}
+	db, err := schema.Open(ctx, SQLite, filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	query := db.PrepareQuery(&err, "prefixes", `SELECT :a AS a, @b AS b, $c AS c;`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type row struct{ A, B, C string }
+	var got row
+	if err := Transactor("prefixes")(ctx, db, func(ctx context.Context, tx *sql.Tx) error {
+		got, err = QueryOne[row](ctx, query, tx, map[string]interface{}{"a": "1", "b": "2", "c": "3"})
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if want := (row{"1", "2", "3"}); got != want {
+		t.Errorf("got %+v want %+v", got, want)
+	}
+}
+
+type testRow struct {
+	ID    int
+	Name  string
+	Score int `sql:"points"`
+}
+
+func TestSQLiteDatabase(t *testing.T) {
+	ctx := context.Background()
+
+	schema := &Schema{
+		Name: "test",
+		Upgrades: SequentialUpgrades(
+			[]string{`CREATE TABLE people (id INTEGER PRIMARY KEY, name TEXT NOT NULL);`},
+			[]string{`ALTER TABLE people ADD COLUMN points INTEGER NOT NULL DEFAULT 0;`},
+		),
+		CurrentVersion: 2,
+	}
+
+	filename := filepath.Join(t.TempDir(), "test.db")
+	db, err := schema.Open(ctx, SQLite, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var prepErr error
+	insert := db.PrepareInsertExec(&prepErr, "people", []string{"id", "name", "points"})
+	query := db.PrepareQuery(&prepErr, "by-points", `SELECT id, name, points FROM people WHERE points >= :min AND name != :excluded ORDER BY id;`)
+	if prepErr != nil {
+		t.Fatal(prepErr)
+	}
+
+	transact := Transactor("test")
+
+	if err := transact(ctx, db, func(ctx context.Context, tx *sql.Tx) error {
+		for i, name := range []string{"alice", "bob", "carol"} {
+			if err := insert.Exec(ctx, tx, map[string]interface{}{"id": i + 1, "name": name, "points": 10 * i}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []testRow
+	if err := transact(ctx, db, func(ctx context.Context, tx *sql.Tx) error {
+		var row testRow
+		return query.Query(ctx, tx, map[string]interface{}{"min": 5, "excluded": "carol"}, &row, func() (bool, error) {
+			got = append(got, row)
+			return true, nil
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	want := []testRow{{ID: 2, Name: "bob", Score: 10}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v want %v", got, want)
+	}
+
+	for _, argmap := range []map[string]interface{}{
+		{"min": 5},
+		{"min": 5, "excluded": "carol", "extra": 1},
+	} {
+		err := transact(ctx, db, func(ctx context.Context, tx *sql.Tx) error {
+			var row testRow
+			return query.Query(ctx, tx, argmap, &row, nil)
+		})
+		if _, ok := err.(QueryFailed); !ok {
+			t.Errorf("query with arguments %v: got error %v, want QueryFailed", argmap, err)
+		}
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopening runs no further upgrades.
+	db, err = schema.Open(ctx, SQLite, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+}
+
+func TestMigrations(t *testing.T) {
+	ctx := context.Background()
+
+	newSchema := func() *Schema {
+		return &Schema{
+			Name: "test",
+			Upgrades: map[int]SchemaUpgrade{
+				0: {
+					Sql:  []string{`CREATE TABLE a (id INTEGER PRIMARY KEY);`},
+					Down: []string{`DROP TABLE a;`},
+				},
+				1: {
+					Sql:  []string{`CREATE TABLE b (id INTEGER PRIMARY KEY);`},
+					Down: []string{`DROP TABLE b;`},
+				},
+				2: {
+					Next: 5,
+					Sql:  []string{`CREATE TABLE c (id INTEGER PRIMARY KEY);`},
+				},
+			},
+		}
+	}
+
+	filename := filepath.Join(t.TempDir(), "test.db")
+	db, err := newSchema().Open(ctx, SQLite, filename, SkipMigrations())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	versionIs := func(want int) {
+		t.Helper()
+		got, err := db.Version(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("version = %d want %d", got, want)
+		}
+	}
+
+	versionIs(0)
+
+	steps, err := db.MigrateTo(ctx, LatestVersion, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(steps) != 3 || steps[2].To != 5 {
+		t.Errorf("dry run steps = %v", steps)
+	}
+	versionIs(0)
+
+	if _, err := db.MigrateTo(ctx, 2, false); err != nil {
+		t.Fatal(err)
+	}
+	versionIs(2)
+
+	if _, err := db.MigrateTo(ctx, 3, false); err == nil {
+		t.Errorf("migrated to version 3, which no upgrade leads to")
+	}
+
+	step, err := db.Rollback(ctx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !step.Down || step.From != 2 || step.To != 1 {
+		t.Errorf("rollback step = %v", step)
+	}
+	versionIs(2)
+
+	if _, err := db.Rollback(ctx, false); err != nil {
+		t.Fatal(err)
+	}
+	versionIs(1)
+
+	if _, err := db.MigrateTo(ctx, LatestVersion, false); err != nil {
+		t.Fatal(err)
+	}
+	versionIs(5)
+
+	if _, err := db.Rollback(ctx, false); err == nil {
+		t.Errorf("rolled back upgrade without down migration")
+	}
+
+	status, err := db.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Version != 5 || status.LatestVersion != 5 || len(status.Upgrades) != 3 {
+		t.Errorf("unexpected status: %+v", status)
+	}
+	for _, upgrade := range status.Upgrades {
+		if !upgrade.Applied || upgrade.AppliedAt == "" || upgrade.Modified {
+			t.Errorf("unexpected upgrade status: %+v", upgrade)
+		}
+	}
+	db.Close()
+
+	edited := newSchema()
+	edited.Upgrades[1] = SchemaUpgrade{Sql: []string{`CREATE TABLE b (id INTEGER PRIMARY KEY, x TEXT);`}}
+	if _, err := edited.Open(ctx, SQLite, filename); err == nil {
+		t.Errorf("opened database with an edited upgrade")
+	}
+
+	db, err = newSchema().Open(ctx, SQLite, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+}
+
+func TestMultilineUpgrade(t *testing.T) {
+	ctx := context.Background()
+
+	newSchema := func(column string) *Schema {
+		return &Schema{
+			Name: "test",
+			Upgrades: SequentialUpgrades([]string{`
+				CREATE TABLE a (
+					id INTEGER PRIMARY KEY,
+					` + column + ` TEXT
+				);`,
+			}),
+		}
+	}
+
+	filename := filepath.Join(t.TempDir(), "test.db")
+	for i := 0; i < 2; i++ {
+		db, err := newSchema("x").Open(ctx, SQLite, filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.Close()
+	}
+
+	if _, err := newSchema("y").Open(ctx, SQLite, filename); err == nil {
+		t.Errorf("opened database with an edited multi-line upgrade")
+	}
+}
+
+func TestSerialPrimaryKey(t *testing.T) {
+	ctx := context.Background()
+
+	schema := &Schema{
+		Name: "test",
+		Upgrades: SequentialUpgrades([]string{
+			`CREATE TABLE a (id ` + SerialPrimaryKey + `, x TEXT NOT NULL);`,
+		}),
+	}
+	db, err := schema.Open(ctx, SQLite, filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	insert := func() int64 {
+		var id int64
+		if err := db.db.QueryRowContext(ctx, `INSERT INTO a (x) VALUES ('x') RETURNING id;`).Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+
+	if first, second := insert(), insert(); first != 1 || second != 2 {
+		t.Fatalf("generated keys %d, %d; want 1, 2", first, second)
+	}
+	if err := db.exec(ctx, db.db, `DELETE FROM a WHERE id = :id;`, map[string]interface{}{"id": 2}); err != nil {
+		t.Fatal(err)
+	}
+	if id := insert(); id != 3 {
+		t.Errorf("generated key %d after deleting the last row; want 3", id)
+	}
+}
+
+func TestInspect(t *testing.T) {
+	ctx := context.Background()
+
+	upgrades := [][]string{
+		{`CREATE TABLE a (id INTEGER PRIMARY KEY);`},
+		{`CREATE TABLE b (id INTEGER PRIMARY KEY);`},
+	}
+	v1 := &Schema{Name: "test", Upgrades: SequentialUpgrades(upgrades[:1]...)}
+	v2 := &Schema{Name: "test", Upgrades: SequentialUpgrades(upgrades...)}
+
+	dir := t.TempDir()
+	if _, err := v2.Open(ctx, SQLite, filepath.Join(dir, "missing.db"), Inspect()); err == nil {
+		t.Errorf("inspected a database without a metatable")
+	}
+
+	filename := filepath.Join(dir, "test.db")
+	db, err := v1.Open(ctx, SQLite, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	before, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = v2.Open(ctx, SQLite, filename, Inspect())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, err := db.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Version != 1 || status.LatestVersion != 2 {
+		t.Errorf("status = version %d (latest %d) want 1 (latest 2)", status.Version, status.LatestVersion)
+	}
+
+	steps, err := db.MigrateTo(ctx, LatestVersion, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(steps) != 1 {
+		t.Errorf("dry run took %d steps want 1", len(steps))
+	}
+	db.Close()
+
+	after, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Errorf("inspecting the database changed it")
+	}
+}
+
+func TestMigrationLock(t *testing.T) {
+	ctx := context.Background()
+
+	schema := &Schema{
+		Name:     "test",
+		Upgrades: SequentialUpgrades([]string{`CREATE TABLE a (id INTEGER PRIMARY KEY);`}),
+	}
+
+	filename := filepath.Join(t.TempDir(), "test.db")
+	db, err := schema.Open(ctx, SQLite, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	unlock, err := SQLite.LockMigrations(ctx, db.db, schema.Name, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := schema.Open(ctx, SQLite, filename, MigrationLockTimeout(300*time.Millisecond)); err == nil {
+		t.Errorf("opened database while another instance held the migration lock")
+	}
+
+	opened := make(chan error)
+	go func() {
+		other, err := schema.Open(ctx, SQLite, filename, MigrationLockTimeout(10*time.Second))
+		if err == nil {
+			other.Close()
+		}
+		opened <- err
+	}()
+
+	time.Sleep(300 * time.Millisecond)
+	if err := unlock(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-opened; err != nil {
+		t.Errorf("opening database after the migration lock was released: %v", err)
+	}
+}
+
+func TestTransactorRetries(t *testing.T) {
+	ctx := context.Background()
+
+	schema := &Schema{Name: "test"}
+	db, err := schema.Open(ctx, SQLite, filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	busy := QueryFailed{"test", sqlite3.Error{Code: sqlite3.ErrBusy}}
+
+	failingTimes := func(failures int, failure error) (func(context.Context, *sql.Tx) error, *int) {
+		calls := 0
+		return func(ctx context.Context, tx *sql.Tx) error {
+			calls++
+			if calls <= failures {
+				return failure
+			}
+			return nil
+		}, &calls
+	}
+
+	callback, calls := failingTimes(2, busy)
+	if err := Transactor("retried")(ctx, db, callback); err != nil {
+		t.Errorf("transaction failed despite retries: %v", err)
+	}
+	if *calls != 3 {
+		t.Errorf("callback ran %d times, want 3", *calls)
+	}
+
+	callback, calls = failingTimes(5, busy)
+	if err := Transactor("exhausted", MaxAttempts(2))(ctx, db, callback); err == nil {
+		t.Errorf("transaction succeeded after exhausting attempts")
+	}
+	if *calls != 2 {
+		t.Errorf("callback ran %d times, want 2", *calls)
+	}
+
+	callback, calls = failingTimes(1, fmt.Errorf("not retryable"))
+	if err := Transactor("failed")(ctx, db, callback); err == nil {
+		t.Errorf("transaction succeeded after non-retryable error")
+	}
+	if *calls != 1 {
+		t.Errorf("callback ran %d times, want 1", *calls)
+	}
+
+	if err := Transactor("readonly", ReadOnly(), Isolation(sql.LevelDefault))(ctx, db, func(ctx context.Context, tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `SELECT 1;`)
+		return err
+	}); err != nil {
+		t.Errorf("read-only transaction failed: %v", err)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for _, tc := range []struct {
+		failedAttempts int
+		max            time.Duration
+	}{
+		{1, 10 * time.Millisecond},
+		{2, 20 * time.Millisecond},
+		{3, 40 * time.Millisecond},
+		{10, time.Second},
+		{100, time.Second},
+	} {
+		for i := 0; i < 100; i++ {
+			if got := Backoff(tc.failedAttempts, 10*time.Millisecond, time.Second); got < tc.max/2 || got > tc.max {
+				t.Fatalf("Backoff(%d) = %v want between %v and %v", tc.failedAttempts, got, tc.max/2, tc.max)
+			}
+		}
+	}
+
+	if got := Backoff(1, 0, 0); got != 0 {
+		t.Errorf("Backoff without delays = %v want 0", got)
+	}
+}
+
+func TestTransactorRetriesCommitConflict(t *testing.T) {
+	ctx := context.Background()
+
+	schema := &Schema{
+		Name:     "test",
+		Upgrades: SequentialUpgrades([]string{`CREATE TABLE a (id INTEGER PRIMARY KEY);`}),
+	}
+	dialect := SQLiteWith(SQLiteOptions{BusyTimeout: time.Millisecond})
+	filename := filepath.Join(t.TempDir(), "test.db")
+
+	db, err := schema.Open(ctx, dialect, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	other, err := schema.Open(ctx, dialect, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	var reader *sql.Tx
+	calls := 0
+	if err := Transactor("conflict")(ctx, db, func(ctx context.Context, tx *sql.Tx) error {
+		calls++
+		if reader != nil {
+			if err := reader.Rollback(); err != nil {
+				return err
+			}
+			reader = nil
+		}
+
+		if _, err := tx.ExecContext(ctx, `INSERT INTO a (id) VALUES (1);`); err != nil {
+			return err
+		}
+
+		if calls == 1 {
+			// A read transaction on another connection keeps the commit
+			// from taking its exclusive lock.
+			var err error
+			reader, err = other.db.BeginTx(ctx, nil)
+			if err != nil {
+				return err
+			}
+			var count int
+			if err := reader.QueryRowContext(ctx, `SELECT COUNT(*) FROM a;`).Scan(&count); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("transaction failed despite retries: %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("callback ran %d times, want 2", calls)
+	}
+
+	var count int
+	if err := db.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM a;`).Scan(&count); err != nil || count != 1 {
+		t.Errorf("count = %d (%v) want 1", count, err)
+	}
+}
+
+type typedRow struct {
+	ID       int
+	Nickname *string
+	Tags     []string `sql:"tags,json"`
+	Cached   string   `sql:"-"`
+}
+
+func TestTypedQueriesAndBatchInsert(t *testing.T) {
+	ctx := context.Background()
+
+	schema := &Schema{
+		Name: "test",
+		Upgrades: SequentialUpgrades(
+			[]string{`CREATE TABLE things (id INTEGER PRIMARY KEY, nickname TEXT, tags TEXT);`},
+		),
+	}
+	db, err := schema.Open(ctx, SQLite, filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var prepErr error
+	batch := db.PrepareBatchInsert(&prepErr, "things", []string{"id", "nickname", "tags"})
+	all := db.PrepareQuery(&prepErr, "all", `SELECT id, nickname, tags FROM things ORDER BY id;`)
+	byID := db.PrepareQuery(&prepErr, "by-id", `SELECT id, nickname, tags FROM things WHERE id = :id;`)
+	if prepErr != nil {
+		t.Fatal(prepErr)
+	}
+
+	const numRows = 1000
+	var rows []map[string]interface{}
+	for i := 1; i <= numRows; i++ {
+		var nickname interface{}
+		if i%2 == 0 {
+			nickname = fmt.Sprintf("thing%d", i)
+		}
+		rows = append(rows, map[string]interface{}{
+			"id":       i,
+			"nickname": nickname,
+			"tags":     JSON([]string{"a", fmt.Sprint(i)}),
+		})
+	}
+
+	transact := Transactor("test")
+
+	if err := transact(ctx, db, func(ctx context.Context, tx *sql.Tx) error {
+		return batch.Insert(ctx, tx, rows)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []typedRow
+	if err := transact(ctx, db, func(ctx context.Context, tx *sql.Tx) error {
+		var err error
+		got, err = QueryAll[typedRow](ctx, all, tx, nil)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != numRows {
+		t.Fatalf("got %d rows want %d", len(got), numRows)
+	}
+	if got[0].Nickname != nil || got[1].Nickname == nil || *got[1].Nickname != "thing2" {
+		t.Errorf("unexpected nicknames: %v, %v", got[0].Nickname, got[1].Nickname)
+	}
+	if !reflect.DeepEqual(got[9].Tags, []string{"a", "10"}) {
+		t.Errorf("unexpected tags: %v", got[9].Tags)
+	}
+
+	if err := transact(ctx, db, func(ctx context.Context, tx *sql.Tx) error {
+		_, err := QueryOne[typedRow](ctx, byID, tx, map[string]interface{}{"id": numRows + 1})
+		return err
+	}); err != sql.ErrNoRows {
+		t.Errorf("querying missing row: got %v want sql.ErrNoRows", err)
+	}
+
+	if err := transact(ctx, db, func(ctx context.Context, tx *sql.Tx) error {
+		return batch.Insert(ctx, tx, []map[string]interface{}{{"id": numRows + 1}})
+	}); err == nil {
+		t.Errorf("inserted row with missing fields")
+	}
+}
+
+func TestPoolConfig(t *testing.T) {
+	ctx := context.Background()
+
+	schema := &Schema{Name: "test"}
+	db, err := schema.Open(ctx, SQLite, filepath.Join(t.TempDir(), "test.db"), Pool(PoolConfig{MaxOpenConns: 3, MaxIdleConns: 2}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Ping(ctx); err != nil {
+		t.Errorf("ping failed: %v", err)
+	}
+	if got := db.Stats().MaxOpenConnections; got != 3 {
+		t.Errorf("max open connections = %d want 3", got)
+	}
+
+	for _, config := range []PoolConfig{
+		{MaxOpenConns: 1, MaxIdleConns: 2},
+		{MaxIdleConns: -1},
+	} {
+		if err := config.validate(SQLite); err == nil {
+			t.Errorf("accepted invalid pool config %+v", config)
+		}
+	}
+	if err := (PoolConfig{MaxOpenConns: 1}).validate(Postgres); err == nil {
+		t.Errorf("accepted a single Postgres connection, which migrations deadlock on")
+	}
+}
+
+func TestSQLiteBackupAndRestore(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	schema := &Schema{
+		Name:     "test",
+		Upgrades: SequentialUpgrades([]string{`CREATE TABLE a (id INTEGER PRIMARY KEY);`}),
+	}
+	dialect := SQLiteWith(SQLiteOptions{JournalMode: "wal", BusyTimeout: time.Second, Synchronous: "normal", SkipVacuum: true})
+
+	filename := filepath.Join(dir, "test.db")
+	db, err := schema.Open(ctx, dialect, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var journalMode string
+	if err := db.db.QueryRowContext(ctx, `PRAGMA journal_mode;`).Scan(&journalMode); err != nil || journalMode != "wal" {
+		t.Errorf("journal mode = %q (%v) want wal", journalMode, err)
+	}
+
+	count := func(q Queryer) int {
+		t.Helper()
+		var n int
+		if err := q.QueryRowContext(ctx, `SELECT COUNT(*) FROM a;`).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	if _, err := db.db.ExecContext(ctx, `INSERT INTO a (id) VALUES (1), (2);`); err != nil {
+		t.Fatal(err)
+	}
+
+	backupFilename := filepath.Join(dir, "backup.db")
+	if err := db.Backup(ctx, backupFilename); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.db.ExecContext(ctx, `INSERT INTO a (id) VALUES (3);`); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := schema.RestoreSQLite(ctx, backupFilename, filename, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if got := count(db.db); got != 2 {
+		t.Errorf("restored database has %d rows want 2", got)
+	}
+
+	other := &Schema{Name: "other"}
+	if err := other.RestoreSQLite(ctx, backupFilename, filepath.Join(dir, "other.db"), time.Second); err == nil {
+		t.Errorf("restored backup of a different schema")
+	}
+
+	// An encrypted backup is restored only with the key.
+	invert := func(data []byte) ([]byte, error) {
+		rv := make([]byte, len(data))
+		for i, b := range data {
+			rv[i] = ^b
+		}
+		return rv, nil
+	}
+	plaintext, err := ioutil.ReadFile(backupFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, _ := invert(plaintext)
+	encryptedFilename := filepath.Join(dir, "backup.db.pgp")
+	if err := ioutil.WriteFile(encryptedFilename, ciphertext, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.db.ExecContext(ctx, `INSERT INTO a (id) VALUES (3);`); err != nil {
+		t.Fatal(err)
+	}
+	if err := schema.RestoreSQLite(ctx, encryptedFilename, filename, time.Second); err == nil {
+		t.Errorf("restored encrypted backup without decrypting it")
+	}
+	if err := schema.RestoreSQLite(ctx, encryptedFilename, filename, time.Second, DecryptWith(invert)); err != nil {
+		t.Fatal(err)
+	}
+	if got := count(db.db); got != 2 {
+		t.Errorf("database restored from encrypted backup has %d rows want 2", got)
+	}
+
+	if _, err := schema.Open(ctx, SQLiteWith(SQLiteOptions{JournalMode: "sideways"}), filepath.Join(dir, "invalid.db")); err == nil {
+		t.Errorf("opened database with invalid journal mode")
+	}
+}
+
+func TestSlowQueries(t *testing.T) {
+	ctx := context.Background()
+
+	schema := &Schema{
+		Name:     "test",
+		Upgrades: SequentialUpgrades([]string{`CREATE TABLE people (id INTEGER PRIMARY KEY, name TEXT NOT NULL);`}),
+	}
+	db, err := schema.Open(ctx, SQLite, filepath.Join(t.TempDir(), "test.db"), SlowQueryThreshold(time.Nanosecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var prepErr error
+	insert := db.PrepareInsertExec(&prepErr, "people", []string{"id", "name"})
+	query := db.PrepareQuery(&prepErr, "by-name", `SELECT id, name FROM people WHERE name = :name;`)
+	if prepErr != nil {
+		t.Fatal(prepErr)
+	}
+
+	if err := Transactor("test")(ctx, db, func(ctx context.Context, tx *sql.Tx) error {
+		if err := insert.Exec(ctx, tx, map[string]interface{}{"id": 1, "name": "alice"}); err != nil {
+			return err
+		}
+		type person struct {
+			ID   int
+			Name string
+		}
+		_, err := QueryAll[person](ctx, query, tx, map[string]interface{}{"name": "secret"})
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Plans are captured in the background.
+	slow := map[string]SlowQuery{}
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		for _, entry := range db.SlowQueries() {
+			slow[entry.QueryName] = entry
+		}
+		if !slow["by-name"].PlanAt.IsZero() && !slow["insert-people-(id,name)"].PlanAt.IsZero() {
+			break
+		}
+	}
+
+	entry, ok := slow["by-name"]
+	if !ok || len(slow) != 2 {
+		t.Fatalf("slow queries = %v", slow)
+	}
+	if entry.Count != 1 || entry.LastArgs != "name=<string, 6 bytes>" {
+		t.Errorf("unexpected slow query: %+v", entry)
+	}
+	if !strings.Contains(entry.Plan, "people") || entry.PlanErr != "" {
+		t.Errorf("unexpected plan %q (error %q)", entry.Plan, entry.PlanErr)
+	}
+}
+
+func TestIsExplainable(t *testing.T) {
+	for query, want := range map[string]bool{
+		`SELECT 1;`:                       true,
+		"\n\tselect * FROM a;":            true,
+		`INSERT INTO a (id) VALUES ($1);`: true,
+		`UPDATE a SET id = $1;`:           true,
+		`DELETE FROM a;`:                  true,
+		`CREATE TABLE a (id INTEGER);`:    false,
+		`PRAGMA foreign_keys = ON;`:       false,
+		`EXPLAIN SELECT 1;`:               false,
+		``:                                false,
+	} {
+		if got := isExplainable(query); got != want {
+			t.Errorf("isExplainable(%q) = %v want %v", query, got, want)
+		}
+	}
+}
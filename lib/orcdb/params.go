@@ -0,0 +1,155 @@
+package orcdb
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+func isParamStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isParamChar(c byte) bool {
+	return isParamStart(c) || (c >= '0' && c <= '9')
+}
+
+// dollarQuoteDelimiter returns the delimiter ("$$" or "$tag$") of the
+// Postgres dollar-quoted string starting at i, or "" if there is none.
+func dollarQuoteDelimiter(query string, i int) string {
+	if query[i] != '$' || (i > 0 && isParamChar(query[i-1])) {
+		return ""
+	}
+	end := i + 1
+	if end < len(query) && isParamStart(query[end]) {
+		for end < len(query) && isParamChar(query[end]) {
+			end++
+		}
+	}
+	if end >= len(query) || query[end] != '$' {
+		return ""
+	}
+	return query[i : end+1]
+}
+
+// skipQuoted returns the index just past the quoted string, identifier or
+// comment starting at i, or i if there is none. Dollar-quoted strings are
+// only recognised if dollarQuotes is set.
+func skipQuoted(query string, i int, dollarQuotes bool) int {
+	if dollarQuotes {
+		if delimiter := dollarQuoteDelimiter(query, i); delimiter != "" {
+			end := strings.Index(query[i+len(delimiter):], delimiter)
+			if end < 0 {
+				return len(query)
+			}
+			return i + len(delimiter) + end + len(delimiter)
+		}
+	}
+
+	switch {
+	case query[i] == '\'' || query[i] == '"':
+		// Doubled quotes escape themselves, which this handles by
+		// treating them as two adjacent quoted strings.
+		end := strings.IndexByte(query[i+1:], query[i])
+		if end < 0 {
+			return len(query)
+		}
+		return i + 1 + end + 1
+
+	case strings.HasPrefix(query[i:], "--"):
+		end := strings.IndexByte(query[i:], '\n')
+		if end < 0 {
+			return len(query)
+		}
+		return i + end + 1
+
+	case strings.HasPrefix(query[i:], "/*"):
+		end := strings.Index(query[i+2:], "*/")
+		if end < 0 {
+			return len(query)
+		}
+		return i + 2 + end + 2
+	}
+	return i
+}
+
+// rewriteNamedParams replaces the named parameters (":name", or for
+// SQLite also "@name" and "$name") of query with the positional
+// placeholders of dialect. It returns the rewritten query and the name of
+// the parameter at each position. Postgres casts ("::type"), string
+// literals, dollar-quoted strings (unless "$" introduces parameters),
+// quoted identifiers and comments are left alone.
+func rewriteNamedParams(dialect Dialect, query string) (string, []string) {
+	var buf strings.Builder
+	var names []string
+	prefixes := dialect.ParamPrefixes()
+	dollarQuotes := !strings.Contains(prefixes, "$")
+
+	for i := 0; i < len(query); {
+		if next := skipQuoted(query, i, dollarQuotes); next != i {
+			buf.WriteString(query[i:next])
+			i = next
+			continue
+		}
+
+		c := query[i]
+		if strings.IndexByte(prefixes, c) < 0 {
+			buf.WriteByte(c)
+			i++
+			continue
+		}
+
+		if strings.HasPrefix(query[i:], "::") {
+			buf.WriteString("::")
+			i += 2
+			continue
+		}
+
+		// "@" and "$" may also appear within identifiers.
+		inIdentifier := c != ':' && i > 0 && isParamChar(query[i-1])
+		if inIdentifier || i+1 >= len(query) || !isParamStart(query[i+1]) {
+			buf.WriteByte(c)
+			i++
+			continue
+		}
+
+		end := i + 1
+		for end < len(query) && isParamChar(query[end]) {
+			end++
+		}
+		names = append(names, query[i+1:end])
+		buf.WriteString(dialect.Placeholder(len(names)))
+		i = end
+	}
+
+	return buf.String(), names
+}
+
+// fromArgmap orders the arguments in argmap by paramNames. Every
+// parameter must be given, and every argument must be used.
+func fromArgmap(paramNames []string, argmap map[string]interface{}) ([]interface{}, error) {
+	args := make([]interface{}, len(paramNames))
+	used := map[string]bool{}
+
+	for i, name := range paramNames {
+		value, ok := argmap[name]
+		if !ok {
+			return nil, fmt.Errorf("missing parameter %q", name)
+		}
+		args[i] = value
+		used[name] = true
+	}
+
+	if len(used) != len(argmap) {
+		var unused []string
+		for k := range argmap {
+			if !used[k] {
+				unused = append(unused, k)
+			}
+		}
+		sort.Strings(unused)
+		return nil, fmt.Errorf("want %d parameters got %d (unused: %v)", len(used), len(argmap), unused)
+	}
+
+	return args, nil
+}
@@ -0,0 +1,65 @@
+package orcdb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// PoolConfig limits the connections kept by the database. Zero values
+// leave the defaults of database/sql in place.
+type PoolConfig struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+}
+
+func (p PoolConfig) validate(dialect Dialect) error {
+	if p.MaxOpenConns < 0 || p.MaxIdleConns < 0 {
+		return fmt.Errorf("Invalid pool config: negative connection limit")
+	}
+	if p.MaxOpenConns > 0 && p.MaxIdleConns > p.MaxOpenConns {
+		return fmt.Errorf("Invalid pool config: max idle connections (%d) exceeds max open connections (%d)", p.MaxIdleConns, p.MaxOpenConns)
+	}
+	// The Postgres migration lock is held on a connection of its own while
+	// migrations run on another.
+	if dialect == Postgres && p.MaxOpenConns == 1 {
+		return fmt.Errorf("Invalid pool config: %s needs at least 2 open connections", dialect.Name())
+	}
+	return nil
+}
+
+func (p PoolConfig) apply(db *sql.DB) {
+	if p.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(p.MaxOpenConns)
+	}
+	if p.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(p.MaxIdleConns)
+	}
+	if p.ConnMaxLifetime > 0 {
+		db.SetConnMaxLifetime(p.ConnMaxLifetime)
+	}
+	if p.ConnMaxIdleTime > 0 {
+		db.SetConnMaxIdleTime(p.ConnMaxIdleTime)
+	}
+}
+
+// Pool configures the connection pool before the database is brought up
+// to date.
+func Pool(config PoolConfig) OpenOption {
+	return func(opts *openOptions) {
+		opts.pool = config
+	}
+}
+
+// Stats returns the state of the connection pool.
+func (d *Database) Stats() sql.DBStats {
+	return d.db.Stats()
+}
+
+// Ping checks that the database can be reached.
+func (d *Database) Ping(ctx context.Context) error {
+	return d.db.PingContext(ctx)
+}
@@ -0,0 +1,342 @@
+package orcdb
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/steinarvk/sectiontrace"
+)
+
+type QueryFailed struct {
+	QueryName string
+	Err       error
+}
+
+func (q QueryFailed) Error() string {
+	return fmt.Sprintf("query %q failed: %v", q.QueryName, q.Err)
+}
+
+func (q QueryFailed) Unwrap() error {
+	return q.Err
+}
+
+// prepare prepares querySQL. Without paramNames, the query uses named
+// parameters (":name"), which are rewritten for the dialect. With
+// paramNames, the query is used as is, and paramNames name its positional
+// parameters in order.
+func (d *Database) prepare(queryName, querySQL string, paramNames []string) (*sql.Stmt, string, []string, error) {
+	if len(paramNames) == 0 {
+		querySQL, paramNames = rewriteNamedParams(d.dialect, querySQL)
+	}
+
+	stmt, err := d.db.Prepare(querySQL)
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("Failed to prepare query %q: %v"+`
+Query was: """
+%s
+"""`, queryName, err, querySQL)
+	}
+
+	return stmt, querySQL, paramNames, nil
+}
+
+type PreparedExec struct {
+	db         *Database
+	section    sectiontrace.Section
+	stmt       *sql.Stmt
+	queryName  string
+	querySQL   string
+	paramNames []string
+}
+
+func (p *PreparedExec) ExecWithResult(ctx context.Context, tx *sql.Tx, argmap map[string]interface{}) (sql.Result, error) {
+	var rv sql.Result
+	err := p.section.Do(ctx, func(ctx context.Context) error {
+		args, err := fromArgmap(p.paramNames, argmap)
+		if err != nil {
+			return QueryFailed{p.queryName, err}
+		}
+
+		t0 := time.Now()
+		result, err := tx.Stmt(p.stmt).ExecContext(ctx, args...)
+		p.db.observe(p.queryName, p.querySQL, p.paramNames, args, time.Since(t0), err)
+		if err != nil {
+			return QueryFailed{p.queryName, err}
+		}
+		rv = result
+		return nil
+	})
+	return rv, err
+}
+
+func (p *PreparedExec) Exec(ctx context.Context, tx *sql.Tx, argmap map[string]interface{}) error {
+	_, err := p.ExecWithResult(ctx, tx, argmap)
+	return err
+}
+
+// insertSQL returns an insert of rows rows into tableName, with positional
+// parameters for fieldNames in each row.
+func insertSQL(dialect Dialect, tableName string, fieldNames []string, rows int) string {
+	sqlText := "INSERT INTO " + tableName + "("
+	sqlText += strings.Join(fieldNames, ",")
+	sqlText += ") VALUES "
+	position := 0
+	for row := 0; row < rows; row++ {
+		if row > 0 {
+			sqlText += ","
+		}
+		sqlText += "("
+		for i := range fieldNames {
+			if i > 0 {
+				sqlText += ","
+			}
+			position++
+			sqlText += dialect.Placeholder(position)
+		}
+		sqlText += ")"
+	}
+	sqlText += ";"
+	return sqlText
+}
+
+// PrepareInsertExec prepares an insert of one row into tableName, taking
+// a parameter for each of fieldNames.
+func (d *Database) PrepareInsertExec(outErr *error, tableName string, fieldNames []string) *PreparedExec {
+	queryName := fmt.Sprintf("insert-%s-(%s)", tableName, strings.Join(fieldNames, ","))
+	return d.PrepareExec(outErr, queryName, insertSQL(d.dialect, tableName, fieldNames, 1), fieldNames...)
+}
+
+// PrepareExec prepares a statement that returns no rows. See prepare for
+// how parameters are named.
+func (d *Database) PrepareExec(outErr *error, queryName, querySQL string, paramNames ...string) *PreparedExec {
+	if *outErr != nil {
+		return nil
+	}
+
+	stmt, querySQL, paramNames, err := d.prepare(queryName, querySQL, paramNames)
+	if err != nil {
+		*outErr = err
+		return nil
+	}
+
+	return &PreparedExec{
+		db:         d,
+		section:    sections.Get(d.dialect, queryName),
+		queryName:  queryName,
+		querySQL:   querySQL,
+		paramNames: paramNames,
+		stmt:       stmt,
+	}
+}
+
+type PreparedQuery struct {
+	db         *Database
+	section    sectiontrace.Section
+	stmt       *sql.Stmt
+	queryName  string
+	querySQL   string
+	paramNames []string
+}
+
+type fieldTag struct {
+	column string
+	skip   bool
+	json   bool
+}
+
+// parseFieldTag parses the sql tag of a struct field: "-" to skip the
+// field, or a column name optionally followed by ",json" for JSON columns.
+func parseFieldTag(field reflect.StructField) fieldTag {
+	tag := field.Tag.Get("sql")
+	if tag == "-" || field.PkgPath != "" {
+		return fieldTag{skip: true}
+	}
+
+	parts := strings.Split(tag, ",")
+	rv := fieldTag{column: parts[0]}
+	for _, option := range parts[1:] {
+		if option == "json" {
+			rv.json = true
+		}
+	}
+	return rv
+}
+
+func normalizeColumnName(name string) string {
+	return strings.ToLower(strings.Replace(name, "_", "", -1))
+}
+
+// jsonColumn scans a JSON column into the value pointed to by dest.
+type jsonColumn struct {
+	dest interface{}
+}
+
+func (j jsonColumn) Scan(src interface{}) error {
+	// Start from zero, so that slices and maps from a previous row are
+	// not reused.
+	value := reflect.ValueOf(j.dest).Elem()
+	value.Set(reflect.Zero(value.Type()))
+
+	var data []byte
+	switch src := src.(type) {
+	case nil:
+		return nil
+	case []byte:
+		data = src
+	case string:
+		data = []byte(src)
+	default:
+		return fmt.Errorf("Unable to scan %T as JSON", src)
+	}
+	return json.Unmarshal(data, j.dest)
+}
+
+// makeQueryDest maps the columns to the fields of the struct pointed to by
+// dest. Fields match columns by name, ignoring case and underscores, or by
+// the column name in their sql tag. Fields tagged sql:"-" are ignored.
+// Nullable columns may be scanned into pointer fields or sql.Null* types.
+func makeQueryDest(names []string, dest interface{}) ([]interface{}, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	nameMap := map[string]int{}
+	for i, name := range names {
+		nameMap[normalizeColumnName(name)] = i
+	}
+
+	destptrs := make([]interface{}, len(names))
+
+	structValue := reflect.ValueOf(dest).Elem()
+	structType := structValue.Type()
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		tag := parseFieldTag(field)
+		if tag.skip {
+			continue
+		}
+		column := field.Name
+		if tag.column != "" {
+			column = tag.column
+		}
+		index, ok := nameMap[normalizeColumnName(column)]
+		if !ok {
+			return nil, fmt.Errorf("Struct field %q does not match any field (%v)", field.Name, names)
+		}
+		if index < 0 || index >= len(destptrs) {
+			return nil, fmt.Errorf("Struct field %q at index %d out of range (%d)", field.Name, i, len(destptrs))
+		}
+		if destptrs[index] != nil {
+			return nil, fmt.Errorf("Struct field %q is duplicate", field.Name)
+		}
+		ptr := structValue.Field(i).Addr().Interface()
+		if tag.json {
+			ptr = jsonColumn{ptr}
+		}
+		destptrs[index] = ptr
+	}
+
+	for i, ptr := range destptrs {
+		if ptr == nil {
+			return nil, fmt.Errorf("Column %q does not match any struct field", names[i])
+		}
+	}
+
+	return destptrs, nil
+}
+
+// Query runs the query, scanning each row into the struct pointed to by
+// dest and then calling onrow (if not nil) until it returns false.
+func (p *PreparedQuery) Query(ctx context.Context, tx *sql.Tx, argmap map[string]interface{}, dest interface{}, onrow func() (bool, error)) error {
+	return p.section.Do(ctx, func(ctx context.Context) error {
+		args, err := fromArgmap(p.paramNames, argmap)
+		if err != nil {
+			return QueryFailed{p.queryName, err}
+		}
+
+		// Time spent in onrow does not count towards the duration of the
+		// query.
+		var inCallback time.Duration
+		timedOnrow := onrow
+		if onrow != nil {
+			timedOnrow = func() (bool, error) {
+				t0 := time.Now()
+				defer func() { inCallback += time.Since(t0) }()
+				return onrow()
+			}
+		}
+
+		t0 := time.Now()
+		err = p.query(ctx, tx, args, dest, timedOnrow)
+		p.db.observe(p.queryName, p.querySQL, p.paramNames, args, time.Since(t0)-inCallback, err)
+		return err
+	})
+}
+
+func (p *PreparedQuery) query(ctx context.Context, tx *sql.Tx, args []interface{}, dest interface{}, onrow func() (bool, error)) error {
+	rows, err := tx.Stmt(p.stmt).QueryContext(ctx, args...)
+	if err != nil {
+		return QueryFailed{p.queryName, err}
+	}
+	defer rows.Close()
+
+	names, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+
+	destparams, err := makeQueryDest(names, dest)
+	if err != nil {
+		return err
+	}
+
+	for rows.Next() {
+		if err := rows.Scan(destparams...); err != nil {
+			return err
+		}
+
+		cont := true
+		var err error
+
+		if onrow != nil {
+			cont, err = onrow()
+			if err != nil {
+				return err
+			}
+		}
+
+		if !cont {
+			break
+		}
+	}
+
+	return rows.Err()
+}
+
+// PrepareQuery prepares a statement that returns rows. See prepare for
+// how parameters are named.
+func (d *Database) PrepareQuery(outErr *error, queryName, querySQL string, paramNames ...string) *PreparedQuery {
+	if *outErr != nil {
+		return nil
+	}
+
+	stmt, querySQL, paramNames, err := d.prepare(queryName, querySQL, paramNames)
+	if err != nil {
+		*outErr = err
+		return nil
+	}
+
+	return &PreparedQuery{
+		db:         d,
+		section:    sections.Get(d.dialect, queryName),
+		queryName:  queryName,
+		querySQL:   querySQL,
+		stmt:       stmt,
+		paramNames: paramNames,
+	}
+}
@@ -0,0 +1,61 @@
+package orcdb
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+)
+
+// QueryEach runs the query and calls onrow with each row as a T (a struct,
+// mapped as by PreparedQuery.Query), until onrow returns false.
+func QueryEach[T any](ctx context.Context, q *PreparedQuery, tx *sql.Tx, argmap map[string]interface{}, onrow func(T) (bool, error)) error {
+	var row T
+	return q.Query(ctx, tx, argmap, &row, func() (bool, error) {
+		return onrow(row)
+	})
+}
+
+// QueryAll runs the query and returns all rows as Ts.
+func QueryAll[T any](ctx context.Context, q *PreparedQuery, tx *sql.Tx, argmap map[string]interface{}) ([]T, error) {
+	var rv []T
+	err := QueryEach(ctx, q, tx, argmap, func(row T) (bool, error) {
+		rv = append(rv, row)
+		return true, nil
+	})
+	return rv, err
+}
+
+// QueryOne runs the query and returns the first row as a T, or
+// sql.ErrNoRows if there are none.
+func QueryOne[T any](ctx context.Context, q *PreparedQuery, tx *sql.Tx, argmap map[string]interface{}) (T, error) {
+	var rv T
+	found := false
+	err := QueryEach(ctx, q, tx, argmap, func(row T) (bool, error) {
+		rv = row
+		found = true
+		return false, nil
+	})
+	if err == nil && !found {
+		err = sql.ErrNoRows
+	}
+	return rv, err
+}
+
+type jsonValue struct {
+	value interface{}
+}
+
+func (j jsonValue) Value() (driver.Value, error) {
+	data, err := json.Marshal(j.value)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+// JSON wraps a query argument to store it as JSON, e.g. in a column read
+// into a field tagged sql:"name,json".
+func JSON(value interface{}) driver.Valuer {
+	return jsonValue{value}
+}
@@ -0,0 +1,230 @@
+package orcdb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// explainInterval limits how often the plan of a query is captured,
+	// so that a query that is always slow does not double its cost.
+	explainInterval = time.Minute
+
+	// explainTimeout bounds how long capturing a plan may wait for a
+	// connection and run.
+	explainTimeout = 10 * time.Second
+)
+
+// explainableStatements are the kinds of statements whose plan is
+// captured; EXPLAIN does not accept others.
+var explainableStatements = map[string]bool{
+	"SELECT": true,
+	"INSERT": true,
+	"UPDATE": true,
+	"DELETE": true,
+}
+
+func isExplainable(querySQL string) bool {
+	fields := strings.Fields(querySQL)
+	return len(fields) > 0 && explainableStatements[strings.ToUpper(fields[0])]
+}
+
+// SlowQuery summarizes the executions of a prepared query that took
+// longer than the slow query threshold.
+type SlowQuery struct {
+	QueryName string
+	SQL       string
+
+	Count        int
+	MaxDuration  time.Duration
+	LastDuration time.Duration
+	LastAt       time.Time
+
+	// LastArgs describes the arguments of the last slow execution, with
+	// their values redacted.
+	LastArgs string
+
+	// Plan is the query plan, as captured after a recent slow execution.
+	Plan      string
+	PlanAt    time.Time
+	PlanErr   string
+	lastTried time.Time
+}
+
+type slowQueryLog struct {
+	threshold time.Duration
+
+	mu      sync.Mutex
+	queries map[string]*SlowQuery
+}
+
+// SlowQueryThreshold records and logs executions of prepared queries that
+// take longer than threshold. See Database.SlowQueries.
+func SlowQueryThreshold(threshold time.Duration) OpenOption {
+	return func(opts *openOptions) {
+		opts.slowQueryThreshold = threshold
+	}
+}
+
+// redactArgs describes the arguments of a query without their values.
+func redactArgs(paramNames []string, args []interface{}) string {
+	var parts []string
+	for i, arg := range args {
+		var desc string
+		switch arg := arg.(type) {
+		case nil:
+			desc = "NULL"
+		case string:
+			desc = fmt.Sprintf("<string, %d bytes>", len(arg))
+		case []byte:
+			desc = fmt.Sprintf("<bytes, %d bytes>", len(arg))
+		default:
+			desc = fmt.Sprintf("<%T>", arg)
+		}
+		parts = append(parts, paramNames[i]+"="+desc)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// observe records an execution of a prepared query if it was slow, and
+// captures its plan if due. The plan is captured after the query
+// succeeded, with the same arguments, but in the background and outside
+// the caller's transaction: a failing EXPLAIN must not abort it, nor
+// keep its locks held for longer.
+func (d *Database) observe(queryName, querySQL string, paramNames []string, args []interface{}, duration time.Duration, queryErr error) {
+	log := d.slowQueries
+	if log == nil || duration < log.threshold {
+		return
+	}
+
+	redacted := redactArgs(paramNames, args)
+	now := time.Now()
+
+	log.mu.Lock()
+	if log.queries == nil {
+		log.queries = map[string]*SlowQuery{}
+	}
+	entry, ok := log.queries[queryName]
+	if !ok {
+		entry = &SlowQuery{QueryName: queryName, SQL: querySQL}
+		log.queries[queryName] = entry
+	}
+	entry.Count++
+	entry.LastDuration = duration
+	entry.LastAt = now
+	entry.LastArgs = redacted
+	if duration > entry.MaxDuration {
+		entry.MaxDuration = duration
+	}
+	explain := queryErr == nil && isExplainable(querySQL) && now.Sub(entry.lastTried) >= explainInterval
+	if explain {
+		entry.lastTried = now
+	}
+	log.mu.Unlock()
+
+	fields := logrus.Fields{
+		"query":    queryName,
+		"duration": duration,
+		"args":     redacted,
+	}
+
+	if !explain {
+		logrus.WithFields(fields).Warningf("Slow query on database %q", d.schema.Name)
+		return
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), explainTimeout)
+		defer cancel()
+
+		plan, err := d.dialect.Explain(ctx, d.db, querySQL, args)
+
+		log.mu.Lock()
+		if err != nil {
+			entry.PlanErr = err.Error()
+		} else {
+			entry.Plan = plan
+			entry.PlanAt = now
+			entry.PlanErr = ""
+		}
+		log.mu.Unlock()
+
+		if err != nil {
+			fields["explain_error"] = err
+		} else {
+			fields["plan"] = plan
+		}
+
+		logrus.WithFields(fields).Warningf("Slow query on database %q", d.schema.Name)
+	}()
+}
+
+// SlowQueries returns the queries that have been slow, slowest first, or
+// nothing unless the database was opened with a SlowQueryThreshold.
+func (d *Database) SlowQueries() []SlowQuery {
+	log := d.slowQueries
+	if log == nil {
+		return nil
+	}
+
+	log.mu.Lock()
+	defer log.mu.Unlock()
+
+	var rv []SlowQuery
+	for _, entry := range log.queries {
+		rv = append(rv, *entry)
+	}
+	sort.Slice(rv, func(i, j int) bool {
+		return rv[i].MaxDuration > rv[j].MaxDuration
+	})
+	return rv
+}
+
+// SlowQueryThreshold returns the threshold for recording slow queries, or
+// zero if they are not recorded.
+func (d *Database) SlowQueryThreshold() time.Duration {
+	if d.slowQueries == nil {
+		return 0
+	}
+	return d.slowQueries.threshold
+}
+
+// explainRows returns the rows of an EXPLAIN query, with the columns of
+// each row scanned as strings.
+func explainRows(ctx context.Context, q Queryer, query string, args []interface{}) ([][]string, error) {
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	var rv [][]string
+	for rows.Next() {
+		values := make([]sql.NullString, len(columns))
+		dest := make([]interface{}, len(columns))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		row := make([]string, len(columns))
+		for i, value := range values {
+			row[i] = value.String
+		}
+		rv = append(rv, row)
+	}
+	return rv, rows.Err()
+}
@@ -0,0 +1,343 @@
+package orcdb
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+	"github.com/sirupsen/logrus"
+)
+
+// SQLiteOptions tunes SQLite databases. The zero value enables foreign
+// keys, leaves the journal mode and synchronous level alone, and vacuums
+// on startup.
+type SQLiteOptions struct {
+	// JournalMode is e.g. "WAL", which lets readers run concurrently
+	// with a writer.
+	JournalMode string
+
+	// BusyTimeout is how long a connection waits for a lock held by
+	// another before failing with SQLITE_BUSY.
+	BusyTimeout time.Duration
+
+	// Synchronous is e.g. "NORMAL", which is safe in WAL mode and syncs
+	// less often than the default "FULL".
+	Synchronous string
+
+	// SkipVacuum skips the VACUUM on startup, which rewrites the whole
+	// file and may take long for big databases.
+	SkipVacuum bool
+}
+
+var (
+	sqliteJournalModes = []string{"DELETE", "TRUNCATE", "PERSIST", "MEMORY", "WAL", "OFF"}
+	sqliteSynchronous  = []string{"OFF", "NORMAL", "FULL", "EXTRA"}
+
+	sqliteHeader = []byte("SQLite format 3\x00")
+)
+
+// SQLiteWith returns the SQLite dialect with options.
+func SQLiteWith(opts SQLiteOptions) Dialect {
+	return sqliteDialect{opts: opts}
+}
+
+func checkPragmaValue(pragma, value string, allowed []string) (string, error) {
+	value = strings.ToUpper(value)
+	for _, candidate := range allowed {
+		if value == candidate {
+			return value, nil
+		}
+	}
+	return "", fmt.Errorf("Invalid SQLite %s %q (expected one of %v)", pragma, value, allowed)
+}
+
+// pragmas returns the statements that configure a connection.
+func (o SQLiteOptions) pragmas() ([]string, error) {
+	rv := []string{`PRAGMA foreign_keys = ON;`}
+
+	if o.JournalMode != "" {
+		mode, err := checkPragmaValue("journal_mode", o.JournalMode, sqliteJournalModes)
+		if err != nil {
+			return nil, err
+		}
+		rv = append(rv, fmt.Sprintf(`PRAGMA journal_mode = %s;`, mode))
+	}
+
+	if o.BusyTimeout > 0 {
+		rv = append(rv, fmt.Sprintf(`PRAGMA busy_timeout = %d;`, o.BusyTimeout.Milliseconds()))
+	}
+
+	if o.Synchronous != "" {
+		level, err := checkPragmaValue("synchronous", o.Synchronous, sqliteSynchronous)
+		if err != nil {
+			return nil, err
+		}
+		rv = append(rv, fmt.Sprintf(`PRAGMA synchronous = %s;`, level))
+	}
+
+	return rv, nil
+}
+
+// connectorOpener is implemented by dialects that need to configure each
+// connection of the pool as it is made.
+type connectorOpener interface {
+	connector(dataSourceName string) (driver.Connector, error)
+}
+
+type sqliteConnector struct {
+	driver         *sqlite3.SQLiteDriver
+	dataSourceName string
+}
+
+func (c sqliteConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.dataSourceName)
+}
+
+func (c sqliteConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// connector applies the pragmas to each connection, since most of them
+// only affect the connection they run on.
+func (d sqliteDialect) connector(dataSourceName string) (driver.Connector, error) {
+	pragmas, err := d.opts.pragmas()
+	if err != nil {
+		return nil, err
+	}
+
+	return sqliteConnector{
+		driver: &sqlite3.SQLiteDriver{
+			ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+				for _, pragma := range pragmas {
+					if _, err := conn.Exec(pragma, nil); err != nil {
+						return fmt.Errorf("Unable to set %q: %v", pragma, err)
+					}
+				}
+				return nil
+			},
+		},
+		dataSourceName: dataSourceName,
+	}, nil
+}
+
+const backupRetryInterval = 50 * time.Millisecond
+
+// copySQLite copies the src database into dest with the SQLite backup
+// API, which reads a consistent snapshot while src stays in use.
+func copySQLite(ctx context.Context, dest, src *sql.DB) error {
+	srcConn, err := src.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+
+	destConn, err := dest.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer destConn.Close()
+
+	return destConn.Raw(func(destDriverConn interface{}) error {
+		return srcConn.Raw(func(srcDriverConn interface{}) error {
+			destSQLite, ok := destDriverConn.(*sqlite3.SQLiteConn)
+			if !ok {
+				return fmt.Errorf("Backup destination is not a SQLite database (got %T)", destDriverConn)
+			}
+			srcSQLite, ok := srcDriverConn.(*sqlite3.SQLiteConn)
+			if !ok {
+				return fmt.Errorf("Backup source is not a SQLite database (got %T)", srcDriverConn)
+			}
+
+			backup, err := destSQLite.Backup("main", srcSQLite, "main")
+			if err != nil {
+				return err
+			}
+
+			for {
+				// Copying all pages in one step keeps the copy consistent
+				// without restarting when others write to src meanwhile.
+				// Step returns false without error if src is locked.
+				done, err := backup.Step(-1)
+				if err != nil {
+					backup.Finish()
+					return err
+				}
+				if done {
+					break
+				}
+
+				select {
+				case <-ctx.Done():
+					backup.Finish()
+					return ctx.Err()
+				case <-time.After(backupRetryInterval):
+				}
+			}
+
+			return backup.Finish()
+		})
+	})
+}
+
+// Backup writes a copy of the database to filename, which is replaced
+// atomically once the copy is complete. The database may be in use
+// meanwhile. Only SQLite databases can be backed up.
+func (d *Database) Backup(ctx context.Context, filename string) error {
+	if _, ok := d.dialect.(sqliteDialect); !ok {
+		return fmt.Errorf("Backup is not supported for %s databases", d.dialect.Name())
+	}
+
+	tempFilename := filename + ".tmp"
+	if err := os.Remove(tempFilename); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	dest, err := sql.Open(SQLite.DriverName(), tempFilename)
+	if err != nil {
+		return fmt.Errorf("Unable to create backup %q: %v", tempFilename, err)
+	}
+
+	err = copySQLite(ctx, dest, d.db)
+	if closeErr := dest.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tempFilename, 0600)
+	}
+	if err != nil {
+		os.Remove(tempFilename)
+		return fmt.Errorf("Backup of database %q failed: %v", d.schema.Name, err)
+	}
+
+	return os.Rename(tempFilename, filename)
+}
+
+func checkSQLiteHeader(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	header := make([]byte, len(sqliteHeader))
+	if _, err := io.ReadFull(f, header); err != nil || !bytes.Equal(header, sqliteHeader) {
+		return fmt.Errorf("%q is not a SQLite database (encrypted snapshots need a decryption key)", filename)
+	}
+	return nil
+}
+
+type restoreOptions struct {
+	decrypt func(ciphertext []byte) ([]byte, error)
+}
+
+type RestoreOption func(*restoreOptions)
+
+// DecryptWith restores from a backup that was encrypted as a whole, e.g.
+// with PGP, decrypting it with decrypt.
+func DecryptWith(decrypt func(ciphertext []byte) ([]byte, error)) RestoreOption {
+	return func(opts *restoreOptions) {
+		opts.decrypt = decrypt
+	}
+}
+
+// decryptBackup writes the decrypted backup to a temporary file, returning
+// its name and a function to remove it.
+func decryptBackup(backupFilename string, decrypt func([]byte) ([]byte, error)) (string, func(), error) {
+	ciphertext, err := ioutil.ReadFile(backupFilename)
+	if err != nil {
+		return "", nil, err
+	}
+	plaintext, err := decrypt(ciphertext)
+	if err != nil {
+		return "", nil, fmt.Errorf("Unable to decrypt backup %q: %v", backupFilename, err)
+	}
+
+	tempDir, err := ioutil.TempDir("", "orcdb-restore-")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { os.RemoveAll(tempDir) }
+
+	filename := filepath.Join(tempDir, "backup.db")
+	if err := ioutil.WriteFile(filename, plaintext, 0600); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return filename, cleanup, nil
+}
+
+// RestoreSQLite replaces the contents of the SQLite database in filename
+// with a backup of a database with the schema. Nothing else should use
+// the database meanwhile.
+func (s *Schema) RestoreSQLite(ctx context.Context, backupFilename, filename string, lockTimeout time.Duration, opts ...RestoreOption) error {
+	var options restoreOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	plaintextFilename := backupFilename
+	if options.decrypt != nil {
+		decrypted, cleanup, err := decryptBackup(backupFilename, options.decrypt)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+		plaintextFilename = decrypted
+	}
+
+	if err := checkSQLiteHeader(plaintextFilename); err != nil {
+		return err
+	}
+
+	src, err := sql.Open(SQLite.DriverName(), "file:"+plaintextFilename+"?mode=ro")
+	if err != nil {
+		return fmt.Errorf("Unable to open backup %q: %v", backupFilename, err)
+	}
+	defer src.Close()
+
+	var integrity string
+	if err := src.QueryRowContext(ctx, `PRAGMA integrity_check;`).Scan(&integrity); err != nil {
+		return fmt.Errorf("Unable to check backup %q: %v", backupFilename, err)
+	}
+	if integrity != "ok" {
+		return fmt.Errorf("Backup %q is corrupt: %s", backupFilename, integrity)
+	}
+
+	name, version, err := getSchemaVersion(ctx, src)
+	if err != nil {
+		return fmt.Errorf("Unable to read schema of backup %q: %v", backupFilename, err)
+	}
+	if name != s.Name {
+		return fmt.Errorf("Backup schema mismatch (got %q want %q)", name, s.Name)
+	}
+
+	dest, err := sql.Open(SQLite.DriverName(), filename)
+	if err != nil {
+		return fmt.Errorf("Unable to open database %q: %v", filename, err)
+	}
+	defer dest.Close()
+
+	// Keep instances that start meanwhile from migrating the database
+	// while it is being replaced.
+	unlock, err := SQLite.LockMigrations(ctx, dest, s.Name, lockTimeout)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := copySQLite(ctx, dest, src); err != nil {
+		return fmt.Errorf("Restoring %q from %q failed: %v", filename, backupFilename, err)
+	}
+
+	logrus.Infof("Restored database %q from backup %q (schema %q version %d)", filename, backupFilename, name, version)
+	return nil
+}
@@ -0,0 +1,47 @@
+package orcdb
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	statsNamespace = "orcdb"
+)
+
+var (
+	metricTransactions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: statsNamespace,
+		Name:      "transactions",
+		Help:      "Number of transactions run by a Transactor, by dialect, transaction and outcome (after any retries)",
+	},
+		[]string{"dialect", "transaction", "outcome"},
+	)
+
+	metricTransactionRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: statsNamespace,
+		Name:      "transaction_retries",
+		Help:      "Number of times a transaction was retried after failing because of concurrent transactions",
+	},
+		[]string{"dialect", "transaction"},
+	)
+)
+
+func countTransaction(dialect Dialect, transactionName string, retries int, err error) {
+	outcome := "ok"
+	if err != nil {
+		outcome = "error"
+	}
+	metricTransactions.With(prometheus.Labels{
+		"dialect":     dialect.Name(),
+		"transaction": transactionName,
+		"outcome":     outcome,
+	}).Inc()
+
+	if retries > 0 {
+		metricTransactionRetries.With(prometheus.Labels{
+			"dialect":     dialect.Name(),
+			"transaction": transactionName,
+		}).Add(float64(retries))
+	}
+}
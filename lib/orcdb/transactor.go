@@ -0,0 +1,132 @@
+package orcdb
+
+import (
+	"context"
+	"database/sql"
+	"math/rand"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/steinarvk/sectiontrace"
+)
+
+const (
+	DefaultMaxAttempts = 5
+
+	retryBaseDelay = 10 * time.Millisecond
+	retryMaxDelay  = time.Second
+)
+
+type transactorOptions struct {
+	txOpts      sql.TxOptions
+	maxAttempts int
+}
+
+type TransactorOption func(*transactorOptions)
+
+// Isolation sets the isolation level of the transactions (by default
+// serializable).
+func Isolation(level sql.IsolationLevel) TransactorOption {
+	return func(opts *transactorOptions) {
+		opts.txOpts.Isolation = level
+	}
+}
+
+// ReadOnly makes the transactions read-only.
+func ReadOnly() TransactorOption {
+	return func(opts *transactorOptions) {
+		opts.txOpts.ReadOnly = true
+	}
+}
+
+// MaxAttempts sets how many times a transaction is attempted before a
+// retryable error is returned. 1 disables retries.
+func MaxAttempts(attempts int) TransactorOption {
+	return func(opts *transactorOptions) {
+		opts.maxAttempts = attempts
+	}
+}
+
+// Backoff returns a random delay before the next attempt, growing
+// exponentially with the number of failed attempts: minDelay doubled for
+// each failure after the first, capped at maxDelay, and jittered down by
+// up to half.
+func Backoff(failedAttempts int, minDelay, maxDelay time.Duration) time.Duration {
+	delay := minDelay << uint(failedAttempts-1)
+	if delay <= 0 || delay > maxDelay {
+		delay = maxDelay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// Transactor returns a function to run callbacks in named transactions.
+// A transaction that fails because of concurrent transactions (as judged
+// by Dialect.IsRetryable) is rolled back and retried, so the callback may
+// run more than once. Callbacks should wrap errors with %w to keep them
+// retryable.
+func Transactor(transactionName string, options ...TransactorOption) func(context.Context, *Database, func(context.Context, *sql.Tx) error) error {
+	opts := transactorOptions{
+		txOpts:      *defaultTxOpts,
+		maxAttempts: DefaultMaxAttempts,
+	}
+	for _, option := range options {
+		option(&opts)
+	}
+
+	return func(ctx context.Context, db *Database, callback func(ctx context.Context, tx *sql.Tx) error) error {
+		tracer := sections.Get(db.dialect, transactionName)
+		retryTracer := sections.Get(db.dialect, transactionName+".Retry")
+
+		newCtx, sec := tracer.Begin(ctx)
+
+		var err error
+		attempt := 1
+	attempts:
+		for {
+			attemptCtx := newCtx
+			var retrySec sectiontrace.ActiveSection
+			if attempt > 1 {
+				attemptCtx, retrySec = retryTracer.Begin(newCtx)
+			}
+
+			err = db.runInTransaction(ctx, &opts.txOpts, func(tx *sql.Tx) error {
+				return callback(attemptCtx, tx)
+			})
+
+			if retrySec != nil {
+				retrySec.End(err)
+			}
+
+			if err == nil || attempt >= opts.maxAttempts || !db.dialect.IsRetryable(err) {
+				break
+			}
+
+			delay := Backoff(attempt, retryBaseDelay, retryMaxDelay)
+			logrus.WithFields(logrus.Fields{
+				"transaction": transactionName,
+				"attempt":     attempt,
+				"delay":       delay,
+				"error":       err,
+			}).Infof("Retrying transaction")
+
+			select {
+			case <-ctx.Done():
+				err = ctx.Err()
+				break attempts
+			case <-time.After(delay):
+			}
+
+			attempt++
+		}
+
+		countTransaction(db.dialect, transactionName, attempt-1, err)
+		sec.End(err)
+		return err
+	}
+}
+
+// Transact runs callback in a named transaction with the default options
+// of Transactor.
+func Transact(ctx context.Context, db *Database, transactionName string, callback func(context.Context, *sql.Tx) error) error {
+	return Transactor(transactionName)(ctx, db, callback)
+}
@@ -3,6 +3,7 @@ package orchash
 import (
 	"crypto/sha256"
 	"fmt"
+	"io"
 	"strings"
 
 	"github.com/sirupsen/logrus"
@@ -50,3 +51,14 @@ func VerifyJSONHash(h string, data interface{}) (bool, error) {
 	}
 	return VerifyHash(h, serialized)
 }
+
+// ComputeReaderHash hashes everything read from r, returning the hash and
+// the number of bytes read.
+func ComputeReaderHash(r io.Reader) (string, int64, error) {
+	h := sha256.New()
+	n, err := io.Copy(h, r)
+	if err != nil {
+		return "", n, err
+	}
+	return fmt.Sprintf("%s:%x", hashKind, h.Sum(nil)), n, nil
+}
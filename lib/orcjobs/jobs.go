@@ -0,0 +1,514 @@
+package orcjobs
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/steinarvk/orclib/lib/orcdb"
+	"github.com/steinarvk/orclib/lib/orctimestamp"
+	"github.com/steinarvk/orclib/lib/uniqueid"
+)
+
+const (
+	DefaultQueue       = "default"
+	DefaultMaxAttempts = 10
+	DefaultListLimit   = 100
+)
+
+// SchemaSQL creates the job table. Include it in an upgrade of the schema
+// of the database holding the jobs, so that jobs can be enqueued in the
+// same transactions as the data they work on.
+var SchemaSQL = []string{
+	`CREATE TABLE orc_jobs (
+		id TEXT PRIMARY KEY,
+		queue TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		payload TEXT NOT NULL,
+		priority INTEGER NOT NULL,
+		unique_key TEXT NOT NULL,
+		active_key TEXT,
+		state TEXT NOT NULL,
+		run_at BIGINT NOT NULL,
+		attempts INTEGER NOT NULL,
+		max_attempts INTEGER NOT NULL,
+		lease_owner TEXT NOT NULL,
+		lease_until BIGINT NOT NULL,
+		last_error TEXT NOT NULL,
+		created_at TEXT NOT NULL,
+		updated_at TEXT NOT NULL
+	);`,
+	`CREATE UNIQUE INDEX orc_jobs_by_active_key ON orc_jobs (active_key);`,
+	`CREATE INDEX orc_jobs_due ON orc_jobs (queue, state, priority, run_at);`,
+}
+
+// State is the state of a job. Jobs that succeed are deleted, so they
+// have no state.
+type State string
+
+const (
+	// Queued jobs wait to run at their RunAt time.
+	Queued State = "queued"
+
+	// Running jobs are leased by a worker.
+	Running State = "running"
+
+	// Failed jobs were given up on, after too many attempts or a
+	// permanent error. They may be retried by hand.
+	Failed State = "failed"
+
+	// Cancelled jobs were cancelled by hand. They may be retried.
+	Cancelled State = "cancelled"
+)
+
+// Job is a unit of background work.
+type Job struct {
+	ID    string `json:"id"`
+	Queue string `json:"queue"`
+
+	// Kind selects the handler of the job.
+	Kind string `json:"kind"`
+
+	// Payload is JSON.
+	Payload json.RawMessage `json:"payload"`
+
+	// Due jobs with higher priority run first.
+	Priority int `json:"priority"`
+
+	// UniqueKey, if not empty, may only be held by one queued or running
+	// job at a time.
+	UniqueKey string `json:"unique_key,omitempty"`
+
+	State       State     `json:"state"`
+	RunAt       time.Time `json:"run_at"`
+	Attempts    int       `json:"attempts"`
+	MaxAttempts int       `json:"max_attempts"`
+	LeaseOwner  string    `json:"lease_owner,omitempty"`
+	LastError   string    `json:"last_error,omitempty"`
+	CreatedAt   string    `json:"created_at"`
+	UpdatedAt   string    `json:"updated_at"`
+}
+
+type JobNotFound struct {
+	ID string
+}
+
+func (e JobNotFound) Error() string {
+	return fmt.Sprintf("No job %q", e.ID)
+}
+
+// DuplicateJob means that a queued or running job already holds a unique
+// key.
+type DuplicateJob struct {
+	UniqueKey string
+	ID        string
+}
+
+func (e DuplicateJob) Error() string {
+	return fmt.Sprintf("Job %q already has unique key %q", e.ID, e.UniqueKey)
+}
+
+// WrongState means that a job is not in a state allowing an operation.
+type WrongState struct {
+	ID    string
+	State State
+}
+
+func (e WrongState) Error() string {
+	return fmt.Sprintf("Job %q is %s", e.ID, e.State)
+}
+
+type Jobs struct {
+	db *orcdb.Database
+
+	// claimTransactor runs the transactions claiming jobs. On Postgres
+	// they skip the rows locked by other workers rather than conflict.
+	claimTransactor func(context.Context, *orcdb.Database, func(context.Context, *sql.Tx) error) error
+
+	findActive *orcdb.PreparedQuery
+	insert     *orcdb.PreparedExec
+	get        *orcdb.PreparedQuery
+	list       *orcdb.PreparedQuery
+	count      *orcdb.PreparedQuery
+	due        *orcdb.PreparedQuery
+	claim      *orcdb.PreparedExec
+	extend     *orcdb.PreparedExec
+	complete   *orcdb.PreparedExec
+	reschedule *orcdb.PreparedExec
+	fail       *orcdb.PreparedExec
+	cancel     *orcdb.PreparedExec
+	retry      *orcdb.PreparedExec
+
+	mu      sync.Mutex
+	workers map[*Workers]bool
+}
+
+const jobColumns = `id, queue, kind, payload, priority, unique_key, state, run_at, attempts, max_attempts, lease_owner, last_error, created_at, updated_at`
+
+// New prepares the queries of the jobs in db, whose schema must include
+// SchemaSQL.
+func New(db *orcdb.Database) (*Jobs, error) {
+	var err error
+	rv := &Jobs{
+		db:              db,
+		claimTransactor: orcdb.Transactor("jobs-claim"),
+		workers:         map[*Workers]bool{},
+	}
+
+	lockDue := ""
+	if db.Dialect().Name() == orcdb.Postgres.Name() {
+		lockDue = "FOR UPDATE SKIP LOCKED"
+		rv.claimTransactor = orcdb.Transactor("jobs-claim", orcdb.Isolation(sql.LevelReadCommitted))
+	}
+
+	rv.findActive = db.PrepareQuery(&err, "jobs-find-active", `SELECT id FROM orc_jobs WHERE active_key = :key;`)
+	rv.insert = db.PrepareExec(&err, "jobs-insert", `
+		INSERT INTO orc_jobs (id, queue, kind, payload, priority, unique_key, active_key, state, run_at, attempts, max_attempts, lease_owner, lease_until, last_error, created_at, updated_at)
+		VALUES (:id, :queue, :kind, :payload, :priority, :unique_key, :active_key, 'queued', :run_at, 0, :max_attempts, '', 0, '', :created_at, :created_at);`)
+	rv.get = db.PrepareQuery(&err, "jobs-get", `SELECT `+jobColumns+` FROM orc_jobs WHERE id = :id;`)
+	rv.list = db.PrepareQuery(&err, "jobs-list", `
+		SELECT `+jobColumns+` FROM orc_jobs
+		WHERE (:queue = '' OR queue = :queue) AND (:state = '' OR state = :state)
+		ORDER BY updated_at DESC, id
+		LIMIT :limit;`)
+	rv.count = db.PrepareQuery(&err, "jobs-count", `
+		SELECT queue, state, COUNT(*) AS n FROM orc_jobs
+		GROUP BY queue, state
+		ORDER BY queue, state;`)
+
+	// Jobs whose worker stopped renewing its lease are due again.
+	rv.due = db.PrepareQuery(&err, "jobs-due", `
+		SELECT `+jobColumns+` FROM orc_jobs
+		WHERE queue = :queue
+		AND ((state = 'queued' AND run_at <= :now) OR (state = 'running' AND lease_until < :now))
+		ORDER BY priority DESC, run_at, id
+		LIMIT 1 `+lockDue+`;`)
+	rv.claim = db.PrepareExec(&err, "jobs-claim", `
+		UPDATE orc_jobs SET state = 'running', attempts = attempts + 1, lease_owner = :owner, lease_until = :until, updated_at = :updated_at
+		WHERE id = :id;`)
+	rv.extend = db.PrepareExec(&err, "jobs-extend", `
+		UPDATE orc_jobs SET lease_until = :until
+		WHERE id = :id AND lease_owner = :owner AND state = 'running';`)
+	rv.complete = db.PrepareExec(&err, "jobs-complete", `
+		DELETE FROM orc_jobs WHERE id = :id AND lease_owner = :owner AND state = 'running';`)
+	rv.reschedule = db.PrepareExec(&err, "jobs-reschedule", `
+		UPDATE orc_jobs SET state = 'queued', run_at = :run_at, attempts = :attempts, last_error = :last_error, lease_owner = '', lease_until = 0, updated_at = :updated_at
+		WHERE id = :id AND lease_owner = :owner AND state = 'running';`)
+	rv.fail = db.PrepareExec(&err, "jobs-fail", `
+		UPDATE orc_jobs SET state = 'failed', active_key = NULL, last_error = :last_error, lease_owner = '', lease_until = 0, updated_at = :updated_at
+		WHERE id = :id AND lease_owner = :owner AND state = 'running';`)
+	rv.cancel = db.PrepareExec(&err, "jobs-cancel", `
+		UPDATE orc_jobs SET state = 'cancelled', active_key = NULL, lease_owner = '', lease_until = 0, updated_at = :updated_at
+		WHERE id = :id AND state IN ('queued', 'running');`)
+	rv.retry = db.PrepareExec(&err, "jobs-retry", `
+		UPDATE orc_jobs SET state = 'queued', active_key = :active_key, run_at = :run_at, attempts = 0, updated_at = :updated_at
+		WHERE id = :id AND state IN ('failed', 'cancelled');`)
+
+	if err != nil {
+		return nil, fmt.Errorf("Unable to prepare job queries: %v", err)
+	}
+
+	return rv, nil
+}
+
+type EnqueueOption func(*Job)
+
+// Queue sets the queue of a job (by default DefaultQueue).
+func Queue(queue string) EnqueueOption {
+	return func(job *Job) {
+		job.Queue = queue
+	}
+}
+
+// Priority sets the priority of a job (by default 0).
+func Priority(priority int) EnqueueOption {
+	return func(job *Job) {
+		job.Priority = priority
+	}
+}
+
+// RunAt delays a job until t.
+func RunAt(t time.Time) EnqueueOption {
+	return func(job *Job) {
+		job.RunAt = t
+	}
+}
+
+// UniqueKey makes enqueuing the job fail with DuplicateJob while another
+// job with the same key is queued or running.
+func UniqueKey(key string) EnqueueOption {
+	return func(job *Job) {
+		job.UniqueKey = key
+	}
+}
+
+// MaxAttempts sets how many times a job is attempted before it fails (by
+// default DefaultMaxAttempts).
+func MaxAttempts(attempts int) EnqueueOption {
+	return func(job *Job) {
+		job.MaxAttempts = attempts
+	}
+}
+
+// EnqueueInTx adds a job in tx, so that it runs if and only if tx commits.
+// Workers in this process are not woken; call Wake after committing to
+// run the job without waiting for them to poll.
+func (j *Jobs) EnqueueInTx(ctx context.Context, tx *sql.Tx, kind string, payload interface{}, options ...EnqueueOption) (string, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return "", fmt.Errorf("Unable to marshal payload of %q job: %v", kind, err)
+	}
+
+	job := Job{
+		Queue:       DefaultQueue,
+		Kind:        kind,
+		RunAt:       time.Now(),
+		MaxAttempts: DefaultMaxAttempts,
+	}
+	for _, option := range options {
+		option(&job)
+	}
+	if job.MaxAttempts < 1 {
+		return "", fmt.Errorf("Invalid max attempts %d for %q job", job.MaxAttempts, kind)
+	}
+
+	var activeKey interface{}
+	if job.UniqueKey != "" {
+		activeKey = job.UniqueKey
+
+		// Under serializable isolation, a concurrent insert of the same
+		// key makes one of the transactions fail and retry, after which
+		// it finds the other's job here.
+		existing, err := orcdb.QueryOne[struct{ ID string }](ctx, j.findActive, tx, map[string]interface{}{"key": job.UniqueKey})
+		if err == nil {
+			return existing.ID, DuplicateJob{UniqueKey: job.UniqueKey, ID: existing.ID}
+		}
+		if err != sql.ErrNoRows {
+			return "", err
+		}
+	}
+
+	id, err := uniqueid.New()
+	if err != nil {
+		return "", err
+	}
+
+	if err := j.insert.Exec(ctx, tx, map[string]interface{}{
+		"id":           id,
+		"queue":        job.Queue,
+		"kind":         job.Kind,
+		"payload":      string(data),
+		"priority":     job.Priority,
+		"unique_key":   job.UniqueKey,
+		"active_key":   activeKey,
+		"run_at":       job.RunAt.UnixMilli(),
+		"max_attempts": job.MaxAttempts,
+		"created_at":   orctimestamp.Format(time.Now()),
+	}); err != nil {
+		return "", err
+	}
+
+	return id, nil
+}
+
+// Enqueue adds a job in a transaction of its own, and wakes the workers of
+// its queue in this process.
+func (j *Jobs) Enqueue(ctx context.Context, kind string, payload interface{}, options ...EnqueueOption) (string, error) {
+	var id string
+	err := orcdb.Transact(ctx, j.db, "jobs-enqueue", func(ctx context.Context, tx *sql.Tx) error {
+		var err error
+		id, err = j.EnqueueInTx(ctx, tx, kind, payload, options...)
+		return err
+	})
+	if err != nil {
+		return id, err
+	}
+
+	job := Job{Queue: DefaultQueue}
+	for _, option := range options {
+		option(&job)
+	}
+	j.Wake(job.Queue)
+
+	return id, nil
+}
+
+// Wake makes the workers of a queue in this process look for due jobs now
+// rather than at their next poll.
+func (j *Jobs) Wake(queue string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	for w := range j.workers {
+		if w.queue == queue {
+			w.Wake()
+		}
+	}
+}
+
+func (j *Jobs) getInTx(ctx context.Context, tx *sql.Tx, id string) (Job, error) {
+	row, err := orcdb.QueryOne[jobRow](ctx, j.get, tx, map[string]interface{}{"id": id})
+	if err == sql.ErrNoRows {
+		return Job{}, JobNotFound{ID: id}
+	}
+	if err != nil {
+		return Job{}, err
+	}
+	return row.job(), nil
+}
+
+// Get returns a job that has not succeeded, or JobNotFound.
+func (j *Jobs) Get(ctx context.Context, id string) (Job, error) {
+	var rv Job
+	err := orcdb.Transact(ctx, j.db, "jobs-get", func(ctx context.Context, tx *sql.Tx) error {
+		var err error
+		rv, err = j.getInTx(ctx, tx, id)
+		return err
+	})
+	return rv, err
+}
+
+type ListOptions struct {
+	// Queue and State, if not empty, restrict the jobs listed.
+	Queue string
+	State State
+
+	// Limit is the most jobs listed (by default DefaultListLimit).
+	Limit int
+}
+
+// List returns jobs, most recently updated first.
+func (j *Jobs) List(ctx context.Context, opts ListOptions) ([]Job, error) {
+	if opts.Limit <= 0 {
+		opts.Limit = DefaultListLimit
+	}
+
+	var rv []Job
+	err := orcdb.Transact(ctx, j.db, "jobs-list", func(ctx context.Context, tx *sql.Tx) error {
+		rv = nil
+		return orcdb.QueryEach(ctx, j.list, tx, map[string]interface{}{
+			"queue": opts.Queue,
+			"state": string(opts.State),
+			"limit": opts.Limit,
+		}, func(row jobRow) (bool, error) {
+			rv = append(rv, row.job())
+			return true, nil
+		})
+	})
+	return rv, err
+}
+
+type Count struct {
+	Queue string `json:"queue"`
+	State State  `json:"state"`
+	N     int    `json:"n"`
+}
+
+// Counts returns the number of jobs in each queue and state.
+func (j *Jobs) Counts(ctx context.Context) ([]Count, error) {
+	var rv []Count
+	err := orcdb.Transact(ctx, j.db, "jobs-counts", func(ctx context.Context, tx *sql.Tx) error {
+		var err error
+		rv, err = orcdb.QueryAll[Count](ctx, j.count, tx, nil)
+		return err
+	})
+	return rv, err
+}
+
+// Cancel cancels a queued or running job. A running job's handler sees its
+// context cancelled once its worker next renews the lease.
+func (j *Jobs) Cancel(ctx context.Context, id string) error {
+	return orcdb.Transact(ctx, j.db, "jobs-cancel", func(ctx context.Context, tx *sql.Tx) error {
+		job, err := j.getInTx(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+		if job.State != Queued && job.State != Running {
+			return WrongState{ID: id, State: job.State}
+		}
+		return j.cancel.Exec(ctx, tx, map[string]interface{}{
+			"id":         id,
+			"updated_at": orctimestamp.Format(time.Now()),
+		})
+	})
+}
+
+// Retry queues a failed or cancelled job to run now, with its attempts
+// reset.
+func (j *Jobs) Retry(ctx context.Context, id string) error {
+	var queue string
+	err := orcdb.Transact(ctx, j.db, "jobs-retry", func(ctx context.Context, tx *sql.Tx) error {
+		job, err := j.getInTx(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+		if job.State != Failed && job.State != Cancelled {
+			return WrongState{ID: id, State: job.State}
+		}
+		queue = job.Queue
+
+		var activeKey interface{}
+		if job.UniqueKey != "" {
+			activeKey = job.UniqueKey
+			existing, err := orcdb.QueryOne[struct{ ID string }](ctx, j.findActive, tx, map[string]interface{}{"key": job.UniqueKey})
+			if err == nil {
+				return DuplicateJob{UniqueKey: job.UniqueKey, ID: existing.ID}
+			}
+			if err != sql.ErrNoRows {
+				return err
+			}
+		}
+
+		return j.retry.Exec(ctx, tx, map[string]interface{}{
+			"id":         id,
+			"active_key": activeKey,
+			"run_at":     time.Now().UnixMilli(),
+			"updated_at": orctimestamp.Format(time.Now()),
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	j.Wake(queue)
+	return nil
+}
+
+type jobRow struct {
+	ID          string
+	Queue       string
+	Kind        string
+	Payload     string
+	Priority    int
+	UniqueKey   string
+	State       string
+	RunAt       int64
+	Attempts    int
+	MaxAttempts int
+	LeaseOwner  string
+	LastError   string
+	CreatedAt   string
+	UpdatedAt   string
+}
+
+func (r jobRow) job() Job {
+	return Job{
+		ID:          r.ID,
+		Queue:       r.Queue,
+		Kind:        r.Kind,
+		Payload:     json.RawMessage(r.Payload),
+		Priority:    r.Priority,
+		UniqueKey:   r.UniqueKey,
+		State:       State(r.State),
+		RunAt:       time.UnixMilli(r.RunAt),
+		Attempts:    r.Attempts,
+		MaxAttempts: r.MaxAttempts,
+		LeaseOwner:  r.LeaseOwner,
+		LastError:   r.LastError,
+		CreatedAt:   r.CreatedAt,
+		UpdatedAt:   r.UpdatedAt,
+	}
+}
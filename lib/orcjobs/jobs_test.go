@@ -0,0 +1,200 @@
+package orcjobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/steinarvk/orclib/lib/orcdb"
+)
+
+func TestJobs(t *testing.T) {
+	ctx := context.Background()
+
+	schema := &orcdb.Schema{
+		Name:     "test",
+		Upgrades: orcdb.SequentialUpgrades(SchemaSQL),
+	}
+	db, err := schema.Open(ctx, orcdb.SQLite, filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	jobs, err := New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	enqueue := func(kind string, payload interface{}, options ...EnqueueOption) string {
+		t.Helper()
+		id, err := jobs.Enqueue(ctx, kind, payload, options...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+
+	var ran []string
+	flakyAttempts := 0
+	handlers := map[string]Handler{
+		"record": func(ctx context.Context, job Job) error {
+			var s string
+			if err := json.Unmarshal(job.Payload, &s); err != nil {
+				return err
+			}
+			ran = append(ran, s)
+			return nil
+		},
+		"flaky": func(ctx context.Context, job Job) error {
+			flakyAttempts++
+			if flakyAttempts == 1 {
+				return fmt.Errorf("flaky failure")
+			}
+			return nil
+		},
+		"broken": func(ctx context.Context, job Job) error {
+			return Permanent(fmt.Errorf("broken"))
+		},
+		"block": func(ctx context.Context, job Job) error {
+			<-ctx.Done()
+			return ctx.Err()
+		},
+	}
+	cfg := WorkerConfig{
+		Lease:      150 * time.Millisecond,
+		MinBackoff: time.Millisecond,
+		MaxBackoff: time.Millisecond,
+	}
+	workers, err := jobs.NewWorkers(DefaultQueue, handlers, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runAll := func() {
+		t.Helper()
+		for {
+			ran, err := workers.RunOnce(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ran {
+				return
+			}
+		}
+	}
+
+	enqueue("record", "low")
+	enqueue("record", "high", Priority(10))
+	enqueue("record", "later", RunAt(time.Now().Add(time.Hour)))
+	enqueue("record", "unique", UniqueKey("u"))
+	if _, err := jobs.Enqueue(ctx, "record", "duplicate", UniqueKey("u")); !errors.As(err, new(DuplicateJob)) {
+		t.Errorf("Enqueue(duplicate unique key) = %v, want DuplicateJob", err)
+	}
+	enqueue("record", "elsewhere", Queue("other"))
+	flakyID := enqueue("flaky", nil)
+	brokenID := enqueue("broken", nil, UniqueKey("b"))
+	unknownID := enqueue("unknown", nil)
+
+	runAll()
+	time.Sleep(10 * time.Millisecond)
+	runAll()
+
+	if want := []string{"high", "low", "unique"}; !reflect.DeepEqual(ran, want) {
+		t.Errorf("ran %v, want %v", ran, want)
+	}
+	if flakyAttempts != 2 {
+		t.Errorf("flaky job attempted %d times, want 2", flakyAttempts)
+	}
+	if _, err := jobs.Get(ctx, flakyID); !errors.As(err, new(JobNotFound)) {
+		t.Errorf("Get(succeeded job) = %v, want JobNotFound", err)
+	}
+	for _, id := range []string{brokenID, unknownID} {
+		job, err := jobs.Get(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.State != Failed || job.Attempts != 1 || job.LastError == "" {
+			t.Errorf("job %q = %+v, want failed after 1 attempt", job.Kind, job)
+		}
+	}
+
+	// The unique key of a failed job is free again, until it is retried.
+	if err := jobs.Retry(ctx, brokenID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := jobs.Enqueue(ctx, "broken", nil, UniqueKey("b")); !errors.As(err, new(DuplicateJob)) {
+		t.Errorf("Enqueue(retried unique key) = %v, want DuplicateJob", err)
+	}
+	if err := jobs.Cancel(ctx, brokenID); err != nil {
+		t.Fatal(err)
+	}
+	if err := jobs.Cancel(ctx, brokenID); !errors.As(err, new(WrongState)) {
+		t.Errorf("Cancel(cancelled job) = %v, want WrongState", err)
+	}
+
+	// Cancelling a running job cancels its handler once its lease is
+	// renewed.
+	blockID := enqueue("block", nil)
+	done := make(chan error)
+	go func() {
+		_, err := workers.RunOnce(ctx)
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	if err := jobs.Cancel(ctx, blockID); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("cancelled job still running")
+	}
+
+	// A job whose worker died runs again once its lease expires.
+	orphanID := enqueue("record", "orphan")
+	dead, err := jobs.NewWorkers(DefaultQueue, handlers, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job, err := dead.claim(ctx); err != nil || job == nil || job.ID != orphanID {
+		t.Fatalf("claim() = %v, %v; want orphan", job, err)
+	}
+	runAll()
+	time.Sleep(cfg.Lease)
+	ran = nil
+	runAll()
+	if want := []string{"orphan"}; !reflect.DeepEqual(ran, want) {
+		t.Errorf("ran %v, want %v", ran, want)
+	}
+
+	counts, err := jobs.Counts(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantCounts := []Count{
+		{DefaultQueue, Cancelled, 2},
+		{DefaultQueue, Failed, 1},
+		{DefaultQueue, Queued, 1},
+		{"other", Queued, 1},
+	}
+	if !reflect.DeepEqual(counts, wantCounts) {
+		t.Errorf("Counts() = %v, want %v", counts, wantCounts)
+	}
+
+	listed, err := jobs.List(ctx, ListOptions{Queue: DefaultQueue, State: Failed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 1 || listed[0].ID != unknownID {
+		t.Errorf("List(failed) = %+v, want the unknown job", listed)
+	}
+}
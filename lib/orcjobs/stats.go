@@ -0,0 +1,29 @@
+package orcjobs
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	statsNamespace = "jobs"
+)
+
+var (
+	metricRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: statsNamespace,
+		Name:      "runs",
+		Help:      "Number of job runs, by queue, kind and outcome (succeeded, retried, failed, lost or released)",
+	},
+		[]string{"queue", "kind", "outcome"},
+	)
+
+	metricRunDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: statsNamespace,
+		Name:      "run_duration_seconds",
+		Help:      "Time spent running jobs, by queue and kind",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 4, 10),
+	},
+		[]string{"queue", "kind"},
+	)
+)
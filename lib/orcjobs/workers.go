@@ -0,0 +1,406 @@
+package orcjobs
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/steinarvk/orclib/lib/orcdb"
+	"github.com/steinarvk/orclib/lib/orctimestamp"
+	"github.com/steinarvk/orclib/lib/uniqueid"
+)
+
+const (
+	// settleTimeout bounds recording the outcome of a job, which is done
+	// even if the workers are stopping.
+	settleTimeout = 10 * time.Second
+)
+
+// Handler runs a job. A job whose handler returns an error is retried
+// later, unless the error is Permanent or the job has run out of attempts.
+// Jobs may run more than once, e.g. if a worker dies, so handlers should
+// be idempotent.
+type Handler func(ctx context.Context, job Job) error
+
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// Permanent wraps an error from a handler to fail the job without
+// retrying it.
+func Permanent(err error) error {
+	return permanentError{err}
+}
+
+type WorkerConfig struct {
+	// Concurrency is the most jobs run at a time.
+	Concurrency int
+
+	// PollInterval is how often an idle worker looks for due jobs.
+	PollInterval time.Duration
+
+	// Lease is how long a job stays claimed by a worker without the
+	// worker renewing it. Leases are renewed while the job runs, every
+	// third of the lease.
+	Lease time.Duration
+
+	// MinBackoff and MaxBackoff bound the delay before retrying a failed
+	// job, which doubles with each failure.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+var DefaultWorkerConfig = WorkerConfig{
+	Concurrency:  4,
+	PollInterval: time.Second,
+	Lease:        time.Minute,
+	MinBackoff:   time.Second,
+	MaxBackoff:   time.Hour,
+}
+
+// Workers run the jobs of a queue in the background.
+type Workers struct {
+	jobs     *Jobs
+	queue    string
+	handlers map[string]Handler
+	cfg      WorkerConfig
+	owner    string
+
+	wake chan struct{}
+	stop chan struct{}
+	done sync.WaitGroup
+}
+
+// NewWorkers returns workers running the jobs of a queue with the handlers
+// of their kinds. Jobs of other kinds fail. Zero fields of cfg take their
+// values from DefaultWorkerConfig.
+func (j *Jobs) NewWorkers(queue string, handlers map[string]Handler, cfg WorkerConfig) (*Workers, error) {
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = DefaultWorkerConfig.Concurrency
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = DefaultWorkerConfig.PollInterval
+	}
+	if cfg.Lease <= 0 {
+		cfg.Lease = DefaultWorkerConfig.Lease
+	}
+	if cfg.MinBackoff <= 0 {
+		cfg.MinBackoff = DefaultWorkerConfig.MinBackoff
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = DefaultWorkerConfig.MaxBackoff
+	}
+
+	id, err := uniqueid.New()
+	if err != nil {
+		return nil, err
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+
+	return &Workers{
+		jobs:     j,
+		queue:    queue,
+		handlers: handlers,
+		cfg:      cfg,
+		owner:    fmt.Sprintf("%s/%s", hostname, id),
+		wake:     make(chan struct{}, 1),
+	}, nil
+}
+
+// claim leases the most urgent due job of the queue, if any. Jobs whose
+// lease expired on their last attempt fail rather than run again.
+func (w *Workers) claim(ctx context.Context) (*Job, error) {
+	var rv *Job
+	err := w.jobs.claimTransactor(ctx, w.jobs.db, func(ctx context.Context, tx *sql.Tx) error {
+		rv = nil
+		now := time.Now()
+
+		for {
+			row, err := orcdb.QueryOne[jobRow](ctx, w.jobs.due, tx, map[string]interface{}{
+				"queue": w.queue,
+				"now":   now.UnixMilli(),
+			})
+			if err == sql.ErrNoRows {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			job := row.job()
+
+			if job.State == Running && job.Attempts >= job.MaxAttempts {
+				if err := w.jobs.fail.Exec(ctx, tx, map[string]interface{}{
+					"id":         job.ID,
+					"owner":      job.LeaseOwner,
+					"last_error": fmt.Sprintf("Lease of %s expired on attempt %d", job.LeaseOwner, job.Attempts),
+					"updated_at": orctimestamp.Format(now),
+				}); err != nil {
+					return err
+				}
+				metricRuns.With(prometheus.Labels{"queue": job.Queue, "kind": job.Kind, "outcome": "failed"}).Inc()
+				continue
+			}
+
+			if err := w.jobs.claim.Exec(ctx, tx, map[string]interface{}{
+				"id":         job.ID,
+				"owner":      w.owner,
+				"until":      now.Add(w.cfg.Lease).UnixMilli(),
+				"updated_at": orctimestamp.Format(now),
+			}); err != nil {
+				return err
+			}
+
+			job.State = Running
+			job.Attempts++
+			job.LeaseOwner = w.owner
+			rv = &job
+			return nil
+		}
+	})
+	return rv, err
+}
+
+// extend renews the lease of a job, reporting whether the worker still
+// holds it.
+func (w *Workers) extend(ctx context.Context, job Job) (bool, error) {
+	held := false
+	err := orcdb.Transact(ctx, w.jobs.db, "jobs-extend", func(ctx context.Context, tx *sql.Tx) error {
+		result, err := w.jobs.extend.ExecWithResult(ctx, tx, map[string]interface{}{
+			"id":    job.ID,
+			"owner": w.owner,
+			"until": time.Now().Add(w.cfg.Lease).UnixMilli(),
+		})
+		if err != nil {
+			return err
+		}
+		n, err := result.RowsAffected()
+		held = n > 0
+		return err
+	})
+	return held, err
+}
+
+// heartbeat renews the lease of a job until stopped, cancelling the job if
+// the lease is lost (e.g. because the job was cancelled).
+func (w *Workers) heartbeat(ctx context.Context, job Job, cancel func(), lost *int32, stop <-chan struct{}) {
+	ticker := time.NewTicker(w.cfg.Lease / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		held, err := w.extend(ctx, job)
+		if err != nil {
+			logrus.Warningf("Unable to renew lease of job %s: %v", job.ID, err)
+			continue
+		}
+		if !held {
+			logrus.Warningf("Lost lease of job %s (%q); cancelling it", job.ID, job.Kind)
+			atomic.StoreInt32(lost, 1)
+			cancel()
+			return
+		}
+	}
+}
+
+// settle records the outcome of running a job.
+func (w *Workers) settle(ctx context.Context, job Job, runErr error) (string, error) {
+	now := time.Now()
+	args := map[string]interface{}{
+		"id":    job.ID,
+		"owner": w.owner,
+	}
+
+	outcome := "succeeded"
+	exec := w.jobs.complete
+	switch {
+	case runErr == nil:
+	case errors.As(runErr, new(permanentError)) || job.Attempts >= job.MaxAttempts:
+		outcome = "failed"
+		exec = w.jobs.fail
+		args["last_error"] = runErr.Error()
+		args["updated_at"] = orctimestamp.Format(now)
+	default:
+		outcome = "retried"
+		exec = w.jobs.reschedule
+		args["attempts"] = job.Attempts
+		args["run_at"] = now.Add(orcdb.Backoff(job.Attempts, w.cfg.MinBackoff, w.cfg.MaxBackoff)).UnixMilli()
+		args["last_error"] = runErr.Error()
+		args["updated_at"] = orctimestamp.Format(now)
+	}
+
+	err := orcdb.Transact(ctx, w.jobs.db, "jobs-settle", func(ctx context.Context, tx *sql.Tx) error {
+		result, err := exec.ExecWithResult(ctx, tx, args)
+		if err != nil {
+			return err
+		}
+		if n, err := result.RowsAffected(); err == nil && n == 0 {
+			outcome = "lost"
+		}
+		return nil
+	})
+	return outcome, err
+}
+
+// release returns a job interrupted by Stop to its queue, without
+// counting the attempt.
+func (w *Workers) release(ctx context.Context, job Job) error {
+	return orcdb.Transact(ctx, w.jobs.db, "jobs-release", func(ctx context.Context, tx *sql.Tx) error {
+		return w.jobs.reschedule.Exec(ctx, tx, map[string]interface{}{
+			"id":         job.ID,
+			"owner":      w.owner,
+			"attempts":   job.Attempts - 1,
+			"run_at":     time.Now().UnixMilli(),
+			"last_error": job.LastError,
+			"updated_at": orctimestamp.Format(time.Now()),
+		})
+	})
+}
+
+func (w *Workers) runHandler(ctx context.Context, job Job) (err error) {
+	handler, ok := w.handlers[job.Kind]
+	if !ok {
+		return Permanent(fmt.Errorf("No handler for jobs of kind %q in queue %q", job.Kind, job.Queue))
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Panic: %v", r)
+		}
+	}()
+	return handler(ctx, job)
+}
+
+// RunOnce claims and runs the most urgent due job of the queue, reporting
+// whether there was one.
+func (w *Workers) RunOnce(ctx context.Context) (bool, error) {
+	job, err := w.claim(ctx)
+	if err != nil || job == nil {
+		return false, err
+	}
+
+	jobCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var lost int32
+	stopHeartbeat := make(chan struct{})
+	heartbeatDone := make(chan struct{})
+	go func() {
+		defer close(heartbeatDone)
+		w.heartbeat(ctx, *job, cancel, &lost, stopHeartbeat)
+	}()
+
+	t0 := time.Now()
+	runErr := w.runHandler(jobCtx, *job)
+	duration := time.Since(t0)
+
+	close(stopHeartbeat)
+	<-heartbeatDone
+
+	labels := prometheus.Labels{"queue": job.Queue, "kind": job.Kind}
+	metricRunDuration.With(labels).Observe(duration.Seconds())
+
+	settleCtx, cancelSettle := context.WithTimeout(context.Background(), settleTimeout)
+	defer cancelSettle()
+
+	outcome := "lost"
+	switch {
+	case atomic.LoadInt32(&lost) != 0:
+	case ctx.Err() != nil && runErr != nil:
+		outcome = "released"
+		err = w.release(settleCtx, *job)
+	default:
+		outcome, err = w.settle(settleCtx, *job, runErr)
+	}
+	labels["outcome"] = outcome
+	metricRuns.With(labels).Inc()
+
+	switch outcome {
+	case "failed":
+		logrus.Errorf("Job %s (%q) failed after %d attempts: %v", job.ID, job.Kind, job.Attempts, runErr)
+	case "retried":
+		logrus.Warningf("Job %s (%q) failed (attempt %d of %d): %v", job.ID, job.Kind, job.Attempts, job.MaxAttempts, runErr)
+	}
+
+	return true, err
+}
+
+// Wake makes an idle worker look for due jobs now rather than at its next
+// poll.
+func (w *Workers) Wake() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (w *Workers) run(ctx context.Context) {
+	defer w.done.Done()
+
+	ticker := time.NewTicker(w.cfg.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		ran, err := w.RunOnce(ctx)
+		if err != nil && ctx.Err() == nil {
+			logrus.Errorf("Worker of job queue %q failed: %v", w.queue, err)
+		}
+		if ran && err == nil {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-w.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// Start starts running jobs in the background until Stop.
+func (w *Workers) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	w.stop = make(chan struct{})
+
+	w.jobs.mu.Lock()
+	w.jobs.workers[w] = true
+	w.jobs.mu.Unlock()
+
+	go func() {
+		<-w.stop
+		cancel()
+	}()
+	for i := 0; i < w.cfg.Concurrency; i++ {
+		w.done.Add(1)
+		go w.run(ctx)
+	}
+}
+
+// Stop stops running jobs, cancelling the contexts of running handlers
+// and returning their jobs to the queue once they return.
+func (w *Workers) Stop() {
+	w.jobs.mu.Lock()
+	delete(w.jobs.workers, w)
+	w.jobs.mu.Unlock()
+
+	close(w.stop)
+	w.done.Wait()
+}
@@ -0,0 +1,164 @@
+package orckeys
+
+import (
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"github.com/steinarvk/orclib/lib/canonicalgojson"
+)
+
+type Countersignature struct {
+	// Signer is the owner of the countersigning keys.
+	Signer string `json:"signer"`
+
+	// SignerKeyID is the ID of the generation of keys that made the signature.
+	SignerKeyID string `json:"signer_key_id"`
+
+	// Signature is over the canonical JSON form of the Endorsement.
+	Signature string `json:"signature"`
+}
+
+// Endorsement is the statement a countersignature is made over. It leaves
+// out the validity bounds, so that countersignatures survive rotation.
+type Endorsement struct {
+	ID                  string `json:"id"`
+	Owner               string `json:"owner"`
+	PublicSigningKey    string `json:"public_signing_key"`
+	PublicEncryptionKey string `json:"public_encryption_key"`
+}
+
+func (p PublicKeyPacket) endorsement() ([]byte, error) {
+	return canonicalgojson.MarshalCanonicalGoJSON(Endorsement{
+		ID:                  p.Metadata.ID,
+		Owner:               p.Metadata.Owner,
+		PublicSigningKey:    p.PublicSigningKey,
+		PublicEncryptionKey: p.PublicEncryptionKey,
+	})
+}
+
+func fromGenerations(generations []PublicKeyPacket) PublicKeyPacket {
+	rv := generations[0]
+	rv.Previous = append([]PublicKeyPacket(nil), generations[1:]...)
+	return rv
+}
+
+// Countersign returns a copy of p in which every generation carries a
+// countersignature by the currently active keys of k.
+func (k *Keys) Countersign(p PublicKeyPacket) (PublicKeyPacket, error) {
+	signingKeys, err := k.ActiveAt(time.Now())
+	if err != nil {
+		return PublicKeyPacket{}, err
+	}
+
+	var generations []PublicKeyPacket
+	for _, generation := range p.Generations() {
+		countersignature, err := signingKeys.countersignature(generation)
+		if err != nil {
+			return PublicKeyPacket{}, err
+		}
+
+		generation.Metadata.Countersignatures = append(append([]Countersignature(nil), generation.Metadata.Countersignatures...), countersignature)
+		generations = append(generations, generation)
+	}
+
+	return fromGenerations(generations), nil
+}
+
+// countersignature signs the endorsement of a single generation of p with
+// this generation of keys.
+func (k *Keys) countersignature(p PublicKeyPacket) (Countersignature, error) {
+	statement, err := p.endorsement()
+	if err != nil {
+		return Countersignature{}, fmt.Errorf("Error marshalling endorsement of %q: %v", p.Metadata.ID, err)
+	}
+
+	sig, err := k.Signer.Sign(statement)
+	if err != nil {
+		return Countersignature{}, fmt.Errorf("Error countersigning %q: %v", p.Metadata.ID, err)
+	}
+
+	return Countersignature{
+		Signer:      k.Metadata.Owner,
+		SignerKeyID: k.Metadata.ID,
+		Signature:   base64.RawStdEncoding.EncodeToString(sig),
+	}, nil
+}
+
+func (p PublicKeyPacket) isCountersignedBy(root PublicKeyPacket, t time.Time) bool {
+	statement, err := p.endorsement()
+	if err != nil {
+		return false
+	}
+
+	for _, rootGeneration := range root.ValidAt(t) {
+		verifier, err := rootGeneration.VerifyFrom()
+		if err != nil {
+			continue
+		}
+		for _, countersignature := range p.Metadata.Countersignatures {
+			if countersignature.Signer != rootGeneration.Metadata.Owner || countersignature.SignerKeyID != rootGeneration.Metadata.ID {
+				continue
+			}
+			sig, err := base64.RawStdEncoding.DecodeString(countersignature.Signature)
+			if err != nil {
+				continue
+			}
+			if verifier.Verify(sig, statement) == nil {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// CountersignedBy returns the generations of p that carry a countersignature
+// by keys of root valid at time t, or an error if there are none.
+func (p PublicKeyPacket) CountersignedBy(root PublicKeyPacket, t time.Time) (PublicKeyPacket, error) {
+	var generations []PublicKeyPacket
+	for _, generation := range p.Generations() {
+		if generation.isCountersignedBy(root, t) {
+			generations = append(generations, generation)
+		}
+	}
+	if len(generations) == 0 {
+		return PublicKeyPacket{}, fmt.Errorf("Keys for %q are not countersigned by %q", p.Metadata.Owner, root.Metadata.Owner)
+	}
+	return fromGenerations(generations), nil
+}
+
+// AttachCountersignatures copies countersignatures from the matching
+// generations of a public key packet into p, which need not be decrypted.
+// It returns the number of countersignatures added.
+func (p *PrivateKeyPacket) AttachCountersignatures(public PublicKeyPacket) int {
+	byID := map[string][]Countersignature{}
+	for _, generation := range public.Generations() {
+		if generation.Metadata.Owner == p.Metadata.Owner {
+			byID[generation.Metadata.ID] = generation.Metadata.Countersignatures
+		}
+	}
+	return p.attachCountersignatures(byID)
+}
+
+func (p *PrivateKeyPacket) attachCountersignatures(byID map[string][]Countersignature) int {
+	added := 0
+
+	have := map[string]bool{}
+	for _, existing := range p.Metadata.Countersignatures {
+		have[existing.Signature] = true
+	}
+	for _, countersignature := range byID[p.Metadata.ID] {
+		if !have[countersignature.Signature] {
+			p.Metadata.Countersignatures = append(p.Metadata.Countersignatures, countersignature)
+			have[countersignature.Signature] = true
+			added++
+		}
+	}
+
+	for i := range p.Previous {
+		added += p.Previous[i].attachCountersignatures(byID)
+	}
+
+	return added
+}
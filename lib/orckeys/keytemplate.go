@@ -1,9 +1,215 @@
 package orckeys
 
 import (
+	"fmt"
+	"sort"
+	"strings"
+
 	"github.com/google/tink/go/hybrid"
+	"github.com/google/tink/go/keyset"
 	"github.com/google/tink/go/signature"
+
+	tinkpb "github.com/google/tink/go/proto/tink_go_proto"
+)
+
+const (
+	SigningECDSAP256 = "ecdsa-p256"
+	SigningEd25519   = "ed25519"
+
+	EncryptionECIESP256  = "ecies-p256"
+	EncryptionHPKEX25519 = "hpke-x25519"
 )
 
+// DefaultSigningKeyTemplate and DefaultEncryptionKeyTemplate are the
+// templates used for the default algorithms.
 var DefaultSigningKeyTemplate = signature.ECDSAP256KeyTemplate()
 var DefaultEncryptionKeyTemplate = hybrid.ECIESHKDFAES128CTRHMACSHA256KeyTemplate()
+
+// Algorithms names the kinds of keys used for signing and for encryption.
+type Algorithms struct {
+	Signing    string
+	Encryption string
+}
+
+func (a Algorithms) String() string {
+	return a.Signing + "+" + a.Encryption
+}
+
+var DefaultAlgorithms = Algorithms{
+	Signing:    SigningECDSAP256,
+	Encryption: EncryptionECIESP256,
+}
+
+// AlgorithmSuites are the named combinations of algorithms accepted by
+// ParseAlgorithms.
+var AlgorithmSuites = map[string]Algorithms{
+	"p256": DefaultAlgorithms,
+	"25519": {
+		Signing:    SigningEd25519,
+		Encryption: EncryptionHPKEX25519,
+	},
+}
+
+type keyKind struct {
+	template      func() *tinkpb.KeyTemplate
+	typeURL       string
+	publicTypeURL string
+}
+
+var signingKinds = map[string]keyKind{
+	SigningECDSAP256: {
+		template:      func() *tinkpb.KeyTemplate { return DefaultSigningKeyTemplate },
+		typeURL:       "type.googleapis.com/google.crypto.tink.EcdsaPrivateKey",
+		publicTypeURL: "type.googleapis.com/google.crypto.tink.EcdsaPublicKey",
+	},
+	SigningEd25519: {
+		template:      signature.ED25519KeyTemplate,
+		typeURL:       "type.googleapis.com/google.crypto.tink.Ed25519PrivateKey",
+		publicTypeURL: "type.googleapis.com/google.crypto.tink.Ed25519PublicKey",
+	},
+}
+
+var encryptionKinds = map[string]keyKind{
+	EncryptionECIESP256: {
+		template:      func() *tinkpb.KeyTemplate { return DefaultEncryptionKeyTemplate },
+		typeURL:       "type.googleapis.com/google.crypto.tink.EciesAeadHkdfPrivateKey",
+		publicTypeURL: "type.googleapis.com/google.crypto.tink.EciesAeadHkdfPublicKey",
+	},
+	EncryptionHPKEX25519: {
+		template:      hybrid.DHKEM_X25519_HKDF_SHA256_HKDF_SHA256_AES_256_GCM_Key_Template,
+		typeURL:       "type.googleapis.com/google.crypto.tink.HpkePrivateKey",
+		publicTypeURL: "type.googleapis.com/google.crypto.tink.HpkePublicKey",
+	},
+}
+
+func sortedNames(m map[string]keyKind) string {
+	var names []string
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// ParseAlgorithms accepts either the name of a suite in AlgorithmSuites or
+// a signing and an encryption algorithm joined by "+", e.g.
+// "ed25519+ecies-p256".
+func ParseAlgorithms(s string) (Algorithms, error) {
+	if suite, ok := AlgorithmSuites[s]; ok {
+		return suite, nil
+	}
+
+	components := strings.Split(s, "+")
+	if len(components) != 2 {
+		var suites []string
+		for name := range AlgorithmSuites {
+			suites = append(suites, name)
+		}
+		sort.Strings(suites)
+		return Algorithms{}, fmt.Errorf("Unknown algorithm %q: expected one of %s, or <signing>+<encryption>", s, strings.Join(suites, ", "))
+	}
+
+	rv := Algorithms{Signing: components[0], Encryption: components[1]}
+	if err := rv.validate(); err != nil {
+		return Algorithms{}, err
+	}
+	return rv, nil
+}
+
+func (a Algorithms) validate() error {
+	if _, ok := signingKinds[a.Signing]; !ok {
+		return fmt.Errorf("Unknown signing algorithm %q (expected one of %s)", a.Signing, sortedNames(signingKinds))
+	}
+	if _, ok := encryptionKinds[a.Encryption]; !ok {
+		return fmt.Errorf("Unknown encryption algorithm %q (expected one of %s)", a.Encryption, sortedNames(encryptionKinds))
+	}
+	return nil
+}
+
+// primaryKind returns the algorithm of the primary key of a keyset, public or
+// private.
+func primaryKind(handle *keyset.Handle, kinds map[string]keyKind) (string, error) {
+	info := handle.KeysetInfo()
+	for _, keyInfo := range info.GetKeyInfo() {
+		if keyInfo.GetKeyId() != info.GetPrimaryKeyId() {
+			continue
+		}
+		for name, kind := range kinds {
+			if keyInfo.GetTypeUrl() == kind.typeURL || keyInfo.GetTypeUrl() == kind.publicTypeURL {
+				return name, nil
+			}
+		}
+		return "", fmt.Errorf("Unknown key type %q (expected one of %s)", keyInfo.GetTypeUrl(), sortedNames(kinds))
+	}
+	return "", fmt.Errorf("Keyset has no primary key")
+}
+
+// algorithmOf returns the recorded algorithm of a keyset, or for keys
+// from before algorithms were recorded, the algorithm of its primary key.
+func algorithmOf(recorded string, handle *keyset.Handle, kinds map[string]keyKind) (string, error) {
+	if recorded != "" {
+		return recorded, nil
+	}
+	return primaryKind(handle, kinds)
+}
+
+// setAlgorithms records the algorithms of the primary keys of the
+// keysets in metadata, which must not contradict those already recorded.
+func setAlgorithms(metadata *Metadata, signingKey, encryptionKey *keyset.Handle) error {
+	signing, err := primaryKind(signingKey, signingKinds)
+	if err != nil {
+		return fmt.Errorf("Invalid signing key: %v", err)
+	}
+	encryption, err := primaryKind(encryptionKey, encryptionKinds)
+	if err != nil {
+		return fmt.Errorf("Invalid encryption key: %v", err)
+	}
+	if metadata.SigningAlgorithm != "" && metadata.SigningAlgorithm != signing {
+		return fmt.Errorf("Signing key is %q, but metadata says %q", signing, metadata.SigningAlgorithm)
+	}
+	if metadata.EncryptionAlgorithm != "" && metadata.EncryptionAlgorithm != encryption {
+		return fmt.Errorf("Encryption key is %q, but metadata says %q", encryption, metadata.EncryptionAlgorithm)
+	}
+	metadata.SigningAlgorithm = signing
+	metadata.EncryptionAlgorithm = encryption
+	return nil
+}
+
+// Algorithms returns the algorithms the keys were generated with.
+func (k *Keys) Algorithms() Algorithms {
+	return k.algorithms
+}
+
+// Algorithms returns the algorithms of the public keys.
+func (p PublicKeyPacket) Algorithms() (Algorithms, error) {
+	signingKey, err := stringToPublicKey(p.PublicSigningKey)
+	if err != nil {
+		return Algorithms{}, fmt.Errorf("Unable to parse public signing key: %v", err)
+	}
+	encryptionKey, err := stringToPublicKey(p.PublicEncryptionKey)
+	if err != nil {
+		return Algorithms{}, fmt.Errorf("Unable to parse public encryption key: %v", err)
+	}
+
+	var rv Algorithms
+	if rv.Signing, err = algorithmOf(p.Metadata.SigningAlgorithm, signingKey, signingKinds); err != nil {
+		return Algorithms{}, fmt.Errorf("Invalid signing key: %v", err)
+	}
+	if rv.Encryption, err = algorithmOf(p.Metadata.EncryptionAlgorithm, encryptionKey, encryptionKinds); err != nil {
+		return Algorithms{}, fmt.Errorf("Invalid encryption key: %v", err)
+	}
+	return rv, nil
+}
+
+func checkKeyKind(handle *keyset.Handle, kinds map[string]keyKind, name string) error {
+	kind, ok := kinds[name]
+	if !ok {
+		return fmt.Errorf("Unknown algorithm %q", name)
+	}
+	for _, keyInfo := range handle.KeysetInfo().GetKeyInfo() {
+		if keyInfo.GetTypeUrl() != kind.typeURL && keyInfo.GetTypeUrl() != kind.publicTypeURL {
+			return fmt.Errorf("Key of type %q does not match algorithm %q", keyInfo.GetTypeUrl(), name)
+		}
+	}
+	return nil
+}
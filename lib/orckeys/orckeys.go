@@ -21,6 +21,19 @@ type Metadata struct {
 	Owner   string `json:"owner"`
 	Created string `json:"creation_time"`
 	Updated string `json:"update_time"`
+
+	// NotBefore and NotAfter, if set, bound the time during which the keys
+	// may be used.
+	NotBefore string `json:"not_before,omitempty"`
+	NotAfter  string `json:"not_after,omitempty"`
+
+	// SigningAlgorithm and EncryptionAlgorithm name the kinds of keys.
+	// They are empty for keys generated with the original defaults.
+	SigningAlgorithm    string `json:"signing_algorithm,omitempty"`
+	EncryptionAlgorithm string `json:"encryption_algorithm,omitempty"`
+
+	// Countersignatures by other keys vouching for these keys.
+	Countersignatures []Countersignature `json:"countersignatures,omitempty"`
 }
 
 type Key struct {
@@ -32,14 +45,18 @@ type PublicKeyPacket struct {
 	Metadata            Metadata `json:"metadata"`
 	PublicSigningKey    string   `json:"public_signing_key"`
 	PublicEncryptionKey string   `json:"public_encryption_key"`
+
+	// Previous holds earlier generations of keys that may still be in use.
+	Previous []PublicKeyPacket `json:"previous,omitempty"`
 }
 
 type PrivateKeyPacket struct {
-	Metadata             Metadata `json:"metadata"`
-	Encrypted            bool     `json:"encrypted"`
-	MasterKeyURI         string   `json:"master_key_uri"`
-	PrivateSigningKey    []byte   `json:"private_signing_key"`
-	PrivateEncryptionKey []byte   `json:"private_encryption_key"`
+	Metadata             Metadata           `json:"metadata"`
+	Encrypted            bool               `json:"encrypted"`
+	MasterKeyURI         string             `json:"master_key_uri"`
+	PrivateSigningKey    []byte             `json:"private_signing_key"`
+	PrivateEncryptionKey []byte             `json:"private_encryption_key"`
+	Previous             []PrivateKeyPacket `json:"previous,omitempty"`
 }
 
 func (p PublicKeyPacket) EncryptTo() (tink.HybridEncrypt, error) {
@@ -69,11 +86,35 @@ type Keys struct {
 	Metadata      Metadata
 	SigningKey    *Key
 	EncryptionKey *Key
-	Signer        tink.Signer
-	Decrypt       tink.HybridDecrypt
+
+	// Signer signs with these keys only, regardless of validity.
+	Signer tink.Signer
+
+	// Decrypt decrypts with any generation of keys that is currently valid.
+	Decrypt tink.HybridDecrypt
+
+	// Previous holds earlier generations of keys, newest first.
+	Previous []*Keys
+
+	algorithms Algorithms
+	decrypt    tink.HybridDecrypt
 }
 
 func (k *Keys) Public() PublicKeyPacket {
+	rv := k.publicGeneration()
+
+	now := time.Now()
+	for _, previous := range k.Previous {
+		if previous.Metadata.expiredAt(now) {
+			continue
+		}
+		rv.Previous = append(rv.Previous, previous.publicGeneration())
+	}
+
+	return rv
+}
+
+func (k *Keys) publicGeneration() PublicKeyPacket {
 	return PublicKeyPacket{
 		Metadata:            k.Metadata,
 		PublicSigningKey:    k.SigningKey.PublicKey,
@@ -106,7 +147,7 @@ func (k *Keys) sanityCheck() error {
 		return fmt.Errorf("Failed to encrypt empty string: %v", err)
 	}
 
-	plaintext, err := k.Decrypt.Decrypt(ciphertext, nil)
+	plaintext, err := k.decrypt.Decrypt(ciphertext, nil)
 	if err != nil {
 		return fmt.Errorf("Failed to decrypt empty string: %v", err)
 	}
@@ -119,6 +160,21 @@ func (k *Keys) sanityCheck() error {
 }
 
 func fromKeyHandles(metadata Metadata, signingKey, encryptionKey *keyset.Handle) (*Keys, error) {
+	var algorithms Algorithms
+	var err error
+	if algorithms.Signing, err = algorithmOf(metadata.SigningAlgorithm, signingKey, signingKinds); err != nil {
+		return nil, fmt.Errorf("Invalid signing key: %v", err)
+	}
+	if algorithms.Encryption, err = algorithmOf(metadata.EncryptionAlgorithm, encryptionKey, encryptionKinds); err != nil {
+		return nil, fmt.Errorf("Invalid encryption key: %v", err)
+	}
+	if err := checkKeyKind(signingKey, signingKinds, algorithms.Signing); err != nil {
+		return nil, fmt.Errorf("Invalid signing key: %v", err)
+	}
+	if err := checkKeyKind(encryptionKey, encryptionKinds, algorithms.Encryption); err != nil {
+		return nil, fmt.Errorf("Invalid encryption key: %v", err)
+	}
+
 	publicSigningKey, err := publicKeyToString(signingKey)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to format public signing key: %v", err)
@@ -140,7 +196,8 @@ func fromKeyHandles(metadata Metadata, signingKey, encryptionKey *keyset.Handle)
 	}
 
 	rv := &Keys{
-		Metadata: metadata,
+		Metadata:   metadata,
+		algorithms: algorithms,
 		SigningKey: &Key{
 			PublicKey:  publicSigningKey,
 			privateKey: signingKey,
@@ -150,38 +207,51 @@ func fromKeyHandles(metadata Metadata, signingKey, encryptionKey *keyset.Handle)
 			privateKey: encryptionKey,
 		},
 		Signer:  signer,
-		Decrypt: decrypter,
+		decrypt: decrypter,
 	}
+	rv.Decrypt = keyringDecrypt{rv}
 
 	if err := rv.sanityCheck(); err != nil {
 		return nil, fmt.Errorf("Server keys failed sanity check: %v", err)
 	}
 
+	rv.Signer = instrumentedSigner{signer: rv.Signer, owner: metadata.Owner}
+
 	return rv, nil
 }
 
 func Generate(owner string) (*Keys, error) {
+	return GenerateWithAlgorithms(owner, DefaultAlgorithms)
+}
+
+func GenerateWithAlgorithms(owner string, algorithms Algorithms) (*Keys, error) {
+	if err := algorithms.validate(); err != nil {
+		return nil, err
+	}
+
 	id, err := uniqueid.New()
 	if err != nil {
 		return nil, fmt.Errorf("Failed to generate unique ID: %v", err)
 	}
 
-	signingKey, err := keyset.NewHandle(DefaultSigningKeyTemplate)
+	signingKey, err := keyset.NewHandle(signingKinds[algorithms.Signing].template())
 	if err != nil {
 		return nil, fmt.Errorf("Failed to generate signing key: %v", err)
 	}
 
-	encryptionKey, err := keyset.NewHandle(DefaultEncryptionKeyTemplate)
+	encryptionKey, err := keyset.NewHandle(encryptionKinds[algorithms.Encryption].template())
 	if err != nil {
 		return nil, fmt.Errorf("Failed to generate encryption key: %v", err)
 	}
 
 	t := time.Now()
 	return fromKeyHandles(Metadata{
-		ID:      id,
-		Owner:   owner,
-		Created: orctimestamp.Format(t),
-		Updated: orctimestamp.Format(t),
+		ID:                  id,
+		Owner:               owner,
+		Created:             orctimestamp.Format(t),
+		Updated:             orctimestamp.Format(t),
+		SigningAlgorithm:    algorithms.Signing,
+		EncryptionAlgorithm: algorithms.Encryption,
 	}, signingKey, encryptionKey)
 }
 
@@ -197,20 +267,15 @@ func getMasterKey(masterKeyURI string) (tink.AEAD, error) {
 	return masterKey, nil
 }
 
-func (k *Keys) WriteEncrypted(w io.Writer, masterKeyURI string) error {
-	masterKey, err := getMasterKey(masterKeyURI)
-	if err != nil {
-		return err
-	}
-
+func (k *Keys) privatePacket(masterKey tink.AEAD, masterKeyURI string) (PrivateKeyPacket, error) {
 	var signingKeyData, encryptionKeyData bytes.Buffer
 
 	if err := k.SigningKey.privateKey.Write(keyset.NewBinaryWriter(&signingKeyData), masterKey); err != nil {
-		return fmt.Errorf("Unable to write signing key (using master key %q): %v", masterKeyURI, err)
+		return PrivateKeyPacket{}, fmt.Errorf("Unable to write signing key (using master key %q): %v", masterKeyURI, err)
 	}
 
 	if err := k.EncryptionKey.privateKey.Write(keyset.NewBinaryWriter(&encryptionKeyData), masterKey); err != nil {
-		return fmt.Errorf("Unable to write encryption key (using master key %q): %v", masterKeyURI, err)
+		return PrivateKeyPacket{}, fmt.Errorf("Unable to write encryption key (using master key %q): %v", masterKeyURI, err)
 	}
 
 	packet := PrivateKeyPacket{
@@ -221,9 +286,64 @@ func (k *Keys) WriteEncrypted(w io.Writer, masterKeyURI string) error {
 		PrivateEncryptionKey: encryptionKeyData.Bytes(),
 	}
 
+	for _, previous := range k.Previous {
+		previousPacket, err := previous.privatePacket(masterKey, masterKeyURI)
+		if err != nil {
+			return PrivateKeyPacket{}, fmt.Errorf("Unable to write previous keys %q: %v", previous.Metadata.ID, err)
+		}
+		packet.Previous = append(packet.Previous, previousPacket)
+	}
+
+	return packet, nil
+}
+
+func (k *Keys) WriteEncrypted(w io.Writer, masterKeyURI string) error {
+	masterKey, err := getMasterKey(masterKeyURI)
+	if err != nil {
+		return err
+	}
+
+	packet, err := k.privatePacket(masterKey, masterKeyURI)
+	if err != nil {
+		return err
+	}
+
 	return json.NewEncoder(w).Encode(packet)
 }
 
+func fromPrivatePacket(packet PrivateKeyPacket, masterKey tink.AEAD, masterKeyURI string) (*Keys, error) {
+	privateSigningKeyBuf := bytes.NewBuffer(packet.PrivateSigningKey)
+	privateEncryptionKeyBuf := bytes.NewBuffer(packet.PrivateEncryptionKey)
+
+	privateSigningKey, err := keyset.Read(keyset.NewBinaryReader(privateSigningKeyBuf), masterKey)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read private signing key (using master key %q): %v", masterKeyURI, err)
+	}
+
+	privateEncryptionKey, err := keyset.Read(keyset.NewBinaryReader(privateEncryptionKeyBuf), masterKey)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read private encryption key (using master key %q): %v", masterKeyURI, err)
+	}
+
+	rv, err := fromKeyHandles(packet.Metadata, privateSigningKey, privateEncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, previousPacket := range packet.Previous {
+		if previousPacket.Metadata.Owner != packet.Metadata.Owner {
+			return nil, fmt.Errorf("Previous keys %q owned by %q, not %q", previousPacket.Metadata.ID, previousPacket.Metadata.Owner, packet.Metadata.Owner)
+		}
+		previous, err := fromPrivatePacket(previousPacket, masterKey, masterKeyURI)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read previous keys %q: %v", previousPacket.Metadata.ID, err)
+		}
+		rv.Previous = append(rv.Previous, previous)
+	}
+
+	return rv, nil
+}
+
 func LoadEncrypted(r io.Reader, overrideMasterKeyURI string) (*Keys, error) {
 	var packet PrivateKeyPacket
 	if err := json.NewDecoder(r).Decode(&packet); err != nil {
@@ -244,18 +364,5 @@ func LoadEncrypted(r io.Reader, overrideMasterKeyURI string) (*Keys, error) {
 		return nil, err
 	}
 
-	privateSigningKeyBuf := bytes.NewBuffer(packet.PrivateSigningKey)
-	privateEncryptionKeyBuf := bytes.NewBuffer(packet.PrivateEncryptionKey)
-
-	privateSigningKey, err := keyset.Read(keyset.NewBinaryReader(privateSigningKeyBuf), masterKey)
-	if err != nil {
-		return nil, fmt.Errorf("Unable to read private signing key (using master key %q): %v", masterKeyURI, err)
-	}
-
-	privateEncryptionKey, err := keyset.Read(keyset.NewBinaryReader(privateEncryptionKeyBuf), masterKey)
-	if err != nil {
-		return nil, fmt.Errorf("Unable to read private encryption key (using master key %q): %v", masterKeyURI, err)
-	}
-
-	return fromKeyHandles(packet.Metadata, privateSigningKey, privateEncryptionKey)
+	return fromPrivatePacket(packet, masterKey, masterKeyURI)
 }
@@ -0,0 +1,194 @@
+package orckeys
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/steinarvk/orclib/lib/orctimestamp"
+)
+
+type NotYetValid struct {
+	ID        string
+	NotBefore string
+}
+
+func (e NotYetValid) Error() string {
+	return fmt.Sprintf("Keys %q are not valid before %s", e.ID, e.NotBefore)
+}
+
+type Expired struct {
+	ID       string
+	NotAfter string
+}
+
+func (e Expired) Error() string {
+	return fmt.Sprintf("Keys %q expired at %s", e.ID, e.NotAfter)
+}
+
+// ValidAt returns an error unless the keys may be used at time t.
+// Unparseable bounds are treated as excluding every time.
+func (m Metadata) ValidAt(t time.Time) error {
+	if m.NotBefore != "" {
+		notBefore, err := orctimestamp.Parse(m.NotBefore)
+		if err != nil {
+			return fmt.Errorf("Keys %q have invalid not_before %q: %v", m.ID, m.NotBefore, err)
+		}
+		if t.Before(notBefore) {
+			return NotYetValid{ID: m.ID, NotBefore: m.NotBefore}
+		}
+	}
+
+	if m.expiredAt(t) {
+		return Expired{ID: m.ID, NotAfter: m.NotAfter}
+	}
+
+	return nil
+}
+
+func (m Metadata) expiredAt(t time.Time) bool {
+	if m.NotAfter == "" {
+		return false
+	}
+	notAfter, err := orctimestamp.Parse(m.NotAfter)
+	return err != nil || t.After(notAfter)
+}
+
+// Generations returns these keys followed by all previous generations.
+func (k *Keys) Generations() []*Keys {
+	return append([]*Keys{k}, k.Previous...)
+}
+
+// ActiveAt returns the newest generation of keys valid at time t, which
+// is the one that should be used for signing.
+func (k *Keys) ActiveAt(t time.Time) (*Keys, error) {
+	var firstErr error
+	for _, generation := range k.Generations() {
+		err := generation.Metadata.ValidAt(t)
+		if err == nil {
+			return generation, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, fmt.Errorf("No valid keys for %q: %v", k.Metadata.Owner, firstErr)
+}
+
+// Generations returns this packet followed by all previous generations,
+// each without its own Previous list.
+func (p PublicKeyPacket) Generations() []PublicKeyPacket {
+	current := p
+	current.Previous = nil
+
+	rv := []PublicKeyPacket{current}
+	for _, previous := range p.Previous {
+		previous.Previous = nil
+		rv = append(rv, previous)
+	}
+	return rv
+}
+
+// ValidAt returns the generations of public keys valid at time t, newest first.
+func (p PublicKeyPacket) ValidAt(t time.Time) []PublicKeyPacket {
+	var rv []PublicKeyPacket
+	for _, generation := range p.Generations() {
+		if generation.Metadata.ValidAt(t) == nil {
+			rv = append(rv, generation)
+		}
+	}
+	return rv
+}
+
+// ActiveAt returns the newest generation of public keys valid at time t,
+// which is the one that should be used for encryption.
+func (p PublicKeyPacket) ActiveAt(t time.Time) (PublicKeyPacket, error) {
+	valid := p.ValidAt(t)
+	if len(valid) == 0 {
+		return PublicKeyPacket{}, fmt.Errorf("No valid public keys for %q", p.Metadata.Owner)
+	}
+	return valid[0], nil
+}
+
+// keyringDecrypt decrypts with whichever currently valid generation of keys
+// the ciphertext was encrypted to.
+type keyringDecrypt struct {
+	keys *Keys
+}
+
+func (d keyringDecrypt) Decrypt(ciphertext, contextInfo []byte) ([]byte, error) {
+	plaintext, err := d.decrypt(ciphertext, contextInfo)
+	countKeyOperation("decrypt", d.keys.Metadata.Owner, err)
+	return plaintext, err
+}
+
+func (d keyringDecrypt) decrypt(ciphertext, contextInfo []byte) ([]byte, error) {
+	now := time.Now()
+
+	var firstErr error
+	for _, generation := range d.keys.Generations() {
+		if err := generation.Metadata.ValidAt(now); err != nil {
+			continue
+		}
+		plaintext, err := generation.decrypt.Decrypt(ciphertext, contextInfo)
+		if err == nil {
+			return plaintext, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	if firstErr == nil {
+		return nil, fmt.Errorf("No valid keys for %q to decrypt with", d.keys.Metadata.Owner)
+	}
+	return nil, firstErr
+}
+
+// Rotate generates a new generation of keys that becomes active at
+// activateAt, keeping the current keys valid until overlap after that.
+// Previous generations that have already expired are dropped. The current
+// keys countersign the new ones, so that peers that trust them can trust
+// their successor.
+func (k *Keys) Rotate(activateAt time.Time, overlap time.Duration) (*Keys, error) {
+	return k.RotateTo(k.Algorithms(), activateAt, overlap)
+}
+
+// RotateTo is like Rotate, but generates the new keys with the given
+// algorithms, e.g. to migrate to different kinds of keys.
+func (k *Keys) RotateTo(algorithms Algorithms, activateAt time.Time, overlap time.Duration) (*Keys, error) {
+	rv, err := GenerateWithAlgorithms(k.Metadata.Owner, algorithms)
+	if err != nil {
+		return nil, err
+	}
+	rv.Metadata.NotBefore = orctimestamp.Format(activateAt)
+
+	now := time.Now()
+	notAfter := activateAt.Add(overlap)
+
+	if active, err := k.ActiveAt(now); err == nil {
+		countersignature, err := active.countersignature(rv.publicGeneration())
+		if err != nil {
+			return nil, err
+		}
+		rv.Metadata.Countersignatures = append(rv.Metadata.Countersignatures, countersignature)
+	}
+
+	for _, generation := range k.Generations() {
+		if generation.Metadata.expiredAt(now) {
+			continue
+		}
+
+		retired := *generation
+		retired.Previous = nil
+		retired.Decrypt = keyringDecrypt{&retired}
+
+		if !retired.Metadata.expiredAt(notAfter) {
+			retired.Metadata.NotAfter = orctimestamp.Format(notAfter)
+			retired.Metadata.Updated = orctimestamp.Format(now)
+		}
+
+		rv.Previous = append(rv.Previous, &retired)
+	}
+
+	return rv, nil
+}
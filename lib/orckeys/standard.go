@@ -0,0 +1,609 @@
+package orckeys
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"fmt"
+	"math/big"
+
+	"github.com/google/tink/go/insecurecleartextkeyset"
+	"github.com/google/tink/go/keyset"
+	"google.golang.org/protobuf/proto"
+
+	commonpb "github.com/google/tink/go/proto/common_go_proto"
+	ecdsapb "github.com/google/tink/go/proto/ecdsa_go_proto"
+	eciespb "github.com/google/tink/go/proto/ecies_aead_hkdf_go_proto"
+	ed25519pb "github.com/google/tink/go/proto/ed25519_go_proto"
+	hpkepb "github.com/google/tink/go/proto/hpke_go_proto"
+	tinkpb "github.com/google/tink/go/proto/tink_go_proto"
+)
+
+const (
+	UseSigning    = "sig"
+	UseEncryption = "enc"
+)
+
+// StandardKey is a single signing or encryption key as a standard Go crypto
+// key, for conversion to formats understood by other tools.
+//
+// Public is an *ecdsa.PublicKey, ed25519.PublicKey or *ecdh.PublicKey.
+// Private, if set, is the corresponding *ecdsa.PrivateKey,
+// ed25519.PrivateKey or *ecdh.PrivateKey.
+//
+// TinkKeyID is the ID of the key within its Tink keyset. Signatures and
+// ciphertexts made with orc keys are tagged with it, so it must be kept for
+// imported keys to interoperate with the originals. It is zero if unknown,
+// in which case a fresh ID is assigned on import.
+type StandardKey struct {
+	Use       string
+	Algorithm string
+	Public    crypto.PublicKey
+	Private   crypto.PrivateKey
+	TinkKeyID uint32
+}
+
+// StandardKeys returns the signing and encryption keys of this generation,
+// without the private keys.
+func (p PublicKeyPacket) StandardKeys() ([]StandardKey, error) {
+	algorithms, err := p.Algorithms()
+	if err != nil {
+		return nil, err
+	}
+
+	signing, err := standardFromPublicString(p.PublicSigningKey, UseSigning, algorithms.Signing)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to convert public signing key: %v", err)
+	}
+	encryption, err := standardFromPublicString(p.PublicEncryptionKey, UseEncryption, algorithms.Encryption)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to convert public encryption key: %v", err)
+	}
+	return []StandardKey{signing, encryption}, nil
+}
+
+// StandardKeys returns the signing and encryption keys of this generation,
+// including the private keys.
+func (k *Keys) StandardKeys() ([]StandardKey, error) {
+	algorithms := k.Algorithms()
+
+	signing, err := standardFromPrivateHandle(k.SigningKey.privateKey, UseSigning, algorithms.Signing)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to convert signing key: %v", err)
+	}
+	encryption, err := standardFromPrivateHandle(k.EncryptionKey.privateKey, UseEncryption, algorithms.Encryption)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to convert encryption key: %v", err)
+	}
+	return []StandardKey{signing, encryption}, nil
+}
+
+// PublicKeyPacketFromStandard builds public keys from a signing and an
+// encryption key. The algorithms in metadata are set from the keys.
+func PublicKeyPacketFromStandard(metadata Metadata, signing, encryption StandardKey) (PublicKeyPacket, error) {
+	if err := checkStandardPair(signing, encryption); err != nil {
+		return PublicKeyPacket{}, err
+	}
+	metadata.SigningAlgorithm = signing.Algorithm
+	metadata.EncryptionAlgorithm = encryption.Algorithm
+
+	signingHandle, err := publicHandleFromStandard(signing)
+	if err != nil {
+		return PublicKeyPacket{}, fmt.Errorf("Unable to convert signing key: %v", err)
+	}
+	encryptionHandle, err := publicHandleFromStandard(encryption)
+	if err != nil {
+		return PublicKeyPacket{}, fmt.Errorf("Unable to convert encryption key: %v", err)
+	}
+
+	publicSigningKey, err := publicHandleToString(signingHandle)
+	if err != nil {
+		return PublicKeyPacket{}, fmt.Errorf("Failed to format public signing key: %v", err)
+	}
+	publicEncryptionKey, err := publicHandleToString(encryptionHandle)
+	if err != nil {
+		return PublicKeyPacket{}, fmt.Errorf("Failed to format public encryption key: %v", err)
+	}
+
+	return PublicKeyPacket{
+		Metadata:            metadata,
+		PublicSigningKey:    publicSigningKey,
+		PublicEncryptionKey: publicEncryptionKey,
+	}, nil
+}
+
+// KeysFromStandard builds keys from a private signing and a private
+// encryption key. The algorithms in metadata are set from the keys.
+func KeysFromStandard(metadata Metadata, signing, encryption StandardKey) (*Keys, error) {
+	if err := checkStandardPair(signing, encryption); err != nil {
+		return nil, err
+	}
+	metadata.SigningAlgorithm = signing.Algorithm
+	metadata.EncryptionAlgorithm = encryption.Algorithm
+
+	signingHandle, err := privateHandleFromStandard(signing)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to convert signing key: %v", err)
+	}
+	encryptionHandle, err := privateHandleFromStandard(encryption)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to convert encryption key: %v", err)
+	}
+	return fromKeyHandles(metadata, signingHandle, encryptionHandle)
+}
+
+func checkStandardPair(signing, encryption StandardKey) error {
+	if signing.Use != UseSigning {
+		return fmt.Errorf("Expected a signing key, got use %q", signing.Use)
+	}
+	if encryption.Use != UseEncryption {
+		return fmt.Errorf("Expected an encryption key, got use %q", encryption.Use)
+	}
+	return Algorithms{Signing: signing.Algorithm, Encryption: encryption.Algorithm}.validate()
+}
+
+// primaryKey returns the primary key of a keyset, the one orc keys use.
+func primaryKey(ks *tinkpb.Keyset) (*tinkpb.Keyset_Key, error) {
+	for _, key := range ks.GetKey() {
+		if key.GetKeyId() == ks.GetPrimaryKeyId() {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("Keyset has no primary key")
+}
+
+func publicKeyset(publicHandle *keyset.Handle) (*tinkpb.Keyset, error) {
+	mem := &keyset.MemReaderWriter{}
+	if err := publicHandle.WriteWithNoSecrets(mem); err != nil {
+		return nil, err
+	}
+	return mem.Keyset, nil
+}
+
+func privateKeyset(handle *keyset.Handle) (*tinkpb.Keyset, error) {
+	mem := &keyset.MemReaderWriter{}
+	if err := insecurecleartextkeyset.Write(handle, mem); err != nil {
+		return nil, err
+	}
+	return mem.Keyset, nil
+}
+
+func standardFromPublicString(packed, use, algorithm string) (StandardKey, error) {
+	handle, err := stringToPublicKey(packed)
+	if err != nil {
+		return StandardKey{}, err
+	}
+	ks, err := publicKeyset(handle)
+	if err != nil {
+		return StandardKey{}, err
+	}
+	key, err := primaryKey(ks)
+	if err != nil {
+		return StandardKey{}, err
+	}
+	public, err := standardPublicKey(algorithm, key.GetKeyData().GetValue())
+	if err != nil {
+		return StandardKey{}, err
+	}
+	return StandardKey{Use: use, Algorithm: algorithm, Public: public, TinkKeyID: key.GetKeyId()}, nil
+}
+
+func standardFromPrivateHandle(handle *keyset.Handle, use, algorithm string) (StandardKey, error) {
+	ks, err := privateKeyset(handle)
+	if err != nil {
+		return StandardKey{}, err
+	}
+	key, err := primaryKey(ks)
+	if err != nil {
+		return StandardKey{}, err
+	}
+	public, private, err := standardPrivateKey(algorithm, key.GetKeyData().GetValue())
+	if err != nil {
+		return StandardKey{}, err
+	}
+	return StandardKey{Use: use, Algorithm: algorithm, Public: public, Private: private, TinkKeyID: key.GetKeyId()}, nil
+}
+
+func ecdsaPublicFromCoordinates(x, y []byte) (*ecdsa.PublicKey, error) {
+	rv := &ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(x),
+		Y:     new(big.Int).SetBytes(y),
+	}
+	if !rv.Curve.IsOnCurve(rv.X, rv.Y) {
+		return nil, fmt.Errorf("Point is not on curve P-256")
+	}
+	return rv, nil
+}
+
+func standardPublicKey(algorithm string, value []byte) (crypto.PublicKey, error) {
+	switch algorithm {
+	case SigningECDSAP256:
+		var key ecdsapb.EcdsaPublicKey
+		if err := proto.Unmarshal(value, &key); err != nil {
+			return nil, err
+		}
+		if key.GetParams().GetCurve() != commonpb.EllipticCurveType_NIST_P256 {
+			return nil, fmt.Errorf("Unsupported ECDSA curve %v", key.GetParams().GetCurve())
+		}
+		return ecdsaPublicFromCoordinates(key.GetX(), key.GetY())
+
+	case SigningEd25519:
+		var key ed25519pb.Ed25519PublicKey
+		if err := proto.Unmarshal(value, &key); err != nil {
+			return nil, err
+		}
+		return ed25519.PublicKey(key.GetKeyValue()), nil
+
+	case EncryptionECIESP256:
+		var key eciespb.EciesAeadHkdfPublicKey
+		if err := proto.Unmarshal(value, &key); err != nil {
+			return nil, err
+		}
+		if key.GetParams().GetKemParams().GetCurveType() != commonpb.EllipticCurveType_NIST_P256 {
+			return nil, fmt.Errorf("Unsupported ECIES curve %v", key.GetParams().GetKemParams().GetCurveType())
+		}
+		return ecdsaPublicFromCoordinates(key.GetX(), key.GetY())
+
+	case EncryptionHPKEX25519:
+		var key hpkepb.HpkePublicKey
+		if err := proto.Unmarshal(value, &key); err != nil {
+			return nil, err
+		}
+		return ecdh.X25519().NewPublicKey(key.GetPublicKey())
+	}
+	return nil, fmt.Errorf("Unsupported algorithm %q", algorithm)
+}
+
+func standardPrivateKey(algorithm string, value []byte) (crypto.PublicKey, crypto.PrivateKey, error) {
+	switch algorithm {
+	case SigningECDSAP256:
+		var key ecdsapb.EcdsaPrivateKey
+		if err := proto.Unmarshal(value, &key); err != nil {
+			return nil, nil, err
+		}
+		public, err := ecdsaPublicFromCoordinates(key.GetPublicKey().GetX(), key.GetPublicKey().GetY())
+		if err != nil {
+			return nil, nil, err
+		}
+		return public, &ecdsa.PrivateKey{PublicKey: *public, D: new(big.Int).SetBytes(key.GetKeyValue())}, nil
+
+	case SigningEd25519:
+		var key ed25519pb.Ed25519PrivateKey
+		if err := proto.Unmarshal(value, &key); err != nil {
+			return nil, nil, err
+		}
+		private := ed25519.NewKeyFromSeed(key.GetKeyValue())
+		return private.Public(), private, nil
+
+	case EncryptionECIESP256:
+		var key eciespb.EciesAeadHkdfPrivateKey
+		if err := proto.Unmarshal(value, &key); err != nil {
+			return nil, nil, err
+		}
+		public, err := ecdsaPublicFromCoordinates(key.GetPublicKey().GetX(), key.GetPublicKey().GetY())
+		if err != nil {
+			return nil, nil, err
+		}
+		return public, &ecdsa.PrivateKey{PublicKey: *public, D: new(big.Int).SetBytes(key.GetKeyValue())}, nil
+
+	case EncryptionHPKEX25519:
+		var key hpkepb.HpkePrivateKey
+		if err := proto.Unmarshal(value, &key); err != nil {
+			return nil, nil, err
+		}
+		private, err := ecdh.X25519().NewPrivateKey(key.GetPrivateKey())
+		if err != nil {
+			return nil, nil, err
+		}
+		return private.PublicKey(), private, nil
+	}
+	return nil, nil, fmt.Errorf("Unsupported algorithm %q", algorithm)
+}
+
+func kindOf(key StandardKey) (keyKind, error) {
+	kinds := signingKinds
+	if key.Use == UseEncryption {
+		kinds = encryptionKinds
+	}
+	kind, ok := kinds[key.Algorithm]
+	if !ok {
+		return keyKind{}, fmt.Errorf("Unsupported algorithm %q for use %q", key.Algorithm, key.Use)
+	}
+	return kind, nil
+}
+
+// skeletonHandle generates a fresh keyset of the right kind, whose key
+// material is then replaced. This keeps the parameters identical to those
+// of keys generated by orc.
+func skeletonHandle(key StandardKey) (*keyset.Handle, error) {
+	kind, err := kindOf(key)
+	if err != nil {
+		return nil, err
+	}
+	return keyset.NewHandle(kind.template())
+}
+
+func coordinateBytes(n *big.Int) []byte {
+	return n.FillBytes(make([]byte, 32))
+}
+
+// fillPrivateKeyData replaces the key material of a private key proto.
+func fillPrivateKeyData(key StandardKey, value []byte) (proto.Message, error) {
+	switch key.Algorithm {
+	case SigningECDSAP256:
+		priv, ok := key.Private.(*ecdsa.PrivateKey)
+		if !ok || priv.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("Expected a P-256 ECDSA private key, got %T", key.Private)
+		}
+		var msg ecdsapb.EcdsaPrivateKey
+		if err := proto.Unmarshal(value, &msg); err != nil {
+			return nil, err
+		}
+		msg.KeyValue = coordinateBytes(priv.D)
+		msg.PublicKey.X = coordinateBytes(priv.X)
+		msg.PublicKey.Y = coordinateBytes(priv.Y)
+		return &msg, nil
+
+	case SigningEd25519:
+		priv, ok := key.Private.(ed25519.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("Expected an Ed25519 private key, got %T", key.Private)
+		}
+		var msg ed25519pb.Ed25519PrivateKey
+		if err := proto.Unmarshal(value, &msg); err != nil {
+			return nil, err
+		}
+		msg.KeyValue = priv.Seed()
+		msg.PublicKey.KeyValue = []byte(priv.Public().(ed25519.PublicKey))
+		return &msg, nil
+
+	case EncryptionECIESP256:
+		priv, ok := key.Private.(*ecdsa.PrivateKey)
+		if !ok || priv.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("Expected a P-256 EC private key, got %T", key.Private)
+		}
+		var msg eciespb.EciesAeadHkdfPrivateKey
+		if err := proto.Unmarshal(value, &msg); err != nil {
+			return nil, err
+		}
+		msg.KeyValue = coordinateBytes(priv.D)
+		msg.PublicKey.X = coordinateBytes(priv.X)
+		msg.PublicKey.Y = coordinateBytes(priv.Y)
+		return &msg, nil
+
+	case EncryptionHPKEX25519:
+		priv, ok := key.Private.(*ecdh.PrivateKey)
+		if !ok || priv.Curve() != ecdh.X25519() {
+			return nil, fmt.Errorf("Expected an X25519 private key, got %T", key.Private)
+		}
+		var msg hpkepb.HpkePrivateKey
+		if err := proto.Unmarshal(value, &msg); err != nil {
+			return nil, err
+		}
+		msg.PrivateKey = priv.Bytes()
+		msg.PublicKey.PublicKey = priv.PublicKey().Bytes()
+		return &msg, nil
+	}
+	return nil, fmt.Errorf("Unsupported algorithm %q", key.Algorithm)
+}
+
+// fillPublicKeyData replaces the key material of a public key proto.
+func fillPublicKeyData(key StandardKey, value []byte) (proto.Message, error) {
+	switch key.Algorithm {
+	case SigningECDSAP256, EncryptionECIESP256:
+		pub, ok := key.Public.(*ecdsa.PublicKey)
+		if !ok || pub.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("Expected a P-256 EC public key, got %T", key.Public)
+		}
+		if key.Algorithm == SigningECDSAP256 {
+			var msg ecdsapb.EcdsaPublicKey
+			if err := proto.Unmarshal(value, &msg); err != nil {
+				return nil, err
+			}
+			msg.X, msg.Y = coordinateBytes(pub.X), coordinateBytes(pub.Y)
+			return &msg, nil
+		}
+		var msg eciespb.EciesAeadHkdfPublicKey
+		if err := proto.Unmarshal(value, &msg); err != nil {
+			return nil, err
+		}
+		msg.X, msg.Y = coordinateBytes(pub.X), coordinateBytes(pub.Y)
+		return &msg, nil
+
+	case SigningEd25519:
+		pub, ok := key.Public.(ed25519.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("Expected an Ed25519 public key, got %T", key.Public)
+		}
+		var msg ed25519pb.Ed25519PublicKey
+		if err := proto.Unmarshal(value, &msg); err != nil {
+			return nil, err
+		}
+		msg.KeyValue = []byte(pub)
+		return &msg, nil
+
+	case EncryptionHPKEX25519:
+		pub, ok := key.Public.(*ecdh.PublicKey)
+		if !ok || pub.Curve() != ecdh.X25519() {
+			return nil, fmt.Errorf("Expected an X25519 public key, got %T", key.Public)
+		}
+		var msg hpkepb.HpkePublicKey
+		if err := proto.Unmarshal(value, &msg); err != nil {
+			return nil, err
+		}
+		msg.PublicKey = pub.Bytes()
+		return &msg, nil
+	}
+	return nil, fmt.Errorf("Unsupported algorithm %q", key.Algorithm)
+}
+
+func setKeyID(ks *tinkpb.Keyset, primary *tinkpb.Keyset_Key, id uint32) {
+	if id == 0 {
+		return
+	}
+	primary.KeyId = id
+	ks.PrimaryKeyId = id
+}
+
+func privateHandleFromStandard(key StandardKey) (*keyset.Handle, error) {
+	if key.Private == nil {
+		return nil, fmt.Errorf("Missing private key")
+	}
+	handle, err := skeletonHandle(key)
+	if err != nil {
+		return nil, err
+	}
+	ks, err := privateKeyset(handle)
+	if err != nil {
+		return nil, err
+	}
+	primary, err := primaryKey(ks)
+	if err != nil {
+		return nil, err
+	}
+	private, err := fillPrivateKeyData(key, primary.KeyData.Value)
+	if err != nil {
+		return nil, err
+	}
+	primary.KeyData.Value, err = proto.Marshal(private)
+	if err != nil {
+		return nil, err
+	}
+	setKeyID(ks, primary, key.TinkKeyID)
+	return insecurecleartextkeyset.Read(&keyset.MemReaderWriter{Keyset: ks})
+}
+
+func publicHandleFromStandard(key StandardKey) (*keyset.Handle, error) {
+	handle, err := skeletonHandle(key)
+	if err != nil {
+		return nil, err
+	}
+	publicHandle, err := handle.Public()
+	if err != nil {
+		return nil, err
+	}
+	publicKs, err := publicKeyset(publicHandle)
+	if err != nil {
+		return nil, err
+	}
+	publicPrimary, err := primaryKey(publicKs)
+	if err != nil {
+		return nil, err
+	}
+	public, err := fillPublicKeyData(key, publicPrimary.KeyData.Value)
+	if err != nil {
+		return nil, err
+	}
+	publicPrimary.KeyData.Value, err = proto.Marshal(public)
+	if err != nil {
+		return nil, err
+	}
+	setKeyID(publicKs, publicPrimary, key.TinkKeyID)
+	return keyset.NewHandleWithNoSecrets(publicKs)
+}
+
+// TinkJSONKeysets returns the public keysets of this generation in Tink's
+// JSON keyset format.
+func (p PublicKeyPacket) TinkJSONKeysets() (signing, encryption []byte, err error) {
+	signing, err = publicStringToJSON(p.PublicSigningKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to convert public signing key: %v", err)
+	}
+	encryption, err = publicStringToJSON(p.PublicEncryptionKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to convert public encryption key: %v", err)
+	}
+	return signing, encryption, nil
+}
+
+// TinkJSONKeysets returns the private keysets of this generation in Tink's
+// JSON keyset format, unencrypted.
+func (k *Keys) TinkJSONKeysets() (signing, encryption []byte, err error) {
+	var signingBuf, encryptionBuf bytes.Buffer
+	if err := insecurecleartextkeyset.Write(k.SigningKey.privateKey, keyset.NewJSONWriter(&signingBuf)); err != nil {
+		return nil, nil, fmt.Errorf("Unable to write signing keyset: %v", err)
+	}
+	if err := insecurecleartextkeyset.Write(k.EncryptionKey.privateKey, keyset.NewJSONWriter(&encryptionBuf)); err != nil {
+		return nil, nil, fmt.Errorf("Unable to write encryption keyset: %v", err)
+	}
+	return signingBuf.Bytes(), encryptionBuf.Bytes(), nil
+}
+
+func publicStringToJSON(packed string) ([]byte, error) {
+	handle, err := stringToPublicKey(packed)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := handle.WriteWithNoSecrets(keyset.NewJSONWriter(&buf)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// PublicKeyPacketFromTinkJSON builds public keys from public keysets in
+// Tink's JSON keyset format. The algorithms in metadata are set from the
+// keysets.
+func PublicKeyPacketFromTinkJSON(metadata Metadata, signing, encryption []byte) (PublicKeyPacket, error) {
+	signingHandle, err := keyset.ReadWithNoSecrets(keyset.NewJSONReader(bytes.NewReader(signing)))
+	if err != nil {
+		return PublicKeyPacket{}, fmt.Errorf("Unable to read signing keyset: %v", err)
+	}
+	encryptionHandle, err := keyset.ReadWithNoSecrets(keyset.NewJSONReader(bytes.NewReader(encryption)))
+	if err != nil {
+		return PublicKeyPacket{}, fmt.Errorf("Unable to read encryption keyset: %v", err)
+	}
+	if err := setAlgorithms(&metadata, signingHandle, encryptionHandle); err != nil {
+		return PublicKeyPacket{}, err
+	}
+	if err := checkKeyKind(signingHandle, signingKinds, metadata.SigningAlgorithm); err != nil {
+		return PublicKeyPacket{}, fmt.Errorf("Invalid signing key: %v", err)
+	}
+	if err := checkKeyKind(encryptionHandle, encryptionKinds, metadata.EncryptionAlgorithm); err != nil {
+		return PublicKeyPacket{}, fmt.Errorf("Invalid encryption key: %v", err)
+	}
+
+	publicSigningKey, err := publicHandleToString(signingHandle)
+	if err != nil {
+		return PublicKeyPacket{}, fmt.Errorf("Failed to format public signing key: %v", err)
+	}
+	publicEncryptionKey, err := publicHandleToString(encryptionHandle)
+	if err != nil {
+		return PublicKeyPacket{}, fmt.Errorf("Failed to format public encryption key: %v", err)
+	}
+
+	rv := PublicKeyPacket{
+		Metadata:            metadata,
+		PublicSigningKey:    publicSigningKey,
+		PublicEncryptionKey: publicEncryptionKey,
+	}
+	if _, err := rv.VerifyFrom(); err != nil {
+		return PublicKeyPacket{}, fmt.Errorf("Signing keyset is not usable for verification: %v", err)
+	}
+	if _, err := rv.EncryptTo(); err != nil {
+		return PublicKeyPacket{}, fmt.Errorf("Encryption keyset is not usable for encryption: %v", err)
+	}
+	return rv, nil
+}
+
+// KeysFromTinkJSON builds keys from unencrypted private keysets in Tink's
+// JSON keyset format. The algorithms in metadata are set from the
+// keysets.
+func KeysFromTinkJSON(metadata Metadata, signing, encryption []byte) (*Keys, error) {
+	signingHandle, err := insecurecleartextkeyset.Read(keyset.NewJSONReader(bytes.NewReader(signing)))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read signing keyset: %v", err)
+	}
+	encryptionHandle, err := insecurecleartextkeyset.Read(keyset.NewJSONReader(bytes.NewReader(encryption)))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read encryption keyset: %v", err)
+	}
+	if err := setAlgorithms(&metadata, signingHandle, encryptionHandle); err != nil {
+		return nil, err
+	}
+	return fromKeyHandles(metadata, signingHandle, encryptionHandle)
+}
@@ -0,0 +1,45 @@
+package orckeys
+
+import (
+	"github.com/google/tink/go/tink"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	statsNamespace = "orckeys"
+)
+
+var (
+	metricKeyOperations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: statsNamespace,
+		Name:      "key_operations",
+		Help:      "Number of private key operations, by operation, owner and outcome",
+	},
+		[]string{"operation", "owner", "outcome"},
+	)
+)
+
+func countKeyOperation(operation, owner string, err error) {
+	outcome := "ok"
+	if err != nil {
+		outcome = "error"
+	}
+	metricKeyOperations.With(prometheus.Labels{
+		"operation": operation,
+		"owner":     owner,
+		"outcome":   outcome,
+	}).Inc()
+}
+
+// instrumentedSigner counts signatures made with the private signing key.
+type instrumentedSigner struct {
+	signer tink.Signer
+	owner  string
+}
+
+func (s instrumentedSigner) Sign(data []byte) ([]byte, error) {
+	sig, err := s.signer.Sign(data)
+	countKeyOperation("sign", s.owner, err)
+	return sig, err
+}
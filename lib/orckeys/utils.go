@@ -13,6 +13,10 @@ func publicKeyToString(handle *keyset.Handle) (string, error) {
 	if err != nil {
 		return "", fmt.Errorf("handle.Public() failed: %v", err)
 	}
+	return publicHandleToString(publicHandle)
+}
+
+func publicHandleToString(publicHandle *keyset.Handle) (string, error) {
 	publicKeyBuf := &bytes.Buffer{}
 	if err := publicHandle.WriteWithNoSecrets(keyset.NewBinaryWriter(publicKeyBuf)); err != nil {
 		return "", fmt.Errorf("WriteWithNoSecrets() failed: %v", err)
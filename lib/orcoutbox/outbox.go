@@ -0,0 +1,260 @@
+package orcoutbox
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/steinarvk/orclib/lib/orcdb"
+	"github.com/steinarvk/orclib/lib/orctimestamp"
+)
+
+// SchemaSQL creates the outbox tables. Include it in an upgrade of the
+// schema of the database holding the outbox, so that entries can be
+// enqueued in the same transactions as the data they describe.
+var SchemaSQL = []string{
+	`CREATE TABLE orc_outbox (
+		id ` + orcdb.SerialPrimaryKey + `,
+		topic TEXT NOT NULL,
+		entry_key TEXT NOT NULL,
+		payload TEXT NOT NULL,
+		created_at TEXT NOT NULL,
+		attempts INTEGER NOT NULL,
+		next_attempt_at BIGINT NOT NULL,
+		last_error TEXT NOT NULL
+	);`,
+	`CREATE INDEX orc_outbox_by_key ON orc_outbox (entry_key, id);`,
+	`CREATE TABLE orc_outbox_dead (
+		id BIGINT PRIMARY KEY,
+		topic TEXT NOT NULL,
+		entry_key TEXT NOT NULL,
+		payload TEXT NOT NULL,
+		created_at TEXT NOT NULL,
+		attempts INTEGER NOT NULL,
+		last_error TEXT NOT NULL,
+		dead_at TEXT NOT NULL
+	);`,
+}
+
+// Entry is an event to publish.
+type Entry struct {
+	ID    int64
+	Topic string
+
+	// Key orders entries: those with the same key are delivered one at a
+	// time, in the order they were enqueued.
+	Key string
+
+	// Payload is JSON.
+	Payload json.RawMessage
+
+	CreatedAt string
+	Attempts  int
+	LastError string
+}
+
+// Message is the form in which entries are sent to recipients.
+type Message struct {
+	ID        int64           `json:"id"`
+	Topic     string          `json:"topic"`
+	Key       string          `json:"key"`
+	Payload   json.RawMessage `json:"payload"`
+	CreatedAt string          `json:"created_at"`
+}
+
+func (e Entry) Message() Message {
+	return Message{
+		ID:        e.ID,
+		Topic:     e.Topic,
+		Key:       e.Key,
+		Payload:   e.Payload,
+		CreatedAt: e.CreatedAt,
+	}
+}
+
+// DeadEntry is an entry that was given up on after too many failed
+// delivery attempts.
+type DeadEntry struct {
+	Entry
+	DeadAt string
+}
+
+type Outbox struct {
+	db *orcdb.Database
+
+	insert     *orcdb.PreparedQuery
+	pending    *orcdb.PreparedQuery
+	claim      *orcdb.PreparedExec
+	remove     *orcdb.PreparedExec
+	retry      *orcdb.PreparedExec
+	bury       *orcdb.PreparedExec
+	listDead   *orcdb.PreparedQuery
+	unbury     *orcdb.PreparedExec
+	removeDead *orcdb.PreparedExec
+	count      *orcdb.PreparedQuery
+}
+
+// New prepares the queries of an outbox in db, whose schema must include
+// SchemaSQL.
+func New(db *orcdb.Database) (*Outbox, error) {
+	var err error
+	rv := &Outbox{db: db}
+
+	rv.insert = db.PrepareQuery(&err, "outbox-insert", `
+		INSERT INTO orc_outbox (topic, entry_key, payload, created_at, attempts, next_attempt_at, last_error)
+		VALUES (:topic, :entry_key, :payload, :created_at, 0, 0, '')
+		RETURNING id;`)
+
+	// Only the first entry of each key may be delivered, once due.
+	rv.pending = db.PrepareQuery(&err, "outbox-pending", `
+		SELECT id, topic, entry_key, payload, created_at, attempts, last_error FROM orc_outbox o
+		WHERE next_attempt_at <= :now
+		AND NOT EXISTS (SELECT 1 FROM orc_outbox p WHERE p.entry_key = o.entry_key AND p.id < o.id)
+		ORDER BY id
+		LIMIT :limit;`)
+	rv.claim = db.PrepareExec(&err, "outbox-claim", `UPDATE orc_outbox SET next_attempt_at = :until WHERE id = :id;`)
+	rv.remove = db.PrepareExec(&err, "outbox-remove", `DELETE FROM orc_outbox WHERE id = :id;`)
+	rv.retry = db.PrepareExec(&err, "outbox-retry", `
+		UPDATE orc_outbox SET attempts = :attempts, next_attempt_at = :next_attempt_at, last_error = :last_error
+		WHERE id = :id;`)
+	rv.bury = db.PrepareExec(&err, "outbox-bury", `
+		INSERT INTO orc_outbox_dead (id, topic, entry_key, payload, created_at, attempts, last_error, dead_at)
+		SELECT id, topic, entry_key, payload, created_at, :attempts, :last_error, :dead_at FROM orc_outbox WHERE id = :id;`)
+	rv.listDead = db.PrepareQuery(&err, "outbox-list-dead", `
+		SELECT id, topic, entry_key, payload, created_at, attempts, last_error, dead_at FROM orc_outbox_dead
+		ORDER BY id DESC
+		LIMIT :limit;`)
+	rv.unbury = db.PrepareExec(&err, "outbox-unbury", `
+		INSERT INTO orc_outbox (id, topic, entry_key, payload, created_at, attempts, next_attempt_at, last_error)
+		SELECT id, topic, entry_key, payload, created_at, 0, 0, last_error FROM orc_outbox_dead WHERE id = :id;`)
+	rv.removeDead = db.PrepareExec(&err, "outbox-remove-dead", `DELETE FROM orc_outbox_dead WHERE id = :id;`)
+	rv.count = db.PrepareQuery(&err, "outbox-count", `
+		SELECT (SELECT COUNT(*) FROM orc_outbox) AS pending, (SELECT COUNT(*) FROM orc_outbox_dead) AS dead;`)
+
+	if err != nil {
+		return nil, fmt.Errorf("Unable to prepare outbox queries: %v", err)
+	}
+
+	return rv, nil
+}
+
+type EnqueueOption func(*Entry)
+
+// Key sets the ordering key of an entry (by default its topic).
+func Key(key string) EnqueueOption {
+	return func(entry *Entry) {
+		entry.Key = key
+	}
+}
+
+// EnqueueInTx adds an entry to the outbox in tx, so that it is published
+// if and only if tx commits. The database numbers the entries as they are
+// enqueued, so entries of concurrent transactions are ordered by when
+// they were enqueued rather than when the transactions committed.
+func (o *Outbox) EnqueueInTx(ctx context.Context, tx *sql.Tx, topic string, payload interface{}, options ...EnqueueOption) (int64, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return 0, fmt.Errorf("Unable to marshal outbox payload for %q: %v", topic, err)
+	}
+
+	entry := Entry{Topic: topic, Key: topic}
+	for _, option := range options {
+		option(&entry)
+	}
+
+	row, err := orcdb.QueryOne[struct{ ID int64 }](ctx, o.insert, tx, map[string]interface{}{
+		"topic":      entry.Topic,
+		"entry_key":  entry.Key,
+		"payload":    string(data),
+		"created_at": orctimestamp.Format(time.Now()),
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return row.ID, nil
+}
+
+type Counts struct {
+	Pending int
+	Dead    int
+}
+
+// Counts returns the number of pending and dead entries.
+func (o *Outbox) Counts(ctx context.Context) (Counts, error) {
+	var rv Counts
+	err := orcdb.Transact(ctx, o.db, "outbox-counts", func(ctx context.Context, tx *sql.Tx) error {
+		return o.count.Query(ctx, tx, nil, &rv, nil)
+	})
+	return rv, err
+}
+
+// DeadEntries returns the most recently buried entries, newest first.
+func (o *Outbox) DeadEntries(ctx context.Context, limit int) ([]DeadEntry, error) {
+	var rv []DeadEntry
+	err := orcdb.Transact(ctx, o.db, "outbox-dead-entries", func(ctx context.Context, tx *sql.Tx) error {
+		rv = nil
+		var row deadRow
+		return o.listDead.Query(ctx, tx, map[string]interface{}{"limit": limit}, &row, func() (bool, error) {
+			rv = append(rv, row.deadEntry())
+			return true, nil
+		})
+	})
+	return rv, err
+}
+
+// Requeue moves a dead entry back into the outbox, to be delivered anew.
+// It is delivered after later entries with the same key that were
+// delivered while it was dead.
+func (o *Outbox) Requeue(ctx context.Context, id int64) error {
+	return orcdb.Transact(ctx, o.db, "outbox-requeue", func(ctx context.Context, tx *sql.Tx) error {
+		result, err := o.unbury.ExecWithResult(ctx, tx, map[string]interface{}{"id": id})
+		if err != nil {
+			return err
+		}
+		if n, err := result.RowsAffected(); err == nil && n == 0 {
+			return fmt.Errorf("No dead outbox entry %d", id)
+		}
+		return o.removeDead.Exec(ctx, tx, map[string]interface{}{"id": id})
+	})
+}
+
+type entryRow struct {
+	ID        int64
+	Topic     string
+	EntryKey  string
+	Payload   string
+	CreatedAt string
+	Attempts  int
+	LastError string
+}
+
+func (r entryRow) entry() Entry {
+	return Entry{
+		ID:        r.ID,
+		Topic:     r.Topic,
+		Key:       r.EntryKey,
+		Payload:   json.RawMessage(r.Payload),
+		CreatedAt: r.CreatedAt,
+		Attempts:  r.Attempts,
+		LastError: r.LastError,
+	}
+}
+
+type deadRow struct {
+	ID        int64
+	Topic     string
+	EntryKey  string
+	Payload   string
+	CreatedAt string
+	Attempts  int
+	LastError string
+	DeadAt    string
+}
+
+func (r deadRow) deadEntry() DeadEntry {
+	entry := entryRow{r.ID, r.Topic, r.EntryKey, r.Payload, r.CreatedAt, r.Attempts, r.LastError}.entry()
+	return DeadEntry{Entry: entry, DeadAt: r.DeadAt}
+}
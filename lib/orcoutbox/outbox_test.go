@@ -0,0 +1,133 @@
+package orcoutbox
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/steinarvk/orclib/lib/orcdb"
+)
+
+func TestOutbox(t *testing.T) {
+	ctx := context.Background()
+
+	schema := &orcdb.Schema{
+		Name:     "test",
+		Upgrades: orcdb.SequentialUpgrades(SchemaSQL),
+	}
+	db, err := schema.Open(ctx, orcdb.SQLite, filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	outbox, err := New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	enqueue := func(topic string, payload interface{}, options ...EnqueueOption) {
+		t.Helper()
+		if err := orcdb.Transactor("enqueue")(ctx, db, func(ctx context.Context, tx *sql.Tx) error {
+			_, err := outbox.EnqueueInTx(ctx, tx, topic, payload, options...)
+			return err
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		enqueue("ordered", i)
+	}
+	enqueue("flaky", "x")
+	enqueue("broken", "y", Key("broken-key"))
+
+	// A rolled back transaction enqueues nothing.
+	orcdb.Transactor("rolled-back")(ctx, db, func(ctx context.Context, tx *sql.Tx) error {
+		if _, err := outbox.EnqueueInTx(ctx, tx, "ordered", 99); err != nil {
+			return err
+		}
+		return fmt.Errorf("rolling back")
+	})
+
+	var mu sync.Mutex
+	var ordered []int
+	flakyAttempts := 0
+	deliver := func(ctx context.Context, entry Entry) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		switch entry.Topic {
+		case "ordered":
+			var n int
+			if err := json.Unmarshal(entry.Payload, &n); err != nil {
+				return err
+			}
+			ordered = append(ordered, n)
+		case "flaky":
+			flakyAttempts++
+			if flakyAttempts == 1 {
+				return fmt.Errorf("flaky failure")
+			}
+		case "broken":
+			return fmt.Errorf("broken")
+		}
+		return nil
+	}
+
+	relay := outbox.NewRelay(deliver, RelayConfig{
+		MaxAttempts: 3,
+		MinBackoff:  time.Millisecond,
+		MaxBackoff:  time.Millisecond,
+	})
+
+	for i := 0; i < 20; i++ {
+		if _, err := relay.RelayOnce(ctx); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if want := []int{0, 1, 2}; !reflect.DeepEqual(ordered, want) {
+		t.Errorf("delivered %v want %v", ordered, want)
+	}
+	if flakyAttempts != 2 {
+		t.Errorf("flaky entry attempted %d times want 2", flakyAttempts)
+	}
+
+	counts, err := outbox.Counts(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts != (Counts{Pending: 0, Dead: 1}) {
+		t.Errorf("counts = %+v", counts)
+	}
+
+	dead, err := outbox.DeadEntries(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dead) != 1 || dead[0].Key != "broken-key" || dead[0].Attempts != 3 || dead[0].LastError != "broken" {
+		t.Fatalf("dead entries = %+v", dead)
+	}
+
+	if err := outbox.Requeue(ctx, dead[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := outbox.Requeue(ctx, dead[0].ID); err == nil {
+		t.Errorf("requeued entry twice")
+	}
+	counts, err = outbox.Counts(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts != (Counts{Pending: 1, Dead: 0}) {
+		t.Errorf("counts after requeue = %+v", counts)
+	}
+}
@@ -0,0 +1,267 @@
+package orcoutbox
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/steinarvk/orclib/lib/orcdb"
+	"github.com/steinarvk/orclib/lib/orctimestamp"
+)
+
+// Deliverer publishes an entry, returning an error if it should be retried.
+// Entries may be delivered more than once, so recipients should ignore
+// entries whose ID they have already seen.
+type Deliverer func(ctx context.Context, entry Entry) error
+
+type RelayConfig struct {
+	// BatchSize is the most entries claimed at a time.
+	BatchSize int
+
+	// Concurrency is the most entries delivered at a time. Entries
+	// delivered at the same time always have different keys.
+	Concurrency int
+
+	// PollInterval is how often to look for due entries.
+	PollInterval time.Duration
+
+	// Lease is how long a claimed entry is hidden from other relays. It
+	// should exceed the time to deliver a batch.
+	Lease time.Duration
+
+	// MaxAttempts is how many times delivery of an entry is attempted
+	// before it is moved to the dead letter table.
+	MaxAttempts int
+
+	// MinBackoff and MaxBackoff bound the delay before retrying a failed
+	// delivery, which doubles with each failure.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+var DefaultRelayConfig = RelayConfig{
+	BatchSize:    100,
+	Concurrency:  8,
+	PollInterval: time.Second,
+	Lease:        5 * time.Minute,
+	MaxAttempts:  10,
+	MinBackoff:   time.Second,
+	MaxBackoff:   10 * time.Minute,
+}
+
+// Relay delivers the entries of an outbox in the background.
+type Relay struct {
+	outbox  *Outbox
+	deliver Deliverer
+	cfg     RelayConfig
+
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewRelay returns a relay delivering the entries of the outbox. Zero
+// fields of cfg take their values from DefaultRelayConfig.
+func (o *Outbox) NewRelay(deliver Deliverer, cfg RelayConfig) *Relay {
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = DefaultRelayConfig.BatchSize
+	}
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = DefaultRelayConfig.Concurrency
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = DefaultRelayConfig.PollInterval
+	}
+	if cfg.Lease <= 0 {
+		cfg.Lease = DefaultRelayConfig.Lease
+	}
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = DefaultRelayConfig.MaxAttempts
+	}
+	if cfg.MinBackoff <= 0 {
+		cfg.MinBackoff = DefaultRelayConfig.MinBackoff
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = DefaultRelayConfig.MaxBackoff
+	}
+
+	return &Relay{
+		outbox:  o,
+		deliver: deliver,
+		cfg:     cfg,
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// claim returns the due entries, hiding them from other relays for the
+// duration of the lease.
+func (r *Relay) claim(ctx context.Context) ([]Entry, error) {
+	var entries []Entry
+	err := orcdb.Transact(ctx, r.outbox.db, "outbox-claim", func(ctx context.Context, tx *sql.Tx) error {
+		entries = nil
+		now := time.Now()
+
+		var row entryRow
+		if err := r.outbox.pending.Query(ctx, tx, map[string]interface{}{
+			"now":   now.UnixMilli(),
+			"limit": r.cfg.BatchSize,
+		}, &row, func() (bool, error) {
+			entries = append(entries, row.entry())
+			return true, nil
+		}); err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			if err := r.outbox.claim.Exec(ctx, tx, map[string]interface{}{
+				"id":    entry.ID,
+				"until": now.Add(r.cfg.Lease).UnixMilli(),
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return entries, err
+}
+
+// settle records the outcome of delivering an entry.
+func (r *Relay) settle(ctx context.Context, entry Entry, deliveryErr error) error {
+	outcome := "delivered"
+	err := orcdb.Transact(ctx, r.outbox.db, "outbox-settle", func(ctx context.Context, tx *sql.Tx) error {
+		id := map[string]interface{}{"id": entry.ID}
+
+		if deliveryErr == nil {
+			return r.outbox.remove.Exec(ctx, tx, id)
+		}
+
+		attempts := entry.Attempts + 1
+		if attempts >= r.cfg.MaxAttempts {
+			outcome = "dead"
+			if err := r.outbox.bury.Exec(ctx, tx, map[string]interface{}{
+				"id":         entry.ID,
+				"attempts":   attempts,
+				"last_error": deliveryErr.Error(),
+				"dead_at":    orctimestamp.Format(time.Now()),
+			}); err != nil {
+				return err
+			}
+			return r.outbox.remove.Exec(ctx, tx, id)
+		}
+
+		outcome = "failed"
+		return r.outbox.retry.Exec(ctx, tx, map[string]interface{}{
+			"id":              entry.ID,
+			"attempts":        attempts,
+			"next_attempt_at": time.Now().Add(orcdb.Backoff(attempts, r.cfg.MinBackoff, r.cfg.MaxBackoff)).UnixMilli(),
+			"last_error":      deliveryErr.Error(),
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	metricDeliveries.With(prometheus.Labels{"topic": entry.Topic, "outcome": outcome}).Inc()
+
+	switch outcome {
+	case "dead":
+		logrus.Errorf("Giving up on outbox entry %d (topic %q) after %d attempts: %v", entry.ID, entry.Topic, entry.Attempts+1, deliveryErr)
+	case "failed":
+		logrus.Warningf("Delivering outbox entry %d (topic %q) failed (attempt %d): %v", entry.ID, entry.Topic, entry.Attempts+1, deliveryErr)
+	}
+	return nil
+}
+
+// RelayOnce claims and delivers a batch of due entries, returning how many
+// it handled.
+func (r *Relay) RelayOnce(ctx context.Context) (int, error) {
+	entries, err := r.claim(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	sem := make(chan struct{}, r.cfg.Concurrency)
+
+	for _, entry := range entries {
+		entry := entry
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			err := r.settle(ctx, entry, r.deliver(ctx, entry))
+			if err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	return len(entries), firstErr
+}
+
+// Wake makes the relay look for due entries now rather than at its next
+// poll, e.g. after a transaction enqueuing entries has committed.
+func (r *Relay) Wake() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (r *Relay) run(ctx context.Context) {
+	defer close(r.done)
+
+	ticker := time.NewTicker(r.cfg.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		n, err := r.RelayOnce(ctx)
+		if err != nil && ctx.Err() == nil {
+			logrus.Errorf("Outbox relay failed: %v", err)
+		}
+
+		// A full batch suggests there are more entries due.
+		if err == nil && n == r.cfg.BatchSize {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// Start starts relaying in the background until Stop.
+func (r *Relay) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	r.stop = make(chan struct{})
+	r.done = make(chan struct{})
+
+	go func() {
+		<-r.stop
+		cancel()
+	}()
+	go r.run(ctx)
+}
+
+// Stop stops relaying, abandoning deliveries in progress. Their entries
+// are delivered again once their lease expires.
+func (r *Relay) Stop() {
+	close(r.stop)
+	<-r.done
+}
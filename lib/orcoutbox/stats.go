@@ -0,0 +1,20 @@
+package orcoutbox
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	statsNamespace = "outbox"
+)
+
+var (
+	metricDeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: statsNamespace,
+		Name:      "deliveries",
+		Help:      "Number of outbox delivery attempts, by topic and outcome (delivered, failed or dead)",
+	},
+		[]string{"topic", "outcome"},
+	)
+)
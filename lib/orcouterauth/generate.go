@@ -0,0 +1,33 @@
+package orcouterauth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/steinarvk/orclib/lib/orctimestamp"
+)
+
+// secretBytes is kept small enough that the bcrypt input of hashedsecret
+// (timestamp, canonical host and secret) stays within 72 bytes.
+const secretBytes = 16
+
+// GenerateSecret creates a new random shared secret. The name identifies
+// the secret in logs, and the timestamp tells rotations apart.
+func GenerateSecret(name string, now time.Time) (*Secret, error) {
+	if name == "" {
+		return nil, fmt.Errorf("Secret must have a name")
+	}
+
+	buf := make([]byte, secretBytes)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, fmt.Errorf("Error generating secret: %v", err)
+	}
+
+	return &Secret{
+		Name:      name,
+		Timestamp: orctimestamp.Format(now),
+		Secret:    hex.EncodeToString(buf),
+	}, nil
+}
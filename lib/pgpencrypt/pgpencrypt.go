@@ -6,10 +6,10 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
-	"os"
 	"strings"
 
 	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
 )
 
 type Config struct {
@@ -27,6 +27,10 @@ type Encrypter struct {
 	recipients     []string
 }
 
+type Decrypter struct {
+	keyring openpgp.EntityList
+}
+
 type Armoring bool
 
 const (
@@ -90,14 +94,13 @@ func readKeysFromURL(url string) ([]*openpgp.Entity, error) {
 }
 
 func readKeysFromFile(filename string) ([]*openpgp.Entity, error) {
-	f, err := os.Open(filename)
+	data, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
-	rv, err := readKeysFromReaderAs(f, Armored)
+	rv, err := readKeysFromReaderAs(bytes.NewReader(data), Armored)
 	if err != nil {
-		rv, err = readKeysFromReaderAs(f, Binary)
+		rv, err = readKeysFromReaderAs(bytes.NewReader(data), Binary)
 	}
 	if err != nil {
 		return nil, fmt.Errorf("Error reading keys from %q: %v", filename, err)
@@ -205,3 +208,50 @@ func (e *Encrypter) Encrypt(data []byte) ([]byte, error) {
 	}
 	return buf.Bytes(), nil
 }
+
+func unlockPrivateKey(key *packet.PrivateKey, passphrase []byte) error {
+	if key == nil || !key.Encrypted {
+		return nil
+	}
+	if passphrase == nil {
+		return fmt.Errorf("private key %s is protected by a passphrase", key.KeyIdString())
+	}
+	if err := key.Decrypt(passphrase); err != nil {
+		return fmt.Errorf("unable to unlock private key %s: %v", key.KeyIdString(), err)
+	}
+	return nil
+}
+
+// Decrypter decrypts with the private keys in the keyring, unlocking those
+// protected by a passphrase with passphrase.
+func (k *Keyring) Decrypter(passphrase []byte) (*Decrypter, error) {
+	var entities openpgp.EntityList
+	for _, entity := range k.entities {
+		if entity.PrivateKey == nil {
+			continue
+		}
+		if err := unlockPrivateKey(entity.PrivateKey, passphrase); err != nil {
+			return nil, err
+		}
+		for _, subkey := range entity.Subkeys {
+			if err := unlockPrivateKey(subkey.PrivateKey, passphrase); err != nil {
+				return nil, err
+			}
+		}
+		entities = append(entities, entity)
+	}
+	if len(entities) == 0 {
+		return nil, fmt.Errorf("no private keys in keyring")
+	}
+	return &Decrypter{keyring: entities}, nil
+}
+
+func (d *Decrypter) Decrypt(data []byte) ([]byte, error) {
+	md, err := openpgp.ReadMessage(bytes.NewReader(data), d.keyring, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	// The integrity of the message is checked once it has been read in
+	// full, failing the read otherwise.
+	return ioutil.ReadAll(md.UnverifiedBody)
+}
@@ -0,0 +1,88 @@
+package tracepropagation
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/steinarvk/sectiontrace"
+)
+
+const (
+	// ParentKey and AncestorKey are lowercase so that they can be used
+	// unchanged as gRPC metadata keys as well as HTTP headers.
+	ParentKey   = "x-orc-trace-parent"
+	AncestorKey = "x-orc-trace-ancestor"
+)
+
+func format(node sectiontrace.NodeAndScope) string {
+	return fmt.Sprintf("%s/%d", node.Scope, node.ID)
+}
+
+func parse(s string) (sectiontrace.NodeAndScope, error) {
+	i := strings.LastIndex(s, "/")
+	if i <= 0 {
+		return sectiontrace.NodeAndScope{}, fmt.Errorf("malformed trace node %q", s)
+	}
+	id, err := strconv.ParseInt(s[i+1:], 10, 32)
+	if err != nil || id == 0 {
+		return sectiontrace.NodeAndScope{}, fmt.Errorf("malformed trace node %q", s)
+	}
+	return sectiontrace.NodeAndScope{
+		Scope: s[:i],
+		ID:    int32(id),
+	}, nil
+}
+
+// Outgoing returns the keys and values describing the current section in
+// ctx, to be sent along with an outgoing request. It returns nil if ctx is
+// not within a section.
+func Outgoing(ctx context.Context) map[string]string {
+	parentID, ok := ctx.Value(sectiontrace.ParentNodeContextKey).(int32)
+	if !ok || parentID == 0 {
+		return nil
+	}
+
+	parent := sectiontrace.NodeAndScope{
+		Scope: sectiontrace.DefaultScope,
+		ID:    parentID,
+	}
+	ancestor := parent
+
+	if info, err := sectiontrace.RemoteInfoFromContext(ctx); err == nil && info != nil {
+		ancestor = info.Ancestor
+	} else if ancestorID, ok := ctx.Value(sectiontrace.AncestorNodeContextKey).(int32); ok && ancestorID != 0 {
+		ancestor.ID = ancestorID
+	}
+
+	return map[string]string{
+		ParentKey:   format(parent),
+		AncestorKey: format(ancestor),
+	}
+}
+
+// Incoming returns ctx annotated with the remote trace context found via
+// get, so that sections begun from it record their remote parent. Missing
+// or malformed values leave ctx unchanged.
+func Incoming(ctx context.Context, get func(key string) string) context.Context {
+	parentValue := get(ParentKey)
+	ancestorValue := get(AncestorKey)
+	if parentValue == "" || ancestorValue == "" {
+		return ctx
+	}
+
+	parent, err := parse(parentValue)
+	if err != nil {
+		return ctx
+	}
+	ancestor, err := parse(ancestorValue)
+	if err != nil {
+		return ctx
+	}
+
+	return sectiontrace.ContextWithRemoteInfo(ctx, &sectiontrace.RemoteInfo{
+		Parent:   parent,
+		Ancestor: ancestor,
+	})
+}
@@ -0,0 +1,46 @@
+package tracepropagation
+
+import (
+	"context"
+	"testing"
+
+	"github.com/steinarvk/sectiontrace"
+)
+
+func TestRoundTrip(t *testing.T) {
+	sectiontrace.DefaultScope = "sender"
+
+	if got := Outgoing(context.Background()); got != nil {
+		t.Errorf("Outgoing(outside section) = %v want nil", got)
+	}
+
+	ctx, sec := sectiontrace.New("tracepropagation.TestRoundTrip").Begin(context.Background())
+	defer sec.End(nil)
+
+	sent := Outgoing(ctx)
+	received := Incoming(context.Background(), func(key string) string { return sent[key] })
+
+	info, err := sectiontrace.RemoteInfoFromContext(received)
+	if err != nil || info == nil {
+		t.Fatalf("RemoteInfoFromContext() = %v, %v want info", info, err)
+	}
+
+	want := sec.GetBeginRecord().ID
+	if info.Parent.ID != want || info.Parent.Scope != "sender" {
+		t.Errorf("parent = %v want sender/%d", info.Parent, want)
+	}
+	if info.Ancestor != info.Parent {
+		t.Errorf("ancestor = %v want same as parent %v", info.Ancestor, info.Parent)
+	}
+}
+
+func TestIncomingIgnoresMalformed(t *testing.T) {
+	values := map[string]string{
+		ParentKey:   "no-id",
+		AncestorKey: "scope/12",
+	}
+	ctx := Incoming(context.Background(), func(key string) string { return values[key] })
+	if info, _ := sectiontrace.RemoteInfoFromContext(ctx); info != nil {
+		t.Errorf("got remote info %v from malformed values", info)
+	}
+}
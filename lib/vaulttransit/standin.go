@@ -0,0 +1,108 @@
+package vaulttransit
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/google/tink/go/tink"
+)
+
+const (
+	standInCiphertextPrefix = "vault:v1:"
+)
+
+// StandIn is a local stand-in for the encrypt and decrypt endpoints of a
+// Vault transit server, for tests and development. Every key name is served
+// by the same AEAD, with the key name bound as associated data.
+type StandIn struct {
+	AEAD tink.AEAD
+
+	// Token, if set, must be presented by clients.
+	Token string
+}
+
+type standInRequest struct {
+	Plaintext      string `json:"plaintext"`
+	Ciphertext     string `json:"ciphertext"`
+	AssociatedData string `json:"associated_data"`
+}
+
+func writeJSON(w http.ResponseWriter, code int, resp response) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func writeError(w http.ResponseWriter, code int, message string) {
+	writeJSON(w, code, response{Errors: []string{message}})
+}
+
+func (s *StandIn) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if s.Token != "" && req.Header.Get(TokenHeader) != s.Token {
+		writeError(w, http.StatusForbidden, "permission denied")
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/v1/"), "/")
+	if len(parts) < 3 {
+		writeError(w, http.StatusNotFound, "unsupported path")
+		return
+	}
+	operation, name := parts[len(parts)-2], parts[len(parts)-1]
+
+	if operation != "encrypt" && operation != "decrypt" {
+		writeError(w, http.StatusNotFound, "unsupported operation")
+		return
+	}
+
+	var body standInRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	associatedData, err := base64.StdEncoding.DecodeString(body.AssociatedData)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid associated_data")
+		return
+	}
+	associatedData = append([]byte(name+"\x00"), associatedData...)
+
+	switch operation {
+	case "encrypt":
+		plaintext, err := base64.StdEncoding.DecodeString(body.Plaintext)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid plaintext")
+			return
+		}
+		ciphertext, err := s.AEAD.Encrypt(plaintext, associatedData)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "encryption failed")
+			return
+		}
+		writeJSON(w, http.StatusOK, response{Data: &responseData{
+			Ciphertext: standInCiphertextPrefix + base64.StdEncoding.EncodeToString(ciphertext),
+		}})
+
+	case "decrypt":
+		ciphertext, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(body.Ciphertext, standInCiphertextPrefix))
+		if err != nil || !strings.HasPrefix(body.Ciphertext, standInCiphertextPrefix) {
+			writeError(w, http.StatusBadRequest, "invalid ciphertext")
+			return
+		}
+		plaintext, err := s.AEAD.Decrypt(ciphertext, associatedData)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "decryption failed")
+			return
+		}
+		writeJSON(w, http.StatusOK, response{Data: &responseData{
+			Plaintext: base64.StdEncoding.EncodeToString(plaintext),
+		}})
+	}
+}
@@ -0,0 +1,181 @@
+package vaulttransit
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/google/tink/go/tink"
+)
+
+const (
+	Prefix = "vault-transit://"
+
+	TokenHeader = "X-Vault-Token"
+
+	maxResponseBytes = 1 << 20
+)
+
+// Client is a Tink KMS client for vault-transit:// URIs, which name a key as
+// "vault-transit://<mount>/keys/<name>", e.g. "vault-transit://transit/keys/orckeys".
+type Client struct {
+	// Address is the base URL of the server, e.g. "https://vault.example.com:8200".
+	Address string
+
+	// Token is called before every request to get the access token.
+	Token func() (string, error)
+
+	// HTTPClient defaults to http.DefaultClient.
+	HTTPClient *http.Client
+}
+
+func (c *Client) Supported(keyURI string) bool {
+	return strings.HasPrefix(keyURI, Prefix)
+}
+
+// ParseURI splits a vault-transit:// URI into mount path and key name.
+func ParseURI(keyURI string) (string, string, error) {
+	if !strings.HasPrefix(keyURI, Prefix) {
+		return "", "", fmt.Errorf("Not a %s URI: %q", Prefix, keyURI)
+	}
+	path := strings.TrimPrefix(keyURI, Prefix)
+
+	index := strings.LastIndex(path, "/keys/")
+	if index <= 0 {
+		return "", "", fmt.Errorf("Malformed URI %q: want %s<mount>/keys/<name>", keyURI, Prefix)
+	}
+	mount, name := path[:index], path[index+len("/keys/"):]
+	if name == "" || strings.Contains(name, "/") {
+		return "", "", fmt.Errorf("Malformed URI %q: bad key name %q", keyURI, name)
+	}
+	return mount, name, nil
+}
+
+func (c *Client) GetAEAD(keyURI string) (tink.AEAD, error) {
+	if c.Address == "" {
+		return nil, fmt.Errorf("No Vault address configured for %q", keyURI)
+	}
+	mount, name, err := ParseURI(keyURI)
+	if err != nil {
+		return nil, err
+	}
+	return &remoteAEAD{
+		client: c,
+		mount:  mount,
+		name:   name,
+	}, nil
+}
+
+type encryptRequest struct {
+	Plaintext      string `json:"plaintext"`
+	AssociatedData string `json:"associated_data,omitempty"`
+}
+
+type decryptRequest struct {
+	Ciphertext     string `json:"ciphertext"`
+	AssociatedData string `json:"associated_data,omitempty"`
+}
+
+type responseData struct {
+	Plaintext  string `json:"plaintext,omitempty"`
+	Ciphertext string `json:"ciphertext,omitempty"`
+}
+
+type response struct {
+	Data   *responseData `json:"data,omitempty"`
+	Errors []string      `json:"errors,omitempty"`
+}
+
+type remoteAEAD struct {
+	client *Client
+	mount  string
+	name   string
+}
+
+func (a *remoteAEAD) call(operation string, req interface{}) (*responseData, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	url := fmt.Sprintf("%s/v1/%s/%s/%s", strings.TrimRight(a.client.Address, "/"), a.mount, operation, a.name)
+	httpReq, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	if a.client.Token != nil {
+		token, err := a.client.Token()
+		if err != nil {
+			return nil, fmt.Errorf("Unable to get Vault token: %v", err)
+		}
+		httpReq.Header.Set(TokenHeader, token)
+	}
+
+	httpClient := a.client.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	resp, err := httpClient.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("Vault %s request to %q failed: %v", operation, url, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(http.MaxBytesReader(nil, resp.Body, maxResponseBytes))
+	if err != nil {
+		return nil, fmt.Errorf("Error reading Vault %s response: %v", operation, err)
+	}
+
+	var parsed response
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		return nil, fmt.Errorf("Invalid Vault %s response (HTTP %d): %v", operation, resp.StatusCode, err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Vault %s failed (HTTP %d): %v", operation, resp.StatusCode, parsed.Errors)
+	}
+	if parsed.Data == nil {
+		return nil, fmt.Errorf("Vault %s response has no data", operation)
+	}
+
+	return parsed.Data, nil
+}
+
+func encodeOptional(data []byte) string {
+	if len(data) == 0 {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+func (a *remoteAEAD) Encrypt(plaintext, associatedData []byte) ([]byte, error) {
+	data, err := a.call("encrypt", encryptRequest{
+		Plaintext:      base64.StdEncoding.EncodeToString(plaintext),
+		AssociatedData: encodeOptional(associatedData),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if data.Ciphertext == "" {
+		return nil, fmt.Errorf("Vault encrypt response has no ciphertext")
+	}
+	return []byte(data.Ciphertext), nil
+}
+
+func (a *remoteAEAD) Decrypt(ciphertext, associatedData []byte) ([]byte, error) {
+	data, err := a.call("decrypt", decryptRequest{
+		Ciphertext:     string(ciphertext),
+		AssociatedData: encodeOptional(associatedData),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(data.Plaintext)
+}
@@ -0,0 +1,72 @@
+package vaulttransit
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/tink/go/aead"
+	"github.com/google/tink/go/keyset"
+)
+
+func TestStandIn(t *testing.T) {
+	handle, err := keyset.NewHandle(aead.AES256GCMKeyTemplate())
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, err := aead.New(handle)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(&StandIn{AEAD: local, Token: "secret"})
+	defer server.Close()
+
+	client := &Client{
+		Address: server.URL,
+		Token:   func() (string, error) { return "secret", nil },
+	}
+
+	remote, err := client.GetAEAD("vault-transit://transit/keys/orckeys")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ciphertext, err := remote.Encrypt([]byte("hello"), []byte("context"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := remote.Decrypt(ciphertext, []byte("context"))
+	if err != nil || !bytes.Equal(plaintext, []byte("hello")) {
+		t.Errorf("Decrypt = %q, %v; want hello", plaintext, err)
+	}
+
+	if _, err := remote.Decrypt(ciphertext, []byte("other context")); err == nil {
+		t.Errorf("Decrypt with wrong associated data succeeded")
+	}
+
+	other, err := client.GetAEAD("vault-transit://transit/keys/other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Decrypt(ciphertext, []byte("context")); err == nil {
+		t.Errorf("Decrypt with wrong key name succeeded")
+	}
+
+	client.Token = func() (string, error) { return "wrong", nil }
+	if _, err := remote.Encrypt([]byte("hello"), nil); err == nil {
+		t.Errorf("Encrypt with wrong token succeeded")
+	}
+}
+
+func TestParseURI(t *testing.T) {
+	mount, name, err := ParseURI("vault-transit://secrets/transit/keys/orckeys")
+	if err != nil || mount != "secrets/transit" || name != "orckeys" {
+		t.Errorf("ParseURI = %q, %q, %v", mount, name, err)
+	}
+	for _, bad := range []string{"gcp-kms://x", "vault-transit://orckeys", "vault-transit://transit/keys/", "vault-transit:///keys/x"} {
+		if _, _, err := ParseURI(bad); err == nil {
+			t.Errorf("ParseURI(%q) succeeded; want error", bad)
+		}
+	}
+}
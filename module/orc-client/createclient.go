@@ -11,6 +11,13 @@ import (
 )
 
 func (c *Config) createClient() (*http.Client, error) {
+	if c.Transport != nil {
+		return &http.Client{
+			Transport: c.Transport,
+			Timeout:   c.OutboundRequestTimeout,
+		}, nil
+	}
+
 	return &http.Client{
 		Transport: &http.Transport{
 			TLSClientConfig: &tls.Config{
@@ -16,6 +16,9 @@ type Config struct {
 	RootCAs                     *x509.CertPool
 	AllowOutboundOnlyToSuffixes []string
 	OutboundRequestTimeout      time.Duration
+
+	// Transport, if set, replaces the HTTPS transport used by clients.
+	Transport http.RoundTripper
 }
 
 type Module struct {
@@ -27,6 +30,17 @@ type Module struct {
 
 var M = &Module{}
 
+// NewWithTransport creates a module whose clients send their requests
+// through transport rather than over the network. It is intended for tests;
+// requests still go through the usual checks and outer auth.
+func NewWithTransport(transport http.RoundTripper) *Module {
+	return &Module{
+		cfg: Config{
+			Transport: transport,
+		},
+	}
+}
+
 func (m *Module) ModuleName() string { return "OrcClient" }
 
 func (m *Module) OnRegister(hooks orc.ModuleHooks) {
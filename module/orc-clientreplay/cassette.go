@@ -0,0 +1,146 @@
+package orcclientreplay
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"unicode/utf8"
+
+	"github.com/steinarvk/orclib/lib/mutatefile"
+)
+
+// RedactedHeaders are request headers whose values are never written to a
+// cassette, only noted as present. The outer auth token is time-dependent
+// and derived from a shared secret.
+var RedactedHeaders = []string{
+	"Authorization",
+	"X-Authorization",
+}
+
+const redactedValue = "<redacted>"
+
+type Body struct {
+	Text   string `json:"text,omitempty"`
+	Base64 string `json:"base64,omitempty"`
+}
+
+func newBody(data []byte) Body {
+	if utf8.Valid(data) {
+		return Body{Text: string(data)}
+	}
+	return Body{Base64: base64.StdEncoding.EncodeToString(data)}
+}
+
+func (b Body) Bytes() ([]byte, error) {
+	if b.Base64 != "" {
+		return base64.StdEncoding.DecodeString(b.Base64)
+	}
+	return []byte(b.Text), nil
+}
+
+type RecordedRequest struct {
+	Method string              `json:"method"`
+	URL    string              `json:"url"`
+	Host   string              `json:"host"`
+	Path   string              `json:"path"`
+	Header map[string][]string `json:"header,omitempty"`
+	Body   Body                `json:"body"`
+}
+
+type RecordedResponse struct {
+	StatusCode int                 `json:"status_code"`
+	Header     map[string][]string `json:"header,omitempty"`
+	Body       Body                `json:"body"`
+}
+
+type Interaction struct {
+	Request  RecordedRequest  `json:"request"`
+	Response RecordedResponse `json:"response"`
+}
+
+type Cassette struct {
+	Interactions []*Interaction `json:"interactions"`
+}
+
+func isRedacted(key string) bool {
+	for _, redacted := range RedactedHeaders {
+		if http.CanonicalHeaderKey(redacted) == http.CanonicalHeaderKey(key) {
+			return true
+		}
+	}
+	return false
+}
+
+func recordHeader(header http.Header, redact bool) map[string][]string {
+	if len(header) == 0 {
+		return nil
+	}
+	rv := map[string][]string{}
+	for key, values := range header {
+		if redact && isRedacted(key) {
+			rv[key] = []string{redactedValue}
+			continue
+		}
+		rv[key] = append([]string(nil), values...)
+	}
+	return rv
+}
+
+func newRecordedRequest(req *http.Request, body []byte) RecordedRequest {
+	return RecordedRequest{
+		Method: req.Method,
+		URL:    req.URL.String(),
+		Host:   req.URL.Host,
+		Path:   req.URL.Path,
+		Header: recordHeader(req.Header, true),
+		Body:   newBody(body),
+	}
+}
+
+func newRecordedResponse(resp *http.Response, body []byte) RecordedResponse {
+	return RecordedResponse{
+		StatusCode: resp.StatusCode,
+		Header:     recordHeader(resp.Header, false),
+		Body:       newBody(body),
+	}
+}
+
+// LoadCassette reads a cassette from filename. A missing file yields an empty cassette.
+func LoadCassette(filename string) (*Cassette, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &Cassette{}, nil
+		}
+		return nil, fmt.Errorf("Error reading cassette %q: %v", filename, err)
+	}
+
+	var rv Cassette
+	if err := json.Unmarshal(data, &rv); err != nil {
+		return nil, fmt.Errorf("Error parsing cassette %q: %v", filename, err)
+	}
+	return &rv, nil
+}
+
+func (c *Cassette) WriteFile(filename string) error {
+	return mutatefile.MutateFile(filename, 0644, func(_ []byte) ([]byte, error) {
+		data, err := json.MarshalIndent(c, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		return append(data, '\n'), nil
+	})
+}
+
+func (c *Cassette) describe() []string {
+	var rv []string
+	for _, interaction := range c.Interactions {
+		rv = append(rv, fmt.Sprintf("%s %s", interaction.Request.Method, interaction.Request.URL))
+	}
+	sort.Strings(rv)
+	return rv
+}
@@ -0,0 +1,79 @@
+package orcclientreplay
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"reflect"
+)
+
+// Matcher decides whether an outgoing request (with its already-read body)
+// corresponds to a recorded one.
+type Matcher func(req *http.Request, body []byte, recorded *RecordedRequest) bool
+
+var DefaultMatchers = []Matcher{MatchMethod, MatchHost, MatchPath, MatchBody}
+
+func MatchMethod(req *http.Request, _ []byte, recorded *RecordedRequest) bool {
+	return req.Method == recorded.Method
+}
+
+func MatchHost(req *http.Request, _ []byte, recorded *RecordedRequest) bool {
+	return req.URL.Host == recorded.Host
+}
+
+func MatchPath(req *http.Request, _ []byte, recorded *RecordedRequest) bool {
+	return req.URL.Path == recorded.Path
+}
+
+func MatchURL(req *http.Request, _ []byte, recorded *RecordedRequest) bool {
+	return req.URL.String() == recorded.URL
+}
+
+func MatchBody(_ *http.Request, body []byte, recorded *RecordedRequest) bool {
+	recordedBody, err := recorded.Body.Bytes()
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(body, recordedBody)
+}
+
+// MatchJSONBody compares bodies as JSON values, ignoring formatting and key order.
+func MatchJSONBody(_ *http.Request, body []byte, recorded *RecordedRequest) bool {
+	recordedBody, err := recorded.Body.Bytes()
+	if err != nil {
+		return false
+	}
+	if len(body) == 0 || len(recordedBody) == 0 {
+		return len(body) == len(recordedBody)
+	}
+	var got, want interface{}
+	if err := json.Unmarshal(body, &got); err != nil {
+		return false
+	}
+	if err := json.Unmarshal(recordedBody, &want); err != nil {
+		return false
+	}
+	return reflect.DeepEqual(got, want)
+}
+
+// MatchHeaderPresent requires the header to be present on both the outgoing
+// and the recorded request. Useful for checking that outer auth was added,
+// since its value is redacted.
+func MatchHeaderPresent(key string) Matcher {
+	return func(req *http.Request, _ []byte, recorded *RecordedRequest) bool {
+		if req.Header.Get(key) == "" {
+			return false
+		}
+		_, ok := recorded.Header[http.CanonicalHeaderKey(key)]
+		return ok
+	}
+}
+
+func matchesAll(matchers []Matcher, req *http.Request, body []byte, recorded *RecordedRequest) bool {
+	for _, matcher := range matchers {
+		if !matcher(req, body, recorded) {
+			return false
+		}
+	}
+	return true
+}
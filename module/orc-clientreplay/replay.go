@@ -0,0 +1,232 @@
+package orcclientreplay
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+
+	orcclient "github.com/steinarvk/orclib/module/orc-client"
+)
+
+type Mode int
+
+const (
+	// Replay serves responses from the cassette and never touches the network.
+	Replay = Mode(iota)
+	// Record forwards requests to the real transport and appends them to the cassette.
+	Record
+)
+
+func (m Mode) String() string {
+	switch m {
+	case Replay:
+		return "replay"
+	case Record:
+		return "record"
+	}
+	return fmt.Sprintf("Mode(%d)", int(m))
+}
+
+type Options struct {
+	Mode Mode
+
+	// Matchers used to pick a recorded interaction. Defaults to DefaultMatchers.
+	Matchers []Matcher
+
+	// Transport used to make real requests in Record mode. Defaults to http.DefaultTransport.
+	Transport http.RoundTripper
+}
+
+type NoMatchingInteraction struct {
+	Method   string
+	URL      string
+	Recorded []string
+}
+
+func (e NoMatchingInteraction) Error() string {
+	return fmt.Sprintf("No unused recorded interaction matches %s %s (cassette has: %v)", e.Method, e.URL, e.Recorded)
+}
+
+// Recorder is a http.RoundTripper backed by a cassette.
+type Recorder struct {
+	filename  string
+	mode      Mode
+	matchers  []Matcher
+	transport http.RoundTripper
+
+	mu       sync.Mutex
+	cassette *Cassette
+	used     []bool
+}
+
+func NewRecorder(filename string, opts Options) (*Recorder, error) {
+	rv := &Recorder{
+		filename:  filename,
+		mode:      opts.Mode,
+		matchers:  opts.Matchers,
+		transport: opts.Transport,
+	}
+	if rv.matchers == nil {
+		rv.matchers = DefaultMatchers
+	}
+	if rv.transport == nil {
+		rv.transport = http.DefaultTransport
+	}
+
+	switch opts.Mode {
+	case Replay:
+		cassette, err := LoadCassette(filename)
+		if err != nil {
+			return nil, err
+		}
+		rv.cassette = cassette
+	case Record:
+		rv.cassette = &Cassette{}
+	default:
+		return nil, fmt.Errorf("Invalid mode: %v", opts.Mode)
+	}
+
+	rv.used = make([]bool, len(rv.cassette.Interactions))
+
+	return rv, nil
+}
+
+// NewModule creates an orc-client module whose clients talk to a cassette
+// instead of the network. Replace orcclient.M with it in tests.
+func NewModule(filename string, opts Options) (*orcclient.Module, *Recorder, error) {
+	recorder, err := NewRecorder(filename, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	return orcclient.NewWithTransport(recorder), recorder, nil
+}
+
+func readBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil {
+		return nil, nil
+	}
+	defer req.Body.Close()
+	data, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(data))
+	return data, nil
+}
+
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := readBody(req)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading request body: %v", err)
+	}
+
+	if r.mode == Record {
+		return r.record(req, body)
+	}
+	return r.replay(req, body)
+}
+
+func (r *Recorder) record(req *http.Request, body []byte) (*http.Response, error) {
+	resp, err := r.transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading response body: %v", err)
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(respBody))
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.cassette.Interactions = append(r.cassette.Interactions, &Interaction{
+		Request:  newRecordedRequest(req, body),
+		Response: newRecordedResponse(resp, respBody),
+	})
+	r.used = append(r.used, true)
+
+	logrus.WithFields(logrus.Fields{
+		"method": req.Method,
+		"url":    req.URL.String(),
+		"code":   resp.StatusCode,
+	}).Infof("Recorded outgoing request")
+
+	return resp, nil
+}
+
+func (r *Recorder) replay(req *http.Request, body []byte) (*http.Response, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i, interaction := range r.cassette.Interactions {
+		if r.used[i] {
+			continue
+		}
+		if !matchesAll(r.matchers, req, body, &interaction.Request) {
+			continue
+		}
+
+		respBody, err := interaction.Response.Body.Bytes()
+		if err != nil {
+			return nil, fmt.Errorf("Corrupt recorded response body for %s %s: %v", req.Method, req.URL, err)
+		}
+
+		r.used[i] = true
+
+		header := http.Header{}
+		for key, values := range interaction.Response.Header {
+			header[key] = append([]string(nil), values...)
+		}
+
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", interaction.Response.StatusCode, http.StatusText(interaction.Response.StatusCode)),
+			StatusCode:    interaction.Response.StatusCode,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        header,
+			Body:          ioutil.NopCloser(bytes.NewReader(respBody)),
+			ContentLength: int64(len(respBody)),
+			Request:       req,
+		}, nil
+	}
+
+	return nil, NoMatchingInteraction{
+		Method:   req.Method,
+		URL:      req.URL.String(),
+		Recorded: r.cassette.describe(),
+	}
+}
+
+// Unused returns the recorded interactions that were never replayed.
+func (r *Recorder) Unused() []*Interaction {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var rv []*Interaction
+	for i, interaction := range r.cassette.Interactions {
+		if !r.used[i] {
+			rv = append(rv, interaction)
+		}
+	}
+	return rv
+}
+
+// Save writes the cassette to its file. It does nothing in Replay mode.
+func (r *Recorder) Save() error {
+	if r.mode != Record {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.cassette.WriteFile(r.filename)
+}
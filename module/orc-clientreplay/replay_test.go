@@ -0,0 +1,78 @@
+package orcclientreplay
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRecordThenReplay(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(req.Method + " " + req.URL.Path + " " + string(body)))
+	}))
+
+	filename := filepath.Join(t.TempDir(), "cassette.json")
+
+	recordingModule, recorder, err := NewModule(filename, Options{
+		Mode:      Record,
+		Transport: server.Client().Transport,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := recordingModule.MustNew("test")
+	for _, body := range []string{"first", "second"} {
+		resp, err := client.Post(server.URL+"/echo", "text/plain", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if err := recorder.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	server.Close()
+
+	replayingModule, replayer, err := NewModule(filename, Options{Mode: Replay})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client = replayingModule.MustNew("test")
+
+	for _, body := range []string{"second", "first"} {
+		resp, err := client.Post(server.URL+"/echo", "text/plain", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if want := "POST /echo " + body; string(got) != want {
+			t.Errorf("replayed body = %q want %q", got, want)
+		}
+	}
+
+	if unused := replayer.Unused(); len(unused) != 0 {
+		t.Errorf("unused interactions: %v", unused)
+	}
+
+	if _, err := client.Post(server.URL+"/echo", "text/plain", strings.NewReader("first")); err == nil {
+		t.Errorf("replaying an already-used interaction succeeded; want error")
+	}
+}
+
+func TestReplayStillRejectsNonHTTPS(t *testing.T) {
+	module, _, err := NewModule(filepath.Join(t.TempDir(), "missing.json"), Options{Mode: Replay})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := module.MustNew("test").Get("http://example.com/"); err == nil {
+		t.Errorf("plain HTTP request succeeded; want rejection")
+	}
+}
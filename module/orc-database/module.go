@@ -0,0 +1,205 @@
+package orcdatabase
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/steinarvk/orc"
+	"github.com/steinarvk/orclib/lib/orcdb"
+	"github.com/steinarvk/orclib/lib/postgresdb"
+
+	orcdebug "github.com/steinarvk/orclib/module/orc-debug"
+	httprouter "github.com/steinarvk/orclib/module/orc-httprouter"
+	orcpgpencrypt "github.com/steinarvk/orclib/module/orc-pgpencrypt"
+	orcprometheus "github.com/steinarvk/orclib/module/orc-prometheus"
+)
+
+type Module struct {
+	schema      *orcdb.Schema
+	pingTimeout time.Duration
+	snapshots   *snapshotter
+	Database    *orcdb.Database
+}
+
+// New returns a module that opens a database with the schema, taking
+// flags prefixed with the schema name.
+func New(schema *orcdb.Schema) *Module {
+	return &Module{
+		schema: schema,
+	}
+}
+
+func (m *Module) ModuleName() string { return fmt.Sprintf("Database(%s)", m.schema.Name) }
+
+func (m *Module) flagName(suffix string) string {
+	return m.schema.Name + "_" + suffix
+}
+
+func dataSourceName(dialect orcdb.Dialect, dataSource, passwordFile string) (string, error) {
+	if dialect != orcdb.Postgres {
+		return dataSource, nil
+	}
+
+	var password string
+	if passwordFile != "" {
+		data, err := ioutil.ReadFile(passwordFile)
+		if err != nil {
+			return "", fmt.Errorf("Unable to read database password: %v", err)
+		}
+		password = strings.TrimSpace(string(data))
+	}
+
+	return postgresdb.ConnectionString(dataSource, password)
+}
+
+func (m *Module) ping(w http.ResponseWriter, req *http.Request) {
+	ctx, cancel := context.WithTimeout(req.Context(), m.pingTimeout)
+	defer cancel()
+
+	t0 := time.Now()
+	err := m.Database.Ping(ctx)
+	latency := time.Since(t0)
+
+	w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "error: %v\n", err)
+		return
+	}
+	fmt.Fprintf(w, "ok (%v)\n", latency)
+}
+
+func (m *Module) OnRegister(hooks orc.ModuleHooks) {
+	var dialectName string
+	var dataSource string
+	var passwordFile string
+	var lockTimeout time.Duration
+	var pool orcdb.PoolConfig
+	var sqliteOpts orcdb.SQLiteOptions
+	var vacuumOnStartup bool
+	var snapshotDir string
+	var snapshotInterval time.Duration
+	var snapshotKeep int
+	var snapshotEncrypt bool
+	var slowQueryThreshold time.Duration
+
+	var dialect orcdb.Dialect
+
+	hooks.OnUse(func(u orc.UseContext) {
+		u.Use(httprouter.M)
+		u.Use(orcdebug.M)
+		u.Use(orcprometheus.M)
+		u.Use(orcpgpencrypt.M)
+
+		u.Flags.StringVar(&dialectName, m.flagName("database_dialect"), orcdb.SQLite.Name(), "database dialect for "+m.schema.Name+": sqlite or postgres")
+		u.Flags.StringVar(&dataSource, m.flagName("database"), "", "SQLite database file, or PostgreSQL connection string (without password), for "+m.schema.Name)
+		u.Flags.StringVar(&passwordFile, m.flagName("database_password_file"), "", "file containing the PostgreSQL password for "+m.schema.Name)
+		u.Flags.DurationVar(&lockTimeout, m.flagName("database_migration_lock_timeout"), orcdb.DefaultMigrationLockTimeout, "how long to wait for other instances to finish migrating "+m.schema.Name)
+		u.Flags.IntVar(&pool.MaxOpenConns, m.flagName("database_max_open_conns"), 0, "maximum open connections to "+m.schema.Name+" (0 for unlimited)")
+		u.Flags.IntVar(&pool.MaxIdleConns, m.flagName("database_max_idle_conns"), 0, "maximum idle connections to "+m.schema.Name+" (0 for the default of 2)")
+		u.Flags.DurationVar(&pool.ConnMaxLifetime, m.flagName("database_conn_max_lifetime"), 0, "maximum time to reuse a connection to "+m.schema.Name+" (0 for unlimited)")
+		u.Flags.DurationVar(&pool.ConnMaxIdleTime, m.flagName("database_conn_max_idle_time"), 0, "maximum time a connection to "+m.schema.Name+" may be idle (0 for unlimited)")
+		u.Flags.DurationVar(&m.pingTimeout, m.flagName("database_ping_timeout"), 5*time.Second, "timeout of the debug ping of "+m.schema.Name)
+		u.Flags.DurationVar(&slowQueryThreshold, m.flagName("database_slow_query_threshold"), 0, "log queries on "+m.schema.Name+" slower than this, with their plans, and list them on /debug/queries (0 to disable)")
+
+		u.Flags.StringVar(&sqliteOpts.JournalMode, m.flagName("database_journal_mode"), "", "SQLite journal mode for "+m.schema.Name+", e.g. WAL (default: leave unchanged)")
+		u.Flags.DurationVar(&sqliteOpts.BusyTimeout, m.flagName("database_busy_timeout"), 0, "how long SQLite waits for locks on "+m.schema.Name+" before failing")
+		u.Flags.StringVar(&sqliteOpts.Synchronous, m.flagName("database_synchronous"), "", "SQLite synchronous level for "+m.schema.Name+", e.g. NORMAL (default: leave unchanged)")
+		u.Flags.BoolVar(&vacuumOnStartup, m.flagName("database_vacuum_on_startup"), true, "VACUUM the SQLite database "+m.schema.Name+" on startup")
+		u.Flags.StringVar(&snapshotDir, m.flagName("database_snapshot_dir"), "", "directory in which to write periodic snapshots of the SQLite database "+m.schema.Name+" (default: no snapshots)")
+		u.Flags.DurationVar(&snapshotInterval, m.flagName("database_snapshot_interval"), time.Hour, "interval between snapshots of "+m.schema.Name)
+		u.Flags.IntVar(&snapshotKeep, m.flagName("database_snapshot_keep"), 24, "number of snapshots of "+m.schema.Name+" to keep")
+		u.Flags.BoolVar(&snapshotEncrypt, m.flagName("database_snapshot_encrypt"), false, "PGP-encrypt snapshots of "+m.schema.Name+" (see --pgp_encrypt_to)")
+	})
+
+	hooks.OnValidate(func() error {
+		var err error
+		dialect, err = orcdb.DialectByName(dialectName)
+		if err != nil {
+			return fmt.Errorf("--%s: %v", m.flagName("database_dialect"), err)
+		}
+		if dataSource == "" {
+			return fmt.Errorf("Missing --%s", m.flagName("database"))
+		}
+
+		if dialect != orcdb.SQLite {
+			if sqliteOpts != (orcdb.SQLiteOptions{}) || snapshotDir != "" {
+				return fmt.Errorf("Database %q: journal mode, busy timeout, synchronous level and snapshots are only supported for SQLite", m.schema.Name)
+			}
+			return nil
+		}
+
+		sqliteOpts.SkipVacuum = !vacuumOnStartup
+		dialect = orcdb.SQLiteWith(sqliteOpts)
+
+		if snapshotDir != "" {
+			if snapshotInterval <= 0 {
+				return fmt.Errorf("--%s: must be positive, got %v", m.flagName("database_snapshot_interval"), snapshotInterval)
+			}
+			if snapshotKeep < 1 {
+				return fmt.Errorf("--%s: must be at least 1, got %d", m.flagName("database_snapshot_keep"), snapshotKeep)
+			}
+			m.snapshots = &snapshotter{
+				name:     m.schema.Name,
+				dir:      snapshotDir,
+				interval: snapshotInterval,
+				keep:     snapshotKeep,
+			}
+		} else if snapshotEncrypt {
+			return fmt.Errorf("--%s requires --%s", m.flagName("database_snapshot_encrypt"), m.flagName("database_snapshot_dir"))
+		}
+		return nil
+	})
+
+	hooks.OnStart(func() error {
+		dsn, err := dataSourceName(dialect, dataSource, passwordFile)
+		if err != nil {
+			return err
+		}
+
+		logrus.Infof("Opening %s database %q", dialect.Name(), m.schema.Name)
+		db, err := m.schema.Open(context.Background(), dialect, dsn, orcdb.Pool(pool), orcdb.MigrationLockTimeout(lockTimeout), orcdb.SlowQueryThreshold(slowQueryThreshold))
+		if err != nil {
+			return fmt.Errorf("Failed to open database %q: %v", m.schema.Name, err)
+		}
+		m.Database = db
+
+		if m.snapshots != nil {
+			if snapshotEncrypt {
+				if orcpgpencrypt.M.Encrypter == nil {
+					return fmt.Errorf("--%s requires --pgp_encrypt_to", m.flagName("database_snapshot_encrypt"))
+				}
+				m.snapshots.encrypter = orcpgpencrypt.M.Encrypter
+			}
+			if err := os.MkdirAll(snapshotDir, 0700); err != nil {
+				return fmt.Errorf("Unable to create snapshot directory %q: %v", snapshotDir, err)
+			}
+			m.snapshots.start(db)
+		}
+
+		registerStats(m.schema.Name, db)
+		orcdebug.M.Status.AddTable(m.statusTable)
+		httprouter.M.HandleDebug("/db/"+m.schema.Name+"/ping", http.HandlerFunc(m.ping))
+		handleQueries()
+		return nil
+	})
+
+	hooks.OnStop(func() error {
+		if m.Database == nil {
+			// Starting failed before the database was opened.
+			return nil
+		}
+		logrus.Infof("Closing database %q", m.schema.Name)
+		if m.snapshots != nil {
+			m.snapshots.shutdown()
+		}
+		unregisterStats(m.schema.Name)
+		return m.Database.Close()
+	})
+}
@@ -0,0 +1,93 @@
+package orcdatabase
+
+import (
+	"html/template"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/steinarvk/orclib/lib/orcdb"
+
+	httprouter "github.com/steinarvk/orclib/module/orc-httprouter"
+)
+
+const (
+	defaultTopQueries = 20
+)
+
+var (
+	queriesPageTemplate = template.Must(template.New("queriesPage").Parse(`
+<html>
+	<body>
+		{{ range . }}
+			<h1>Slow queries on {{ .Name }}</h1>
+			{{ if not .Threshold }}
+				<p>Slow queries are not recorded (no threshold set).</p>
+			{{ else }}
+				<p>Queries slower than {{ .Threshold }}, slowest first.</p>
+				<table>
+					<tr>
+						<th>Query
+						<th>Count
+						<th>Max
+						<th>Last
+						<th>Last at
+						<th>Last arguments
+						<th>Plan
+					{{ range .Queries }}
+						<tr>
+							<td><span title="{{ .SQL }}">{{ .QueryName }}</span>
+							<td>{{ .Count }}
+							<td>{{ .MaxDuration }}
+							<td>{{ .LastDuration }}
+							<td>{{ .LastAt.Format "2006-01-02 15:04:05" }}
+							<td>{{ .LastArgs }}
+							<td>{{ if .PlanErr }}error: {{ .PlanErr }}{{ else }}<pre>{{ .Plan }}</pre>{{ end }}
+					{{ end }}
+				</table>
+			{{ end }}
+		{{ end }}
+	</body>
+</html>
+`))
+
+	queriesPageOnce sync.Once
+)
+
+type queriesPageDatabase struct {
+	Name      string
+	Threshold interface{}
+	Queries   []orcdb.SlowQuery
+}
+
+// serveQueries shows the slowest queries of each open database; the
+// number shown per database may be set with "?n=".
+func serveQueries(w http.ResponseWriter, req *http.Request) {
+	top := defaultTopQueries
+	if n, err := strconv.Atoi(req.URL.Query().Get("n")); err == nil && n > 0 {
+		top = n
+	}
+
+	var data []queriesPageDatabase
+	for _, db := range pools.list() {
+		entry := queriesPageDatabase{Name: db.SchemaName()}
+		if threshold := db.SlowQueryThreshold(); threshold > 0 {
+			entry.Threshold = threshold
+		}
+		entry.Queries = db.SlowQueries()
+		if len(entry.Queries) > top {
+			entry.Queries = entry.Queries[:top]
+		}
+		data = append(data, entry)
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	queriesPageTemplate.Execute(w, data)
+}
+
+// handleQueries serves /debug/queries, which is shared by all databases.
+func handleQueries() {
+	queriesPageOnce.Do(func() {
+		httprouter.M.HandleDebug("/queries", http.HandlerFunc(serveQueries))
+	})
+}
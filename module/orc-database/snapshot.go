@@ -0,0 +1,202 @@
+package orcdatabase
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/steinarvk/orclib/lib/orcdb"
+	"github.com/steinarvk/orclib/lib/pgpencrypt"
+)
+
+const (
+	snapshotTimeLayout = "20060102T150405Z"
+	snapshotSuffix     = ".db"
+	encryptedSuffix    = ".pgp"
+)
+
+// snapshotter periodically writes timestamped backups of a database to a
+// directory, keeping the most recent ones.
+type snapshotter struct {
+	name      string
+	dir       string
+	interval  time.Duration
+	keep      int
+	encrypter *pgpencrypt.Encrypter
+
+	stop chan struct{}
+	done chan struct{}
+
+	mu           sync.Mutex
+	lastAttempt  time.Time
+	lastFilename string
+	lastErr      error
+}
+
+func (s *snapshotter) prefix() string {
+	return s.name + "-"
+}
+
+// writeEncrypted backs up the database to a temporary file and writes it
+// encrypted to filename, so that no plaintext copy is left in the
+// snapshot directory.
+func (s *snapshotter) writeEncrypted(ctx context.Context, db *orcdb.Database, filename string) error {
+	tempDir, err := ioutil.TempDir("", "orcdb-snapshot-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tempDir)
+
+	plaintextFilename := filepath.Join(tempDir, "snapshot"+snapshotSuffix)
+	if err := db.Backup(ctx, plaintextFilename); err != nil {
+		return err
+	}
+
+	plaintext, err := ioutil.ReadFile(plaintextFilename)
+	if err != nil {
+		return err
+	}
+
+	ciphertext, err := s.encrypter.Encrypt(plaintext)
+	if err != nil {
+		return fmt.Errorf("Encrypting snapshot failed: %v", err)
+	}
+
+	tempFilename := filename + ".tmp"
+	if err := ioutil.WriteFile(tempFilename, ciphertext, 0600); err != nil {
+		os.Remove(tempFilename)
+		return err
+	}
+	return os.Rename(tempFilename, filename)
+}
+
+func (s *snapshotter) snapshot(ctx context.Context, db *orcdb.Database) (string, error) {
+	filename := filepath.Join(s.dir, s.prefix()+time.Now().UTC().Format(snapshotTimeLayout)+snapshotSuffix)
+
+	if s.encrypter == nil {
+		if err := db.Backup(ctx, filename); err != nil {
+			return "", err
+		}
+	} else {
+		filename += encryptedSuffix
+		if err := s.writeEncrypted(ctx, db, filename); err != nil {
+			return "", err
+		}
+	}
+
+	return filename, s.prune()
+}
+
+// prune removes all but the most recent snapshots. The timestamps in the
+// filenames sort chronologically.
+func (s *snapshotter) prune() error {
+	entries, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+
+	var snapshots []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, s.prefix()) {
+			continue
+		}
+		if !strings.HasSuffix(name, snapshotSuffix) && !strings.HasSuffix(name, snapshotSuffix+encryptedSuffix) {
+			continue
+		}
+		snapshots = append(snapshots, name)
+	}
+	sort.Strings(snapshots)
+
+	for len(snapshots) > s.keep {
+		if err := os.Remove(filepath.Join(s.dir, snapshots[0])); err != nil {
+			return err
+		}
+		logrus.Infof("Removed old snapshot %q of database %q", snapshots[0], s.name)
+		snapshots = snapshots[1:]
+	}
+
+	return nil
+}
+
+func (s *snapshotter) run(db *orcdb.Database) {
+	defer close(s.done)
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			select {
+			case <-s.stop:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		t0 := time.Now()
+		filename, err := s.snapshot(ctx, db)
+		cancel()
+
+		labels := prometheus.Labels{"database": s.name, "outcome": "ok"}
+		if err != nil {
+			labels["outcome"] = "error"
+			logrus.Errorf("Snapshot of database %q failed: %v", s.name, err)
+		} else {
+			metricLastSnapshot.With(prometheus.Labels{"database": s.name}).SetToCurrentTime()
+			logrus.Infof("Wrote snapshot %q of database %q in %v", filename, s.name, time.Since(t0))
+		}
+		metricSnapshots.With(labels).Inc()
+
+		s.mu.Lock()
+		s.lastAttempt = t0
+		s.lastFilename = filename
+		s.lastErr = err
+		s.mu.Unlock()
+	}
+}
+
+func (s *snapshotter) start(db *orcdb.Database) {
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	go s.run(db)
+}
+
+// shutdown stops taking snapshots, cancelling any in progress. It does
+// nothing if taking snapshots never started.
+func (s *snapshotter) shutdown() {
+	if s.stop == nil {
+		return
+	}
+	close(s.stop)
+	<-s.done
+}
+
+func (s *snapshotter) status() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case s.lastAttempt.IsZero():
+		return fmt.Sprintf("none yet (every %v)", s.interval)
+	case s.lastErr != nil:
+		return fmt.Sprintf("failed at %v: %v", s.lastAttempt, s.lastErr)
+	default:
+		return fmt.Sprintf("%s at %v", s.lastFilename, s.lastAttempt)
+	}
+}
@@ -0,0 +1,150 @@
+package orcdatabase
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/steinarvk/orclib/lib/orcdb"
+)
+
+const (
+	statsNamespace = "database"
+)
+
+// poolCollector exports the connection pool state of each open database.
+type poolCollector struct {
+	mu        sync.Mutex
+	databases map[string]*orcdb.Database
+}
+
+var (
+	pools = &poolCollector{}
+
+	metricMaxOpenConnections = prometheus.NewDesc(
+		prometheus.BuildFQName(statsNamespace, "", "max_open_connections"),
+		"Maximum number of open connections (0 for unlimited)",
+		[]string{"database"}, nil,
+	)
+	metricOpenConnections = prometheus.NewDesc(
+		prometheus.BuildFQName(statsNamespace, "", "open_connections"),
+		"Number of open connections, in use or idle",
+		[]string{"database"}, nil,
+	)
+	metricInUseConnections = prometheus.NewDesc(
+		prometheus.BuildFQName(statsNamespace, "", "in_use_connections"),
+		"Number of connections in use",
+		[]string{"database"}, nil,
+	)
+	metricIdleConnections = prometheus.NewDesc(
+		prometheus.BuildFQName(statsNamespace, "", "idle_connections"),
+		"Number of idle connections",
+		[]string{"database"}, nil,
+	)
+	metricWaitCount = prometheus.NewDesc(
+		prometheus.BuildFQName(statsNamespace, "", "connection_waits"),
+		"Number of times a connection was waited for",
+		[]string{"database"}, nil,
+	)
+	metricWaitSeconds = prometheus.NewDesc(
+		prometheus.BuildFQName(statsNamespace, "", "connection_wait_seconds"),
+		"Total time spent waiting for connections",
+		[]string{"database"}, nil,
+	)
+	metricClosedConnections = prometheus.NewDesc(
+		prometheus.BuildFQName(statsNamespace, "", "closed_connections"),
+		"Number of connections closed by the pool, by reason",
+		[]string{"database", "reason"}, nil,
+	)
+)
+
+var (
+	metricSnapshots = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: statsNamespace,
+		Name:      "snapshots",
+		Help:      "Number of scheduled snapshots attempted, by outcome",
+	},
+		[]string{"database", "outcome"},
+	)
+
+	metricLastSnapshot = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: statsNamespace,
+		Name:      "last_snapshot_timestamp_seconds",
+		Help:      "Time of the last successful scheduled snapshot",
+	},
+		[]string{"database"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(pools)
+}
+
+func registerStats(name string, db *orcdb.Database) {
+	pools.mu.Lock()
+	defer pools.mu.Unlock()
+
+	if pools.databases == nil {
+		pools.databases = map[string]*orcdb.Database{}
+	}
+	pools.databases[name] = db
+}
+
+func unregisterStats(name string) {
+	pools.mu.Lock()
+	defer pools.mu.Unlock()
+
+	delete(pools.databases, name)
+}
+
+// list returns the open databases, ordered by name.
+func (c *poolCollector) list() []*orcdb.Database {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var names []string
+	for name := range c.databases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var rv []*orcdb.Database
+	for _, name := range names {
+		rv = append(rv, c.databases[name])
+	}
+	return rv
+}
+
+func (c *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- metricMaxOpenConnections
+	ch <- metricOpenConnections
+	ch <- metricInUseConnections
+	ch <- metricIdleConnections
+	ch <- metricWaitCount
+	ch <- metricWaitSeconds
+	ch <- metricClosedConnections
+}
+
+func (c *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for name, db := range c.databases {
+		stats := db.Stats()
+
+		gauge := func(desc *prometheus.Desc, value int) {
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, float64(value), name)
+		}
+		gauge(metricMaxOpenConnections, stats.MaxOpenConnections)
+		gauge(metricOpenConnections, stats.OpenConnections)
+		gauge(metricInUseConnections, stats.InUse)
+		gauge(metricIdleConnections, stats.Idle)
+
+		ch <- prometheus.MustNewConstMetric(metricWaitCount, prometheus.CounterValue, float64(stats.WaitCount), name)
+		ch <- prometheus.MustNewConstMetric(metricWaitSeconds, prometheus.CounterValue, stats.WaitDuration.Seconds(), name)
+		ch <- prometheus.MustNewConstMetric(metricClosedConnections, prometheus.CounterValue, float64(stats.MaxIdleClosed), name, "max_idle")
+		ch <- prometheus.MustNewConstMetric(metricClosedConnections, prometheus.CounterValue, float64(stats.MaxIdleTimeClosed), name, "max_idle_time")
+		ch <- prometheus.MustNewConstMetric(metricClosedConnections, prometheus.CounterValue, float64(stats.MaxLifetimeClosed), name, "max_lifetime")
+	}
+}
@@ -0,0 +1,47 @@
+package orcdatabase
+
+import (
+	"context"
+	"fmt"
+
+	orcdebug "github.com/steinarvk/orclib/module/orc-debug"
+)
+
+func (m *Module) statusTable() orcdebug.Table {
+	tbl := orcdebug.Table{
+		TableName: fmt.Sprintf("Database %q", m.schema.Name),
+		Rows: []orcdebug.Row{
+			{Key: "Dialect", Value: m.Database.Dialect().Name()},
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.pingTimeout)
+	defer cancel()
+
+	var version string
+	if v, err := m.Database.Version(ctx); err != nil {
+		version = fmt.Sprintf("error: %v", err)
+	} else {
+		version = fmt.Sprintf("%d", v)
+	}
+
+	stats := m.Database.Stats()
+	maxOpen := "unlimited"
+	if stats.MaxOpenConnections > 0 {
+		maxOpen = fmt.Sprintf("%d", stats.MaxOpenConnections)
+	}
+
+	tbl.Rows = append(tbl.Rows, []orcdebug.Row{
+		{Key: "Schema version", Value: version},
+		{Key: "Max open connections", Value: maxOpen},
+		{Key: "Open connections", Value: fmt.Sprintf("%d (in use: %d, idle: %d)", stats.OpenConnections, stats.InUse, stats.Idle)},
+		{Key: "Waits for a connection", Value: fmt.Sprintf("%d (total %v)", stats.WaitCount, stats.WaitDuration)},
+		{Key: "Connections closed", Value: fmt.Sprintf("idle limit: %d, idle time: %d, lifetime: %d", stats.MaxIdleClosed, stats.MaxIdleTimeClosed, stats.MaxLifetimeClosed)},
+	}...)
+
+	if m.snapshots != nil {
+		tbl.Rows = append(tbl.Rows, orcdebug.Row{Key: "Last snapshot", Value: m.snapshots.status()})
+	}
+
+	return tbl
+}
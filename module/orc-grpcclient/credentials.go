@@ -0,0 +1,41 @@
+package orcgrpcclient
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/steinarvk/orclib/lib/authinterface"
+)
+
+// outerAuthCredentials attaches OrcOuterAuth headers, addressed to the
+// target's canonical host, to every call.
+type outerAuthCredentials struct {
+	provider      func() authinterface.AuthProvider
+	canonicalHost string
+}
+
+func (c *outerAuthCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	provider := c.provider()
+	if provider == nil {
+		return nil, nil
+	}
+
+	headers, err := provider.MakeAuthHeaders(authinterface.RequestContext{
+		RecipientHost: c.canonicalHost,
+		RequestTime:   time.Now(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	rv := map[string]string{}
+	for key, value := range headers {
+		rv[strings.ToLower(key)] = value
+	}
+	return rv, nil
+}
+
+func (c *outerAuthCredentials) RequireTransportSecurity() bool {
+	return true
+}
@@ -0,0 +1,137 @@
+package orcgrpcclient
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/steinarvk/orclib/lib/tracepropagation"
+	"github.com/steinarvk/sectiontrace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// RetryableCodes are the status codes for which unary calls are retried.
+var RetryableCodes = []codes.Code{codes.Unavailable}
+
+type retryPolicy struct {
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+}
+
+func (p retryPolicy) backoff(attempt int) time.Duration {
+	d := p.initialBackoff
+	for i := 1; i < attempt && d < p.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > p.maxBackoff {
+		d = p.maxBackoff
+	}
+	// Jitter to +/- 50%.
+	return time.Duration(float64(d) * (0.5 + rand.Float64()))
+}
+
+func isRetryable(err error) bool {
+	code := status.Code(err)
+	for _, retryable := range RetryableCodes {
+		if code == retryable {
+			return true
+		}
+	}
+	return false
+}
+
+type sectionmaker struct {
+	mu       sync.Mutex
+	sections map[string]sectiontrace.Section
+}
+
+var sections = &sectionmaker{}
+
+func (s *sectionmaker) Get(clientName, fullMethod string) sectiontrace.Section {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.sections == nil {
+		s.sections = map[string]sectiontrace.Section{}
+	}
+
+	name := fmt.Sprintf("gRPCClient(%s:%s)", clientName, fullMethod)
+
+	sec, ok := s.sections[name]
+	if !ok {
+		sec = sectiontrace.New(name)
+		s.sections[name] = sec
+	}
+
+	return sec
+}
+
+func withOutgoingTrace(ctx context.Context) context.Context {
+	for key, value := range tracepropagation.Outgoing(ctx) {
+		ctx = metadata.AppendToOutgoingContext(ctx, key, value)
+	}
+	return ctx
+}
+
+func (m *Module) recordFinished(method string, t0 time.Time, err error) {
+	labels := prometheus.Labels{
+		"client": m.name,
+		"method": method,
+		"code":   status.Code(err).String(),
+	}
+	metricRequestsFinished.With(labels).Inc()
+	metricRequestsFinishedLatency.With(labels).Observe(time.Since(t0).Seconds())
+}
+
+func (m *Module) unaryInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) (err error) {
+	t0 := time.Now()
+	metricRequestsBegun.With(prometheus.Labels{"client": m.name, "method": method}).Inc()
+
+	ctx, sec := sections.Get(m.name, method).Begin(ctx)
+	defer func() {
+		sec.End(err)
+		m.recordFinished(method, t0, err)
+	}()
+
+	ctx = withOutgoingTrace(ctx)
+
+	for attempt := 1; ; attempt++ {
+		err = invoker(ctx, method, req, reply, cc, opts...)
+		if err == nil || attempt >= m.retry.maxAttempts || !isRetryable(err) {
+			return err
+		}
+
+		metricRetries.With(prometheus.Labels{
+			"client": m.name,
+			"method": method,
+			"code":   status.Code(err).String(),
+		}).Inc()
+
+		select {
+		case <-time.After(m.retry.backoff(attempt)):
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		}
+	}
+}
+
+func (m *Module) streamInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (stream grpc.ClientStream, err error) {
+	t0 := time.Now()
+	metricRequestsBegun.With(prometheus.Labels{"client": m.name, "method": method}).Inc()
+
+	// The section covers establishing the stream, not its lifetime.
+	ctx, sec := sections.Get(m.name, method).Begin(ctx)
+	defer func() {
+		sec.End(err)
+		m.recordFinished(method, t0, err)
+	}()
+
+	return streamer(withOutgoingTrace(ctx), desc, cc, method, opts...)
+}
@@ -2,17 +2,23 @@ package orcgrpcclient
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/steinarvk/orc"
+	"github.com/steinarvk/orclib/lib/authinterface"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/keepalive"
 
 	orcgrpcclientcommon "github.com/steinarvk/orclib/module/orc-grpcclientcommon"
+	orcouterauth "github.com/steinarvk/orclib/module/orc-outerauth"
 )
 
 type Module struct {
-	name string
-	Conn *grpc.ClientConn
+	name  string
+	retry retryPolicy
+	Conn  *grpc.ClientConn
 }
 
 func New(name string) *Module {
@@ -23,17 +29,64 @@ func New(name string) *Module {
 
 func (m *Module) ModuleName() string { return fmt.Sprintf("gRPCServer(%s)", m.name) }
 
+func (m *Module) authProvider() authinterface.AuthProvider {
+	return orcouterauth.M.Provider
+}
+
 func (m *Module) OnRegister(hooks orc.ModuleHooks) {
 	var serverAddr string
+	var canonicalHost string
+	var connectTimeout time.Duration
+	var keepaliveTime time.Duration
+	var keepaliveTimeout time.Duration
 
 	hooks.OnUse(func(u orc.UseContext) {
 		u.Use(orcgrpcclientcommon.M)
+		u.Use(orcouterauth.M)
 		u.Flags.StringVar(&serverAddr, m.name+"_server", "", "gRPC server to connect to for "+m.name)
+		u.Flags.StringVar(&canonicalHost, m.name+"_canonical_host", "", "canonical host of the gRPC server for "+m.name+", for outer auth (default: same as server address)")
+		u.Flags.DurationVar(&connectTimeout, m.name+"_connect_timeout", 20*time.Second, "minimum time to allow for establishing a gRPC connection for "+m.name)
+		u.Flags.DurationVar(&keepaliveTime, m.name+"_keepalive_time", 0, "interval between gRPC keepalive pings for "+m.name+" (0 to disable)")
+		u.Flags.DurationVar(&keepaliveTimeout, m.name+"_keepalive_timeout", 20*time.Second, "time to wait for a gRPC keepalive ping acknowledgement for "+m.name)
+		u.Flags.IntVar(&m.retry.maxAttempts, m.name+"_max_attempts", 3, "maximum attempts for unary gRPC calls for "+m.name+", including the first")
+		u.Flags.DurationVar(&m.retry.initialBackoff, m.name+"_retry_backoff", 100*time.Millisecond, "initial backoff between gRPC retries for "+m.name)
+		u.Flags.DurationVar(&m.retry.maxBackoff, m.name+"_retry_max_backoff", 5*time.Second, "maximum backoff between gRPC retries for "+m.name)
+	})
+
+	hooks.OnValidate(func() error {
+		if m.retry.maxAttempts < 1 {
+			return fmt.Errorf("--%s_max_attempts: must be at least 1, got %d", m.name, m.retry.maxAttempts)
+		}
+		return nil
 	})
 
 	hooks.OnStart(func() error {
+		if canonicalHost == "" {
+			canonicalHost = serverAddr
+		}
+
+		dialOpts := append([]grpc.DialOption{}, orcgrpcclientcommon.M.DialOptions...)
+		dialOpts = append(dialOpts,
+			grpc.WithPerRPCCredentials(&outerAuthCredentials{
+				provider:      m.authProvider,
+				canonicalHost: canonicalHost,
+			}),
+			grpc.WithChainUnaryInterceptor(m.unaryInterceptor),
+			grpc.WithChainStreamInterceptor(m.streamInterceptor),
+			grpc.WithConnectParams(grpc.ConnectParams{
+				Backoff:           backoff.DefaultConfig,
+				MinConnectTimeout: connectTimeout,
+			}),
+		)
+		if keepaliveTime > 0 {
+			dialOpts = append(dialOpts, grpc.WithKeepaliveParams(keepalive.ClientParameters{
+				Time:    keepaliveTime,
+				Timeout: keepaliveTimeout,
+			}))
+		}
+
 		logrus.Infof("Dialing gRPC connection to %s (%q)", m.name, serverAddr)
-		conn, err := grpc.Dial(serverAddr, orcgrpcclientcommon.M.DialOptions...)
+		conn, err := grpc.Dial(serverAddr, dialOpts...)
 		if err != nil {
 			return fmt.Errorf("Failed to dial %s (%q): %v", m.name, serverAddr, err)
 		}
@@ -0,0 +1,46 @@
+package orcgrpcclient
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	orcprometheus "github.com/steinarvk/orclib/module/orc-prometheus"
+)
+
+const (
+	statsNamespace = "grpcclient"
+)
+
+var (
+	metricRequestsBegun = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: statsNamespace,
+		Name:      "requests_sent",
+		Help:      "Number of outgoing gRPC calls started",
+	},
+		[]string{"client", "method"},
+	)
+
+	metricRequestsFinished = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: statsNamespace,
+		Name:      "requests_finished",
+		Help:      "Number of outgoing gRPC calls finished, by status code",
+	},
+		[]string{"client", "method", "code"},
+	)
+
+	metricRequestsFinishedLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: statsNamespace,
+		Name:      "request_latency_histogram",
+		Help:      "Outgoing gRPC call latency, including retries",
+		Buckets:   orcprometheus.DefTimeBuckets,
+	},
+		[]string{"client", "method", "code"},
+	)
+
+	metricRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: statsNamespace,
+		Name:      "retries",
+		Help:      "Number of outgoing gRPC call attempts that were retries, by the code that caused the retry",
+	},
+		[]string{"client", "method", "code"},
+	)
+)
@@ -0,0 +1,105 @@
+package orcgrpcgateway
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/test/bufconn"
+
+	jsonapi "github.com/steinarvk/orclib/module/orc-jsonapi"
+)
+
+func TestMuxPath(t *testing.T) {
+	testcases := []struct {
+		template string
+		want     string
+	}{
+		{"/v1/users/{user_id}", "/v1/users/{user_id}"},
+		{"/v1/{name=shelves/*/books/*}", "/v1/{name:shelves/[^/]+/books/[^/]+}"},
+		{"/v1/files/{path=**}", "/v1/files/{path:.+}"},
+		{"/v1/jobs/{id}:cancel", "/v1/jobs/{id}:cancel"},
+	}
+	for _, tc := range testcases {
+		got, err := muxPath(tc.template)
+		if err != nil {
+			t.Errorf("muxPath(%q) failed: %v", tc.template, err)
+		} else if got != tc.want {
+			t.Errorf("muxPath(%q) = %q want %q", tc.template, got, tc.want)
+		}
+	}
+
+	if _, err := muxPath("v1/nope"); err == nil {
+		t.Errorf("muxPath accepted relative template")
+	}
+}
+
+func TestTranscodeHealthCheck(t *testing.T) {
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus("up", healthpb.HealthCheckResponse_SERVING)
+
+	server := grpc.NewServer()
+	healthpb.RegisterHealthServer(server, healthServer)
+	listener := bufconn.Listen(1 << 16)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	conn, err := grpc.Dial("inprocess",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	route := Route{
+		Method:     "GET",
+		Path:       "/health/{service}",
+		GRPCMethod: "/grpc.health.v1.Health/Check",
+	}
+	method, err := findMethod(route.GRPCMethod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc := &transcoder{route: route, method: method, conn: func() *grpc.ClientConn { return conn }}
+
+	router := mux.NewRouter()
+	router.Path("/health/{service}").Handler(jsonapi.Methods{Get: tc.handler()})
+	httpServer := httptest.NewServer(router)
+	defer httpServer.Close()
+
+	for path, want := range map[string]struct {
+		code int
+		body string
+	}{
+		"/health/up":      {http.StatusOK, `"SERVING"`},
+		"/health/missing": {http.StatusNotFound, "unknown service"},
+	} {
+		resp, err := http.Get(httpServer.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		body := string(data)
+
+		if resp.StatusCode != want.code {
+			t.Errorf("GET %s: code %d want %d (body %q)", path, resp.StatusCode, want.code, body)
+		}
+		if !strings.Contains(body, want.body) {
+			t.Errorf("GET %s: body %q does not contain %q", path, body, want.body)
+		}
+	}
+}
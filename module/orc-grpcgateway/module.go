@@ -0,0 +1,178 @@
+package orcgrpcgateway
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/steinarvk/orc"
+	"google.golang.org/grpc"
+
+	orcdebug "github.com/steinarvk/orclib/module/orc-debug"
+	orcgrpcserver "github.com/steinarvk/orclib/module/orc-grpcserver"
+	jsonapi "github.com/steinarvk/orclib/module/orc-jsonapi"
+)
+
+type Module struct {
+	mu       sync.Mutex
+	routes   []Route
+	services []string
+	started  bool
+}
+
+func (m *Module) ModuleName() string { return "gRPCGateway" }
+
+var M = &Module{}
+
+// Handle adds routes from an explicit mapping table. It must be called
+// before the module starts, e.g. from the OnSetup hook of a dependent module.
+func (m *Module) Handle(routes ...Route) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.started {
+		logrus.Panicf("gRPC gateway: Handle called after start (routes: %v)", routes)
+	}
+	m.routes = append(m.routes, routes...)
+}
+
+// HandleService adds the routes declared with google.api.http annotations
+// on the named service, e.g. "pkg.Service". Like Handle, it must be called
+// before the module starts.
+func (m *Module) HandleService(serviceName string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.started {
+		logrus.Panicf("gRPC gateway: HandleService(%q) called after start", serviceName)
+	}
+	m.services = append(m.services, serviceName)
+}
+
+func (m *Module) conn() *grpc.ClientConn {
+	return orcgrpcserver.M.InProcessConn()
+}
+
+func (m *Module) allRoutes() ([]Route, error) {
+	routes := append([]Route(nil), m.routes...)
+	for _, service := range m.services {
+		more, err := RoutesFromAnnotations(service)
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, more...)
+	}
+	return routes, nil
+}
+
+func (m *Module) register(routes []Route) error {
+	byPath := map[string]*jsonapi.Methods{}
+	var paths []string
+
+	for _, route := range routes {
+		path, err := muxPath(route.Path)
+		if err != nil {
+			return err
+		}
+
+		method, err := findMethod(route.GRPCMethod)
+		if err != nil {
+			return fmt.Errorf("Bad route %v: %v", route, err)
+		}
+
+		methods, ok := byPath[path]
+		if !ok {
+			methods = &jsonapi.Methods{Others: map[string]jsonapi.Handler{}}
+			byPath[path] = methods
+			paths = append(paths, path)
+		}
+
+		handler := (&transcoder{route: route, method: method, conn: m.conn}).handler()
+
+		var slot *jsonapi.Handler
+		switch route.Method {
+		case "GET":
+			slot = &methods.Get
+		case "POST":
+			slot = &methods.Post
+		case "PUT":
+			slot = &methods.Put
+		case "DELETE":
+			slot = &methods.Delete
+		case "PATCH":
+			slot = &methods.Patch
+		}
+
+		if slot != nil && *slot == nil {
+			*slot = handler
+		} else if _, taken := methods.Others[route.Method]; slot == nil && !taken {
+			methods.Others[route.Method] = handler
+		} else {
+			return fmt.Errorf("Duplicate route: %s %s", route.Method, route.Path)
+		}
+
+		logrus.Infof("gRPC gateway: %v", route)
+	}
+
+	sort.Strings(paths)
+	for _, path := range paths {
+		jsonapi.M.Handle(path, *byPath[path])
+	}
+	return nil
+}
+
+func (m *Module) statusTable() orcdebug.Table {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	routes, err := m.allRoutes()
+
+	var rows []orcdebug.Row
+	if err != nil {
+		rows = append(rows, orcdebug.Row{Key: "Error", Value: err.Error()})
+	}
+	for _, route := range routes {
+		rows = append(rows, orcdebug.Row{
+			Key:   fmt.Sprintf("%s %s%s", route.Method, jsonapi.APIPrefix, route.Path[1:]),
+			Value: route.GRPCMethod,
+		})
+	}
+
+	return orcdebug.Table{
+		TableName: "gRPC gateway",
+		Rows:      rows,
+	}
+}
+
+func (m *Module) OnRegister(hooks orc.ModuleHooks) {
+	hooks.OnUse(func(u orc.UseContext) {
+		u.Use(jsonapi.M)
+		u.Use(orcdebug.M)
+		u.Use(orcgrpcserver.M)
+	})
+
+	hooks.OnSetup(func() error {
+		orcdebug.M.Status.AddTable(m.statusTable)
+		return nil
+	})
+
+	hooks.OnStart(func() error {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		m.started = true
+
+		routes, err := m.allRoutes()
+		if err != nil {
+			return err
+		}
+
+		if err := m.register(routes); err != nil {
+			return err
+		}
+
+		logrus.Infof("gRPC gateway: registered %d routes", len(routes))
+		return nil
+	})
+}
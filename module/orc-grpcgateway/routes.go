@@ -0,0 +1,178 @@
+package orcgrpcgateway
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+// Route maps an HTTP endpoint to a gRPC method.
+type Route struct {
+	// HTTP method, e.g. "GET".
+	Method string
+
+	// Path relative to the API prefix, in google.api.http template syntax,
+	// e.g. "/v1/users/{user_id}" or "/v1/{name=shelves/*/books/*}".
+	Path string
+
+	// Fully qualified gRPC method, e.g. "/pkg.Service/GetUser".
+	GRPCMethod string
+
+	// Body names the request field the HTTP body is decoded into: "*" for
+	// the whole request message, a field name, or empty for no body.
+	// Request fields not bound by the path or body are read from query
+	// parameters.
+	Body string
+}
+
+func (r Route) String() string {
+	return fmt.Sprintf("%s %s -> %s", r.Method, r.Path, r.GRPCMethod)
+}
+
+var templateVariable = regexp.MustCompile(`\{([^}=]+)(=([^}]*))?\}`)
+
+// muxPath converts a google.api.http path template to a gorilla/mux one.
+func muxPath(template string) (string, error) {
+	if !strings.HasPrefix(template, "/") {
+		return "", fmt.Errorf("Path template %q does not start with '/'", template)
+	}
+
+	var outErr error
+	rv := templateVariable.ReplaceAllStringFunc(template, func(match string) string {
+		parts := templateVariable.FindStringSubmatch(match)
+		name, pattern := parts[1], parts[3]
+		if pattern == "" {
+			return "{" + name + "}"
+		}
+
+		var segments []string
+		for _, segment := range strings.Split(pattern, "/") {
+			switch {
+			case segment == "*":
+				segments = append(segments, "[^/]+")
+			case segment == "**":
+				segments = append(segments, ".+")
+			case strings.ContainsAny(segment, "{}*:"):
+				outErr = fmt.Errorf("Unsupported segment %q in path template %q", segment, template)
+			default:
+				segments = append(segments, regexp.QuoteMeta(segment))
+			}
+		}
+		return "{" + name + ":" + strings.Join(segments, "/") + "}"
+	})
+	if outErr != nil {
+		return "", outErr
+	}
+
+	return rv, nil
+}
+
+func findMethod(fullMethod string) (protoreflect.MethodDescriptor, error) {
+	trimmed := strings.TrimPrefix(fullMethod, "/")
+	slash := strings.LastIndex(trimmed, "/")
+	if slash < 0 {
+		return nil, fmt.Errorf("Malformed gRPC method name %q", fullMethod)
+	}
+	serviceName, methodName := trimmed[:slash], trimmed[slash+1:]
+
+	desc, err := protoregistry.GlobalFiles.FindDescriptorByName(protoreflect.FullName(serviceName))
+	if err != nil {
+		return nil, fmt.Errorf("Unknown gRPC service %q: %v", serviceName, err)
+	}
+	service, ok := desc.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%q is not a gRPC service", serviceName)
+	}
+
+	method := service.Methods().ByName(protoreflect.Name(methodName))
+	if method == nil {
+		return nil, fmt.Errorf("Unknown method %q in gRPC service %q", methodName, serviceName)
+	}
+	if method.IsStreamingClient() || method.IsStreamingServer() {
+		return nil, fmt.Errorf("Streaming method %q cannot be transcoded", fullMethod)
+	}
+	return method, nil
+}
+
+func routesFromRule(fullMethod string, rule *annotations.HttpRule) ([]Route, error) {
+	var method, path string
+	switch pattern := rule.Pattern.(type) {
+	case *annotations.HttpRule_Get:
+		method, path = "GET", pattern.Get
+	case *annotations.HttpRule_Put:
+		method, path = "PUT", pattern.Put
+	case *annotations.HttpRule_Post:
+		method, path = "POST", pattern.Post
+	case *annotations.HttpRule_Delete:
+		method, path = "DELETE", pattern.Delete
+	case *annotations.HttpRule_Patch:
+		method, path = "PATCH", pattern.Patch
+	case *annotations.HttpRule_Custom:
+		method, path = pattern.Custom.GetKind(), pattern.Custom.GetPath()
+	default:
+		return nil, fmt.Errorf("Missing HTTP pattern in annotation on %q", fullMethod)
+	}
+
+	rv := []Route{{
+		Method:     method,
+		Path:       path,
+		GRPCMethod: fullMethod,
+		Body:       rule.Body,
+	}}
+
+	for _, additional := range rule.AdditionalBindings {
+		more, err := routesFromRule(fullMethod, additional)
+		if err != nil {
+			return nil, err
+		}
+		rv = append(rv, more...)
+	}
+
+	return rv, nil
+}
+
+// RoutesFromAnnotations returns the routes declared with google.api.http
+// options on the methods of a registered gRPC service. The service's
+// generated Go package must be linked into the binary.
+func RoutesFromAnnotations(serviceName string) ([]Route, error) {
+	desc, err := protoregistry.GlobalFiles.FindDescriptorByName(protoreflect.FullName(serviceName))
+	if err != nil {
+		return nil, fmt.Errorf("Unknown gRPC service %q: %v", serviceName, err)
+	}
+	service, ok := desc.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%q is not a gRPC service", serviceName)
+	}
+
+	var rv []Route
+
+	methods := service.Methods()
+	for i := 0; i < methods.Len(); i++ {
+		method := methods.Get(i)
+		if method.Options() == nil || !proto.HasExtension(method.Options(), annotations.E_Http) {
+			continue
+		}
+		rule, ok := proto.GetExtension(method.Options(), annotations.E_Http).(*annotations.HttpRule)
+		if !ok || rule == nil {
+			continue
+		}
+
+		fullMethod := fmt.Sprintf("/%s/%s", serviceName, method.Name())
+		routes, err := routesFromRule(fullMethod, rule)
+		if err != nil {
+			return nil, err
+		}
+		rv = append(rv, routes...)
+	}
+
+	if len(rv) == 0 {
+		return nil, fmt.Errorf("gRPC service %q has no google.api.http annotations", serviceName)
+	}
+
+	return rv, nil
+}
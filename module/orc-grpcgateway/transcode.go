@@ -0,0 +1,240 @@
+package orcgrpcgateway
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/steinarvk/orclib/lib/tracepropagation"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+
+	jsonapi "github.com/steinarvk/orclib/module/orc-jsonapi"
+)
+
+// forwardedHeaders are passed on to the gRPC handler as metadata.
+var forwardedHeaders = []string{
+	"Accept-Language",
+	"User-Agent",
+	"X-Request-Id",
+}
+
+type transcoder struct {
+	route  Route
+	method protoreflect.MethodDescriptor
+	conn   func() *grpc.ClientConn
+}
+
+func newMessage(desc protoreflect.MessageDescriptor) proto.Message {
+	return dynamicpb.NewMessage(desc)
+}
+
+// findField resolves a dotted field path, creating intermediate messages.
+func findField(msg protoreflect.Message, path string) (protoreflect.Message, protoreflect.FieldDescriptor, error) {
+	parts := strings.Split(path, ".")
+	for i, name := range parts {
+		fields := msg.Descriptor().Fields()
+		fd := fields.ByName(protoreflect.Name(name))
+		if fd == nil {
+			fd = fields.ByJSONName(name)
+		}
+		if fd == nil {
+			return nil, nil, fmt.Errorf("no such field %q", path)
+		}
+		if i == len(parts)-1 {
+			return msg, fd, nil
+		}
+		if fd.Kind() != protoreflect.MessageKind || fd.IsList() || fd.IsMap() {
+			return nil, nil, fmt.Errorf("field %q is not a message", name)
+		}
+		msg = msg.Mutable(fd).Message()
+	}
+	return nil, nil, fmt.Errorf("empty field path")
+}
+
+func parseScalar(fd protoreflect.FieldDescriptor, value string) (protoreflect.Value, error) {
+	switch fd.Kind() {
+	case protoreflect.StringKind:
+		return protoreflect.ValueOfString(value), nil
+	case protoreflect.BoolKind:
+		v, err := strconv.ParseBool(value)
+		return protoreflect.ValueOfBool(v), err
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		v, err := strconv.ParseInt(value, 10, 32)
+		return protoreflect.ValueOfInt32(int32(v)), err
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		v, err := strconv.ParseInt(value, 10, 64)
+		return protoreflect.ValueOfInt64(v), err
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		v, err := strconv.ParseUint(value, 10, 32)
+		return protoreflect.ValueOfUint32(uint32(v)), err
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		v, err := strconv.ParseUint(value, 10, 64)
+		return protoreflect.ValueOfUint64(v), err
+	case protoreflect.FloatKind:
+		v, err := strconv.ParseFloat(value, 32)
+		return protoreflect.ValueOfFloat32(float32(v)), err
+	case protoreflect.DoubleKind:
+		v, err := strconv.ParseFloat(value, 64)
+		return protoreflect.ValueOfFloat64(v), err
+	case protoreflect.BytesKind:
+		v, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			v, err = base64.URLEncoding.DecodeString(value)
+		}
+		return protoreflect.ValueOfBytes(v), err
+	case protoreflect.EnumKind:
+		if ev := fd.Enum().Values().ByName(protoreflect.Name(value)); ev != nil {
+			return protoreflect.ValueOfEnum(ev.Number()), nil
+		}
+		v, err := strconv.ParseInt(value, 10, 32)
+		if err != nil {
+			return protoreflect.Value{}, fmt.Errorf("unknown enum value %q", value)
+		}
+		return protoreflect.ValueOfEnum(protoreflect.EnumNumber(v)), nil
+	}
+	return protoreflect.Value{}, fmt.Errorf("unsupported field type %v", fd.Kind())
+}
+
+// setField sets the field at a dotted path from its string form, as found
+// in path variables and query parameters. Repeated fields are appended to.
+func setField(msg proto.Message, path string, value string) error {
+	parent, fd, err := findField(msg.ProtoReflect(), path)
+	if err != nil {
+		return err
+	}
+	if fd.IsMap() {
+		return fmt.Errorf("map field %q cannot be set from a string", path)
+	}
+
+	v, err := parseScalar(fd, value)
+	if err != nil {
+		return fmt.Errorf("invalid value for %q: %v", path, err)
+	}
+
+	if fd.IsList() {
+		parent.Mutable(fd).List().Append(v)
+		return nil
+	}
+	parent.Set(fd, v)
+	return nil
+}
+
+func (t *transcoder) readBody(req *http.Request, msg proto.Message) error {
+	defer req.Body.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(req.Body, int64(jsonapi.MaxRequestDataBytes)+1))
+	if err != nil {
+		return jsonapi.HttpCode(http.StatusBadRequest)
+	}
+	if len(data) > jsonapi.MaxRequestDataBytes {
+		return jsonapi.WithCode{Code: http.StatusRequestEntityTooLarge, Message: fmt.Sprintf("Too large (> %d)", jsonapi.MaxRequestDataBytes)}
+	}
+
+	switch t.route.Body {
+	case "":
+		return nil
+	case "*":
+		if len(data) == 0 {
+			return nil
+		}
+	default:
+		parent, fd, err := findField(msg.ProtoReflect(), t.route.Body)
+		if err != nil {
+			return fmt.Errorf("Bad body field in route %v: %v", t.route, err)
+		}
+		if fd.Kind() != protoreflect.MessageKind || fd.IsList() || fd.IsMap() {
+			return fmt.Errorf("Bad body field in route %v: not a message", t.route)
+		}
+		msg = parent.Mutable(fd).Message().Interface()
+	}
+
+	if err := protojson.Unmarshal(data, msg); err != nil {
+		return jsonapi.BadRequest(fmt.Sprintf("invalid JSON body: %v", err))
+	}
+	return nil
+}
+
+func (t *transcoder) buildRequest(req *http.Request) (proto.Message, error) {
+	msg := newMessage(t.method.Input())
+
+	if err := t.readBody(req, msg); err != nil {
+		return nil, err
+	}
+
+	bound := map[string]bool{}
+	for name, value := range mux.Vars(req) {
+		if err := setField(msg, name, value); err != nil {
+			return nil, jsonapi.BadRequest(err.Error())
+		}
+		bound[name] = true
+	}
+
+	if t.route.Body != "*" {
+		for name, values := range req.URL.Query() {
+			if bound[name] {
+				continue
+			}
+			for _, value := range values {
+				if err := setField(msg, name, value); err != nil {
+					return nil, jsonapi.BadRequest(err.Error())
+				}
+			}
+		}
+	}
+
+	return msg, nil
+}
+
+func (t *transcoder) outgoingContext(req *http.Request) metadata.MD {
+	md := metadata.New(tracepropagation.Outgoing(req.Context()))
+	for _, header := range forwardedHeaders {
+		if value := req.Header.Get(header); value != "" {
+			md.Set(strings.ToLower(header), value)
+		}
+	}
+	return md
+}
+
+func (t *transcoder) serve(w http.ResponseWriter, req *http.Request) error {
+	in, err := t.buildRequest(req)
+	if err != nil {
+		return err
+	}
+
+	conn := t.conn()
+	if conn == nil {
+		return jsonapi.WithCode{Code: http.StatusServiceUnavailable, Message: "gRPC server not available"}
+	}
+
+	out := newMessage(t.method.Output())
+	ctx := metadata.NewOutgoingContext(req.Context(), t.outgoingContext(req))
+	if err := conn.Invoke(ctx, t.route.GRPCMethod, in, out); err != nil {
+		st := status.Convert(err)
+		return jsonapi.WithCode{Code: HTTPStatusFromCode(st.Code()), Message: st.Message()}
+	}
+
+	data, err := protojson.MarshalOptions{Multiline: true, Indent: "  "}.Marshal(out)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal response from %q: %v", t.route.GRPCMethod, err)
+	}
+
+	w.Header()["Content-Type"] = []string{"application/json"}
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+	return nil
+}
+
+func (t *transcoder) handler() jsonapi.Handler {
+	return jsonapi.WrapOnlyErrors(t.serve)
+}
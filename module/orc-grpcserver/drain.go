@@ -0,0 +1,54 @@
+package orcgrpcserver
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	server "github.com/steinarvk/orclib/module/orc-server"
+)
+
+const (
+	httpShutdownTimeout = 30 * time.Second
+)
+
+// drain reports NOT_SERVING while still accepting calls, so that load
+// balancers stop sending new ones, and then shuts down the main HTTP server
+// once its calls have finished, before stopping the gRPC server.
+//
+// Calls from outside the process are served through ServeHTTP, whose
+// transports GracefulStop cannot drain (it panics), so it is the HTTP
+// server that waits for them. In-process calls are made by its handlers,
+// so they have finished too.
+func (m *Module) drain(period time.Duration) {
+	m.markShuttingDown()
+	logrus.Infof("gRPC server: draining for %v", period)
+	time.Sleep(period)
+
+	if server.Server != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+		defer cancel()
+		if err := server.Server.Shutdown(ctx); err != nil {
+			logrus.Warningf("Error shutting down server: %v", err)
+		}
+	}
+
+	m.Server.Stop()
+	logrus.Infof("gRPC server: stopped")
+}
+
+// drainOnSignal drains the server on SIGTERM.
+func (m *Module) drainOnSignal(period time.Duration) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM)
+
+	go func() {
+		<-signals
+		signal.Stop(signals)
+		m.drain(period)
+	}()
+}
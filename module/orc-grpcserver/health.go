@@ -0,0 +1,55 @@
+package orcgrpcserver
+
+import (
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// UnauthenticatedServices are gRPC services that may be called without
+// passing outer auth. Health checks typically come from load balancers.
+var UnauthenticatedServices = []string{
+	healthpb.Health_ServiceDesc.ServiceName,
+}
+
+func requiresAuth(fullMethod string) bool {
+	for _, service := range UnauthenticatedServices {
+		if strings.HasPrefix(fullMethod, "/"+service+"/") {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *Module) setupHealth() {
+	m.health = health.NewServer()
+	m.health.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	healthpb.RegisterHealthServer(m.Server, m.health)
+}
+
+// markServing reports the server and every registered service as serving.
+func (m *Module) markServing() {
+	m.health.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+	for service := range m.Server.GetServiceInfo() {
+		m.health.SetServingStatus(service, healthpb.HealthCheckResponse_SERVING)
+	}
+	logrus.Infof("gRPC health: serving")
+}
+
+// markShuttingDown reports every service as not serving; later updates are ignored.
+func (m *Module) markShuttingDown() {
+	m.health.Shutdown()
+	logrus.Infof("gRPC health: shutting down")
+}
+
+// SetServingStatus overrides the health status of a single service, e.g.
+// when a backend it depends on becomes unavailable.
+func (m *Module) SetServingStatus(service string, serving bool) {
+	servingStatus := healthpb.HealthCheckResponse_NOT_SERVING
+	if serving {
+		servingStatus = healthpb.HealthCheckResponse_SERVING
+	}
+	m.health.SetServingStatus(service, servingStatus)
+}
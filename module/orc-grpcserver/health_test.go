@@ -0,0 +1,164 @@
+package orcgrpcserver
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	server "github.com/steinarvk/orclib/module/orc-server"
+)
+
+func newTestServer(t *testing.T, enableReflection bool) *Module {
+	t.Helper()
+
+	m := &Module{}
+	m.setupServer(enableReflection)
+	if err := m.dialInProcess(); err != nil {
+		t.Fatal(err)
+	}
+	m.serveInProcess()
+	t.Cleanup(func() {
+		m.inProcessConn.Close()
+		m.Server.Stop()
+	})
+	return m
+}
+
+func TestHealth(t *testing.T) {
+	ctx := context.Background()
+	m := newTestServer(t, true)
+	client := healthpb.NewHealthClient(m.InProcessConn())
+
+	statusIs := func(want healthpb.HealthCheckResponse_ServingStatus) {
+		t.Helper()
+		resp, err := client.Check(ctx, &healthpb.HealthCheckRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Status != want {
+			t.Errorf("health status = %v want %v", resp.Status, want)
+		}
+	}
+
+	statusIs(healthpb.HealthCheckResponse_NOT_SERVING)
+	m.markServing()
+	statusIs(healthpb.HealthCheckResponse_SERVING)
+
+	// While draining, the server still answers, but reports NOT_SERVING.
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		m.drain(200 * time.Millisecond)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	statusIs(healthpb.HealthCheckResponse_NOT_SERVING)
+
+	<-drained
+	if _, err := client.Check(ctx, &healthpb.HealthCheckRequest{}); status.Code(err) != codes.Unavailable {
+		t.Errorf("health check after drain: got %v want Unavailable", err)
+	}
+}
+
+// slowService has a single method, Sleep, that signals when it has begun and
+// then takes a while.
+func slowService(started chan<- struct{}) *grpc.ServiceDesc {
+	return &grpc.ServiceDesc{
+		ServiceName: "test.Slow",
+		HandlerType: (*interface{})(nil),
+		Methods: []grpc.MethodDesc{{
+			MethodName: "Sleep",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				in := &emptypb.Empty{}
+				if err := dec(in); err != nil {
+					return nil, err
+				}
+				handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+					close(started)
+					time.Sleep(300 * time.Millisecond)
+					return &emptypb.Empty{}, nil
+				}
+				return interceptor(ctx, in, &grpc.UnaryServerInfo{Server: srv, FullMethod: "/test.Slow/Sleep"}, handler)
+			},
+		}},
+	}
+}
+
+func TestDrainWaitsForCallsOverHTTP(t *testing.T) {
+	ctx := context.Background()
+
+	defer func(services []string) { UnauthenticatedServices = services }(UnauthenticatedServices)
+	UnauthenticatedServices = append(UnauthenticatedServices, "test.Slow")
+
+	started := make(chan struct{})
+	m := &Module{}
+	m.setupServer(false)
+	m.Server.RegisterService(slowService(started), struct{}{})
+	if err := m.dialInProcess(); err != nil {
+		t.Fatal(err)
+	}
+	m.serveInProcess()
+	defer m.inProcessConn.Close()
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !m.hijacker(w, req) {
+			http.NotFound(w, req)
+		}
+	}))
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+
+	defer func(s *http.Server) { server.Server = s }(server.Server)
+	server.Server = ts.Config
+
+	conn, err := grpc.Dial(ts.Listener.Addr().String(), grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{InsecureSkipVerify: true})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	called := make(chan error, 1)
+	go func() {
+		called <- conn.Invoke(ctx, "/test.Slow/Sleep", &emptypb.Empty{}, &emptypb.Empty{})
+	}()
+	<-started
+
+	m.drain(0)
+
+	select {
+	case err := <-called:
+		if err != nil {
+			t.Errorf("call over HTTP failed during drain: %v", err)
+		}
+	default:
+		t.Errorf("drain returned before the call over HTTP finished")
+	}
+}
+
+func TestReflectionToggle(t *testing.T) {
+	hasReflection := func(m *Module) bool {
+		for service := range m.Server.GetServiceInfo() {
+			if service == "grpc.reflection.v1alpha.ServerReflection" || service == "grpc.reflection.v1.ServerReflection" {
+				return true
+			}
+		}
+		return false
+	}
+
+	if m := newTestServer(t, true); !hasReflection(m) || !m.reflectionEnabled {
+		t.Errorf("reflection not registered when enabled")
+	}
+	if m := newTestServer(t, false); hasReflection(m) || m.reflectionEnabled {
+		t.Errorf("reflection registered when disabled")
+	}
+}
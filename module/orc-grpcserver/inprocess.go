@@ -0,0 +1,58 @@
+package orcgrpcserver
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+const (
+	inProcessBufferSize = 1 << 20
+)
+
+// isInProcess reports whether a call arrived over the in-process connection.
+// Such calls are made by handlers that have already been through the main
+// HTTP middleware chain, including outer auth.
+func isInProcess(ctx context.Context) bool {
+	p, ok := peer.FromContext(ctx)
+	return ok && p.Addr != nil && p.Addr.Network() == "bufconn"
+}
+
+func (m *Module) dialInProcess() error {
+	m.inProcessListener = bufconn.Listen(inProcessBufferSize)
+
+	conn, err := grpc.Dial("inprocess",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return m.inProcessListener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		return fmt.Errorf("Failed to create in-process gRPC connection: %v", err)
+	}
+
+	m.inProcessConn = conn
+	return nil
+}
+
+// serveInProcess must only be called once all services are registered.
+func (m *Module) serveInProcess() {
+	go func() {
+		if err := m.Server.Serve(m.inProcessListener); err != nil {
+			logrus.Infof("In-process gRPC server shut down with error: %v", err)
+		}
+	}()
+}
+
+// InProcessConn returns a connection to this server that does not leave the
+// process. Calls over it skip outer auth, but are otherwise handled like any
+// other call.
+func (m *Module) InProcessConn() *grpc.ClientConn {
+	return m.inProcessConn
+}
@@ -0,0 +1,222 @@
+package orcgrpcserver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/steinarvk/orclib/lib/authinterface"
+	"github.com/steinarvk/orclib/lib/tracepropagation"
+	"github.com/steinarvk/sectiontrace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+type sectionmaker struct {
+	mu       sync.Mutex
+	sections map[string]sectiontrace.Section
+}
+
+var sections = &sectionmaker{}
+
+func (s *sectionmaker) Get(fullMethod string) sectiontrace.Section {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.sections == nil {
+		s.sections = map[string]sectiontrace.Section{}
+	}
+
+	sec, ok := s.sections[fullMethod]
+	if !ok {
+		sec = sectiontrace.New(fmt.Sprintf("gRPC(%s)", fullMethod))
+		s.sections[fullMethod] = sec
+	}
+
+	return sec
+}
+
+// requestFromMetadata builds a stand-in HTTP request carrying the gRPC
+// metadata as headers, so that HTTP gatekeepers can be applied to gRPC calls.
+func requestFromMetadata(ctx context.Context, fullMethod string) *http.Request {
+	header := http.Header{}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		for key, values := range md {
+			if strings.HasPrefix(key, ":") {
+				continue
+			}
+			for _, value := range values {
+				header.Add(key, value)
+			}
+		}
+	}
+
+	req := &http.Request{
+		Method:     "POST",
+		URL:        &url.URL{Path: fullMethod},
+		Proto:      "HTTP/2.0",
+		ProtoMajor: 2,
+		Header:     header,
+		Host:       header.Get("Host"),
+	}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		req.RemoteAddr = p.Addr.String()
+	}
+	return req.WithContext(ctx)
+}
+
+// withRemoteTrace attaches the caller's trace context, if it sent one.
+func withRemoteTrace(ctx context.Context) context.Context {
+	md, _ := metadata.FromIncomingContext(ctx)
+	return tracepropagation.Incoming(ctx, func(key string) string {
+		if values := md.Get(key); len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	})
+}
+
+func checkAuth(ctx context.Context, gk authinterface.Gatekeeper, fullMethod string) error {
+	if !requiresAuth(fullMethod) || isInProcess(ctx) {
+		return nil
+	}
+
+	labels := prometheus.Labels{
+		"method": fullMethod,
+		"status": "null",
+	}
+	defer func() {
+		metricAuthChecks.With(labels).Inc()
+	}()
+
+	if gk == nil {
+		labels["status"] = "no-gatekeeper"
+		logrus.WithFields(logrus.Fields{
+			"method": fullMethod,
+		}).Errorf("gRPC auth failed: no gatekeeper configured")
+		return status.Error(codes.Unauthenticated, "Unauthorized")
+	}
+
+	success, err := gk.CheckAuth(requestFromMetadata(ctx, fullMethod))
+	if err != nil || success == nil {
+		labels["status"] = "failed"
+
+		fields := logrus.Fields{
+			"method": fullMethod,
+			"error":  err,
+		}
+		if failure, ok := err.(authinterface.ErrorWithFailureInfo); ok {
+			attempt := failure.AuthFailureInfo().Attempt
+			fields["gatekeeper_id"] = attempt.GatekeeperID
+			fields["username"] = attempt.Username
+			fields["realm"] = attempt.Realm
+		}
+		logrus.WithFields(fields).Infof("gRPC auth failed")
+
+		return status.Error(codes.Unauthenticated, "Unauthorized")
+	}
+
+	labels["status"] = "ok"
+	logrus.WithFields(logrus.Fields{
+		"method":        fullMethod,
+		"gatekeeper_id": success.Attempt.GatekeeperID,
+		"username":      success.Attempt.Username,
+		"realm":         success.Attempt.Realm,
+	}).Debugf("gRPC auth successful")
+
+	return nil
+}
+
+func recoverAsInternal(fullMethod string, outErr *error) {
+	if r := recover(); r != nil {
+		metricPanics.With(prometheus.Labels{"method": fullMethod}).Inc()
+		logrus.WithFields(logrus.Fields{
+			"method": fullMethod,
+			"panic":  r,
+			"stack":  string(debug.Stack()),
+		}).Errorf("Recovered from panic in gRPC handler")
+		*outErr = status.Error(codes.Internal, "Internal error")
+	}
+}
+
+func recordFinished(fullMethod string, t0 time.Time, err error) {
+	code := status.Code(err)
+	duration := time.Since(t0)
+
+	calls.record(fullMethod, code)
+
+	labels := prometheus.Labels{
+		"method": fullMethod,
+		"code":   code.String(),
+	}
+	metricRequestsHandled.With(labels).Inc()
+	metricRequestsHandledLatency.With(labels).Observe(duration.Seconds())
+
+	fields := logrus.Fields{
+		"method":   fullMethod,
+		"code":     code.String(),
+		"duration": duration,
+	}
+	if err != nil {
+		logrus.WithFields(fields).Infof("gRPC request finished with error: %v", err)
+	} else {
+		logrus.WithFields(fields).Infof("gRPC request succeeded")
+	}
+}
+
+func (m *Module) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	t0 := time.Now()
+	metricRequestsBegun.With(prometheus.Labels{"method": info.FullMethod}).Inc()
+
+	ctx, sec := sections.Get(info.FullMethod).Begin(withRemoteTrace(ctx))
+	defer func() {
+		sec.End(err)
+		recordFinished(info.FullMethod, t0, err)
+	}()
+
+	defer recoverAsInternal(info.FullMethod, &err)
+
+	if err := checkAuth(ctx, m.gatekeeper(), info.FullMethod); err != nil {
+		return nil, err
+	}
+
+	return handler(ctx, req)
+}
+
+type wrappedServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (w *wrappedServerStream) Context() context.Context {
+	return w.ctx
+}
+
+func (m *Module) streamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	t0 := time.Now()
+	metricRequestsBegun.With(prometheus.Labels{"method": info.FullMethod}).Inc()
+
+	ctx, sec := sections.Get(info.FullMethod).Begin(withRemoteTrace(ss.Context()))
+	defer func() {
+		sec.End(err)
+		recordFinished(info.FullMethod, t0, err)
+	}()
+
+	defer recoverAsInternal(info.FullMethod, &err)
+
+	if err := checkAuth(ctx, m.gatekeeper(), info.FullMethod); err != nil {
+		return err
+	}
+
+	return handler(srv, &wrappedServerStream{ServerStream: ss, ctx: ctx})
+}
@@ -0,0 +1,57 @@
+package orcgrpcserver
+
+import (
+	"context"
+	"testing"
+
+	"github.com/steinarvk/orclib/lib/authinterface"
+	orcouterauth "github.com/steinarvk/orclib/module/orc-outerauth"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestUnaryInterceptor(t *testing.T) {
+	m := &Module{}
+	info := &grpc.UnaryServerInfo{FullMethod: "/test.Service/Method"}
+
+	testcases := []struct {
+		name       string
+		gatekeeper authinterface.Gatekeeper
+		handler    grpc.UnaryHandler
+		want       codes.Code
+	}{
+		{
+			name:       "allowed",
+			gatekeeper: authinterface.AllowAll,
+			handler:    func(ctx context.Context, req interface{}) (interface{}, error) { return "ok", nil },
+			want:       codes.OK,
+		},
+		{
+			name:       "denied",
+			gatekeeper: authinterface.DenyAll,
+			handler:    func(ctx context.Context, req interface{}) (interface{}, error) { return "ok", nil },
+			want:       codes.Unauthenticated,
+		},
+		{
+			name:       "no gatekeeper",
+			gatekeeper: nil,
+			handler:    func(ctx context.Context, req interface{}) (interface{}, error) { return "ok", nil },
+			want:       codes.Unauthenticated,
+		},
+		{
+			name:       "panic",
+			gatekeeper: authinterface.AllowAll,
+			handler:    func(ctx context.Context, req interface{}) (interface{}, error) { panic("oops") },
+			want:       codes.Internal,
+		},
+	}
+
+	for _, tc := range testcases {
+		orcouterauth.M.MainGatekeeper = tc.gatekeeper
+		_, err := m.unaryInterceptor(context.Background(), nil, info, tc.handler)
+		if got := status.Code(err); got != tc.want {
+			t.Errorf("%s: got code %v (err %v) want %v", tc.name, got, err, tc.want)
+		}
+	}
+}
@@ -3,19 +3,33 @@ package orcgrpcserver
 import (
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 	"github.com/steinarvk/orc"
+	"github.com/steinarvk/orclib/lib/authinterface"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
 	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/test/bufconn"
 
 	orcdebug "github.com/steinarvk/orclib/module/orc-debug"
 	httprouter "github.com/steinarvk/orclib/module/orc-httprouter"
+	orcouterauth "github.com/steinarvk/orclib/module/orc-outerauth"
+	orcprometheus "github.com/steinarvk/orclib/module/orc-prometheus"
+	orcsectiontrace "github.com/steinarvk/orclib/module/orc-sectiontrace"
+	server "github.com/steinarvk/orclib/module/orc-server"
 )
 
 type Module struct {
 	Server *grpc.Server
+
+	health            *health.Server
+	reflectionEnabled bool
+
+	inProcessListener *bufconn.Listener
+	inProcessConn     *grpc.ClientConn
 }
 
 func (m *Module) ModuleName() string { return "gRPCServer" }
@@ -42,31 +56,89 @@ func (m *Module) hijacker(w http.ResponseWriter, req *http.Request) bool {
 
 var M = &Module{}
 
+func (m *Module) gatekeeper() authinterface.Gatekeeper {
+	return orcouterauth.M.MainGatekeeper
+}
+
+// onListen arranges for f to be called once all modules have started,
+// just before the server begins listening.
+func (m *Module) onListen(f func()) {
+	listenAndServe := server.ListenAndServe
+	if listenAndServe == nil {
+		logrus.Warningf("gRPC server: no server.ListenAndServe to hook into; marking as serving immediately")
+		f()
+		return
+	}
+	server.ListenAndServe = func() error {
+		f()
+		err := listenAndServe()
+		if err == http.ErrServerClosed {
+			// Shut down by drain.
+			return nil
+		}
+		return err
+	}
+}
+
+func (m *Module) setupServer(enableReflection bool) {
+	m.Server = grpc.NewServer(
+		grpc.ChainUnaryInterceptor(m.unaryInterceptor),
+		grpc.ChainStreamInterceptor(m.streamInterceptor),
+	)
+
+	m.setupHealth()
+
+	m.reflectionEnabled = enableReflection
+	if m.reflectionEnabled {
+		reflection.Register(m.Server)
+	}
+}
+
 func (m *Module) OnRegister(hooks orc.ModuleHooks) {
+	var flagDisableReflection bool
+	var flagShutdownDrain time.Duration
+
 	hooks.OnUse(func(u orc.UseContext) {
 		u.Use(httprouter.M)
 		u.Use(orcdebug.M)
+		u.Use(orcouterauth.M)
+		u.Use(orcprometheus.M)
+		u.Use(orcsectiontrace.M)
+		u.Use(server.M)
+
+		u.Flags.BoolVar(&flagDisableReflection, "grpc_disable_reflection", false, "disable the gRPC reflection service")
+		u.Flags.DurationVar(&flagShutdownDrain, "grpc_shutdown_drain", 0, "on SIGTERM, time to report NOT_SERVING on gRPC health checks before shutting down gracefully")
 	})
 
 	hooks.OnSetup(func() error {
-		m.Server = grpc.NewServer()
+		m.setupServer(!flagDisableReflection)
 
-		reflection.Register(m.Server)
-
-		orcdebug.M.Status.AddTable(func() orcdebug.Table {
-			return orcdebug.Table{
-				TableName: "gRPC server",
-				Rows: []orcdebug.Row{
-					{"Active", "true"},
-				},
-			}
-		})
+		orcdebug.M.Status.AddTable(m.statusTable)
 		logrus.Infof("Initialized gRPC server.")
 		return nil
 	})
 
 	hooks.OnStart(func() error {
 		httprouter.ConnectionHijackers = append(httprouter.ConnectionHijackers, m.hijacker)
+		if err := m.dialInProcess(); err != nil {
+			return err
+		}
+		m.onListen(func() {
+			m.serveInProcess()
+			m.markServing()
+			if flagShutdownDrain > 0 {
+				m.drainOnSignal(flagShutdownDrain)
+			}
+		})
+		return nil
+	})
+
+	hooks.OnStop(func() error {
+		m.markShuttingDown()
+		if m.inProcessConn != nil {
+			m.inProcessConn.Close()
+		}
+		m.Server.Stop()
 		return nil
 	})
 }
@@ -3,6 +3,7 @@ package orcgrpcserver
 import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	orcprometheus "github.com/steinarvk/orclib/module/orc-prometheus"
 )
 
 var (
@@ -13,4 +14,45 @@ var (
 	},
 		[]string{"grpc"},
 	)
+
+	metricRequestsBegun = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "grpc",
+		Name:      "server_requests_begun",
+		Help:      "Number of gRPC calls for which processing was started.",
+	},
+		[]string{"method"},
+	)
+
+	metricRequestsHandled = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "grpc",
+		Name:      "server_requests_handled",
+		Help:      "Number of gRPC calls for which processing finished, by status code.",
+	},
+		[]string{"method", "code"},
+	)
+
+	metricRequestsHandledLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "grpc",
+		Name:      "server_request_latency_histogram",
+		Help:      "Latency between starting and finishing processing of a gRPC call.",
+		Buckets:   orcprometheus.DefTimeBuckets,
+	},
+		[]string{"method", "code"},
+	)
+
+	metricAuthChecks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "grpc",
+		Name:      "server_auth_checks",
+		Help:      "Number of gRPC calls for which outer auth was processed.",
+	},
+		[]string{"method", "status"},
+	)
+
+	metricPanics = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "grpc",
+		Name:      "server_panics_recovered",
+		Help:      "Number of panics in gRPC handlers converted to Internal errors.",
+	},
+		[]string{"method"},
+	)
 )
@@ -0,0 +1,88 @@
+package orcgrpcserver
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+
+	orcdebug "github.com/steinarvk/orclib/module/orc-debug"
+)
+
+type methodCounts struct {
+	calls  int64
+	errors int64
+}
+
+type callCounter struct {
+	mu     sync.Mutex
+	counts map[string]*methodCounts
+}
+
+func (c *callCounter) record(fullMethod string, code codes.Code) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.counts == nil {
+		c.counts = map[string]*methodCounts{}
+	}
+
+	counts, ok := c.counts[fullMethod]
+	if !ok {
+		counts = &methodCounts{}
+		c.counts[fullMethod] = counts
+	}
+	counts.calls++
+	if code != codes.OK {
+		counts.errors++
+	}
+}
+
+func (c *callCounter) get(fullMethod string) methodCounts {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if counts, ok := c.counts[fullMethod]; ok {
+		return *counts
+	}
+	return methodCounts{}
+}
+
+var calls = &callCounter{}
+
+func (m *Module) statusTable() orcdebug.Table {
+	tbl := orcdebug.Table{
+		TableName: "gRPC server",
+		Rows: []orcdebug.Row{
+			{Key: "Active", Value: "true"},
+			{Key: "Reflection", Value: fmt.Sprintf("%v", m.reflectionEnabled)},
+		},
+	}
+
+	serviceInfo := m.Server.GetServiceInfo()
+
+	var serviceNames []string
+	for name := range serviceInfo {
+		serviceNames = append(serviceNames, name)
+	}
+	sort.Strings(serviceNames)
+
+	for _, serviceName := range serviceNames {
+		tbl.Rows = append(tbl.Rows, orcdebug.Row{
+			Key:   serviceName,
+			Value: fmt.Sprintf("%d methods", len(serviceInfo[serviceName].Methods)),
+		})
+
+		for _, method := range serviceInfo[serviceName].Methods {
+			fullMethod := fmt.Sprintf("/%s/%s", serviceName, method.Name)
+			counts := calls.get(fullMethod)
+			tbl.Rows = append(tbl.Rows, orcdebug.Row{
+				Key:   fullMethod,
+				Value: fmt.Sprintf("calls: %d (errors: %d)", counts.calls, counts.errors),
+			})
+		}
+	}
+
+	return tbl
+}
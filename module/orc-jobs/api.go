@@ -0,0 +1,88 @@
+package orcjobs
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/steinarvk/orclib/lib/orcjobs"
+
+	httprouter "github.com/steinarvk/orclib/module/orc-httprouter"
+	jsonapi "github.com/steinarvk/orclib/module/orc-jsonapi"
+)
+
+// apiError gives errors about jobs their HTTP status codes.
+func apiError(err error) error {
+	switch {
+	case errors.As(err, new(orcjobs.JobNotFound)):
+		return jsonapi.WithCode{Code: http.StatusNotFound, Message: err.Error()}
+	case errors.As(err, new(orcjobs.DuplicateJob)), errors.As(err, new(orcjobs.WrongState)):
+		return jsonapi.WithCode{Code: http.StatusConflict, Message: err.Error()}
+	}
+	return err
+}
+
+func (m *Module) listJobs(req *http.Request) (interface{}, error) {
+	query := req.URL.Query()
+	opts := orcjobs.ListOptions{
+		Queue: query.Get("queue"),
+		State: orcjobs.State(query.Get("state")),
+	}
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil {
+			return nil, jsonapi.BadField("limit", err)
+		}
+		opts.Limit = n
+	}
+
+	jobs, err := m.Jobs.List(req.Context(), opts)
+	if err != nil {
+		return nil, err
+	}
+	if jobs == nil {
+		jobs = []orcjobs.Job{}
+	}
+	return jobs, nil
+}
+
+func (m *Module) getJob(req *http.Request) (interface{}, error) {
+	job, err := m.Jobs.Get(req.Context(), mux.Vars(req)["id"])
+	if err != nil {
+		return nil, apiError(err)
+	}
+	return job, nil
+}
+
+func (m *Module) handleAPI() {
+	validID := jsonapi.ValidateVar("id", jsonapi.Nonempty)
+
+	httprouter.M.HandleDebug("/internal-api/jobs", jsonapi.Methods{
+		Get: jsonapi.DiscardBody(m.listJobs),
+	})
+	httprouter.M.HandleDebug("/internal-api/job-counts", jsonapi.Methods{
+		Get: jsonapi.DiscardBody(func(req *http.Request) (interface{}, error) {
+			return m.Jobs.Counts(req.Context())
+		}),
+	})
+	httprouter.M.HandleDebug("/internal-api/jobs/{id}", jsonapi.Methods{
+		Get: jsonapi.DiscardBody(m.getJob, validID),
+	})
+	httprouter.M.HandleDebug("/internal-api/jobs/{id}/retry", jsonapi.Methods{
+		Post: jsonapi.DiscardBody(func(req *http.Request) (interface{}, error) {
+			if err := m.Jobs.Retry(req.Context(), mux.Vars(req)["id"]); err != nil {
+				return nil, apiError(err)
+			}
+			return m.getJob(req)
+		}, validID),
+	})
+	httprouter.M.HandleDebug("/internal-api/jobs/{id}/cancel", jsonapi.Methods{
+		Post: jsonapi.DiscardBody(func(req *http.Request) (interface{}, error) {
+			if err := m.Jobs.Cancel(req.Context(), mux.Vars(req)["id"]); err != nil {
+				return nil, apiError(err)
+			}
+			return m.getJob(req)
+		}, validID),
+	})
+}
@@ -0,0 +1,146 @@
+package orcjobs
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/steinarvk/orc"
+	"github.com/steinarvk/orclib/lib/orcjobs"
+
+	orcdatabase "github.com/steinarvk/orclib/module/orc-database"
+	orcdebug "github.com/steinarvk/orclib/module/orc-debug"
+	httprouter "github.com/steinarvk/orclib/module/orc-httprouter"
+)
+
+type Module struct {
+	database *orcdatabase.Module
+	handlers map[string]map[string]orcjobs.Handler
+	workers  []*orcjobs.Workers
+
+	Jobs *orcjobs.Jobs
+}
+
+// New returns a module running the jobs in the database opened by
+// database, whose schema must include orcjobs.SchemaSQL.
+func New(database *orcdatabase.Module) *Module {
+	return &Module{
+		database: database,
+		handlers: map[string]map[string]orcjobs.Handler{},
+	}
+}
+
+func (m *Module) ModuleName() string { return "Jobs" }
+
+// Handle sets the handler of the jobs of a kind in a queue. Workers are
+// started for each queue with handlers, so Handle must be called before
+// the module starts.
+func (m *Module) Handle(queue, kind string, handler orcjobs.Handler) {
+	if m.Jobs != nil {
+		logrus.Fatalf("Handler for %q jobs in queue %q added after jobs started", kind, queue)
+	}
+	if m.handlers[queue] == nil {
+		m.handlers[queue] = map[string]orcjobs.Handler{}
+	}
+	m.handlers[queue][kind] = handler
+}
+
+func (m *Module) queues() []string {
+	var rv []string
+	for queue := range m.handlers {
+		rv = append(rv, queue)
+	}
+	sort.Strings(rv)
+	return rv
+}
+
+func (m *Module) statusTable() orcdebug.Table {
+	tbl := orcdebug.Table{TableName: "Jobs"}
+
+	for _, queue := range m.queues() {
+		var kinds []string
+		for kind := range m.handlers[queue] {
+			kinds = append(kinds, kind)
+		}
+		sort.Strings(kinds)
+		tbl.Rows = append(tbl.Rows, orcdebug.Row{Key: fmt.Sprintf("Handlers for queue %q", queue), Value: fmt.Sprintf("%v", kinds)})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	counts, err := m.Jobs.Counts(ctx)
+	if err != nil {
+		tbl.Rows = append(tbl.Rows, orcdebug.Row{Key: "Error", Value: err.Error()})
+		return tbl
+	}
+	for _, count := range counts {
+		tbl.Rows = append(tbl.Rows, orcdebug.Row{
+			Key:   fmt.Sprintf("Queue %q %s", count.Queue, count.State),
+			Value: fmt.Sprintf("%d", count.N),
+		})
+	}
+
+	return tbl
+}
+
+func (m *Module) OnRegister(hooks orc.ModuleHooks) {
+	cfg := orcjobs.DefaultWorkerConfig
+	var disableWorkers bool
+
+	hooks.OnUse(func(u orc.UseContext) {
+		u.Use(m.database)
+		u.Use(orcdebug.M)
+		u.Use(httprouter.M)
+
+		u.Flags.IntVar(&cfg.Concurrency, "jobs_concurrency", cfg.Concurrency, "maximum jobs run at a time, per queue")
+		u.Flags.DurationVar(&cfg.PollInterval, "jobs_poll_interval", cfg.PollInterval, "how often idle workers look for due jobs")
+		u.Flags.DurationVar(&cfg.Lease, "jobs_lease", cfg.Lease, "how long a job stays claimed by a worker that stops renewing its lease")
+		u.Flags.DurationVar(&cfg.MaxBackoff, "jobs_max_backoff", cfg.MaxBackoff, "maximum delay before retrying a failed job")
+		u.Flags.BoolVar(&disableWorkers, "jobs_disable_workers", false, "do not run jobs, only enqueue and inspect them")
+	})
+
+	hooks.OnValidate(func() error {
+		if cfg.Concurrency < 1 {
+			return fmt.Errorf("--jobs_concurrency: must be at least 1, got %d", cfg.Concurrency)
+		}
+		if cfg.Lease < time.Second {
+			return fmt.Errorf("--jobs_lease: must be at least 1s, got %v", cfg.Lease)
+		}
+		return nil
+	})
+
+	hooks.OnStart(func() error {
+		jobs, err := orcjobs.New(m.database.Database)
+		if err != nil {
+			return err
+		}
+		m.Jobs = jobs
+
+		if !disableWorkers {
+			for _, queue := range m.queues() {
+				workers, err := jobs.NewWorkers(queue, m.handlers[queue], cfg)
+				if err != nil {
+					return fmt.Errorf("Unable to create workers for job queue %q: %v", queue, err)
+				}
+				workers.Start()
+				m.workers = append(m.workers, workers)
+			}
+			logrus.Infof("Started workers for job queues %v", m.queues())
+		}
+
+		orcdebug.M.Status.AddTable(m.statusTable)
+		httprouter.M.HandleDebug("/jobs", m.page())
+		m.handleAPI()
+		return nil
+	})
+
+	hooks.OnStop(func() error {
+		for _, workers := range m.workers {
+			workers.Stop()
+		}
+		return nil
+	})
+}
@@ -0,0 +1,99 @@
+package orcjobs
+
+import (
+	"html/template"
+	"net/http"
+
+	"github.com/steinarvk/orclib/lib/orcjobs"
+)
+
+var (
+	jobsPageTemplate = template.Must(template.New("jobsPage").Parse(`
+<html>
+	<body>
+		<h1>Jobs</h1>
+		<table>
+			<tr>
+				<th>Queue
+				<th>State
+				<th>Jobs
+			{{ range .Counts }}
+				<tr>
+					<td><a href="?queue={{ .Queue }}">{{ .Queue }}</a>
+					<td><a href="?queue={{ .Queue }}&state={{ .State }}">{{ .State }}</a>
+					<td>{{ .N }}
+			{{ end }}
+		</table>
+
+		<h2>{{ if .Queue }}Queue {{ .Queue }}{{ else }}All queues{{ end }}{{ if .State }}, {{ .State }}{{ end }}</h2>
+		<table>
+			<tr>
+				<th>ID
+				<th>Kind
+				<th>State
+				<th>Priority
+				<th>Run at
+				<th>Attempts
+				<th>Worker
+				<th>Last error
+				<th>Updated
+				<th>
+			{{ range .Jobs }}
+				<tr>
+					<td><a href="internal-api/jobs/{{ .ID }}"><span title="{{ printf "%s" .Payload }}">{{ .ID }}</span></a>
+					<td>{{ .Kind }}{{ if .UniqueKey }} ({{ .UniqueKey }}){{ end }}
+					<td>{{ .State }}
+					<td>{{ .Priority }}
+					<td>{{ .RunAt.Format "2006-01-02 15:04:05" }}
+					<td>{{ .Attempts }}/{{ .MaxAttempts }}
+					<td>{{ .LeaseOwner }}
+					<td>{{ .LastError }}
+					<td>{{ .UpdatedAt }}
+					<td>
+						{{ if or (eq .State "queued") (eq .State "running") }}
+							<form method="post" action="internal-api/jobs/{{ .ID }}/cancel"><input type="submit" value="Cancel"></form>
+						{{ else }}
+							<form method="post" action="internal-api/jobs/{{ .ID }}/retry"><input type="submit" value="Retry"></form>
+						{{ end }}
+			{{ end }}
+		</table>
+	</body>
+</html>
+`))
+)
+
+type jobsPage struct {
+	Queue  string
+	State  string
+	Counts []orcjobs.Count
+	Jobs   []orcjobs.Job
+}
+
+// page serves the counts of jobs and a list of jobs, which may be
+// filtered with "?queue=" and "?state=".
+func (m *Module) page() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		data := jobsPage{
+			Queue: req.URL.Query().Get("queue"),
+			State: req.URL.Query().Get("state"),
+		}
+
+		var err error
+		data.Counts, err = m.Jobs.Counts(req.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		data.Jobs, err = m.Jobs.List(req.Context(), orcjobs.ListOptions{
+			Queue: data.Queue,
+			State: orcjobs.State(data.State),
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html")
+		jobsPageTemplate.Execute(w, data)
+	})
+}
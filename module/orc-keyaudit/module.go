@@ -0,0 +1,47 @@
+package orckeyaudit
+
+import (
+	"github.com/sirupsen/logrus"
+	"github.com/steinarvk/orc"
+	"github.com/steinarvk/orclib/lib/cryptopacket"
+)
+
+type Module struct {
+	auditLog *cryptopacket.FileAuditLog
+}
+
+func (m *Module) ModuleName() string { return "KeyAudit" }
+
+var M = &Module{}
+
+func (m *Module) OnRegister(hooks orc.ModuleHooks) {
+	var auditLogFilename string
+
+	hooks.OnUse(func(ctx orc.UseContext) {
+		ctx.Flags.StringVar(&auditLogFilename, "key_audit_log_filename", "", "file to append a JSON-lines audit log of packets signed, verified, encrypted and decrypted with the server keys to")
+	})
+
+	hooks.OnStart(func() error {
+		if auditLogFilename == "" {
+			return nil
+		}
+
+		auditLog, err := cryptopacket.OpenFileAuditLog(auditLogFilename)
+		if err != nil {
+			return err
+		}
+		m.auditLog = auditLog
+		cryptopacket.SetAuditLog(auditLog)
+
+		logrus.Infof("Writing key audit log to %q", auditLogFilename)
+		return nil
+	})
+
+	hooks.OnStop(func() error {
+		if m.auditLog == nil {
+			return nil
+		}
+		cryptopacket.SetAuditLog(nil)
+		return m.auditLog.Close()
+	})
+}
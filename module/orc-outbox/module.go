@@ -0,0 +1,189 @@
+package orcoutbox
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/steinarvk/orc"
+	"github.com/steinarvk/orclib/lib/cryptopacket"
+	"github.com/steinarvk/orclib/lib/orcoutbox"
+
+	orcclient "github.com/steinarvk/orclib/module/orc-client"
+	orcdatabase "github.com/steinarvk/orclib/module/orc-database"
+	orcdebug "github.com/steinarvk/orclib/module/orc-debug"
+	orcpersistentkeys "github.com/steinarvk/orclib/module/orc-persistentkeys"
+)
+
+const (
+	maxErrorBodyBytes = 1024
+)
+
+type Module struct {
+	database     *orcdatabase.Module
+	destinations map[string]string
+	sign         bool
+	client       orcclient.Client
+
+	Outbox *orcoutbox.Outbox
+	Relay  *orcoutbox.Relay
+}
+
+// New returns a module relaying the outbox in the database opened by
+// database, whose schema must include orcoutbox.SchemaSQL.
+func New(database *orcdatabase.Module) *Module {
+	return &Module{
+		database: database,
+	}
+}
+
+func (m *Module) ModuleName() string { return "Outbox" }
+
+// deliver posts the entry, as a JSON orcoutbox.Message or a signed packet
+// containing one, to the destination of its topic.
+func (m *Module) deliver(ctx context.Context, entry orcoutbox.Entry) error {
+	url, ok := m.destinations[entry.Topic]
+	if !ok {
+		return fmt.Errorf("No destination for topic %q", entry.Topic)
+	}
+
+	var body []byte
+	if m.sign {
+		packet, err := cryptopacket.PackUnencryptedContext(ctx, entry.Message(), orcpersistentkeys.M.Keys, cryptopacket.PackOptions{})
+		if err != nil {
+			return fmt.Errorf("Unable to sign outbox entry: %v", err)
+		}
+		body = []byte(packet)
+	} else {
+		var err error
+		body, err = json.Marshal(entry.Message())
+		if err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBodyBytes))
+		return fmt.Errorf("%s from %s: %q", resp.Status, url, data)
+	}
+
+	return nil
+}
+
+func (m *Module) statusTable() orcdebug.Table {
+	tbl := orcdebug.Table{TableName: "Outbox"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	counts, err := m.Outbox.Counts(ctx)
+	if err != nil {
+		tbl.Rows = append(tbl.Rows, orcdebug.Row{Key: "Error", Value: err.Error()})
+		return tbl
+	}
+	tbl.Rows = append(tbl.Rows,
+		orcdebug.Row{Key: "Pending", Value: fmt.Sprintf("%d", counts.Pending)},
+		orcdebug.Row{Key: "Dead", Value: fmt.Sprintf("%d", counts.Dead)},
+		orcdebug.Row{Key: "Signed", Value: fmt.Sprintf("%v", m.sign)},
+	)
+
+	var topics []string
+	for topic := range m.destinations {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	for _, topic := range topics {
+		tbl.Rows = append(tbl.Rows, orcdebug.Row{Key: "Topic " + topic, Value: m.destinations[topic]})
+	}
+
+	dead, err := m.Outbox.DeadEntries(ctx, 10)
+	if err != nil {
+		tbl.Rows = append(tbl.Rows, orcdebug.Row{Key: "Error", Value: err.Error()})
+		return tbl
+	}
+	for _, entry := range dead {
+		tbl.Rows = append(tbl.Rows, orcdebug.Row{
+			Key:   fmt.Sprintf("Dead entry %d", entry.ID),
+			Value: fmt.Sprintf("topic %q key %q at %s after %d attempts: %s", entry.Topic, entry.Key, entry.DeadAt, entry.Attempts, entry.LastError),
+		})
+	}
+
+	return tbl
+}
+
+func (m *Module) OnRegister(hooks orc.ModuleHooks) {
+	cfg := orcoutbox.DefaultRelayConfig
+
+	hooks.OnUse(func(u orc.UseContext) {
+		u.Use(m.database)
+		u.Use(orcclient.M)
+		u.Use(orcdebug.M)
+
+		u.Flags.StringToStringVar(&m.destinations, "outbox_destination", nil, "URL to which to post outbox entries, by topic (topic=URL)")
+		u.Flags.BoolVar(&m.sign, "outbox_sign", false, "send outbox entries as packets signed with the persistent keys")
+		u.Flags.IntVar(&cfg.MaxAttempts, "outbox_max_attempts", cfg.MaxAttempts, "delivery attempts before an outbox entry is moved to the dead letter table")
+		u.Flags.IntVar(&cfg.Concurrency, "outbox_concurrency", cfg.Concurrency, "maximum outbox entries (with different keys) delivered at a time")
+		u.Flags.DurationVar(&cfg.PollInterval, "outbox_poll_interval", cfg.PollInterval, "how often to look for outbox entries to deliver")
+		u.Flags.DurationVar(&cfg.Lease, "outbox_lease", cfg.Lease, "how long an outbox entry being delivered is hidden from other instances")
+	})
+
+	hooks.OnValidate(func() error {
+		if cfg.MaxAttempts < 1 {
+			return fmt.Errorf("--outbox_max_attempts: must be at least 1, got %d", cfg.MaxAttempts)
+		}
+		return nil
+	})
+
+	hooks.OnStart(func() error {
+		// The persistent keys module is not used here, since it fails to
+		// start without keys. Servers that sign must use it before this
+		// module, so that it has started first.
+		if m.sign && orcpersistentkeys.M.Keys == nil {
+			return fmt.Errorf("--outbox_sign requires persistent keys")
+		}
+
+		client, err := orcclient.M.New("outbox")
+		if err != nil {
+			return fmt.Errorf("Unable to create outbox client: %v", err)
+		}
+		m.client = client
+
+		outbox, err := orcoutbox.New(m.database.Database)
+		if err != nil {
+			return err
+		}
+		m.Outbox = outbox
+
+		m.Relay = outbox.NewRelay(m.deliver, cfg)
+		m.Relay.Start()
+		logrus.Infof("Started outbox relay (%d destinations)", len(m.destinations))
+
+		orcdebug.M.Status.AddTable(m.statusTable)
+		return nil
+	})
+
+	hooks.OnStop(func() error {
+		m.Relay.Stop()
+		return nil
+	})
+}
@@ -35,6 +35,10 @@ var (
 
 type Module struct {
 	Provider authinterface.AuthProvider
+
+	// MainGatekeeper checks inbound requests to the main realm. It is set
+	// during setup, for use by servers that bypass the HTTP middleware.
+	MainGatekeeper authinterface.Gatekeeper
 }
 
 func (m *Module) ModuleName() string {
@@ -183,6 +187,8 @@ func (m *Module) OnRegister(hooks orc.ModuleHooks) {
 			debugAuth = authinterface.AllowAll
 		}
 
+		m.MainGatekeeper = mainOuterAuth
+
 		outgoingDesc := "(none)"
 		if outerAuthProvider != nil {
 			outgoingDesc = "(set)"
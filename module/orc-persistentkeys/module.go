@@ -10,6 +10,8 @@ import (
 	canonicalhost "github.com/steinarvk/orclib/module/orc-canonicalhost"
 	identity "github.com/steinarvk/orclib/module/orc-identity"
 	orctinkgcpkms "github.com/steinarvk/orclib/module/orc-tinkgcpkms"
+	orctinklocalkms "github.com/steinarvk/orclib/module/orc-tinklocalkms"
+	orctinkvaultkms "github.com/steinarvk/orclib/module/orc-tinkvaultkms"
 )
 
 var (
@@ -35,6 +37,8 @@ func (m *Module) OnRegister(hooks orc.ModuleHooks) {
 
 	hooks.OnUse(func(ctx orc.UseContext) {
 		ctx.Use(orctinkgcpkms.M)
+		ctx.Use(orctinklocalkms.M)
+		ctx.Use(orctinkvaultkms.M)
 		ctx.Use(canonicalhost.M)
 		if !FakePersistentKeys {
 			ctx.Flags.StringVar(&keysFilename, "keys_filename", "", "name of file from which to load server keys")
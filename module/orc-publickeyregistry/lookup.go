@@ -2,16 +2,109 @@ package publickeyregistry
 
 import (
 	"fmt"
+	"sort"
+	"time"
 
+	"github.com/sirupsen/logrus"
 	"github.com/steinarvk/orclib/lib/orckeys"
+	"github.com/steinarvk/orclib/lib/orctimestamp"
 )
 
+type cacheEntry struct {
+	keys    *orckeys.PublicKeyPacket
+	fetched time.Time
+	expires time.Time
+}
+
+func (m *Module) lookupLocked(canonicalName string, now time.Time) (*orckeys.PublicKeyPacket, *cacheEntry) {
+	if value, ok := m.PublicKeys[canonicalName]; ok {
+		return value, nil
+	}
+
+	entry := m.cache[canonicalName]
+	if entry != nil && now.Before(entry.expires) {
+		return entry.keys, nil
+	}
+	return nil, entry
+}
+
 func (m *Module) LookupPublicKeys(canonicalName string) (*orckeys.PublicKeyPacket, error) {
-	if m.PublicKeys != nil {
-		value, ok := m.PublicKeys[canonicalName]
-		if ok {
-			return value, nil
+	now := time.Now()
+
+	m.mu.Lock()
+	value, stale := m.lookupLocked(canonicalName, now)
+	fetch := m.Fetch
+	m.mu.Unlock()
+
+	if value != nil {
+		return value, nil
+	}
+
+	if fetch == nil {
+		return nil, fmt.Errorf("No public keys found for %q", canonicalName)
+	}
+
+	keys, err := m.fetchAndVerify(fetch, canonicalName)
+	if err != nil {
+		if stale != nil {
+			logrus.WithFields(logrus.Fields{
+				"owner":   canonicalName,
+				"fetched": stale.fetched,
+				"error":   err,
+			}).Warningf("Failed to refresh public keys; using stale keys")
+			return stale.keys, nil
 		}
+		return nil, fmt.Errorf("No public keys found for %q: %v", canonicalName, err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.cache[canonicalName] = &cacheEntry{
+		keys:    keys,
+		fetched: now,
+		expires: now.Add(m.cacheTTL),
+	}
+
+	return keys, nil
+}
+
+type Entry struct {
+	Owner   string                   `json:"owner"`
+	Source  string                   `json:"source"`
+	Fetched string                   `json:"fetched,omitempty"`
+	Expires string                   `json:"expires,omitempty"`
+	Keys    *orckeys.PublicKeyPacket `json:"keys"`
+}
+
+// Entries lists all known public keys: static, fetched and pinned.
+func (m *Module) Entries() []Entry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var rv []Entry
+	for owner, keys := range m.PublicKeys {
+		rv = append(rv, Entry{Owner: owner, Source: "static", Keys: keys})
+	}
+	for owner, entry := range m.cache {
+		rv = append(rv, Entry{
+			Owner:   owner,
+			Source:  "fetched",
+			Fetched: orctimestamp.Format(entry.fetched),
+			Expires: orctimestamp.Format(entry.expires),
+			Keys:    entry.keys,
+		})
+	}
+	for owner, keys := range m.pins {
+		rv = append(rv, Entry{Owner: owner, Source: "pinned", Keys: keys})
 	}
-	return nil, fmt.Errorf("No public keys found for %q", canonicalName)
+
+	sort.SliceStable(rv, func(i, j int) bool {
+		if rv[i].Owner != rv[j].Owner {
+			return rv[i].Owner < rv[j].Owner
+		}
+		return rv[i].Source < rv[j].Source
+	})
+
+	return rv
 }
@@ -1,56 +1,126 @@
 package publickeyregistry
 
 import (
-	"encoding/json"
 	"fmt"
-	"io/ioutil"
+	"sync"
+	"time"
 
 	"github.com/steinarvk/orc"
 	"github.com/steinarvk/orclib/lib/orckeys"
 )
 
+const (
+	TrustOnFirstUse = "tofu"
+	TrustRoot       = "root"
+)
+
 type Module struct {
+	// PublicKeys holds the keys loaded from --public_keys_filename.
+	// They are trusted as-is. Use Lookup rather than reading the map directly,
+	// as it is replaced when the file changes.
 	PublicKeys map[string]*orckeys.PublicKeyPacket
+
+	// Fetch, if set, is used to get the self-signed public keys packet of
+	// owners not found in the static file. Set it with SetFetch once
+	// lookups may have begun.
+	Fetch func(owner string) ([]byte, error)
+
+	mu       sync.Mutex
+	cache    map[string]*cacheEntry
+	pins     map[string]*orckeys.PublicKeyPacket
+	root     *orckeys.PublicKeyPacket
+	trust    string
+	cacheTTL time.Duration
+
+	pinsFilename string
+	stopReload   chan struct{}
 }
 
 func (m *Module) ModuleName() string { return "ServerKeys" }
 
+// SetFetch sets Fetch, safely for concurrent lookups.
+func (m *Module) SetFetch(fetch func(owner string) ([]byte, error)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Fetch = fetch
+}
+
 var M = &Module{}
 
 func (m *Module) OnRegister(hooks orc.ModuleHooks) {
 	var publicKeysFilename string
+	var reloadInterval time.Duration
+	var rootFilename string
 
 	hooks.OnUse(func(ctx orc.UseContext) {
 		ctx.Flags.StringVar(&publicKeysFilename, "public_keys_filename", "", "name of JSON file from which to load server keys")
+		ctx.Flags.DurationVar(&reloadInterval, "public_keys_reload_interval", 10*time.Second, "how often to check --public_keys_filename for changes (0 to disable)")
+		ctx.Flags.DurationVar(&m.cacheTTL, "public_keys_cache_ttl", time.Hour, "how long to cache fetched public keys")
+		ctx.Flags.StringVar(&m.trust, "public_keys_trust", TrustOnFirstUse, "how to trust fetched public keys: \"tofu\" (pin on first use) or \"root\" (require countersignature by root key)")
+		ctx.Flags.StringVar(&rootFilename, "public_keys_root_filename", "", "name of JSON file containing the root public keys (for --public_keys_trust=root)")
+		ctx.Flags.StringVar(&m.pinsFilename, "public_keys_pins_filename", "", "name of JSON file in which to persist keys pinned on first use")
+	})
+
+	hooks.OnValidate(func() error {
+		switch m.trust {
+		case TrustOnFirstUse:
+			if rootFilename != "" {
+				return fmt.Errorf("--public_keys_root_filename requires --public_keys_trust=%s", TrustRoot)
+			}
+		case TrustRoot:
+			if rootFilename == "" {
+				return fmt.Errorf("--public_keys_trust=%s requires --public_keys_root_filename", TrustRoot)
+			}
+		default:
+			return fmt.Errorf("invalid --public_keys_trust=%q", m.trust)
+		}
+		return nil
 	})
 
 	hooks.OnSetup(func() error {
 		m.PublicKeys = map[string]*orckeys.PublicKeyPacket{}
+		m.cache = map[string]*cacheEntry{}
+		m.pins = map[string]*orckeys.PublicKeyPacket{}
 		return nil
 	})
 
 	hooks.OnStart(func() error {
-		if publicKeysFilename == "" {
-			return nil
+		if rootFilename != "" {
+			root, err := loadRoot(rootFilename)
+			if err != nil {
+				return err
+			}
+			m.root = root
 		}
 
-		data, err := ioutil.ReadFile(publicKeysFilename)
-		if err != nil {
-			return fmt.Errorf("unable to open --public_keys_filename=%q: %v", publicKeysFilename, err)
+		if m.pinsFilename != "" {
+			pins, err := loadPublicKeysFile(m.pinsFilename, true)
+			if err != nil {
+				return fmt.Errorf("unable to load --public_keys_pins_filename=%q: %v", m.pinsFilename, err)
+			}
+			m.pins = pins
 		}
 
-		var publicKeysFromFile map[string]*orckeys.PublicKeyPacket
+		if publicKeysFilename == "" {
+			return nil
+		}
 
-		if err := json.Unmarshal(data, &publicKeysFromFile); err != nil {
-			return fmt.Errorf("unable to parse --public_keys_filename=%q: %v", publicKeysFilename, err)
+		if err := m.reload(publicKeysFilename); err != nil {
+			return fmt.Errorf("unable to load --public_keys_filename=%q: %v", publicKeysFilename, err)
 		}
 
-		if publicKeysFromFile != nil {
-			for k := range publicKeysFromFile {
-				m.PublicKeys[k] = publicKeysFromFile[k]
-			}
+		if reloadInterval > 0 {
+			m.stopReload = make(chan struct{})
+			go m.watch(publicKeysFilename, reloadInterval, m.stopReload)
 		}
 
 		return nil
 	})
+
+	hooks.OnStop(func() error {
+		if m.stopReload != nil {
+			close(m.stopReload)
+		}
+		return nil
+	})
 }
@@ -0,0 +1,159 @@
+package publickeyregistry
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/steinarvk/orclib/lib/cryptopacket"
+	"github.com/steinarvk/orclib/lib/orckeys"
+)
+
+func newTestModule(trust string, root *orckeys.PublicKeyPacket) *Module {
+	return &Module{
+		PublicKeys: map[string]*orckeys.PublicKeyPacket{},
+		cache:      map[string]*cacheEntry{},
+		pins:       map[string]*orckeys.PublicKeyPacket{},
+		root:       root,
+		trust:      trust,
+		cacheTTL:   time.Hour,
+	}
+}
+
+func servePublicKeys(keys **orckeys.Keys, fetches *int) func(string) ([]byte, error) {
+	return func(owner string) ([]byte, error) {
+		*fetches++
+		if (*keys).Metadata.Owner != owner {
+			return nil, fmt.Errorf("unknown host %q", owner)
+		}
+		return []byte(mustPack(*keys)), nil
+	}
+}
+
+func mustPack(keys *orckeys.Keys) string {
+	packet, err := cryptopacket.PackUnencrypted(keys.Public(), keys)
+	if err != nil {
+		panic(err)
+	}
+	return packet
+}
+
+func TestTrustOnFirstUse(t *testing.T) {
+	keys, err := orckeys.Generate("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetches := 0
+
+	m := newTestModule(TrustOnFirstUse, nil)
+	m.Fetch = servePublicKeys(&keys, &fetches)
+
+	got, err := m.LookupPublicKeys("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.PublicSigningKey != keys.Public().PublicSigningKey {
+		t.Errorf("looked up wrong keys")
+	}
+	if _, err := m.LookupPublicKeys("example.com"); err != nil || fetches != 1 {
+		t.Errorf("second lookup: err %v, %d fetches; want cached", err, fetches)
+	}
+	if _, err := m.LookupPublicKeys("other.example.com"); err == nil {
+		t.Errorf("lookup of unknown owner succeeded")
+	}
+
+	// Keys rotated with a delayed activation are announced under the pinned key.
+	keys, err = keys.Rotate(time.Now().Add(time.Hour), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.cache = map[string]*cacheEntry{}
+	if _, err := m.LookupPublicKeys("example.com"); err != nil {
+		t.Errorf("lookup after announced rotation: %v", err)
+	}
+
+	// Entirely new keys are not signed by any pinned key.
+	keys, err = orckeys.Generate("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.cache = map[string]*cacheEntry{}
+	if _, err := m.LookupPublicKeys("example.com"); err == nil {
+		t.Errorf("lookup of replaced keys succeeded despite pin")
+	}
+}
+
+func TestTrustOnFirstUseAfterRotation(t *testing.T) {
+	keys, err := orckeys.Generate("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pinned := keys.Public()
+	fetches := 0
+
+	m := newTestModule(TrustOnFirstUse, nil)
+	m.Fetch = servePublicKeys(&keys, &fetches)
+	if _, err := m.LookupPublicKeys("example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Keys rotated to activate at once sign with the new generation, which
+	// the pinned generation has endorsed. A peer that missed a rotation
+	// follows the endorsements from its pin.
+	for i := 0; i < 2; i++ {
+		keys, err = keys.Rotate(time.Now(), time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	m.cache = map[string]*cacheEntry{}
+	got, err := m.LookupPublicKeys("example.com")
+	if err != nil {
+		t.Fatalf("lookup after immediate rotations: %v", err)
+	}
+	if got.Metadata.ID != keys.Metadata.ID {
+		t.Errorf("looked up keys %q want rotated keys %q", got.Metadata.ID, keys.Metadata.ID)
+	}
+
+	// Listing the pinned keys as a previous generation is not enough.
+	other, err := orckeys.Generate("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := other.Public()
+	forged.Previous = append(forged.Previous, pinned)
+	if endorsedByPinned(forged, pinned, time.Now()) {
+		t.Errorf("keys listing the pinned keys were accepted as endorsed")
+	}
+}
+
+func TestTrustRoot(t *testing.T) {
+	root, err := orckeys.Generate("root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootPublic := root.Public()
+
+	keys, err := orckeys.Generate("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetches := 0
+
+	m := newTestModule(TrustRoot, &rootPublic)
+	m.Fetch = servePublicKeys(&keys, &fetches)
+
+	if _, err := m.LookupPublicKeys("example.com"); err == nil {
+		t.Errorf("lookup of keys without countersignature succeeded")
+	}
+
+	countersigned, err := root.Countersign(keys.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys.Metadata.Countersignatures = countersigned.Metadata.Countersignatures
+
+	if _, err := m.LookupPublicKeys("example.com"); err != nil {
+		t.Errorf("lookup of countersigned keys failed: %v", err)
+	}
+}
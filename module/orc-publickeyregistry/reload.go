@@ -0,0 +1,101 @@
+package publickeyregistry
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/steinarvk/orclib/lib/orckeys"
+)
+
+func loadPublicKeysFile(filename string, allowMissing bool) (map[string]*orckeys.PublicKeyPacket, error) {
+	rv := map[string]*orckeys.PublicKeyPacket{}
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if allowMissing && os.IsNotExist(err) {
+			return rv, nil
+		}
+		return nil, err
+	}
+
+	var publicKeysFromFile map[string]*orckeys.PublicKeyPacket
+	if err := json.Unmarshal(data, &publicKeysFromFile); err != nil {
+		return nil, fmt.Errorf("unable to parse: %v", err)
+	}
+
+	for k, v := range publicKeysFromFile {
+		if v != nil {
+			rv[k] = v
+		}
+	}
+
+	return rv, nil
+}
+
+func loadRoot(filename string) (*orckeys.PublicKeyPacket, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open --public_keys_root_filename=%q: %v", filename, err)
+	}
+	var root orckeys.PublicKeyPacket
+	if err := json.Unmarshal(data, &root); err != nil {
+		return nil, fmt.Errorf("unable to parse --public_keys_root_filename=%q: %v", filename, err)
+	}
+	if root.PublicSigningKey == "" {
+		return nil, fmt.Errorf("no public signing key in --public_keys_root_filename=%q", filename)
+	}
+	return &root, nil
+}
+
+func (m *Module) reload(filename string) error {
+	publicKeys, err := loadPublicKeysFile(filename, false)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.PublicKeys = publicKeys
+	return nil
+}
+
+func modificationTime(filename string) time.Time {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+func (m *Module) watch(filename string, interval time.Duration, stop <-chan struct{}) {
+	lastModified := modificationTime(filename)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		modified := modificationTime(filename)
+		if modified.IsZero() || modified.Equal(lastModified) {
+			continue
+		}
+
+		if err := m.reload(filename); err != nil {
+			logrus.Errorf("Failed to reload public keys from %q (keeping previous keys): %v", filename, err)
+			continue
+		}
+
+		lastModified = modified
+		logrus.Infof("Reloaded public keys from %q", filename)
+	}
+}
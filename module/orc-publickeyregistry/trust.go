@@ -0,0 +1,149 @@
+package publickeyregistry
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/steinarvk/orclib/lib/cryptopacket"
+	"github.com/steinarvk/orclib/lib/mutatefile"
+	"github.com/steinarvk/orclib/lib/orckeys"
+)
+
+type fixedRegistry struct {
+	owner string
+	keys  *orckeys.PublicKeyPacket
+}
+
+func (r fixedRegistry) LookupPublicKeys(owner string) (*orckeys.PublicKeyPacket, error) {
+	if owner != r.owner {
+		return nil, fmt.Errorf("Unexpected signer %q (want %q)", owner, r.owner)
+	}
+	return r.keys, nil
+}
+
+func selfSignedPayload(data []byte) (orckeys.PublicKeyPacket, error) {
+	var packet struct {
+		Contents struct {
+			Payload orckeys.PublicKeyPacket `json:"payload"`
+		} `json:"contents"`
+	}
+	if err := json.Unmarshal(data, &packet); err != nil {
+		return orckeys.PublicKeyPacket{}, fmt.Errorf("Invalid public keys packet: %v", err)
+	}
+	return packet.Contents.Payload, nil
+}
+
+// fetchAndVerify fetches the public keys of owner and checks that they are
+// self-signed by keys that are trusted according to the trust policy.
+func (m *Module) fetchAndVerify(fetch func(string) ([]byte, error), owner string) (*orckeys.PublicKeyPacket, error) {
+	data, err := fetch(owner)
+	if err != nil {
+		return nil, fmt.Errorf("Error fetching public keys: %v", err)
+	}
+
+	candidate, err := selfSignedPayload(data)
+	if err != nil {
+		return nil, err
+	}
+	if candidate.Metadata.Owner != owner {
+		return nil, fmt.Errorf("Fetched public keys for %q are for %q", owner, candidate.Metadata.Owner)
+	}
+	if _, err := cryptopacket.UnpackUnencrypted(nil, string(data), fixedRegistry{owner, &candidate}); err != nil {
+		return nil, fmt.Errorf("Invalid self-signature on public keys packet: %v", err)
+	}
+
+	switch m.trust {
+	case TrustRoot:
+		countersigned, err := candidate.CountersignedBy(*m.root, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		// The self-signature must be by one of the countersigned keys.
+		if _, err := cryptopacket.UnpackUnencrypted(nil, string(data), fixedRegistry{owner, &countersigned}); err != nil {
+			return nil, fmt.Errorf("Public keys packet not signed by countersigned keys: %v", err)
+		}
+		return &countersigned, nil
+
+	case TrustOnFirstUse:
+		m.mu.Lock()
+		pinned := m.pins[owner]
+		m.mu.Unlock()
+
+		if pinned != nil {
+			// Rotated keys are accepted only if announced under a pinned
+			// key, or endorsed by one that is still valid.
+			if _, err := cryptopacket.UnpackUnencrypted(nil, string(data), fixedRegistry{owner, pinned}); err != nil && !endorsedByPinned(candidate, *pinned, time.Now()) {
+				return nil, fmt.Errorf("Public keys packet not signed by pinned keys: %v", err)
+			}
+		} else {
+			logrus.WithFields(logrus.Fields{
+				"owner":  owner,
+				"key_id": candidate.Metadata.ID,
+			}).Warningf("Pinning public keys on first use")
+		}
+
+		if err := m.pin(owner, &candidate); err != nil {
+			return nil, err
+		}
+		return &candidate, nil
+	}
+
+	return nil, fmt.Errorf("Invalid trust policy %q", m.trust)
+}
+
+// endorsedByPinned reports whether the current generation of candidate
+// descends from a pinned generation that candidate still lists as valid at
+// time t, through generations each countersigned by a valid predecessor.
+func endorsedByPinned(candidate, pinned orckeys.PublicKeyPacket, t time.Time) bool {
+	pinnedKeys := map[string]orckeys.PublicKeyPacket{}
+	for _, generation := range pinned.Generations() {
+		pinnedKeys[generation.Metadata.ID] = generation
+	}
+
+	generations := candidate.Generations()
+
+	var trusted []orckeys.PublicKeyPacket
+	for _, generation := range generations[1:] {
+		pinnedGeneration, ok := pinnedKeys[generation.Metadata.ID]
+		if ok && pinnedGeneration.PublicSigningKey == generation.PublicSigningKey && pinnedGeneration.PublicEncryptionKey == generation.PublicEncryptionKey {
+			trusted = append(trusted, generation)
+		}
+	}
+
+	// Generations are listed newest first, so each is endorsed by an older one.
+	for i := len(generations) - 1; i >= 0; i-- {
+		if len(trusted) == 0 {
+			continue
+		}
+		root := trusted[0]
+		root.Previous = trusted[1:]
+		if _, err := generations[i].CountersignedBy(root, t); err == nil {
+			if i == 0 {
+				return true
+			}
+			trusted = append(trusted, generations[i])
+		}
+	}
+
+	return false
+}
+
+func (m *Module) pin(owner string, keys *orckeys.PublicKeyPacket) error {
+	m.mu.Lock()
+	m.pins[owner] = keys
+	pins := map[string]*orckeys.PublicKeyPacket{}
+	for k, v := range m.pins {
+		pins[k] = v
+	}
+	m.mu.Unlock()
+
+	if m.pinsFilename == "" {
+		return nil
+	}
+
+	return mutatefile.MutateFile(m.pinsFilename, 0600, func([]byte) ([]byte, error) {
+		return json.MarshalIndent(pins, "", "  ")
+	})
+}
@@ -0,0 +1,90 @@
+package publickeyregistryapi
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"github.com/steinarvk/orc"
+
+	orcclient "github.com/steinarvk/orclib/module/orc-client"
+	httprouter "github.com/steinarvk/orclib/module/orc-httprouter"
+	jsonapi "github.com/steinarvk/orclib/module/orc-jsonapi"
+	publickeyregistry "github.com/steinarvk/orclib/module/orc-publickeyregistry"
+)
+
+const (
+	publicKeysEndpoint = "/api/internal/public-keys"
+
+	maxPublicKeysBytes = 1 << 20
+)
+
+type Module struct {
+}
+
+var M = &Module{}
+
+func (m *Module) ModuleName() string { return "PublicKeyRegistryAPI" }
+
+func fetcher(client orcclient.Client) func(string) ([]byte, error) {
+	return func(owner string) ([]byte, error) {
+		u := url.URL{
+			Scheme: "https",
+			Host:   owner,
+			Path:   publicKeysEndpoint,
+		}
+
+		resp, err := client.Get(u.String())
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			io.Copy(ioutil.Discard, resp.Body)
+			return nil, fmt.Errorf("GET %s: HTTP %d", u.String(), resp.StatusCode)
+		}
+
+		data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxPublicKeysBytes+1))
+		if err != nil {
+			return nil, fmt.Errorf("GET %s: error reading body: %v", u.String(), err)
+		}
+		if len(data) > maxPublicKeysBytes {
+			return nil, fmt.Errorf("GET %s: response too large", u.String())
+		}
+		return data, nil
+	}
+}
+
+func (m *Module) OnRegister(hooks orc.ModuleHooks) {
+	var fetchEnabled bool
+
+	hooks.OnUse(func(u orc.UseContext) {
+		u.Use(publickeyregistry.M)
+		u.Use(orcclient.M)
+		u.Use(httprouter.M)
+		u.Use(jsonapi.M)
+
+		u.Flags.BoolVar(&fetchEnabled, "public_keys_fetch", false, "fetch public keys of unknown owners from their "+publicKeysEndpoint+" endpoint")
+	})
+
+	hooks.OnStart(func() error {
+		if fetchEnabled {
+			client, err := orcclient.M.New("publickeyregistry")
+			if err != nil {
+				return fmt.Errorf("Unable to create client for fetching public keys: %v", err)
+			}
+			publickeyregistry.M.SetFetch(fetcher(client))
+		}
+
+		listHandler := jsonapi.Methods{
+			Get: jsonapi.DiscardBody(func(req *http.Request) (interface{}, error) {
+				return publickeyregistry.M.Entries(), nil
+			}),
+		}
+		httprouter.M.HandleDebug("/publickeys", listHandler)
+		return nil
+	})
+}
@@ -0,0 +1,42 @@
+package orctinklocalkms
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/google/tink/go/core/registry"
+	"github.com/steinarvk/orc"
+	"github.com/steinarvk/orclib/lib/localkms"
+)
+
+type Module struct {
+}
+
+func (m *Module) ModuleName() string { return "TinkLocalKMS" }
+
+var M = &Module{}
+
+func (m *Module) OnRegister(hooks orc.ModuleHooks) {
+	var passphraseFilename string
+
+	hooks.OnUse(func(ctx orc.UseContext) {
+		ctx.Flags.StringVar(&passphraseFilename, "local_kms_passphrase_file", "", "file containing the passphrase for passphrase-derived local-kms:// master keys")
+	})
+
+	hooks.OnSetup(func() error {
+		registry.RegisterKMSClient(&localkms.Client{
+			Passphrase: func() ([]byte, error) {
+				if passphraseFilename == "" {
+					return nil, fmt.Errorf("missing --local_kms_passphrase_file")
+				}
+				data, err := ioutil.ReadFile(passphraseFilename)
+				if err != nil {
+					return nil, fmt.Errorf("unable to read --local_kms_passphrase_file=%q: %v", passphraseFilename, err)
+				}
+				return bytes.TrimRight(data, "\r\n"), nil
+			},
+		})
+		return nil
+	})
+}
@@ -0,0 +1,59 @@
+package orctinkvaultkms
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/google/tink/go/core/registry"
+	"github.com/sirupsen/logrus"
+	"github.com/steinarvk/orc"
+	"github.com/steinarvk/orclib/lib/vaulttransit"
+)
+
+type Module struct {
+}
+
+func (m *Module) ModuleName() string { return "TinkVaultKMS" }
+
+var M = &Module{}
+
+func (m *Module) OnRegister(hooks orc.ModuleHooks) {
+	var vaultAddress string
+	var tokenFilename string
+
+	hooks.OnUse(func(ctx orc.UseContext) {
+		ctx.Flags.StringVar(&vaultAddress, "vault_address", "", "base URL of the Vault (transit-compatible) server for vault-transit:// master keys")
+		ctx.Flags.StringVar(&tokenFilename, "vault_token_file", "", "file containing the Vault access token")
+	})
+
+	hooks.OnValidate(func() error {
+		if tokenFilename != "" && vaultAddress == "" {
+			return fmt.Errorf("--vault_token_file given without --vault_address")
+		}
+		return nil
+	})
+
+	hooks.OnSetup(func() error {
+		if vaultAddress == "" {
+			return nil
+		}
+
+		client := &vaulttransit.Client{
+			Address: vaultAddress,
+		}
+		if tokenFilename != "" {
+			client.Token = func() (string, error) {
+				data, err := ioutil.ReadFile(tokenFilename)
+				if err != nil {
+					return "", fmt.Errorf("unable to read --vault_token_file=%q: %v", tokenFilename, err)
+				}
+				return strings.TrimSpace(string(data)), nil
+			}
+		}
+
+		registry.RegisterKMSClient(client)
+		logrus.Infof("Registered Vault transit KMS client for %q", vaultAddress)
+		return nil
+	})
+}